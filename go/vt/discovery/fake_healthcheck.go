@@ -86,6 +86,13 @@ func (fhc *FakeHealthCheck) AddTablet(tablet *topodatapb.Tablet) {
 	fhc.items[key] = item
 }
 
+// AddTablets adds the tablets.
+func (fhc *FakeHealthCheck) AddTablets(tablets []*topodatapb.Tablet) {
+	for _, tablet := range tablets {
+		fhc.AddTablet(tablet)
+	}
+}
+
 // RemoveTablet removes the tablet.
 func (fhc *FakeHealthCheck) RemoveTablet(tablet *topodatapb.Tablet) {
 	fhc.mu.Lock()
@@ -0,0 +1,130 @@
+/*
+Copyright 2020 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"sync"
+	"time"
+
+	"vitess.io/vitess/go/vt/topo/topoproto"
+)
+
+// The kinds of the events of the health history, see HealthEvent.Event.
+const (
+	// HealthEventAdded is recorded when a tablet is added to the healthcheck.
+	HealthEventAdded = "added"
+	// HealthEventRemoved is recorded when a tablet is removed from the healthcheck.
+	HealthEventRemoved = "removed"
+	// HealthEventServing is recorded when a tablet starts serving.
+	HealthEventServing = "serving"
+	// HealthEventNotServing is recorded when a tablet stops serving.
+	HealthEventNotServing = "not_serving"
+	// HealthEventError is recorded for each health check error of a tablet.
+	HealthEventError = "error"
+)
+
+// maxHealthHistoryEvents bounds the number of events kept in the health
+// history, whatever -healthcheck_history_retention is, so that a flapping
+// fleet cannot grow it without limit. The oldest events are dropped first.
+const maxHealthHistoryEvents = 10000
+
+// HealthEvent is an event of the health history of the tablets, as served
+// at the history path of the healthcheck, e.g. /debug/gateway/history.
+type HealthEvent struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Alias      string    `json:"alias"`
+	Keyspace   string    `json:"keyspace"`
+	Shard      string    `json:"shard"`
+	TabletType string    `json:"type"`
+	// Event is one of the HealthEvent* constants.
+	Event string `json:"event"`
+	// Detail is the error of a HealthEventError event, or the reason of a
+	// change of the serving state.
+	Detail string `json:"detail,omitempty"`
+}
+
+// healthHistory is the log of the health events of all the tablets over
+// the last retention, for post-mortems.
+type healthHistory struct {
+	retention time.Duration
+	clock     clock
+
+	// mu protects events, which are sorted by timestamp.
+	mu     sync.Mutex
+	events []HealthEvent
+}
+
+// newHealthHistory returns a healthHistory keeping the events for the given
+// duration, or nil if it is not positive, and timestamping them with clock.
+// A nil healthHistory records nothing.
+func newHealthHistory(retention time.Duration, clock clock) *healthHistory {
+	if retention <= 0 {
+		return nil
+	}
+	return &healthHistory{retention: retention, clock: clock}
+}
+
+// record appends an event of the tablet to the history.
+func (h *healthHistory) record(thc *tabletHealthCheck, event, detail string) {
+	if h == nil {
+		return
+	}
+	e := HealthEvent{
+		Alias:      topoproto.TabletAliasString(thc.Tablet.Alias),
+		Keyspace:   thc.Target.Keyspace,
+		Shard:      thc.Target.Shard,
+		TabletType: topoproto.TabletTypeLString(thc.Target.TabletType),
+		Event:      event,
+		Detail:     detail,
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// the timestamp is taken under the lock, so that the events are
+	// appended in order
+	e.Timestamp = h.clock.Now()
+	h.events = append(h.events, e)
+	h.pruneLocked(e.Timestamp)
+}
+
+// pruneLocked drops the events older than the retention, and the oldest
+// events above maxHealthHistoryEvents.
+// h.mu must be locked before calling this function.
+func (h *healthHistory) pruneLocked(now time.Time) {
+	cutoff := now.Add(-h.retention)
+	drop := 0
+	for drop < len(h.events) && h.events[drop].Timestamp.Before(cutoff) {
+		drop++
+	}
+	if over := len(h.events) - maxHealthHistoryEvents; over > drop {
+		drop = over
+	}
+	// the dropped events are freed when append reallocates the array
+	h.events = h.events[drop:]
+}
+
+// snapshot returns a copy of the events within the retention, sorted by
+// timestamp.
+func (h *healthHistory) snapshot() []HealthEvent {
+	res := []HealthEvent{}
+	if h == nil {
+		return res
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pruneLocked(h.clock.Now())
+	return append(res, h.events...)
+}
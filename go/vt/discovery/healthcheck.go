@@ -33,6 +33,7 @@ package discovery
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"flag"
@@ -45,6 +46,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/golang/protobuf/proto"
+
 	"vitess.io/vitess/go/vt/proto/vtrpc"
 	"vitess.io/vitess/go/vt/vterrors"
 	"vitess.io/vitess/go/vt/vttablet/queryservice"
@@ -54,7 +57,9 @@ import (
 	"vitess.io/vitess/go/vt/topo"
 
 	"vitess.io/vitess/go/stats"
+	"vitess.io/vitess/go/sync2"
 	"vitess.io/vitess/go/vt/log"
+	"vitess.io/vitess/go/vt/logutil"
 	"vitess.io/vitess/go/vt/proto/query"
 	"vitess.io/vitess/go/vt/proto/topodata"
 	"vitess.io/vitess/go/vt/topo/topoproto"
@@ -63,11 +68,23 @@ import (
 var (
 	hcErrorCounters          = stats.NewCountersWithMultiLabels("HealthcheckErrors", "Healthcheck Errors", []string{"Keyspace", "ShardName", "TabletType"})
 	hcMasterPromotedCounters = stats.NewCountersWithMultiLabels("HealthcheckMasterPromoted", "Master promoted in keyspace/shard name because of health check errors", []string{"Keyspace", "ShardName"})
-	healthcheckOnce          sync.Once
+	hcResponseCounters       = stats.NewCountersWithMultiLabels("HealthcheckResponsesReceived", "Valid health check responses received from tablets", []string{"Keyspace", "ShardName", "TabletType"})
+	hcDialErrorCounters      = stats.NewCountersWithMultiLabels("HealthcheckDialErrors", "Healthcheck errors while dialing a tablet", []string{"Keyspace", "ShardName", "TabletType"})
+	hcRedialCounters         = stats.NewCountersWithMultiLabels("HealthcheckRedials", "Connections to a tablet made again after the previous one was closed on error", []string{"Keyspace", "ShardName", "TabletType"})
+	hcAddAfterCloseCounter   = stats.NewCounter("HealthcheckAddAfterClose", "Tablets added to the healthcheck after it was closed")
+	hcDuplicateAddCounter    = stats.NewCounter("HealthcheckDuplicateAdd", "Tablets added to the healthcheck again at the same address, e.g. by overlapping topology watchers")
+	hcStreamDurations        = stats.NewMultiTimings("HealthcheckStreamDuration", "How long the health check streams lasted before they ended", []string{"Keyspace", "ShardName", "TabletType"})
+	hcErrorCategoryCounters  = stats.NewCountersWithMultiLabels("HealthcheckErrorsByCategory", "Healthcheck errors by category: network, canceled, application or auth", []string{"Keyspace", "ShardName", "TabletType", "Category"})
+	hcEvictionLatencies      = stats.NewMultiTimings("HealthcheckEvictionLatency", "How long the tablets were not serving before they were removed from the healthcheck", []string{"Keyspace", "ShardName", "TabletType"})
+	hcExcludedByCellCounters = stats.NewCountersWithSingleLabel("TabletsExcludedByCell", "Tablets not health checked because they are not in the local cell or cell alias", "Cell")
+	excludedByCellLogger     = logutil.NewThrottledLogger("TabletsExcludedByCell", 5*time.Second)
 
 	// TabletURLTemplateString is a flag to generate URLs for the tablets that vtgate discovers.
 	TabletURLTemplateString = flag.String("tablet_url_template", "http://{{.GetTabletHostPort}}", "format string describing debug tablet url formatting. See the Go code for getTabletDebugURL() how to customize this.")
-	tabletURLTemplate       *template.Template
+	// tabletURLTemplateMu protects tabletURLTemplate, which is swapped by
+	// ReloadTabletURLTemplate while the status pages are served
+	tabletURLTemplateMu sync.RWMutex
+	tabletURLTemplate   *template.Template
 
 	//TODO(deepthi): change these vars back to unexported when discoveryGateway is removed
 
@@ -75,8 +92,17 @@ var (
 	CellsToWatch = flag.String("cells_to_watch", "", "comma-separated list of cells for watching tablets")
 	// AllowedTabletTypes is the list of allowed tablet types. e.g. {MASTER, REPLICA}
 	AllowedTabletTypes []topodata.TabletType
+	// allowedTabletTypesByKeyspace overrides AllowedTabletTypes for some keyspaces
+	allowedTabletTypesByKeyspace = make(keyspaceTabletTypes)
+	// retryDelayByTabletType overrides the retry delay of the healthcheck for some tablet types
+	retryDelayByTabletType = make(tabletTypeDurations)
+	// readFallbackOrder is an ordered list of tablet types. When a target of one of
+	// these types has no healthy tablets, the types that follow it are tried in order.
+	readFallbackOrder []topodata.TabletType
 	// TabletFilters are the keyspace|shard or keyrange filters to apply to the full set of tablets
 	TabletFilters flagutil.StringListValue
+	// TabletTagFilters are the key=value pairs the tags of the tablets must all match
+	TabletTagFilters flagutil.StringListValue
 	// KeyspacesToWatch - if provided this specifies which keyspaces should be
 	// visible to the healthcheck. By default the healthcheck will watch all keyspaces.
 	KeyspacesToWatch flagutil.StringListValue
@@ -84,10 +110,74 @@ var (
 	RefreshInterval = flag.Duration("tablet_refresh_interval", 1*time.Minute, "tablet refresh interval")
 	// RefreshKnownTablets tells us whether to process all tablets or only new tablets
 	RefreshKnownTablets = flag.Bool("tablet_refresh_known_tablets", true, "tablet refresh reloads the tablet address/port map from topo in case it changes")
+	// RefreshKnownTabletsEvery tells us how often the known tablets are reloaded when RefreshKnownTablets is false
+	RefreshKnownTabletsEvery = flag.Int("tablet_refresh_known_tablets_every", 0, "when -tablet_refresh_known_tablets is false, the known tablets are still reloaded from topo every this many successful refreshes if set, so that the tablets deleted from topo are eventually removed. 0 (default) never reloads them")
 	// TopoReadConcurrency tells us how many topo reads are allowed in parallel
 	TopoReadConcurrency = flag.Int("topo_read_concurrency", 32, "concurrent topo reads")
+	// TopoReadTimeout is how long a single tablet read from topo can take
+	TopoReadTimeout = flag.Duration("topo_read_timeout", 30*time.Second, "timeout of each tablet read from topo, so that a hung read doesn't stall the tablet refresh. 0 or less disables the timeout")
+	// healthErrorGracePeriod is how long a tablet can report a health error before it is considered not serving
+	healthErrorGracePeriod = flag.Duration("healthcheck_health_error_grace_period", 0, "how long a tablet can keep reporting a health error before it is considered not serving. A health error which clears within this period is ignored")
+	// disableHealthStream disables the health checks, the tablets are only discovered from topo
+	disableHealthStream = flag.Bool("disable_health_stream", false, "if set, the health of the tablets is not checked: the tablets found in topo are only listed, and all of them are returned as healthy with an unknown health")
+	// minServingDuration is how long a replica must have been serving before it is used for queries
+	minServingDuration = flag.Duration("min_serving_duration", 0, "if positive, the tablets which started serving less than this duration ago are not used for queries, e.g. to let them warm up, unless none of the tablets of the target has been serving for that long. Masters are always used")
+	// errorRateDecay is the weight of the latest outcome in the error rate of the tablets
+	errorRateDecay = flag.Float64("healthcheck_error_rate_decay", 0.1, "weight, between 0 and 1, of the latest health check outcome in the exponential moving average of the error rate of each tablet. Higher values forget the past outcomes faster")
+	// adaptiveTimeoutMultiplier, if positive, makes the health check timeout of each tablet adapt to its response interval
+	adaptiveTimeoutMultiplier = flag.Float64("healthcheck_adaptive_timeout_multiplier", 0, "if positive, the health check timeout of each tablet is this multiple of the median interval between its recent health responses, bounded by -healthcheck_adaptive_timeout_min and -healthcheck_adaptive_timeout_max, instead of -healthcheck_timeout")
+	// adaptiveTimeoutMin is the lower bound of the adaptive health check timeout
+	adaptiveTimeoutMin = flag.Duration("healthcheck_adaptive_timeout_min", 5*time.Second, "lower bound of the adaptive health check timeout, see -healthcheck_adaptive_timeout_multiplier")
+	// adaptiveTimeoutMax is the upper bound of the adaptive health check timeout
+	adaptiveTimeoutMax = flag.Duration("healthcheck_adaptive_timeout_max", 5*time.Minute, "upper bound of the adaptive health check timeout, see -healthcheck_adaptive_timeout_multiplier")
+	// servingStateLogJSON logs the serving state changes of the tablets as JSON
+	servingStateLogJSON = flag.Bool("healthcheck_serving_state_log_json", false, "if set, the serving state changes of the tablets are logged as one JSON object per line, which is easier to parse by log pipelines, instead of as text")
+	// maxConcurrentStreams, if positive, is the number of goroutines over which the health checks are run
+	maxConcurrentStreams = flag.Int("healthcheck_max_concurrent_streams", 0, "if positive, the health of the tablets is polled by this many goroutines, with short lived streams, instead of streamed continuously by one goroutine per tablet. Health changes are then noticed up to -healthcheck_poll_interval later")
+	// pollInterval is how often the health of each tablet is polled with -healthcheck_max_concurrent_streams
+	pollInterval = flag.Duration("healthcheck_poll_interval", 20*time.Second, "with -healthcheck_max_concurrent_streams, how often the health of each tablet is polled, each poll being a StreamHealth RPC. It should be on the order of the interval at which the tablets broadcast their health, and must be at least 1s")
+	// servingDebounce, if positive, is how long a serving state change must be reported before it is applied
+	servingDebounce = flag.Duration("healthcheck_serving_debounce", 0, "if positive, a change of the serving state reported by a tablet in the direction set by -healthcheck_serving_debounce_direction only takes effect if no response cancels it for this long, e.g. to ignore the brief not serving blips of the replicas during schema changes or backups. The changes in the other direction take effect immediately")
+	// servingDebounceDirection is the serving state change delayed by servingDebounce
+	servingDebounceDirection = flag.String("healthcheck_serving_debounce_direction", servingDebounceNotServing, "Allowed values: not_serving (default), serving. not_serving delays the tablets going not serving, which favors availability, serving delays the tablets going serving, which favors stability")
+	// targetAvailabilityDebounce is how long a target must keep or lack healthy tablets before the availability callbacks are called
+	targetAvailabilityDebounce = flag.Duration("healthcheck_target_availability_debounce", time.Second, "how long a target must have had no healthy tablet, or some again, before the functions registered with OnTargetAvailabilityChange are called, so that they are not called when the tablets flap")
+	// maxConnectionsPerCell, if positive, is the number of tablets of each remote cell whose health is checked
+	maxConnectionsPerCell = flag.Int("max_connections_per_cell", 0, "if positive, the health of at most this many tablets of each cell other than the local one is checked at the same time, e.g. to limit the traffic to the remote cells. The other tablets of the cell are known, but with an unknown health, until the health check of one of the checked tablets stops. 0 checks all the tablets")
+	// initialWarmFraction, if positive, is the fraction of the tablets WaitForInitialTopology waits to leave warming
+	initialWarmFraction = flag.Float64("healthcheck_initial_warm_fraction", 0, "if positive, at startup vtgate also waits for this fraction, between 0 and 1, of the tablets found in topo to have answered their first health check, or failed to, before serving queries")
+	// maxRetryDuration, if positive, is how long an unreachable tablet is retried before it is removed
+	maxRetryDuration = flag.Duration("healthcheck_max_retry_duration", 0, "if positive, a tablet which has not sent any health check response for this long, or since it was added, is removed from the healthcheck and not retried anymore, until the topology watcher adds it again. 0 retries forever")
+	// healthErrorAsDegraded deprioritizes the tablets reporting a health error instead of excluding them
+	healthErrorAsDegraded = flag.Bool("healthcheck_health_error_as_degraded", false, "if set, a replica or rdonly tablet reporting a health error is degraded instead of not serving: it is only used when its target has no other healthy tablet. The health error of a master never stops it from being used")
+	// tabletServingStats exports the serving state of each tablet in HealthcheckTabletServing
+	tabletServingStats = flag.Bool("healthcheck_tablet_serving_stats", false, "if set, the HealthcheckTabletServing gauge reports 1 or 0 for each tablet, serving or not, labeled by tablet alias. It has one value per tablet, which may be too many for some monitoring systems")
+	// historyRetention is how long the health events are kept in the health history
+	historyRetention = flag.Duration("healthcheck_history_retention", 15*time.Minute, "how long the serving state changes, additions, removals and health check errors of the tablets are kept in the health history served at <gateway debug path>/history, e.g. /debug/gateway/history, for post-mortems. At most 10000 events are kept. 0 disables the history")
+)
+
+// registeredHandlers keeps track of the debug handlers registered per mux and path,
+// since registering the same path twice on a mux panics.
+var (
+	registeredHandlersMu sync.Mutex
+	registeredHandlers   = make(map[*http.ServeMux]map[string]bool)
 )
 
+var (
+	// ErrNoTablets is returned when the healthcheck does not know about any tablet for a target.
+	// It is UNAVAILABLE like ErrNoHealthyTablets, so that the queries are
+	// retried the same way: use errors.Is to tell them apart.
+	ErrNoTablets = vterrors.New(vtrpc.Code_UNAVAILABLE, "no valid tablet")
+	// ErrNoHealthyTablets is returned when tablets exist for a target but none of them can be used.
+	ErrNoHealthyTablets = vterrors.New(vtrpc.Code_UNAVAILABLE, "no available connection")
+	// ErrFailedInitialConnect is the error of a tablet which sent no health
+	// check response before its connect deadline, see AddTabletWithConnectDeadline.
+	ErrFailedInitialConnect = vterrors.New(vtrpc.Code_DEADLINE_EXCEEDED, "failed initial connect")
+)
+
+// responseStalenessCutoffs are the histogram buckets, in milliseconds, for HealthcheckResponseStaleness.
+var responseStalenessCutoffs = []int64{100, 500, 1000, 5000, 10000, 30000, 60000, 300000, 600000}
+
 // See the documentation for NewHealthCheck below for an explanation of these parameters.
 const (
 	DefaultHealthCheckRetryDelay = 5 * time.Second
@@ -98,6 +188,17 @@ const (
 	// DefaultTopologyWatcherRefreshInterval is used as the default value for
 	// the refresh interval of a topology watcher.
 	DefaultTopologyWatcherRefreshInterval = 1 * time.Minute
+	// DefaultHealthCheckHTTPPath is the default path at which the
+	// HealthCheck cache is served.
+	DefaultHealthCheckHTTPPath = "/debug/gateway"
+
+	// responseStalenessSampleInterval is how often the time since the last
+	// health check response of each tablet is recorded.
+	responseStalenessSampleInterval = 10 * time.Second
+	// servingDebounceNotServing and servingDebounceServing are the values of
+	// -healthcheck_serving_debounce_direction.
+	servingDebounceNotServing = "not_serving"
+	servingDebounceServing    = "serving"
 	// HealthCheckTemplate is the HTML code to display a TabletsCacheStatusList
 	HealthCheckTemplate = `
 <style>
@@ -134,22 +235,155 @@ const (
 )
 
 // ParseTabletURLTemplateFromFlag loads or reloads the URL template.
+// It exits if the template cannot be parsed.
 func ParseTabletURLTemplateFromFlag() {
-	tabletURLTemplate = template.New("")
-	_, err := tabletURLTemplate.Parse(*TabletURLTemplateString)
+	if err := ReloadTabletURLTemplate(); err != nil {
+		log.Exitf("%v", err)
+	}
+}
+
+// ReloadTabletURLTemplate parses -tablet_url_template again, e.g. after it
+// was changed at runtime, and uses it for the tablet URLs from then on.
+// If the template cannot be parsed, the previous one is kept.
+func ReloadTabletURLTemplate() error {
+	templ, err := template.New("").Parse(*TabletURLTemplateString)
 	if err != nil {
-		log.Exitf("error parsing template: %v", err)
+		return fmt.Errorf("error parsing template: %v", err)
 	}
+	tabletURLTemplateMu.Lock()
+	defer tabletURLTemplateMu.Unlock()
+	tabletURLTemplate = templ
+	return nil
+}
+
+// getTabletURLTemplate returns the current URL template.
+func getTabletURLTemplate() *template.Template {
+	tabletURLTemplateMu.RLock()
+	defer tabletURLTemplateMu.RUnlock()
+	return tabletURLTemplate
 }
 
 func init() {
 	// Flags are not parsed at this point and the default value of the flag (just the hostname) will be used.
 	ParseTabletURLTemplateFromFlag()
-	flag.Var(&TabletFilters, "tablet_filters", "Specifies a comma-separated list of 'keyspace|shard_name or keyrange' values to filter the tablets to watch")
+	flag.Var(&TabletFilters, "tablet_filters", "Specifies a comma-separated list of 'keyspace|shard_name or keyrange' values to filter the tablets to watch. Applied in addition to -keyspaces_to_watch")
+	flag.Var(&TabletTagFilters, "tablet_tag_filters", "Specifies a comma-separated list of 'key=value' tags that the tablets to watch must all have. Applied in addition to -tablet_filters and -keyspaces_to_watch")
 	topoproto.TabletTypeListVar(&AllowedTabletTypes, "allowed_tablet_types", "Specifies the tablet types this vtgate is allowed to route queries to")
+	flag.Var(&allowedTabletTypesByKeyspace, "allowed_tablet_types_by_keyspace", "Overrides -allowed_tablet_types for some keyspaces, e.g. ks1:master,replica,rdonly;ks2:master,replica. The tablets of these keyspaces with another type are not health checked")
+	flag.Var(&retryDelayByTabletType, "healthcheck_retry_delay_by_tablet_type", "Overrides the retry delay of the healthcheck, -healthcheck_retry_delay in vtgate, for the tablets of some types, e.g. master:100ms,rdonly:10s. The tablets of the other types use the global retry delay")
+	topoproto.TabletTypeListVar(&readFallbackOrder, "read_fallback_order", "Specifies an ordered list of read-only tablet types, e.g. rdonly,replica. When a tablet type of the list has no healthy tablets, the types following it are used instead")
 	flag.Var(&KeyspacesToWatch, "keyspaces_to_watch", "Specifies which keyspaces this vtgate should have access to while routing queries or accessing the vschema")
 }
 
+// keyspaceTabletTypes is a flag.Value for a list of tablet types per
+// keyspace, formatted as ks1:type1,type2;ks2:type3.
+type keyspaceTabletTypes map[string][]topodata.TabletType
+
+// String is part of the flag.Value interface.
+func (k *keyspaceTabletTypes) String() string {
+	keyspaces := make([]string, 0, len(*k))
+	for keyspace := range *k {
+		keyspaces = append(keyspaces, keyspace)
+	}
+	sort.Strings(keyspaces)
+	parts := make([]string, 0, len(keyspaces))
+	for _, keyspace := range keyspaces {
+		parts = append(parts, keyspace+":"+strings.ToLower(strings.Join(topoproto.MakeStringTypeList((*k)[keyspace]), ",")))
+	}
+	return strings.Join(parts, ";")
+}
+
+// Set is part of the flag.Value interface.
+func (k *keyspaceTabletTypes) Set(value string) error {
+	res := make(keyspaceTabletTypes)
+	for _, part := range strings.Split(value, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		fields := strings.SplitN(part, ":", 2)
+		keyspace := strings.TrimSpace(fields[0])
+		if len(fields) != 2 || keyspace == "" {
+			return fmt.Errorf("invalid keyspace tablet types %q, expected keyspace:type1,type2", part)
+		}
+		types, err := topoproto.ParseTabletTypes(fields[1])
+		if err != nil {
+			return fmt.Errorf("invalid tablet types for keyspace %v: %v", keyspace, err)
+		}
+		res[keyspace] = types
+	}
+	*k = res
+	return nil
+}
+
+// tabletTypeDurations is a flag.Value for a duration per tablet type,
+// formatted as type1:duration1,type2:duration2.
+type tabletTypeDurations map[topodata.TabletType]time.Duration
+
+// String is part of the flag.Value interface.
+func (d *tabletTypeDurations) String() string {
+	parts := make([]string, 0, len(*d))
+	for tabletType, duration := range *d {
+		parts = append(parts, topoproto.TabletTypeLString(tabletType)+":"+duration.String())
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// Set is part of the flag.Value interface.
+func (d *tabletTypeDurations) Set(value string) error {
+	res := make(tabletTypeDurations)
+	for _, part := range strings.Split(value, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		fields := strings.SplitN(part, ":", 2)
+		if len(fields) != 2 {
+			return fmt.Errorf("invalid tablet type duration %q, expected type:duration", part)
+		}
+		tabletType, err := topoproto.ParseTabletType(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return err
+		}
+		duration, err := time.ParseDuration(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return fmt.Errorf("invalid duration for tablet type %v: %v", fields[0], err)
+		}
+		res[tabletType] = duration
+	}
+	*d = res
+	return nil
+}
+
+// clone returns a copy of d, which is not changed by a later Set of d.
+func (d tabletTypeDurations) clone() tabletTypeDurations {
+	res := make(tabletTypeDurations, len(d))
+	for tabletType, duration := range d {
+		res[tabletType] = duration
+	}
+	return res
+}
+
+// AllowedTabletTypesForKeyspace returns the tablet types the queries to
+// the keyspace can be routed to: from -allowed_tablet_types_by_keyspace,
+// or from -allowed_tablet_types for the keyspaces it doesn't list.
+// An empty list allows all the tablet types.
+func AllowedTabletTypesForKeyspace(keyspace string) []topodata.TabletType {
+	if types, ok := allowedTabletTypesByKeyspace[keyspace]; ok {
+		return types
+	}
+	return AllowedTabletTypes
+}
+
+// IsTabletTypeAllowed returns true if the queries to the keyspace can be
+// routed to the tablets of the given type, see AllowedTabletTypesForKeyspace.
+func IsTabletTypeAllowed(keyspace string, tabletType topodata.TabletType) bool {
+	allowed := AllowedTabletTypesForKeyspace(keyspace)
+	if len(allowed) == 0 {
+		return true
+	}
+	return topoproto.IsTypeInList(tabletType, allowed)
+}
+
 // TabletRecorder is a sub interface of HealthCheck.
 // It is separated out to enable unit testing.
 type TabletRecorder interface {
@@ -161,6 +395,25 @@ type TabletRecorder interface {
 	ReplaceTablet(old, new *topodata.Tablet)
 }
 
+// batchTabletRecorder is implemented by the TabletRecorders which can add
+// many tablets at once more cheaply than one by one, like HealthCheckImpl.
+// The topology watchers use it when it is available.
+type batchTabletRecorder interface {
+	// AddTablets adds all the tablets at once.
+	AddTablets(tablets []*topodata.Tablet)
+}
+
+// tabletAdmitter is implemented by the TabletRecorders which reject the
+// tablets of some types, like HealthCheckImpl with
+// -allowed_tablet_types_by_keyspace. The topology watchers don't record the
+// rejected tablets as known, so that they are read again from topo and
+// added once their type is allowed.
+type tabletAdmitter interface {
+	// admitsTablet returns false if the tablet would be rejected because
+	// of its type.
+	admitsTablet(tablet *topodata.Tablet) bool
+}
+
 type keyspaceShardTabletType string
 type tabletAliasString string
 
@@ -183,6 +436,10 @@ type HealthCheckImpl struct {
 	healthCheckTimeout time.Duration
 	ts                 *topo.Server
 	cell               string
+	httpPath           string
+	httpMux            *http.ServeMux
+	// clock is the source of time of the health checks, the tests replace it.
+	clock clock
 	// mu protects all the following fields.
 	mu sync.Mutex
 	// authoritative map of tabletHealth by alias
@@ -193,16 +450,256 @@ type HealthCheckImpl struct {
 	healthData map[keyspaceShardTabletType]map[tabletAliasString]*TabletHealth
 	// another map keyed by keyspace.shard.tabletType, this one containing a sorted list of TabletHealth
 	healthy map[keyspaceShardTabletType][]*TabletHealth
+	// masterTermStartTimes is the highest MasterTermStartTime accepted for
+	// the master of each keyspace.shard.tabletType, so that a demoted master
+	// which still reports being the master is never accepted again
+	masterTermStartTimes map[keyspaceShardTabletType]int64
 	// connsWG keeps track of all launched Go routines that monitor tablet connections.
 	connsWG sync.WaitGroup
+	// activeConns is the number of running checkConn goroutines, see ActiveConnections
+	activeConns sync2.AtomicInt64
 	// topology watchers that inform healthcheck of tablets being added and deleted
 	topoWatchers []*TopologyWatcher
 	// cellAliases is a cache of cell aliases
 	cellAliases map[string]string
 	// mutex to protect subscribers
 	subMu sync.Mutex
-	// subscribers
-	subscribers map[chan *TabletHealth]struct{}
+	// subscribers, mapped to whether they are sent the removals of tablets
+	subscribers map[chan *TabletHealth]bool
+	// responseValidator is an optional additional check run on each health check response
+	responseValidator func(*query.StreamHealthResponse) error
+	// connectionVerifier is an optional check run on each new connection to a tablet
+	connectionVerifier func(tablet *topodata.Tablet, conn queryservice.QueryService) error
+	// targetNormalizer optionally rewrites the targets before they are keyed
+	targetNormalizer func(*query.Target) *query.Target
+	// denylist is the set of tablets that must not be returned as healthy,
+	// even though they are still health checked
+	denylist map[tabletAliasString]bool
+	// keyspacesToWatch is the filter built from KeyspacesToWatch, nil if all keyspaces are watched
+	keyspacesToWatch *FilterByKeyspace
+	// closeChan is closed when the healthcheck is closed
+	closeChan chan struct{}
+	// streamPool runs the health checks when -healthcheck_max_concurrent_streams is set
+	streamPool *streamPool
+	// masterChangeCallbacks are called when the master of a shard changes
+	masterChangeCallbacks []func(keyspace, shard string, old, new *topodata.Tablet)
+	// availabilityCallbacks are called when a target loses all its healthy
+	// tablets, or gets some again
+	availabilityCallbacks []func(target *query.Target, available bool)
+	// availability is the availability of each target, as last reported to
+	// the availabilityCallbacks
+	availability map[keyspaceShardTabletType]*targetAvailability
+	// availabilityDebounce is set from -healthcheck_target_availability_debounce
+	availabilityDebounce time.Duration
+	// maxConnectionsPerCell is set from -max_connections_per_cell
+	maxConnectionsPerCell int
+	// cellConnections is the number of tablets of each remote cell whose
+	// health is checked, and waitingForCell are the tablets of each remote
+	// cell waiting for one of them to stop, when maxConnectionsPerCell is set
+	cellConnections map[string]int
+	waitingForCell  map[string][]*tabletHealthCheck
+	// healthStreamDisabled is set from -disable_health_stream
+	healthStreamDisabled bool
+	// errorRateDecay is set from -healthcheck_error_rate_decay
+	errorRateDecay float64
+	// healthErrorAsDegraded is set from -healthcheck_health_error_as_degraded
+	healthErrorAsDegraded bool
+	// initialWarmFraction is set from -healthcheck_initial_warm_fraction
+	initialWarmFraction float64
+	// maxRetryDuration is set from -healthcheck_max_retry_duration
+	maxRetryDuration time.Duration
+	// retryDelayByTabletType is set from -healthcheck_retry_delay_by_tablet_type
+	retryDelayByTabletType tabletTypeDurations
+	// perTabletServingStats is set from -healthcheck_tablet_serving_stats
+	perTabletServingStats bool
+	// history is the health history, nil if -healthcheck_history_retention is 0
+	history *healthHistory
+	// servingDebounce is set from -healthcheck_serving_debounce, and
+	// debouncedServing is the serving state whose reports it delays, as set
+	// by -healthcheck_serving_debounce_direction
+	servingDebounce  time.Duration
+	debouncedServing bool
+	// adaptiveTimeoutMultiplier, adaptiveTimeoutMin and adaptiveTimeoutMax
+	// are set from the -healthcheck_adaptive_timeout_* flags
+	adaptiveTimeoutMultiplier float64
+	adaptiveTimeoutMin        time.Duration
+	adaptiveTimeoutMax        time.Duration
+	// sampleStalenessOnce starts sampling the response staleness once
+	sampleStalenessOnce sync.Once
+	// paused is set between Pause and Resume
+	paused sync2.AtomicBool
+	// initialTablets are set by WithInitialTablets, until they are added
+	initialTablets []*topodata.Tablet
+	// topoServerForCell is set by WithTopoServerForCell
+	topoServerForCell func(cell string) *topo.Server
+}
+
+// retryDelayFor returns the delay before the first retry to connect to a
+// tablet of the given type, from -healthcheck_retry_delay_by_tablet_type,
+// or the retry delay of the healthcheck for the types it doesn't list.
+func (hc *HealthCheckImpl) retryDelayFor(tabletType topodata.TabletType) time.Duration {
+	if retryDelay, ok := hc.retryDelayByTabletType[tabletType]; ok {
+		return retryDelay
+	}
+	return hc.retryDelay
+}
+
+// clock abstracts the time for the health checks, so that their timeouts
+// can be tested without waiting.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// The reasons for which the healthcheck closes a tablet connection, as
+// returned by CloseReason.
+const (
+	// CloseReasonShutdown is used when the healthcheck is closed.
+	CloseReasonShutdown = "shutdown"
+	// CloseReasonRemoved is used when the tablet is removed from the healthcheck.
+	CloseReasonRemoved = "removed"
+	// CloseReasonError is used when the health check stream failed.
+	CloseReasonError = "error"
+)
+
+type closeReasonKey struct{}
+
+// withCloseReason returns a context carrying the reason for which a
+// connection is closed.
+func withCloseReason(ctx context.Context, reason string) context.Context {
+	return context.WithValue(ctx, closeReasonKey{}, reason)
+}
+
+// CloseReason returns the reason for which the healthcheck closes a tablet
+// connection, from the context passed to the Close method of the
+// connection, or "" if the connection was not closed by the healthcheck.
+// It lets the connections tell an orderly disconnect from an error.
+func CloseReason(ctx context.Context) string {
+	reason, _ := ctx.Value(closeReasonKey{}).(string)
+	return reason
+}
+
+// Pause freezes the view of the healthcheck until Resume is called: the
+// health check responses are still read from the tablets but ignored, and
+// the tablets are not reloaded from the topo. The connections are kept
+// open. Meanwhile, the tablets are selected from their last known state.
+func (hc *HealthCheckImpl) Pause() {
+	hc.paused.Set(true)
+	for _, tw := range hc.topoWatchers {
+		tw.Pause()
+	}
+	log.Infof("HealthCheck paused")
+}
+
+// Resume undoes Pause. The state of each tablet is updated with its next
+// health check response, and the tablets are reloaded from the topo at the
+// next refresh.
+func (hc *HealthCheckImpl) Resume() {
+	for _, tw := range hc.topoWatchers {
+		tw.Resume()
+	}
+	hc.paused.Set(false)
+	log.Infof("HealthCheck resumed")
+}
+
+// isClosed returns true once Close was called.
+func (hc *HealthCheckImpl) isClosed() bool {
+	select {
+	case <-hc.closeChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// cellsToWatch parses the comma-separated list of cells to watch, and
+// returns the cells which exist in topo. The cells which don't exist are
+// logged and skipped, since their tablets could never be read. It returns
+// an error if there are cells in the list but none of them exists.
+// If the known cells cannot be read from topo, the cells are not validated.
+func cellsToWatch(ctx context.Context, ts *topo.Server, list string) ([]string, error) {
+	var cells []string
+	seen := make(map[string]bool)
+	for _, c := range strings.Split(list, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" || seen[c] {
+			continue
+		}
+		seen[c] = true
+		cells = append(cells, c)
+	}
+	if len(cells) == 0 {
+		return nil, nil
+	}
+
+	knownCells, err := ts.GetKnownCells(ctx)
+	if err != nil {
+		log.Warningf("cannot read the cells from topo, not validating the cells to watch %v: %v", cells, err)
+		return cells, nil
+	}
+	known := make(map[string]bool, len(knownCells))
+	for _, c := range knownCells {
+		known[c] = true
+	}
+	valid := make([]string, 0, len(cells))
+	for _, c := range cells {
+		if !known[c] {
+			log.Errorf("cell %q does not exist in topo, not watching it", c)
+			continue
+		}
+		valid = append(valid, c)
+	}
+	if len(valid) == 0 {
+		return nil, fmt.Errorf("none of the cells to watch %v exists in topo, known cells: %v", cells, knownCells)
+	}
+	return valid, nil
+}
+
+// HealthCheckOption sets an optional parameter of a HealthCheck.
+type HealthCheckOption func(hc *HealthCheckImpl)
+
+// WithHTTPPath sets the path at which the HealthCheck cache is served.
+// It defaults to DefaultHealthCheckHTTPPath.
+func WithHTTPPath(path string) HealthCheckOption {
+	return func(hc *HealthCheckImpl) {
+		hc.httpPath = path
+	}
+}
+
+// WithServeMux sets the mux on which the HealthCheck cache is served.
+// It defaults to http.DefaultServeMux.
+func WithServeMux(mux *http.ServeMux) HealthCheckOption {
+	return func(hc *HealthCheckImpl) {
+		hc.httpMux = mux
+	}
+}
+
+// WithInitialTablets adds the given tablets, e.g. from a snapshot of the
+// topo, before the topology watchers start, so that they are health checked
+// right away. The watchers then reconcile them with the topo like the
+// tablets they found themselves: the ones which are not in the topo anymore
+// are removed, and the ones whose address changed are replaced. If tablets
+// are watched, the tablets that no watcher would report are ignored.
+func WithInitialTablets(tablets []*topodata.Tablet) HealthCheckOption {
+	return func(hc *HealthCheckImpl) {
+		hc.initialTablets = tablets
+	}
+}
+
+// WithTopoServerForCell sets the function which returns the topology server
+// from which the tablets of each watched cell are read, e.g. the local topo
+// of the cell when it is not served by the global one. The topoServer given
+// to NewHealthCheck is used for the cells for which it returns nil.
+func WithTopoServerForCell(topoServerForCell func(cell string) *topo.Server) HealthCheckOption {
+	return func(hc *HealthCheckImpl) {
+		hc.topoServerForCell = topoServerForCell
+	}
 }
 
 // NewHealthCheck creates a new HealthCheck object.
@@ -220,52 +717,107 @@ type HealthCheckImpl struct {
 //   The localCell for this healthcheck
 // callback.
 //   A function to call when there is a master change. Used to notify vtgate's buffer to stop buffering.
-func NewHealthCheck(ctx context.Context, retryDelay, healthCheckTimeout time.Duration, topoServer *topo.Server, localCell string) *HealthCheckImpl {
+// opts.
+//   Optional parameters, e.g. WithHTTPPath to serve the cache at a different path.
+func NewHealthCheck(ctx context.Context, retryDelay, healthCheckTimeout time.Duration, topoServer *topo.Server, localCell string, opts ...HealthCheckOption) *HealthCheckImpl {
 	log.Infof("loading tablets for cells: %v", *CellsToWatch)
 
 	hc := &HealthCheckImpl{
-		ts:                 topoServer,
-		cell:               localCell,
-		retryDelay:         retryDelay,
-		healthCheckTimeout: healthCheckTimeout,
-		healthByAlias:      make(map[tabletAliasString]*tabletHealthCheck),
-		healthData:         make(map[keyspaceShardTabletType]map[tabletAliasString]*TabletHealth),
-		healthy:            make(map[keyspaceShardTabletType][]*TabletHealth),
-		subscribers:        make(map[chan *TabletHealth]struct{}),
-		cellAliases:        make(map[string]string),
+		ts:                   topoServer,
+		cell:                 localCell,
+		retryDelay:           retryDelay,
+		healthCheckTimeout:   healthCheckTimeout,
+		clock:                realClock{},
+		healthByAlias:        make(map[tabletAliasString]*tabletHealthCheck),
+		healthData:           make(map[keyspaceShardTabletType]map[tabletAliasString]*TabletHealth),
+		healthy:              make(map[keyspaceShardTabletType][]*TabletHealth),
+		masterTermStartTimes: make(map[keyspaceShardTabletType]int64),
+		availability:         make(map[keyspaceShardTabletType]*targetAvailability),
+		cellConnections:      make(map[string]int),
+		waitingForCell:       make(map[string][]*tabletHealthCheck),
+		subscribers:          make(map[chan *TabletHealth]bool),
+		cellAliases:          make(map[string]string),
+		denylist:             make(map[tabletAliasString]bool),
+		httpPath:             DefaultHealthCheckHTTPPath,
+		httpMux:              http.DefaultServeMux,
+		closeChan:            make(chan struct{}),
+		healthStreamDisabled: *disableHealthStream,
+		errorRateDecay:       *errorRateDecay,
+		maxRetryDuration:     *maxRetryDuration,
+		initialWarmFraction:  *initialWarmFraction,
+		servingDebounce:      *servingDebounce,
+		availabilityDebounce: *targetAvailabilityDebounce,
+
+		adaptiveTimeoutMultiplier: *adaptiveTimeoutMultiplier,
+		adaptiveTimeoutMin:        *adaptiveTimeoutMin,
+		adaptiveTimeoutMax:        *adaptiveTimeoutMax,
+		maxConnectionsPerCell:     *maxConnectionsPerCell,
+		retryDelayByTabletType:    retryDelayByTabletType.clone(),
+		healthErrorAsDegraded:     *healthErrorAsDegraded,
+		perTabletServingStats:     *tabletServingStats,
+	}
+	switch *servingDebounceDirection {
+	case servingDebounceNotServing:
+	case servingDebounceServing:
+		hc.debouncedServing = true
+	default:
+		log.Exitf("Unknown serving debounce direction: %v", *servingDebounceDirection)
+	}
+	for _, opt := range opts {
+		opt(hc)
+	}
+	hc.history = newHealthHistory(*historyRetention, hc.clock)
+	if *maxConcurrentStreams > 0 && !hc.healthStreamDisabled {
+		if *pollInterval < minPollInterval {
+			log.Exitf("-healthcheck_poll_interval must be at least %v, got %v", minPollInterval, *pollInterval)
+		}
+		hc.streamPool = newStreamPool(hc, *maxConcurrentStreams, *pollInterval)
+	}
+	if len(KeyspacesToWatch) > 0 {
+		hc.keyspacesToWatch = NewFilterByKeyspace(KeyspacesToWatch)
 	}
 	var topoWatchers []*TopologyWatcher
-	var filter TabletFilter
-	cells := strings.Split(*CellsToWatch, ",")
-	if len(cells) == 0 {
-		cells = append(cells, localCell)
+	filter, err := newTabletFilter(hc.keyspacesToWatch, TabletFilters, TabletTagFilters)
+	if err != nil {
+		log.Exitf("Invalid tablet filters: %v", err)
+	}
+	cells, err := cellsToWatch(ctx, topoServer, *CellsToWatch)
+	if err != nil {
+		log.Exitf("Cannot use cells_to_watch parameter: %v", err)
 	}
 	for _, c := range cells {
 		log.Infof("Setting up healthcheck for cell: %v", c)
-		if c == "" {
+		cellTopoServer := topoServer
+		if hc.topoServerForCell != nil {
+			if ts := hc.topoServerForCell(c); ts != nil {
+				cellTopoServer = ts
+			}
+		}
+		if len(KeyspacesToWatch) > 0 {
+			// only enumerate the tablets of the watched keyspaces instead of the whole cell
+			topoWatchers = append(topoWatchers, NewKeyspacesTabletsWatcher(ctx, cellTopoServer, hc, filter, c, KeyspacesToWatch, *RefreshInterval, *RefreshKnownTablets, *TopoReadConcurrency))
 			continue
 		}
-		if len(TabletFilters) > 0 {
-			if len(KeyspacesToWatch) > 0 {
-				log.Exitf("Only one of -keyspaces_to_watch and -tablet_filters may be specified at a time")
-			}
+		topoWatchers = append(topoWatchers, NewCellTabletsWatcher(ctx, cellTopoServer, hc, filter, c, *RefreshInterval, *RefreshKnownTablets, *TopoReadConcurrency))
+	}
 
-			fbs, err := NewFilterByShard(TabletFilters)
-			if err != nil {
-				log.Exitf("Cannot parse tablet_filters parameter: %v", err)
+	hc.topoWatchers = topoWatchers
+	registerDebugHandler(hc.httpMux, hc.httpPath, hc)
+	registerDebugHandler(hc.httpMux, hc.httpPath+"/history", http.HandlerFunc(hc.serveHistory))
+	registerDebugHandler(hc.httpMux, hc.httpPath+"/topo_watchers", http.HandlerFunc(hc.serveTopoWatchers))
+
+	if len(hc.initialTablets) > 0 {
+		tablets := hc.initialTablets
+		if len(hc.topoWatchers) > 0 {
+			tablets = nil
+			for _, tw := range hc.topoWatchers {
+				tablets = append(tablets, tw.seedTablets(hc.initialTablets)...)
 			}
-			filter = fbs
-		} else if len(KeyspacesToWatch) > 0 {
-			filter = NewFilterByKeyspace(KeyspacesToWatch)
 		}
-		topoWatchers = append(topoWatchers, NewCellTabletsWatcher(ctx, topoServer, hc, filter, c, *RefreshInterval, *RefreshKnownTablets, *TopoReadConcurrency))
+		hc.AddTablets(tablets)
+		hc.initialTablets = nil
 	}
 
-	hc.topoWatchers = topoWatchers
-	healthcheckOnce.Do(func() {
-		http.Handle("/debug/gateway", hc)
-	})
-
 	// start the topo watches here
 	for _, tw := range hc.topoWatchers {
 		go tw.Start()
@@ -274,10 +826,76 @@ func NewHealthCheck(ctx context.Context, retryDelay, healthCheckTimeout time.Dur
 	return hc
 }
 
+// newTabletFilter returns the filter which includes the tablets included by
+// all of keyspaces, and of the filters parsed from shards and tags, as given
+// to -tablet_filters and -tablet_tag_filters. keyspaces may be nil. It
+// returns nil if there is no filter.
+func newTabletFilter(keyspaces *FilterByKeyspace, shards, tags []string) (TabletFilter, error) {
+	var filters []TabletFilter
+	if keyspaces != nil {
+		filters = append(filters, keyspaces)
+	}
+	if len(shards) > 0 {
+		fbs, err := NewFilterByShard(shards)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse tablet_filters parameter: %v", err)
+		}
+		filters = append(filters, fbs)
+	}
+	if len(tags) > 0 {
+		fbt, err := NewFilterByTagsFromList(tags)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse tablet_tag_filters parameter: %v", err)
+		}
+		filters = append(filters, fbt)
+	}
+	switch len(filters) {
+	case 0:
+		return nil, nil
+	case 1:
+		return filters[0], nil
+	default:
+		return NewFilterAll(filters...), nil
+	}
+}
+
+// registerDebugHandler serves handler on path of mux, unless another
+// HealthCheck is already served at that path on the same mux.
+func registerDebugHandler(mux *http.ServeMux, path string, handler http.Handler) {
+	registeredHandlersMu.Lock()
+	defer registeredHandlersMu.Unlock()
+	paths, ok := registeredHandlers[mux]
+	if !ok {
+		paths = make(map[string]bool)
+		registeredHandlers[mux] = paths
+	}
+	if paths[path] {
+		log.Warningf("a HealthCheck is already served at %v, not serving this one", path)
+		return
+	}
+	paths[path] = true
+	mux.Handle(path, handler)
+}
+
 // AddTablet adds the tablet, and starts health check.
 // It does not block on making connection.
 // name is an optional tag for the tablet, e.g. an alternative address.
 func (hc *HealthCheckImpl) AddTablet(tablet *topodata.Tablet) {
+	hc.addTablet(tablet, time.Time{})
+}
+
+// AddTabletWithConnectDeadline is like AddTablet, but if the tablet has not
+// sent any health check response by the given deadline, e.g. because it is
+// unreachable, its LastError becomes an ErrFailedInitialConnect error, and
+// it is marked FailedInitialConnect until it sends one. Its health is still
+// checked after the deadline.
+func (hc *HealthCheckImpl) AddTabletWithConnectDeadline(tablet *topodata.Tablet, deadline time.Time) {
+	hc.addTablet(tablet, deadline)
+}
+
+// addTablet implements AddTablet and AddTabletWithConnectDeadline, the
+// connect deadline is ignored if it is zero.
+func (hc *HealthCheckImpl) addTablet(tablet *topodata.Tablet, connectDeadline time.Time) {
 	log.Infof("Calling AddTablet for tablet: %v", tablet)
 	// check whether we should really add this tablet
 	if !hc.isIncluded(tablet) {
@@ -287,29 +905,160 @@ func (hc *HealthCheckImpl) AddTablet(tablet *topodata.Tablet) {
 	defer hc.mu.Unlock()
 	if hc.healthByAlias == nil {
 		// already closed.
+		log.Warningf("Not adding tablet %v: the healthcheck is closed", topoproto.TabletAliasString(tablet.Alias))
+		hcAddAfterCloseCounter.Add(1)
+		return
+	}
+	if thc := hc.addTabletLocked(tablet); thc != nil {
+		// the health check of the tablet is not started yet
+		thc.connectDeadline = connectDeadline
+		hc.startHealthCheckLocked(thc)
+	}
+}
+
+// AddTablets adds the tablets, and starts health check for each of them.
+// Unlike calling AddTablet for each tablet, it only takes the lock once,
+// which matters when loading a large number of tablets at once.
+// It does not block on making connections.
+func (hc *HealthCheckImpl) AddTablets(tablets []*topodata.Tablet) {
+	log.Infof("Calling AddTablets for %v tablets", len(tablets))
+	// check whether we should really add these tablets, before taking the lock
+	included := make([]*topodata.Tablet, 0, len(tablets))
+	for _, tablet := range tablets {
+		log.Infof("Calling AddTablet for tablet: %v", tablet)
+		if hc.isIncluded(tablet) {
+			included = append(included, tablet)
+		}
+	}
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.healthByAlias == nil {
+		// already closed.
+		log.Warningf("Not adding %v tablets: the healthcheck is closed", len(included))
+		hcAddAfterCloseCounter.Add(int64(len(included)))
+		return
+	}
+	for _, tablet := range included {
+		if thc := hc.addTabletLocked(tablet); thc != nil {
+			hc.startHealthCheckLocked(thc)
+		}
+	}
+}
+
+// startHealthCheckLocked starts the health check of a newly added tablet,
+// either on its own goroutine or on the stream pool.
+// hc.mu must be locked before calling this function.
+func (hc *HealthCheckImpl) startHealthCheckLocked(thc *tabletHealthCheck) {
+	if hc.healthStreamDisabled || !hc.acquireCellConnectionLocked(thc) {
+		return
+	}
+	if hc.streamPool != nil {
+		hc.streamPool.add(thc, hc.clock.Now())
+		return
+	}
+	hc.connsWG.Add(1)
+	hc.activeConns.Add(1)
+	go thc.checkConn(hc)
+}
+
+// acquireCellConnectionLocked returns true if the health of the tablet can
+// be checked, or false if -max_connections_per_cell is reached for its
+// cell, in which case the tablet waits for releaseCellConnectionLocked.
+// hc.mu must be locked before calling this function.
+func (hc *HealthCheckImpl) acquireCellConnectionLocked(thc *tabletHealthCheck) bool {
+	cell := thc.Tablet.Alias.Cell
+	if hc.maxConnectionsPerCell <= 0 || cell == hc.cell {
+		return true
+	}
+	if hc.cellConnections[cell] >= hc.maxConnectionsPerCell {
+		hc.waitingForCell[cell] = append(hc.waitingForCell[cell], thc)
+		hc.setHealthUnknownLocked(thc, true)
+		return false
+	}
+	hc.cellConnections[cell]++
+	thc.cellConnection = true
+	return true
+}
+
+// releaseCellConnectionLocked is called when the health check of the tablet
+// stops. It starts the health check of the next tablet of the same cell
+// waiting for one to stop, if any.
+// hc.mu must be locked before calling this function.
+func (hc *HealthCheckImpl) releaseCellConnectionLocked(thc *tabletHealthCheck) {
+	if !thc.cellConnection {
 		return
 	}
+	thc.cellConnection = false
+	cell := thc.Tablet.Alias.Cell
+	hc.cellConnections[cell]--
+	for len(hc.waitingForCell[cell]) > 0 {
+		next := hc.waitingForCell[cell][0]
+		hc.waitingForCell[cell] = hc.waitingForCell[cell][1:]
+		if next.ctx.Err() != nil {
+			// removed while waiting
+			continue
+		}
+		hc.setHealthUnknownLocked(next, false)
+		hc.startHealthCheckLocked(next)
+		return
+	}
+}
+
+// setHealthUnknownLocked sets whether the health of the tablet is unknown
+// because it is not checked.
+// hc.mu must be locked before calling this function.
+func (hc *HealthCheckImpl) setHealthUnknownLocked(thc *tabletHealthCheck, unknown bool) {
+	thc.connMu.Lock()
+	thc.healthUnknown = unknown
+	thc.connMu.Unlock()
+	alias := tabletAliasString(topoproto.TabletAliasString(thc.Tablet.Alias))
+	if ths, ok := hc.healthData[hc.keyFromTarget(thc.Target)]; ok {
+		if _, ok := ths[alias]; ok {
+			ths[alias] = thc.SimpleCopy()
+		}
+	}
+}
+
+// addTabletLocked adds the tablet to our datastore and returns its
+// tabletHealthCheck, or nil if the tablet is already known.
+// hc.mu must be locked before calling this function.
+func (hc *HealthCheckImpl) addTabletLocked(tablet *topodata.Tablet) *tabletHealthCheck {
+	tabletAlias := topoproto.TabletAliasString(tablet.Alias)
+	if existing, ok := hc.healthByAlias[tabletAliasString(tabletAlias)]; ok {
+		if TabletToMapKey(existing.Tablet) == TabletToMapKey(tablet) {
+			// The same tablet is added again, e.g. by two watchers of the
+			// same cell. Its health is already checked at that address, so
+			// only the tablet record is refreshed.
+			log.V(2).Infof("Tablet %v is already in the healthcheck, not adding it again", tabletAlias)
+			hcDuplicateAddCounter.Add(1)
+			existing.setTablet(tablet)
+			return nil
+		}
+		// We should not add a tablet that we already have
+		log.Errorf("Program bug: tried to add existing tablet: %v to healthcheck", tabletAlias)
+		return nil
+	}
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	target := &query.Target{
 		Keyspace:   tablet.Keyspace,
 		Shard:      tablet.Shard,
 		TabletType: tablet.Type,
 	}
+	now := hc.clock.Now()
 	thc := &tabletHealthCheck{
-		ctx:        ctx,
-		cancelFunc: cancelFunc,
-		Tablet:     tablet,
-		Target:     target,
+		ctx:             ctx,
+		cancelFunc:      cancelFunc,
+		Tablet:          tablet,
+		Target:          target,
+		FirstSeen:       now,
+		LastStateChange: now,
+		warming:         !hc.healthStreamDisabled,
+		history:         hc.history,
 	}
+	hc.history.record(thc, HealthEventAdded, "")
 
 	// add to our datastore
 	key := hc.keyFromTarget(target)
-	tabletAlias := topoproto.TabletAliasString(tablet.Alias)
-	if _, ok := hc.healthByAlias[tabletAliasString(tabletAlias)]; ok {
-		// We should not add a tablet that we already have
-		log.Errorf("Program bug: tried to add existing tablet: %v to healthcheck", tabletAlias)
-		return
-	}
 	hc.healthByAlias[tabletAliasString(tabletAlias)] = thc
 	res := thc.SimpleCopy()
 	if ths, ok := hc.healthData[key]; !ok {
@@ -321,8 +1070,7 @@ func (hc *HealthCheckImpl) AddTablet(tablet *topodata.Tablet) {
 	}
 
 	hc.broadcast(res)
-	hc.connsWG.Add(1)
-	go thc.checkConn(hc)
+	return thc
 }
 
 // RemoveTablet removes the tablet, and stops the health check.
@@ -340,11 +1088,77 @@ func (hc *HealthCheckImpl) ReplaceTablet(old, new *topodata.Tablet) {
 	hc.AddTablet(new)
 }
 
+// SetTablets makes the given tablets the tablets of the healthcheck, for
+// the callers which compute the whole set of tablets themselves instead of
+// having them watched in topo. The tablets which are not in the set are
+// removed, the new ones are added, and the ones whose address changed are
+// replaced, all at once under the lock of the healthcheck.
+// It does not block on making connections.
+func (hc *HealthCheckImpl) SetTablets(tablets []*topodata.Tablet) {
+	log.Infof("Calling SetTablets for %v tablets", len(tablets))
+	// check whether we should really have these tablets, before taking the lock
+	newTablets := make(map[string]*tabletInfo, len(tablets))
+	for _, tablet := range tablets {
+		if hc.isIncluded(tablet) {
+			alias := topoproto.TabletAliasString(tablet.Alias)
+			newTablets[alias] = &tabletInfo{alias: alias, tablet: tablet}
+		}
+	}
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.healthByAlias == nil {
+		// already closed.
+		log.Warningf("Not setting %v tablets: the healthcheck is closed", len(newTablets))
+		hcAddAfterCloseCounter.Add(int64(len(newTablets)))
+		return
+	}
+	oldTablets := make(map[string]*tabletInfo, len(hc.healthByAlias))
+	for alias, thc := range hc.healthByAlias {
+		oldTablets[string(alias)] = &tabletInfo{alias: string(alias), tablet: thc.Tablet}
+	}
+	diff := diffTablets(oldTablets, newTablets)
+	for _, tablet := range diff.removed {
+		hc.deleteTabletLocked(tablet)
+	}
+	for _, replaced := range diff.replaced {
+		hc.deleteTabletLocked(replaced.old)
+		diff.added = append(diff.added, replaced.new)
+	}
+	for _, tablet := range diff.added {
+		if thc := hc.addTabletLocked(tablet); thc != nil {
+			hc.startHealthCheckLocked(thc)
+		}
+	}
+}
+
 func (hc *HealthCheckImpl) deleteTablet(tablet *topodata.Tablet) {
 	hc.mu.Lock()
 	defer hc.mu.Unlock()
+	hc.deleteTabletLocked(tablet)
+}
+
+// evictTablet removes the tablet of thc, which exceeded its retry budget,
+// unless it was replaced in the meantime. The topology watchers forget it,
+// so that it is added again by their next refresh if it is still in topo.
+func (hc *HealthCheckImpl) evictTablet(thc *tabletHealthCheck) {
+	hc.mu.Lock()
+	alias := topoproto.TabletAliasString(thc.Tablet.Alias)
+	if hc.healthByAlias[tabletAliasString(alias)] != thc {
+		hc.mu.Unlock()
+		return
+	}
+	hc.deleteTabletLocked(thc.Tablet)
+	hc.mu.Unlock()
+
+	// the watchers call into the healthcheck with their lock held
+	for _, tw := range hc.topoWatchers {
+		tw.forgetTablet(alias)
+	}
+}
 
-	key := hc.keyFromTablet(tablet)
+// deleteTabletLocked removes the tablet and stops its health check.
+// hc.mu must be locked before calling this function.
+func (hc *HealthCheckImpl) deleteTabletLocked(tablet *topodata.Tablet) {
 	tabletAlias := tabletAliasString(topoproto.TabletAliasString(tablet.Alias))
 	// delete from authoritative map
 	th, ok := hc.healthByAlias[tabletAlias]
@@ -352,58 +1166,107 @@ func (hc *HealthCheckImpl) deleteTablet(tablet *topodata.Tablet) {
 		log.Infof("We have no health data for tablet: %v, it might have been deleted already", tabletAlias)
 		return
 	}
+	if unhealthySince := th.getUnhealthySince(); !unhealthySince.IsZero() {
+		hcEvictionLatencies.Add([]string{th.Target.Keyspace, th.Target.Shard, topoproto.TabletTypeLString(th.Target.TabletType)}, hc.clock.Now().Sub(unhealthySince))
+	}
 	// calling this will end the context associated with th.checkConn
 	// which will call finalizeConn, which will close the connection
 	th.cancelFunc()
+	hc.releaseCellConnectionLocked(th)
 	delete(hc.healthByAlias, tabletAlias)
-	// delete from map by keyspace.shard.tabletType
+	hc.history.record(th, HealthEventRemoved, "")
+	// let the subscribers which asked for it know that the tablet is gone
+	removed := th.SimpleCopy()
+	removed.Removed = true
+	hc.broadcast(removed)
+	// delete from map by keyspace.shard.tabletType, which is the target the
+	// tablet reported last and not the one of its topo record
+	key := hc.keyFromTarget(th.Target)
 	ths, ok := hc.healthData[key]
 	if !ok {
 		log.Warningf("We have no health data for target: %v", key)
 		return
 	}
 	delete(ths, tabletAlias)
+	for i, healthy := range hc.healthy[key] {
+		if topoproto.TabletAliasEqual(healthy.Tablet.Alias, tablet.Alias) {
+			hc.healthy[key] = append(hc.healthy[key][:i:i], hc.healthy[key][i+1:]...)
+			break
+		}
+	}
+	hc.checkAvailabilityLocked(key, th.Target)
 }
 
 func (hc *HealthCheckImpl) updateHealth(th *TabletHealth, shr *query.StreamHealthResponse, currentTarget *query.Target, trivialNonMasterUpdate bool, isMasterUpdate bool, isMasterChange bool) {
+	// the master change callbacks are run once hc.mu is released
+	var oldMaster *TabletHealth
+	var masterChangeCallbacks []func(keyspace, shard string, old, new *topodata.Tablet)
+	defer func() {
+		for _, callback := range masterChangeCallbacks {
+			callback(shr.Target.Keyspace, shr.Target.Shard, oldMaster.Tablet, th.Tablet)
+		}
+	}()
+
 	// hc.healthByAlias is authoritative, it should be updated
 	hc.mu.Lock()
 	defer hc.mu.Unlock()
+	if hc.healthData == nil {
+		// already closed
+		return
+	}
 
 	tabletAlias := tabletAliasString(topoproto.TabletAliasString(shr.TabletAlias))
 
 	hcErrorCounters.Add([]string{shr.Target.Keyspace, shr.Target.Shard, topoproto.TabletTypeLString(shr.Target.TabletType)}, 0)
 	targetKey := hc.keyFromTarget(shr.Target)
-	targetChanged := currentTarget.TabletType != shr.Target.TabletType || currentTarget.Keyspace != shr.Target.Keyspace || currentTarget.Shard != shr.Target.Shard
+	targetChanged := !sameTarget(currentTarget, shr.Target)
 	if targetChanged {
 		// keyspace and shard are not expected to change, but just in case ...
 		// move this tabletHealthCheck to the correct map
 		oldTargetKey := hc.keyFromTarget(currentTarget)
 		delete(hc.healthData[oldTargetKey], tabletAlias)
-		_, ok := hc.healthData[targetKey]
-		if !ok {
-			hc.healthData[targetKey] = make(map[tabletAliasString]*TabletHealth)
+		if currentTarget.TabletType == topodata.TabletType_MASTER {
+			// the healthy list of the masters is not recomputed below
+			if healthy := hc.healthy[oldTargetKey]; len(healthy) > 0 && topoproto.TabletAliasEqual(healthy[0].Tablet.Alias, th.Tablet.Alias) {
+				hc.healthy[oldTargetKey] = nil
+			}
 		}
 	}
-	// add it to the map by target
+	// add it to the map by target, which may be the first one of its target
+	if _, ok := hc.healthData[targetKey]; !ok {
+		hc.healthData[targetKey] = make(map[tabletAliasString]*TabletHealth)
+	}
 	hc.healthData[targetKey][tabletAlias] = th
 
 	if isMasterUpdate {
-		if len(hc.healthy[targetKey]) == 0 {
+		if maxTermStartTime := hc.masterTermStartTimes[targetKey]; th.MasterTermStartTime < maxTermStartTime {
+			// a demoted master which still reports being the master
+			log.Warningf("not marking healthy master %s as Up for %s because its MasterTermStartTime is smaller than the highest known timestamp from previous MASTERs: %d < %d ",
+				topoproto.TabletAliasString(shr.TabletAlias),
+				topoproto.KeyspaceShardString(shr.Target.Keyspace, shr.Target.Shard),
+				th.MasterTermStartTime,
+				maxTermStartTime)
+		} else if len(hc.healthy[targetKey]) == 0 {
 			hc.healthy[targetKey] = append(hc.healthy[targetKey], th)
+			hc.masterTermStartTimes[targetKey] = th.MasterTermStartTime
 		} else {
 			// We already have one up server, see if we
 			// need to replace it.
-			if shr.TabletExternallyReparentedTimestamp < hc.healthy[targetKey][0].MasterTermStartTime {
-				log.Warningf("not marking healthy master %s as Up for %s because its MasterTermStartTime is smaller than the highest known timestamp from previous MASTERs %s: %d < %d ",
+			if old := hc.healthy[targetKey][0]; topoproto.TabletAliasEqual(old.Tablet.Alias, th.Tablet.Alias) {
+				hc.healthy[targetKey][0] = th
+				hc.masterTermStartTimes[targetKey] = th.MasterTermStartTime
+			} else if IsMoreRecentMaster(th, old) {
+				oldMaster = old
+				masterChangeCallbacks = hc.masterChangeCallbacks
+				hc.healthy[targetKey][0] = th
+				hc.masterTermStartTimes[targetKey] = th.MasterTermStartTime
+			} else {
+				log.Warningf("not marking healthy master %s as Up for %s because the MASTER %s is more recent: %d <= %d ",
 					topoproto.TabletAliasString(shr.TabletAlias),
 					topoproto.KeyspaceShardString(shr.Target.Keyspace, shr.Target.Shard),
-					topoproto.TabletAliasString(hc.healthy[targetKey][0].Tablet.Alias),
-					shr.TabletExternallyReparentedTimestamp,
-					hc.healthy[targetKey][0].MasterTermStartTime)
-			} else {
-				// Just replace it.
-				hc.healthy[targetKey][0] = th
+					topoproto.TabletAliasString(old.Tablet.Alias),
+					th.MasterTermStartTime,
+					old.MasterTermStartTime)
 			}
 		}
 	}
@@ -426,6 +1289,10 @@ func (hc *HealthCheckImpl) updateHealth(th *TabletHealth, shr *query.StreamHealt
 			hc.healthy[oldTargetKey] = FilterStatsByReplicationLag(allArray)
 		}
 	}
+	hc.checkAvailabilityLocked(targetKey, shr.Target)
+	if targetChanged {
+		hc.checkAvailabilityLocked(hc.keyFromTarget(currentTarget), currentTarget)
+	}
 	if isMasterChange {
 		log.Errorf("Adding 1 to MasterPromoted counter for tablet: %v, shr.Tablet: %v, shr.TabletType: %v", currentTarget, topoproto.TabletAliasString(shr.TabletAlias), shr.Target.TabletType)
 		hcMasterPromotedCounters.Add([]string{shr.Target.Keyspace, shr.Target.Shard}, 1)
@@ -435,26 +1302,256 @@ func (hc *HealthCheckImpl) updateHealth(th *TabletHealth, shr *query.StreamHealt
 
 }
 
-// Subscribe adds a listener. Only used for testing right now
-func (hc *HealthCheckImpl) Subscribe() chan *TabletHealth {
-	hc.subMu.Lock()
-	defer hc.subMu.Unlock()
-	c := make(chan *TabletHealth, 2)
-	hc.subscribers[c] = struct{}{}
-	return c
+// SetTabletDenylist sets the list of tablets which must be excluded from
+// the healthy tablets, replacing any previous list. Unlike RemoveTablet,
+// denylisted tablets keep being health checked and stay in the cache, and
+// the denylist is not affected by topology refreshes.
+func (hc *HealthCheckImpl) SetTabletDenylist(aliases []*topodata.TabletAlias) {
+	denylist := make(map[tabletAliasString]bool, len(aliases))
+	for _, alias := range aliases {
+		denylist[tabletAliasString(topoproto.TabletAliasString(alias))] = true
+	}
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.denylist = denylist
 }
 
-// Unsubscribe removes a listener. Only used for testing right now
-func (hc *HealthCheckImpl) Unsubscribe(c chan *TabletHealth) {
-	hc.subMu.Lock()
-	defer hc.subMu.Unlock()
-	delete(hc.subscribers, c)
+// OnMasterChange registers a function which is called when a new master
+// replaces the known master of a shard, i.e. when a different tablet reports
+// being the master with a MasterTermStartTime at least as high as the
+// previous master's. It is called once per change, from the goroutine
+// processing the health of the new master, so it must not block.
+func (hc *HealthCheckImpl) OnMasterChange(callback func(keyspace, shard string, old, new *topodata.Tablet)) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.masterChangeCallbacks = append(hc.masterChangeCallbacks, callback)
 }
 
-func (hc *HealthCheckImpl) broadcast(th *TabletHealth) {
+// OnTargetAvailabilityChange registers a function which is called when a
+// target which had healthy tablets has none anymore, with available set to
+// false, and when it has some again, with available set to true. The target
+// must have stayed in that state for -healthcheck_target_availability_debounce
+// so that the tablets which flap do not call it repeatedly. It is called from
+// a separate goroutine, so it must not block.
+func (hc *HealthCheckImpl) OnTargetAvailabilityChange(callback func(target *query.Target, available bool)) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.availabilityCallbacks = append(hc.availabilityCallbacks, callback)
+}
+
+// targetAvailability is the availability of a target, as reported to the
+// functions registered with OnTargetAvailabilityChange.
+type targetAvailability struct {
+	target    *query.Target
+	available bool
+	// changing is set while the timer of a change of availability runs,
+	// and timer identifies it, so that a timer which was canceled by
+	// changing back does nothing
+	changing bool
+	timer    int
+}
+
+// checkAvailabilityLocked starts the timer which calls the availability
+// callbacks if the availability of the target of the given key changed, or
+// cancels it if it changed back.
+// hc.mu must be locked before calling this function.
+func (hc *HealthCheckImpl) checkAvailabilityLocked(key keyspaceShardTabletType, target *query.Target) {
+	if len(hc.availabilityCallbacks) == 0 {
+		return
+	}
+	if hc.targetNormalizer != nil {
+		target = hc.targetNormalizer(target)
+	}
+	state, ok := hc.availability[key]
+	if !ok {
+		state = &targetAvailability{}
+		hc.availability[key] = state
+	}
+	state.target = &query.Target{Keyspace: target.Keyspace, Shard: target.Shard, TabletType: target.TabletType}
+	if available := len(hc.healthyTabletsByKeyLocked(key)) > 0; available == state.available {
+		// cancel the pending change, if any
+		state.changing = false
+		return
+	}
+	if state.changing {
+		return
+	}
+	state.changing = true
+	state.timer++
+	timer, timerID := hc.clock.After(hc.availabilityDebounce), state.timer
+	hc.connsWG.Add(1)
+	go func() {
+		defer hc.connsWG.Done()
+		select {
+		case <-timer:
+		case <-hc.closeChan:
+			return
+		}
+		hc.mu.Lock()
+		if !state.changing || state.timer != timerID || hc.healthData == nil {
+			hc.mu.Unlock()
+			return
+		}
+		state.changing = false
+		state.available = !state.available
+		target, available := state.target, state.available
+		callbacks := hc.availabilityCallbacks
+		hc.mu.Unlock()
+		for _, callback := range callbacks {
+			callback(target, available)
+		}
+	}()
+}
+
+// SetResponseValidator sets a function that is run on every health check
+// response that passed the built-in validation. If it returns an error,
+// the tablet is marked as not serving and the error is recorded as its
+// LastError. Passing nil removes the validator.
+func (hc *HealthCheckImpl) SetResponseValidator(validator func(*query.StreamHealthResponse) error) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.responseValidator = validator
+}
+
+func (hc *HealthCheckImpl) getResponseValidator() func(*query.StreamHealthResponse) error {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	return hc.responseValidator
+}
+
+// SetTargetNormalizer sets a function which rewrites the targets before the
+// tablets are grouped by target, e.g. to serve a virtual keyspace with the
+// tablets of a physical one: the tablets of all the targets it maps to the
+// same target are returned together by GetHealthyTabletStats. It must be
+// deterministic, and must return a new target rather than modify its
+// argument. The known tablets are regrouped right away. Passing nil removes
+// the normalizer.
+func (hc *HealthCheckImpl) SetTargetNormalizer(normalizer func(*query.Target) *query.Target) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.targetNormalizer = normalizer
+	hc.rekeyLocked()
+}
+
+// rekeyLocked regroups the known tablets after the keys of their targets
+// changed.
+// hc.mu must be locked before calling this function.
+func (hc *HealthCheckImpl) rekeyLocked() {
+	if hc.healthData == nil {
+		// already closed
+		return
+	}
+	healthData := make(map[keyspaceShardTabletType]map[tabletAliasString]*TabletHealth)
+	for _, ths := range hc.healthData {
+		for alias, th := range ths {
+			key := hc.keyFromTarget(th.Target)
+			if _, ok := healthData[key]; !ok {
+				healthData[key] = make(map[tabletAliasString]*TabletHealth)
+			}
+			healthData[key][alias] = th
+		}
+	}
+	healthy := make(map[keyspaceShardTabletType][]*TabletHealth)
+	for _, ths := range hc.healthy {
+		for _, th := range ths {
+			if th.Target.TabletType != topodata.TabletType_MASTER {
+				continue
+			}
+			// keep the most recent master
+			key := hc.keyFromTarget(th.Target)
+			if len(healthy[key]) == 0 || IsMoreRecentMaster(th, healthy[key][0]) {
+				healthy[key] = []*TabletHealth{th}
+			}
+		}
+	}
+	// the highest term start times follow the tablets to their new keys
+	masterTermStartTimes := make(map[keyspaceShardTabletType]int64)
+	for key, ths := range hc.healthData {
+		for _, th := range ths {
+			newKey := hc.keyFromTarget(th.Target)
+			if termStartTime := hc.masterTermStartTimes[key]; termStartTime > masterTermStartTimes[newKey] {
+				masterTermStartTimes[newKey] = termStartTime
+			}
+		}
+	}
+	for key, ths := range healthData {
+		all := make([]*TabletHealth, 0, len(ths))
+		for _, th := range ths {
+			if th.Target.TabletType != topodata.TabletType_MASTER {
+				all = append(all, th)
+			}
+		}
+		if len(all) > 0 {
+			healthy[key] = FilterStatsByReplicationLag(all)
+		}
+	}
+	hc.healthData = healthData
+	hc.healthy = healthy
+	hc.masterTermStartTimes = masterTermStartTimes
+}
+
+// SetConnectionVerifier sets a function that is run on every new connection
+// to a tablet, before its health is streamed, e.g. to check the identity the
+// tablet presented. If it returns an error, the connection is closed and
+// handled like a failure to dial the tablet: it is retried later.
+// Passing nil removes the verifier.
+func (hc *HealthCheckImpl) SetConnectionVerifier(verifier func(tablet *topodata.Tablet, conn queryservice.QueryService) error) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.connectionVerifier = verifier
+}
+
+func (hc *HealthCheckImpl) getConnectionVerifier() func(tablet *topodata.Tablet, conn queryservice.QueryService) error {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	return hc.connectionVerifier
+}
+
+// updateTabletHealthData replaces the cached health of a known tablet without
+// recomputing the healthy tablets. It is used to surface errors that happen
+// outside of the processing of health check responses.
+func (hc *HealthCheckImpl) updateTabletHealthData(th *TabletHealth) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	tabletAlias := tabletAliasString(topoproto.TabletAliasString(th.Tablet.Alias))
+	if ths, ok := hc.healthData[hc.keyFromTarget(th.Target)]; ok {
+		if _, ok := ths[tabletAlias]; ok {
+			ths[tabletAlias] = th
+		}
+	}
+}
+
+// Subscribe adds a listener. Only used for testing right now
+func (hc *HealthCheckImpl) Subscribe() chan *TabletHealth {
+	return hc.subscribe(2, false)
+}
+
+// subscribe adds a listener whose channel can hold bufferSize updates.
+// Updates are dropped for listeners whose channel is full. If removals is
+// set, the listener is also sent an update with Removed set when a tablet
+// is removed from the healthcheck.
+func (hc *HealthCheckImpl) subscribe(bufferSize int, removals bool) chan *TabletHealth {
+	hc.subMu.Lock()
+	defer hc.subMu.Unlock()
+	c := make(chan *TabletHealth, bufferSize)
+	hc.subscribers[c] = removals
+	return c
+}
+
+// Unsubscribe removes a listener. Only used for testing right now
+func (hc *HealthCheckImpl) Unsubscribe(c chan *TabletHealth) {
+	hc.subMu.Lock()
+	defer hc.subMu.Unlock()
+	delete(hc.subscribers, c)
+}
+
+func (hc *HealthCheckImpl) broadcast(th *TabletHealth) {
 	hc.subMu.Lock()
 	defer hc.subMu.Unlock()
-	for c := range hc.subscribers {
+	for c, removals := range hc.subscribers {
+		if th.Removed && !removals {
+			continue
+		}
 		select {
 		case c <- th:
 		default:
@@ -462,34 +1559,177 @@ func (hc *HealthCheckImpl) broadcast(th *TabletHealth) {
 	}
 }
 
+// DumpState returns a deep copy of the tablets known by the healthcheck,
+// healthy or not, keyed by keyspace.shard.tablet_type, the way the tablets
+// are looked up for routing. The tablets of each key are sorted by alias.
+// It is meant for diagnostics, e.g. to find why a tablet is not used.
+func (hc *HealthCheckImpl) DumpState() map[string][]*TabletHealth {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	res := make(map[string][]*TabletHealth, len(hc.healthData))
+	for key, ths := range hc.healthData {
+		list := make([]*TabletHealth, 0, len(ths))
+		for _, th := range ths {
+			list = append(list, th.deepCopy())
+		}
+		sort.Slice(list, func(i, j int) bool {
+			return topoproto.TabletAliasString(list[i].Tablet.Alias) < topoproto.TabletAliasString(list[j].Tablet.Alias)
+		})
+		res[string(key)] = list
+	}
+	return res
+}
+
+// The reasons for which a tablet is included in or excluded from the
+// healthy tablets of its target, as reported by ExplainSelection.
+const (
+	SelectionReasonIncluded        = "included"
+	SelectionReasonTypeNotAllowed  = "tablet type not allowed"
+	SelectionReasonDenylisted      = "denylisted"
+	SelectionReasonDraining        = "draining"
+	SelectionReasonDegraded        = "degraded, other tablets are healthy"
+	SelectionReasonNotServing      = "not serving"
+	SelectionReasonError           = "health check error"
+	SelectionReasonNoStats         = "no health check response"
+	SelectionReasonWarming         = "waiting for the first health check response"
+	SelectionReasonNotLatestMaster = "not the most recent master"
+	SelectionReasonReplicationLag  = "replication lag too high"
+	SelectionReasonServingDuration = "not serving for long enough"
+)
+
+// TabletSelectionExplanation tells why a tablet is or is not returned by
+// GetHealthyTabletStats for its target.
+type TabletSelectionExplanation struct {
+	Alias    *topodata.TabletAlias
+	Included bool
+	// Reason is one of the SelectionReason* constants.
+	Reason string
+}
+
+// ExplainSelection returns, for each tablet of the target sorted by alias,
+// whether the queries can be routed to it and why: it must be returned by
+// GetHealthyTabletStats, and its type must be allowed for the keyspace.
+// It is meant for diagnostics, e.g. to find why no tablet is available.
+func (hc *HealthCheckImpl) ExplainSelection(target *query.Target) []TabletSelectionExplanation {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	key := hc.keyFromTarget(target)
+	included := make(map[string]bool)
+	for _, th := range hc.healthyTabletsByKeyLocked(key) {
+		included[topoproto.TabletAliasString(th.Tablet.Alias)] = true
+	}
+	healthy := make(map[string]bool)
+	for _, th := range hc.healthy[key] {
+		healthy[topoproto.TabletAliasString(th.Tablet.Alias)] = true
+	}
+	typeAllowed := IsTabletTypeAllowed(target.Keyspace, target.TabletType)
+
+	res := make([]TabletSelectionExplanation, 0, len(hc.healthData[key]))
+	for _, th := range hc.healthData[key] {
+		alias := topoproto.TabletAliasString(th.Tablet.Alias)
+		explanation := TabletSelectionExplanation{Alias: th.Tablet.Alias}
+		switch {
+		case !typeAllowed:
+			explanation.Reason = SelectionReasonTypeNotAllowed
+		case included[alias]:
+			explanation.Included = true
+			explanation.Reason = SelectionReasonIncluded
+		case hc.denylist[tabletAliasString(alias)]:
+			explanation.Reason = SelectionReasonDenylisted
+		case th.Draining && th.Target.TabletType != topodata.TabletType_MASTER:
+			explanation.Reason = SelectionReasonDraining
+		case th.Degraded && th.Target.TabletType != topodata.TabletType_MASTER:
+			explanation.Reason = SelectionReasonDegraded
+		case healthy[alias] || hc.healthStreamDisabled:
+			// it passed all the health checks, but was filtered out afterwards
+			if th.Target.TabletType == topodata.TabletType_MASTER {
+				explanation.Reason = SelectionReasonNotLatestMaster
+			} else {
+				explanation.Reason = SelectionReasonServingDuration
+			}
+		case th.LastError != nil:
+			explanation.Reason = SelectionReasonError
+		case th.Warming:
+			explanation.Reason = SelectionReasonWarming
+		case !th.Serving:
+			explanation.Reason = SelectionReasonNotServing
+		case th.Stats == nil:
+			explanation.Reason = SelectionReasonNoStats
+		case th.Target.TabletType == topodata.TabletType_MASTER:
+			explanation.Reason = SelectionReasonNotLatestMaster
+		default:
+			explanation.Reason = SelectionReasonReplicationLag
+		}
+		res = append(res, explanation)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return topoproto.TabletAliasString(res[i].Alias) < topoproto.TabletAliasString(res[j].Alias)
+	})
+	return res
+}
+
+// parseCacheStatusFilter returns the keyspace and shard to which the
+// request restricts the served cache, from its keyspace and shard query
+// parameters. They are empty if the request doesn't restrict them.
+// The other query parameters are ignored.
+func parseCacheStatusFilter(r *http.Request) (keyspace, shard string, err error) {
+	query := r.URL.Query()
+	for _, name := range []string{"keyspace", "shard"} {
+		if values, ok := query[name]; ok && (len(values) != 1 || values[0] == "") {
+			return "", "", fmt.Errorf("parameter %q must have one non empty value", name)
+		}
+	}
+	keyspace = query.Get("keyspace")
+	if shard = query.Get("shard"); shard != "" {
+		if shard, _, err = topo.ValidateShardName(shard); err != nil {
+			return "", "", fmt.Errorf("invalid shard: %v", err)
+		}
+	}
+	return keyspace, shard, nil
+}
+
 // CacheStatus returns a displayable version of the cache.
 func (hc *HealthCheckImpl) CacheStatus() TabletsCacheStatusList {
-	tcsMap := hc.cacheStatusMap()
+	return hc.cacheStatus("", "")
+}
+
+// cacheStatus is CacheStatus, restricted to the given keyspace and shard
+// unless they are empty.
+func (hc *HealthCheckImpl) cacheStatus(keyspace, shard string) TabletsCacheStatusList {
+	tcsMap := hc.cacheStatusMap(keyspace, shard)
 	tcsl := make(TabletsCacheStatusList, 0, len(tcsMap))
 	for _, tcs := range tcsMap {
+		sort.Strings(tcs.DenylistedTablets)
 		tcsl = append(tcsl, tcs)
 	}
 	sort.Sort(tcsl)
 	return tcsl
 }
 
-func (hc *HealthCheckImpl) cacheStatusMap() map[string]*TabletsCacheStatus {
+func (hc *HealthCheckImpl) cacheStatusMap(keyspace, shard string) map[string]*TabletsCacheStatus {
 	tcsMap := make(map[string]*TabletsCacheStatus)
 	hc.mu.Lock()
 	defer hc.mu.Unlock()
 	for _, ths := range hc.healthData {
 		for _, th := range ths {
+			if (keyspace != "" && th.Target.Keyspace != keyspace) || (shard != "" && th.Target.Shard != shard) {
+				continue
+			}
 			key := fmt.Sprintf("%v.%v.%v.%v", th.Tablet.Alias.Cell, th.Target.Keyspace, th.Target.Shard, th.Target.TabletType.String())
 			var tcs *TabletsCacheStatus
 			var ok bool
 			if tcs, ok = tcsMap[key]; !ok {
 				tcs = &TabletsCacheStatus{
-					Cell:   th.Tablet.Alias.Cell,
-					Target: th.Target,
+					Cell:          th.Tablet.Alias.Cell,
+					Target:        th.Target,
+					HealthUnknown: hc.healthStreamDisabled,
 				}
 				tcsMap[key] = tcs
 			}
-			tcs.TabletsStats = append(tcs.TabletsStats, th)
+			tcs.TabletsStats = append(tcs.TabletsStats, th.Copy())
+			if alias := topoproto.TabletAliasString(th.Tablet.Alias); hc.denylist[tabletAliasString(alias)] {
+				tcs.DenylistedTablets = append(tcs.DenylistedTablets, alias)
+			}
 		}
 	}
 	return tcsMap
@@ -497,7 +1737,15 @@ func (hc *HealthCheckImpl) cacheStatusMap() map[string]*TabletsCacheStatus {
 
 // Close stops the healthcheck.
 func (hc *HealthCheckImpl) Close() error {
+	hc.UnregisterStats()
 	hc.mu.Lock()
+	// closeChan is closed before the health checks are canceled, so that
+	// they close their connections with CloseReasonShutdown.
+	select {
+	case <-hc.closeChan:
+	default:
+		close(hc.closeChan)
+	}
 	for _, th := range hc.healthByAlias {
 		th.cancelFunc()
 	}
@@ -506,10 +1754,13 @@ func (hc *HealthCheckImpl) Close() error {
 	for _, tw := range hc.topoWatchers {
 		tw.Stop()
 	}
+	// the health checks may still be broadcasting until they exit
+	hc.subMu.Lock()
 	for s := range hc.subscribers {
 		close(s)
 	}
 	hc.subscribers = nil
+	hc.subMu.Unlock()
 	// Release the lock early or a pending checkHealthCheckTimeout
 	// cannot get a read lock on it.
 	hc.mu.Unlock()
@@ -522,33 +1773,201 @@ func (hc *HealthCheckImpl) Close() error {
 }
 
 // GetHealthyTabletStats returns only the healthy tablets.
-// The returned array is owned by the caller.
+// The returned array and the TabletHealth in it are owned by the caller.
 // For TabletType_MASTER, this will only return at most one entry,
 // the most recent tablet of type master.
 // This returns a copy of the data so that callers can access without
 // synchronization
 func (hc *HealthCheckImpl) GetHealthyTabletStats(target *query.Target) []*TabletHealth {
-	var result []*TabletHealth
 	hc.mu.Lock()
 	defer hc.mu.Unlock()
-	return append(result, hc.healthy[hc.keyFromTarget(target)]...)
+	return hc.healthyTabletsLocked(target)
+}
+
+// healthyTabletsLocked returns a copy of the healthy tablets for the target,
+// excluding the denylisted and the draining ones.
+// hc.mu must be locked before calling this function.
+func (hc *HealthCheckImpl) healthyTabletsLocked(target *query.Target) []*TabletHealth {
+	return hc.healthyTabletsByKeyLocked(hc.keyFromTarget(target))
+}
+
+// healthyTabletsByKeyLocked is like healthyTabletsLocked, for the target of the given key.
+// hc.mu must be locked before calling this function.
+func (hc *HealthCheckImpl) healthyTabletsByKeyLocked(key keyspaceShardTabletType) []*TabletHealth {
+	healthy := hc.healthy[key]
+	if hc.healthStreamDisabled {
+		healthy = hc.unknownHealthTabletsByKeyLocked(key)
+	}
+	var result, degraded []*TabletHealth
+	for _, th := range healthy {
+		if hc.denylist[tabletAliasString(topoproto.TabletAliasString(th.Tablet.Alias))] {
+			continue
+		}
+		// a draining or degraded master is still used, as there is no other one
+		if th.Draining && th.Target.TabletType != topodata.TabletType_MASTER {
+			continue
+		}
+		if th.Degraded && th.Target.TabletType != topodata.TabletType_MASTER {
+			degraded = append(degraded, th.Copy())
+			continue
+		}
+		result = append(result, th.Copy())
+	}
+	if len(result) == 0 {
+		// better use a degraded tablet than none
+		result = degraded
+	}
+	if *minServingDuration > 0 {
+		result = filterByServingDuration(result, *minServingDuration, hc.clock.Now())
+	}
+	return result
+}
+
+// filterByServingDuration returns the tablets which have been serving for
+// at least minDuration, or all of them if none has. Masters are not filtered.
+func filterByServingDuration(tablets []*TabletHealth, minDuration time.Duration, now time.Time) []*TabletHealth {
+	var result []*TabletHealth
+	for _, th := range tablets {
+		// Serving last changed when the tablet started serving. The tablets
+		// which are not serving are only returned when their health is unknown.
+		if th.Target.TabletType == topodata.TabletType_MASTER || !th.Serving || now.Sub(th.LastStateChange) >= minDuration {
+			result = append(result, th)
+		}
+	}
+	if len(result) == 0 {
+		// better use a tablet which just started serving than none
+		return tablets
+	}
+	return result
+}
+
+// unknownHealthTabletsByKeyLocked returns the tablets to use for the target
+// of the given key when their health is not checked: all of them, or for
+// TabletType_MASTER, the one with the most recent MasterTermStartTime in topo.
+// hc.mu must be locked before calling this function.
+func (hc *HealthCheckImpl) unknownHealthTabletsByKeyLocked(key keyspaceShardTabletType) []*TabletHealth {
+	var result []*TabletHealth
+	for _, th := range hc.healthData[key] {
+		if th.Target.TabletType != topodata.TabletType_MASTER {
+			result = append(result, th)
+			continue
+		}
+		if len(result) == 0 {
+			result = []*TabletHealth{th}
+		} else if isMoreRecentTopoMaster(th, result[0]) {
+			result[0] = th
+		}
+	}
+	return result
+}
+
+// isMoreRecentTopoMaster is like IsMoreRecentMaster, with the
+// MasterTermStartTime of the tablet records in topo.
+func isMoreRecentTopoMaster(a, b *TabletHealth) bool {
+	aTime := logutil.ProtoToTime(a.Tablet.MasterTermStartTime)
+	bTime := logutil.ProtoToTime(b.Tablet.MasterTermStartTime)
+	if !aTime.Equal(bTime) {
+		return aTime.After(bTime)
+	}
+	return topoproto.TabletAliasString(a.Tablet.Alias) < topoproto.TabletAliasString(b.Tablet.Alias)
+}
+
+// ReadFallbackTabletTypes returns the tablet types to try, in order, when there
+// are no healthy tablets of the given type, as configured by -read_fallback_order.
+func ReadFallbackTabletTypes(tabletType topodata.TabletType) []topodata.TabletType {
+	if tabletType == topodata.TabletType_MASTER {
+		return nil
+	}
+	for i, t := range readFallbackOrder {
+		if t == tabletType {
+			return readFallbackOrder[i+1:]
+		}
+	}
+	return nil
+}
+
+// GetAllTablets returns a copy of every tablet known to the healthcheck,
+// whatever its health, sorted by alias.
+func (hc *HealthCheckImpl) GetAllTablets() []*topodata.Tablet {
+	hc.mu.Lock()
+	tablets := make([]*topodata.Tablet, 0, len(hc.healthByAlias))
+	for _, thc := range hc.healthByAlias {
+		tablets = append(tablets, proto.Clone(thc.Tablet).(*topodata.Tablet))
+	}
+	hc.mu.Unlock()
+
+	sort.Slice(tablets, func(i, j int) bool {
+		return topoproto.TabletAliasString(tablets[i].Alias) < topoproto.TabletAliasString(tablets[j].Alias)
+	})
+	return tablets
+}
+
+// KnownTargets returns the targets of all the tablets known to the
+// healthcheck, whatever their health, once each and sorted. If a target
+// normalizer is set, the targets are the normalized ones.
+func (hc *HealthCheckImpl) KnownTargets() []*query.Target {
+	hc.mu.Lock()
+	keys := make([]string, 0, len(hc.healthData))
+	targets := make(map[string]*query.Target, len(hc.healthData))
+	for key, ths := range hc.healthData {
+		for _, th := range ths {
+			target := th.Target
+			if hc.targetNormalizer != nil {
+				target = hc.targetNormalizer(target)
+			}
+			keys = append(keys, string(key))
+			targets[string(key)] = &query.Target{Keyspace: target.Keyspace, Shard: target.Shard, TabletType: target.TabletType}
+			// all the tablets of a key have the same target
+			break
+		}
+	}
+	hc.mu.Unlock()
+
+	sort.Strings(keys)
+	result := make([]*query.Target, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, targets[key])
+	}
+	return result
 }
 
-// getTabletStats returns all tablets for the given target.
+// GetTabletStats returns all tablets for the given target, healthy or not.
 // The returned array is owned by the caller.
-// For TabletType_MASTER, this will only return at most one entry,
-// the most recent tablet of type master.
-func (hc *HealthCheckImpl) getTabletStats(target *query.Target) []*TabletHealth {
+// For TabletType_MASTER, it returns every tablet which reports being the
+// master, including the demoted ones: use GetHealthyTabletStats to get
+// only the most recent one.
+func (hc *HealthCheckImpl) GetTabletStats(target *query.Target) []*TabletHealth {
 	var result []*TabletHealth
 	hc.mu.Lock()
 	defer hc.mu.Unlock()
 	ths := hc.healthData[hc.keyFromTarget(target)]
 	for _, th := range ths {
-		result = append(result, th)
+		result = append(result, th.Copy())
 	}
 	return result
 }
 
+// IsKeyspaceWatched returns true if the given keyspace is visible to this
+// healthcheck, i.e. if KeyspacesToWatch is empty or contains the keyspace.
+func (hc *HealthCheckImpl) IsKeyspaceWatched(keyspace string) bool {
+	if hc.keyspacesToWatch == nil {
+		return true
+	}
+	return hc.keyspacesToWatch.isKeyspaceIncluded(keyspace)
+}
+
+// NoTabletError returns the error to report when no tablet could be used for
+// the given target. It returns ErrNoTablets if there are no tablets at all for
+// the target, and ErrNoHealthyTablets if there are some but none is healthy.
+func (hc *HealthCheckImpl) NoTabletError(target *query.Target) error {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if len(hc.healthData[hc.keyFromTarget(target)]) == 0 {
+		return ErrNoTablets
+	}
+	return ErrNoHealthyTablets
+}
+
 // WaitForTablets waits for at least one tablet in the given
 // keyspace / shard / tablet type before returning. The tablets do not
 // have to be healthy.  It will return ctx.Err() if the context is canceled.
@@ -563,6 +1982,53 @@ func (hc *HealthCheckImpl) WaitForTablets(ctx context.Context, keyspace, shard s
 	return hc.waitForTablets(ctx, targets, false)
 }
 
+// WaitForInitialTopology waits until every watched cell has been read from
+// the topo server once. Unlike WaitForTablets, it confirms that discovery
+// ran, even if no tablet exists. With -healthcheck_initial_warm_fraction,
+// it then waits for that fraction of the tablets to leave warming.
+// It will return ctx.Err() if the context is canceled.
+func (hc *HealthCheckImpl) WaitForInitialTopology(ctx context.Context) error {
+	for _, tw := range hc.topoWatchers {
+		if err := tw.WaitForInitialTopology(ctx); err != nil {
+			return err
+		}
+	}
+	if hc.initialWarmFraction <= 0 {
+		return nil
+	}
+	for hc.warmFraction() < hc.initialWarmFraction {
+		// Unblock after the sleep or when the context has expired.
+		timer := time.NewTimer(waitAvailableTabletInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil
+}
+
+// warmFraction returns the fraction of the tablets which are not warming,
+// or 1 if there is no tablet.
+func (hc *HealthCheckImpl) warmFraction() float64 {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	total, warm := 0, 0
+	for _, ths := range hc.healthData {
+		for _, th := range ths {
+			total++
+			if !th.Warming {
+				warm++
+			}
+		}
+	}
+	if total == 0 {
+		return 1
+	}
+	return float64(warm) / float64(total)
+}
+
 // WaitForAllServingTablets waits for at least one healthy serving tablet in
 // each given target before returning.
 // It will return ctx.Err() if the context is canceled.
@@ -571,6 +2037,73 @@ func (hc *HealthCheckImpl) WaitForAllServingTablets(ctx context.Context, targets
 	return hc.waitForTablets(ctx, targets, true)
 }
 
+// WaitForServingTabletsByTarget is like WaitForAllServingTablets, but waits
+// for each target separately: onServing, if not nil, is called as soon as a
+// target has a healthy serving tablet, and a target which has none after
+// perTargetTimeout is given up, so that the other targets are still waited
+// for. A perTargetTimeout of 0 waits until ctx is done.
+// It returns the error of each target which has no healthy serving tablet,
+// a DEADLINE_EXCEEDED error if it timed out or ctx.Err() if ctx is done
+// first. The map is empty if all the targets have one.
+func (hc *HealthCheckImpl) WaitForServingTabletsByTarget(ctx context.Context, targets []*query.Target, perTargetTimeout time.Duration, onServing func(target *query.Target)) map[*query.Target]error {
+	start := hc.clock.Now()
+	res := make(map[*query.Target]error)
+	pending := append([]*query.Target(nil), targets...)
+	for {
+		remaining := pending[:0]
+		for _, target := range pending {
+			if len(hc.GetHealthyTabletStats(target)) > 0 {
+				if onServing != nil {
+					onServing(target)
+				}
+				continue
+			}
+			if perTargetTimeout > 0 && hc.clock.Now().Sub(start) >= perTargetTimeout {
+				res[target] = vterrors.Errorf(vtrpc.Code_DEADLINE_EXCEEDED, "no serving tablet for %v (%v) after %v", topoproto.KeyspaceShardString(target.Keyspace, target.Shard), topoproto.TabletTypeLString(target.TabletType), perTargetTimeout)
+				continue
+			}
+			remaining = append(remaining, target)
+		}
+		pending = remaining
+		if len(pending) == 0 {
+			return res
+		}
+
+		// Unblock after the sleep or when the context has expired.
+		timer := time.NewTimer(waitAvailableTabletInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			for _, target := range pending {
+				res[target] = ctx.Err()
+			}
+			return res
+		case <-timer.C:
+		}
+	}
+}
+
+// WaitForTabletCondition waits until the tablets of the given target,
+// healthy or not, satisfy the given predicate. The predicate is called
+// with a copy of the tablets each time they are polled.
+// It will return ctx.Err() if the context is canceled.
+func (hc *HealthCheckImpl) WaitForTabletCondition(ctx context.Context, target *query.Target, pred func([]*TabletHealth) bool) error {
+	for {
+		if pred(hc.GetTabletStats(target)) {
+			return nil
+		}
+
+		// Unblock after the sleep or when the context has expired.
+		timer := time.NewTimer(waitAvailableTabletInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
 // waitForTablets is the internal method that polls for tablets.
 func (hc *HealthCheckImpl) waitForTablets(ctx context.Context, targets []*query.Target, requireServing bool) error {
 	for {
@@ -585,7 +2118,7 @@ func (hc *HealthCheckImpl) waitForTablets(ctx context.Context, targets []*query.
 			if requireServing {
 				tabletHealths = hc.GetHealthyTabletStats(target)
 			} else {
-				tabletHealths = hc.getTabletStats(target)
+				tabletHealths = hc.GetTabletStats(target)
 			}
 			if len(tabletHealths) == 0 {
 				allPresent = false
@@ -610,6 +2143,18 @@ func (hc *HealthCheckImpl) waitForTablets(ctx context.Context, targets []*query.
 	}
 }
 
+// IsTabletServing returns whether the given tablet is currently serving,
+// and whether the healthcheck knows about it at all.
+func (hc *HealthCheckImpl) IsTabletServing(alias *topodata.TabletAlias) (serving bool, known bool) {
+	hc.mu.Lock()
+	thc := hc.healthByAlias[tabletAliasString(topoproto.TabletAliasString(alias))]
+	hc.mu.Unlock()
+	if thc == nil {
+		return false, false
+	}
+	return thc.isServing(), true
+}
+
 // TabletConnection returns the Connection to a given tablet.
 func (hc *HealthCheckImpl) TabletConnection(alias *topodata.TabletAlias) (queryservice.QueryService, error) {
 	hc.mu.Lock()
@@ -619,17 +2164,63 @@ func (hc *HealthCheckImpl) TabletConnection(alias *topodata.TabletAlias) (querys
 		//TODO: test that throws this error
 		return nil, vterrors.Errorf(vtrpc.Code_NOT_FOUND, "tablet: %v is either down or nonexistent", alias)
 	}
-	return thc.Connection(), nil
+	return thc.Connection(hc), nil
+}
+
+// ActiveConnections returns the number of tablets whose health is being
+// checked by their own goroutine, which includes the goroutines of the
+// removed tablets until they stop. The tablets polled with
+// -healthcheck_max_concurrent_streams are not counted.
+// It is meant to find goroutine leaks, e.g. it must be 0 after Close.
+func (hc *HealthCheckImpl) ActiveConnections() int {
+	return int(hc.activeConns.Get())
+}
+
+// GetAllConnections returns the connections to all the healthy tablets of
+// the target, e.g. to broadcast a request to them. It returns nil if the
+// tablet type is not allowed for the keyspace.
+func (hc *HealthCheckImpl) GetAllConnections(target *query.Target) []queryservice.QueryService {
+	if !IsTabletTypeAllowed(target.Keyspace, target.TabletType) {
+		return nil
+	}
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	var conns []queryservice.QueryService
+	for _, th := range hc.healthyTabletsLocked(target) {
+		if th.Conn != nil {
+			conns = append(conns, th.Conn)
+		}
+	}
+	return conns
+}
+
+// sameTarget returns true if the two targets have the same keyspace, shard
+// and tablet type. Like keyFromTarget, it ignores their cell, which some
+// tablets set in their health check responses.
+func sameTarget(a, b *query.Target) bool {
+	return a.Keyspace == b.Keyspace && a.Shard == b.Shard && a.TabletType == b.TabletType
 }
 
-// Target includes cell which we ignore here
-// because tabletStatsCache is intended to be per-cell
+// keyFromTarget returns the key of the tablets of the target, after
+// rewriting it with the target normalizer if any.
+// hc.mu must be locked before calling this function.
 func (hc *HealthCheckImpl) keyFromTarget(target *query.Target) keyspaceShardTabletType {
+	if hc.targetNormalizer != nil {
+		target = hc.targetNormalizer(target)
+	}
 	return keyspaceShardTabletType(fmt.Sprintf("%s.%s.%s", target.Keyspace, target.Shard, topoproto.TabletTypeLString(target.TabletType)))
 }
 
+// keyFromTablet returns the key of the target of the tablet.
+// hc.mu must be locked before calling this function.
 func (hc *HealthCheckImpl) keyFromTablet(tablet *topodata.Tablet) keyspaceShardTabletType {
-	return keyspaceShardTabletType(fmt.Sprintf("%s.%s.%s", tablet.Keyspace, tablet.Shard, topoproto.TabletTypeLString(tablet.Type)))
+	return hc.keyFromTarget(&query.Target{Keyspace: tablet.Keyspace, Shard: tablet.Shard, TabletType: tablet.Type})
+}
+
+// GetAliasByCell returns the cell alias the given cell belongs to,
+// or the cell itself if it is not part of any alias.
+func (hc *HealthCheckImpl) GetAliasByCell(cell string) string {
+	return hc.getAliasByCell(cell)
 }
 
 func (hc *HealthCheckImpl) getAliasByCell(cell string) string {
@@ -649,18 +2240,69 @@ func (hc *HealthCheckImpl) getAliasByCell(cell string) string {
 }
 
 func (hc *HealthCheckImpl) isIncluded(tablet *topodata.Tablet) bool {
+	if !hc.admitsTablet(tablet) {
+		return false
+	}
 	if tablet.Type == topodata.TabletType_MASTER {
 		return true
 	}
+	return hc.isTabletInCell(tablet)
+}
+
+// admitsTablet implements tabletAdmitter. Only the per keyspace override
+// filters the tablets, the global list is enforced when routing.
+func (hc *HealthCheckImpl) admitsTablet(tablet *topodata.Tablet) bool {
+	_, ok := allowedTabletTypesByKeyspace[tablet.Keyspace]
+	return !ok || IsTabletTypeAllowed(tablet.Keyspace, tablet.Type)
+}
+
+// isTabletInCell returns true if the tablet is in the cell of the
+// healthcheck, or in a cell of the same cell alias. The tablets it
+// excludes are counted and logged, as a misconfigured cell alias
+// otherwise silently leaves them out of the healthcheck.
+func (hc *HealthCheckImpl) isTabletInCell(tablet *topodata.Tablet) bool {
 	if tablet.Alias.Cell == hc.cell {
 		return true
 	}
-	if hc.getAliasByCell(tablet.Alias.Cell) == hc.getAliasByCell(hc.cell) {
+	tabletCellAlias := hc.getAliasByCell(tablet.Alias.Cell)
+	localCellAlias := hc.getAliasByCell(hc.cell)
+	if tabletCellAlias == localCellAlias {
 		return true
 	}
+	hcExcludedByCellCounters.Add(tablet.Alias.Cell, 1)
+	excludedByCellLogger.Infof("Not health checking tablet %v: its cell %v resolves to the cell alias %v, and the local cell %v to %v",
+		topoproto.TabletAliasString(tablet.Alias), tablet.Alias.Cell, tabletCellAlias, hc.cell, localCellAlias)
 	return false
 }
 
+// SetRefreshKnownTablets overrides -tablet_refresh_known_tablets for the
+// watchers of all the watched cells, from their next refresh on.
+func (hc *HealthCheckImpl) SetRefreshKnownTablets(refresh bool) {
+	for _, tw := range hc.topoWatchers {
+		tw.SetRefreshKnownTablets(refresh)
+	}
+}
+
+// RefreshNow reloads the tablets of all the watched cells from the topo
+// without waiting for the refresh interval, and returns when done.
+// It will return ctx.Err() if the context is canceled.
+func (hc *HealthCheckImpl) RefreshNow(ctx context.Context) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, len(hc.topoWatchers))
+	for _, tw := range hc.topoWatchers {
+		wg.Add(1)
+		go func(tw *TopologyWatcher) {
+			defer wg.Done()
+			if err := tw.RefreshNow(ctx); err != nil {
+				errs <- err
+			}
+		}(tw)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
 // topologyWatcherMaxRefreshLag returns the maximum lag since the watched
 // cells were refreshed from the topo server
 func (hc *HealthCheckImpl) topologyWatcherMaxRefreshLag() time.Duration {
@@ -674,6 +2316,16 @@ func (hc *HealthCheckImpl) topologyWatcherMaxRefreshLag() time.Duration {
 	return lag
 }
 
+// TopoWatcherStatus returns the state of each topology watcher, in the
+// order of the watched cells. It is served at <gateway debug path>/topo_watchers.
+func (hc *HealthCheckImpl) TopoWatcherStatus() []TopoWatcherStatusEntry {
+	entries := make([]TopoWatcherStatusEntry, 0, len(hc.topoWatchers))
+	for _, tw := range hc.topoWatchers {
+		entries = append(entries, tw.Status())
+	}
+	return entries
+}
+
 // topologyWatcherChecksum returns a checksum of the topology watcher state
 func (hc *HealthCheckImpl) topologyWatcherChecksum() int64 {
 	var checksum int64
@@ -683,47 +2335,301 @@ func (hc *HealthCheckImpl) topologyWatcherChecksum() int64 {
 	return checksum
 }
 
-// RegisterStats registers the connection counts stats
+// The stats exported by RegisterStats are process-global and can only be
+// published once. They are published by the first call to RegisterStats, and
+// report the state of the HealthCheckImpl which called RegisterStats last,
+// until it calls UnregisterStats or is closed.
+var (
+	registerStatsOnce sync.Once
+	// statsMu protects statsHC.
+	statsMu sync.Mutex
+	statsHC *HealthCheckImpl
+	// responseStaleness is HealthcheckResponseStaleness.
+	responseStaleness *stats.Histogram
+	// shardsAtRisk is HealthcheckShardAtRisk.
+	shardsAtRisk *stats.GaugesWithMultiLabels
+)
+
+// RegisterStats registers the connection counts stats, and starts
+// sampling the staleness of the health check responses and the shards
+// at risk.
+// It can be called again, by another HealthCheckImpl, e.g. after the
+// previous one was closed: the stats then report the new HealthCheckImpl.
 func (hc *HealthCheckImpl) RegisterStats() {
+	registerStatsOnce.Do(publishStats)
+	statsMu.Lock()
+	statsHC = hc
+	statsMu.Unlock()
+
+	hc.sampleStalenessOnce.Do(func() {
+		hc.connsWG.Add(1)
+		go func() {
+			defer hc.connsWG.Done()
+			ticker := time.NewTicker(responseStalenessSampleInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-hc.closeChan:
+					return
+				case now := <-ticker.C:
+					if hc.statsRegistered() {
+						hc.sampleResponseStaleness(responseStaleness, now)
+						hc.sampleShardsAtRisk(shardsAtRisk)
+					}
+				}
+			}
+		}()
+	})
+}
+
+// UnregisterStats stops the stats registered by RegisterStats from
+// reporting the state of hc. They report zero values until another
+// HealthCheckImpl calls RegisterStats.
+func (hc *HealthCheckImpl) UnregisterStats() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	if statsHC == hc {
+		statsHC = nil
+	}
+}
+
+// statsRegistered returns true if the stats report the state of hc.
+func (hc *HealthCheckImpl) statsRegistered() bool {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	return statsHC == hc
+}
+
+// publishStats publishes the stats of RegisterStats.
+func publishStats() {
 	stats.NewGaugeDurationFunc(
 		"TopologyWatcherMaxRefreshLag",
 		"maximum time since the topology watcher refreshed a cell",
-		hc.topologyWatcherMaxRefreshLag,
-	)
+		func() time.Duration {
+			if hc := getStatsHC(); hc != nil {
+				return hc.topologyWatcherMaxRefreshLag()
+			}
+			return 0
+		})
 
 	stats.NewGaugeFunc(
 		"TopologyWatcherChecksum",
 		"crc32 checksum of the topology watcher state",
-		hc.topologyWatcherChecksum,
-	)
+		statsInt64Func((*HealthCheckImpl).topologyWatcherChecksum))
 
 	stats.NewGaugesFuncWithMultiLabels(
 		"HealthcheckConnections",
 		"the number of healthcheck connections registered",
 		[]string{"Keyspace", "ShardName", "TabletType"},
-		hc.servingConnStats)
+		statsMapFunc((*HealthCheckImpl).servingConnStats))
+
+	stats.NewGaugesFuncWithMultiLabels(
+		"HealthcheckHealthyTablets",
+		"the number of healthy tablets that can be selected for queries",
+		[]string{"Keyspace", "ShardName", "TabletType"},
+		statsMapFunc((*HealthCheckImpl).healthyTabletStats))
+
+	stats.NewGaugesFuncWithMultiLabels(
+		"HealthcheckWarmingTablets",
+		"the number of tablets waiting for their first health check response",
+		[]string{"Keyspace", "ShardName", "TabletType"},
+		statsMapFunc((*HealthCheckImpl).warmingTabletStats))
+
+	stats.NewGaugesFuncWithMultiLabels(
+		"HealthcheckTabletServing",
+		"1 for each serving tablet, 0 for the others, with -healthcheck_tablet_serving_stats",
+		[]string{"Alias", "Keyspace", "ShardName", "TabletType"},
+		statsMapFunc((*HealthCheckImpl).tabletServingStats))
+
+	stats.NewGaugesFuncWithMultiLabels(
+		"HealthcheckDuplicateMasters",
+		"the number of serving masters of a shard, when there is more than one",
+		[]string{"Keyspace", "ShardName"},
+		statsMapFunc((*HealthCheckImpl).duplicateMasterStats))
 
 	stats.NewGaugeFunc(
 		"HealthcheckChecksum",
 		"crc32 checksum of the current healthcheck state",
-		hc.stateChecksum)
+		statsInt64Func((*HealthCheckImpl).stateChecksum))
+
+	stats.NewGaugeFunc(
+		"HealthcheckMembershipChecksum",
+		"crc32 checksum of the tablets known by the healthcheck, regardless of their health",
+		statsInt64Func((*HealthCheckImpl).membershipChecksum))
+
+	responseStaleness = stats.NewHistogram(
+		"HealthcheckResponseStaleness",
+		"time in milliseconds since the last health check response, sampled periodically for each tablet",
+		responseStalenessCutoffs)
+
+	shardsAtRisk = stats.NewGaugesWithMultiLabels(
+		"HealthcheckShardAtRisk",
+		"1 for the shards which have a healthy master but no healthy replica, sampled periodically",
+		[]string{"Keyspace", "ShardName"})
+}
+
+// getStatsHC returns the HealthCheckImpl the stats report, or nil if none.
+func getStatsHC() *HealthCheckImpl {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	return statsHC
+}
+
+// statsInt64Func returns a function reporting f for the HealthCheckImpl
+// the stats report, or 0 if none.
+func statsInt64Func(f func(*HealthCheckImpl) int64) func() int64 {
+	return func() int64 {
+		if hc := getStatsHC(); hc != nil {
+			return f(hc)
+		}
+		return 0
+	}
+}
+
+// statsMapFunc returns a function reporting f for the HealthCheckImpl
+// the stats report, or nothing if none.
+func statsMapFunc(f func(*HealthCheckImpl) map[string]int64) func() map[string]int64 {
+	return func() map[string]int64 {
+		if hc := getStatsHC(); hc != nil {
+			return f(hc)
+		}
+		return map[string]int64{}
+	}
+}
+
+// sampleResponseStaleness adds the time elapsed between the last health
+// check response of each tablet and now to h. Tablets which have not sent
+// any response yet are skipped.
+func (hc *HealthCheckImpl) sampleResponseStaleness(h *stats.Histogram, now time.Time) {
+	hc.mu.Lock()
+	var lastResponses []time.Time
+	for _, thc := range hc.healthByAlias {
+		if last := thc.getLastResponseTimestamp(); !last.IsZero() {
+			lastResponses = append(lastResponses, last)
+		}
+	}
+	hc.mu.Unlock()
+
+	for _, last := range lastResponses {
+		h.Add(int64(now.Sub(last) / time.Millisecond))
+	}
+}
+
+// sampleShardsAtRisk sets g to 1 for the shards which have a healthy
+// master but no healthy replica, a risk for durability and for the
+// availability of the reads, and to 0 for the other shards with a master.
+func (hc *HealthCheckImpl) sampleShardsAtRisk(g *stats.GaugesWithMultiLabels) {
+	type shard struct {
+		keyspace, shard string
+	}
+	hasMaster := make(map[shard]bool)
+	hasReplica := make(map[shard]bool)
+	hc.mu.Lock()
+	for key, ths := range hc.healthData {
+		var target *query.Target
+		for _, th := range ths {
+			target = th.Target
+			break
+		}
+		if target == nil {
+			continue
+		}
+		s := shard{keyspace: target.Keyspace, shard: target.Shard}
+		switch target.TabletType {
+		case topodata.TabletType_MASTER:
+			hasMaster[s] = hasMaster[s] || len(hc.healthyTabletsByKeyLocked(key)) > 0
+		case topodata.TabletType_REPLICA:
+			hasReplica[s] = hasReplica[s] || len(hc.healthyTabletsByKeyLocked(key)) > 0
+		}
+	}
+	hc.mu.Unlock()
+
+	g.ResetAll()
+	for s, master := range hasMaster {
+		var atRisk int64
+		if master && !hasReplica[s] {
+			atRisk = 1
+		}
+		g.Set([]string{s.keyspace, s.shard}, atRisk)
+	}
 }
 
 // ServeHTTP is part of the http.Handler interface. It renders the current state of the discovery gateway tablet cache into json.
-func (hc *HealthCheckImpl) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+// The keyspace and shard query parameters restrict the tablets to the ones of a keyspace or a shard.
+func (hc *HealthCheckImpl) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	keyspace, shard, err := parseCacheStatusFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	status := hc.CacheStatus()
+	status := hc.cacheStatus(keyspace, shard)
 	b, err := json.MarshalIndent(status, "", " ")
 	if err != nil {
 		w.Write([]byte(err.Error()))
 		return
 	}
 
+	buf := bytes.NewBuffer(nil)
+	json.HTMLEscape(buf, b)
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(r) {
+		w.Write(buf.Bytes())
+		return
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(w)
+	gz.Write(buf.Bytes())
+	gz.Close()
+}
+
+// serveHistory serves the health history of the tablets as JSON, the oldest
+// event first.
+func (hc *HealthCheckImpl) serveHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	b, err := json.MarshalIndent(hc.history.snapshot(), "", " ")
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+	buf := bytes.NewBuffer(nil)
+	json.HTMLEscape(buf, b)
+	w.Write(buf.Bytes())
+}
+
+// serveTopoWatchers serves the state of the topology watchers as JSON, one
+// entry per watched cell.
+func (hc *HealthCheckImpl) serveTopoWatchers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	b, err := json.MarshalIndent(hc.TopoWatcherStatus(), "", " ")
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
 	buf := bytes.NewBuffer(nil)
 	json.HTMLEscape(buf, b)
 	w.Write(buf.Bytes())
 }
 
+// acceptsGzip returns true if the Accept-Encoding header of the request
+// allows a gzip compressed response.
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(encoding, ";")
+		if strings.TrimSpace(fields[0]) != "gzip" {
+			continue
+		}
+		// gzip;q=0 means that gzip is not accepted
+		for _, param := range fields[1:] {
+			if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") && strings.Trim(q[2:], ".0") == "" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
 // servingConnStats returns the number of serving tablets per keyspace/shard/tablet type.
 func (hc *HealthCheckImpl) servingConnStats() map[string]int64 {
 	res := make(map[string]int64)
@@ -739,6 +2645,88 @@ func (hc *HealthCheckImpl) servingConnStats() map[string]int64 {
 	return res
 }
 
+// healthyTabletStats returns the number of healthy tablets per keyspace/shard/tablet type,
+// as returned by GetHealthyTabletStats.
+func (hc *HealthCheckImpl) healthyTabletStats() map[string]int64 {
+	res := make(map[string]int64)
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	for key := range hc.healthData {
+		res[string(key)] = int64(len(hc.healthyTabletsByKeyLocked(key)))
+	}
+	return res
+}
+
+// warmingTabletStats returns the number of warming tablets per target.
+func (hc *HealthCheckImpl) warmingTabletStats() map[string]int64 {
+	res := make(map[string]int64)
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	for key, ths := range hc.healthData {
+		warming := int64(0)
+		for _, th := range ths {
+			if th.Warming {
+				warming++
+			}
+		}
+		res[string(key)] = warming
+	}
+	return res
+}
+
+// tabletServingStats returns 1 for each serving tablet and 0 for the others,
+// by alias and keyspace/shard/tablet type, or nothing unless
+// -healthcheck_tablet_serving_stats is set.
+func (hc *HealthCheckImpl) tabletServingStats() map[string]int64 {
+	res := make(map[string]int64)
+	if !hc.perTabletServingStats {
+		return res
+	}
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	for key, ths := range hc.healthData {
+		for alias, th := range ths {
+			serving := int64(0)
+			if th.Serving && th.LastError == nil {
+				serving = 1
+			}
+			res[string(alias)+"."+string(key)] = serving
+		}
+	}
+	return res
+}
+
+// duplicateMasterStats returns, per keyspace/shard, the number of serving tablets
+// which claim to be the master, if there is more than one. Otherwise it is 0.
+func (hc *HealthCheckImpl) duplicateMasterStats() map[string]int64 {
+	res := make(map[string]int64)
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	for _, ths := range hc.healthData {
+		masters := 0
+		var target *query.Target
+		for _, th := range ths {
+			// all the tablets of ths have the same target type
+			if th.Target.TabletType != topodata.TabletType_MASTER {
+				break
+			}
+			target = th.Target
+			if th.Serving && th.LastError == nil {
+				masters++
+			}
+		}
+		if target == nil {
+			continue
+		}
+		key := strings.Join([]string{target.Keyspace, target.Shard}, ".")
+		res[key] = 0
+		if masters > 1 {
+			res[key] = int64(masters)
+		}
+	}
+	return res
+}
+
 // stateChecksum returns a crc32 checksum of the healthcheck state
 func (hc *HealthCheckImpl) stateChecksum() int64 {
 	// CacheStatus is sorted so this should be stable across vtgates
@@ -760,3 +2748,18 @@ func (hc *HealthCheckImpl) stateChecksum() int64 {
 
 	return int64(crc32.ChecksumIEEE(buf.Bytes()))
 }
+
+// membershipChecksum returns a checksum of the tablets known by the
+// healthcheck: their alias, keyspace, shard and type in topo. Unlike
+// stateChecksum, it doesn't change with their health, so it is equal on
+// all the vtgates which know the same tablets.
+func (hc *HealthCheckImpl) membershipChecksum() int64 {
+	hc.mu.Lock()
+	tablets := make([]string, 0, len(hc.healthByAlias))
+	for alias, thc := range hc.healthByAlias {
+		tablets = append(tablets, fmt.Sprintf("%v %v %v %v\n", alias, thc.Tablet.Keyspace, thc.Tablet.Shard, thc.Tablet.Type))
+	}
+	hc.mu.Unlock()
+	sort.Strings(tablets)
+	return int64(crc32.ChecksumIEEE([]byte(strings.Join(tablets, ""))))
+}
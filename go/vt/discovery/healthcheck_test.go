@@ -18,18 +18,31 @@ package discovery
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"html/template"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"vitess.io/vitess/go/stats"
 	"vitess.io/vitess/go/test/utils"
 	"vitess.io/vitess/go/vt/vttablet/queryservice/fakes"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"vitess.io/vitess/go/vt/topo/memorytopo"
@@ -39,11 +52,13 @@ import (
 	"vitess.io/vitess/go/vt/grpcclient"
 	"vitess.io/vitess/go/vt/status"
 	"vitess.io/vitess/go/vt/topo"
+	"vitess.io/vitess/go/vt/vterrors"
 	"vitess.io/vitess/go/vt/vttablet/queryservice"
 	"vitess.io/vitess/go/vt/vttablet/tabletconn"
 
 	querypb "vitess.io/vitess/go/vt/proto/query"
 	topodatapb "vitess.io/vitess/go/vt/proto/topodata"
+	vtrpcpb "vitess.io/vitess/go/vt/proto/vtrpc"
 )
 
 func init() {
@@ -77,6 +92,7 @@ func TestHealthCheck(t *testing.T) {
 		Serving:             false,
 		Stats:               nil,
 		MasterTermStartTime: 0,
+		Warming:             true,
 	}
 	result := <-resultChan
 	mustMatch(t, want, result, "Wrong TabletHealth data")
@@ -192,6 +208,79 @@ func TestHealthCheck(t *testing.T) {
 	testChecksum(t, 0, hc.stateChecksum())
 }
 
+func TestHealthCheckShardChange(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	tablet := topo.NewTablet(0, "cell", "reshard")
+	tablet.Keyspace = "k"
+	tablet.Shard = "-80"
+	tablet.PortMap["vt"] = 1
+	tablet.Type = topodatapb.TabletType_REPLICA
+	input := make(chan *querypb.StreamHealthResponse)
+	createFakeConn(tablet, input)
+	resultChan := hc.Subscribe()
+	hc.AddTablet(tablet)
+	<-resultChan
+
+	oldTarget := &querypb.Target{Keyspace: "k", Shard: "-80", TabletType: topodatapb.TabletType_REPLICA}
+	newTarget := &querypb.Target{Keyspace: "k", Shard: "80-", TabletType: topodatapb.TabletType_REPLICA}
+	// the tablet sets the cell of its target, which is ignored
+	input <- &querypb.StreamHealthResponse{
+		TabletAlias:   tablet.Alias,
+		Target:        &querypb.Target{Keyspace: "k", Shard: "-80", TabletType: topodatapb.TabletType_REPLICA, Cell: "cell"},
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1},
+	}
+	<-resultChan
+	assert.Equal(t, 1, len(hc.GetHealthyTabletStats(oldTarget)))
+
+	// the shard changes, with the same type and replication lag
+	input <- &querypb.StreamHealthResponse{
+		TabletAlias:   tablet.Alias,
+		Target:        &querypb.Target{Keyspace: "k", Shard: "80-", TabletType: topodatapb.TabletType_REPLICA, Cell: "cell"},
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1},
+	}
+	<-resultChan
+	assert.Empty(t, hc.GetTabletStats(oldTarget), "the tablet should have left its old shard")
+	assert.Empty(t, hc.GetHealthyTabletStats(oldTarget), "the tablet should have left its old shard")
+	assert.Equal(t, 1, len(hc.GetTabletStats(newTarget)), "the tablet should be in its new shard")
+	assert.Equal(t, 1, len(hc.GetHealthyTabletStats(newTarget)), "the tablet should be healthy in its new shard")
+}
+
+// TestRemoveTabletAfterShardChange checks that a tablet is removed from the
+// shard it reported, rather than from the shard of its topo record.
+func TestRemoveTabletAfterShardChange(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	tablet := topo.NewTablet(0, "cell", "a")
+	tablet.Keyspace = "k"
+	tablet.Shard = "s"
+	tablet.PortMap["vt"] = 1
+	tablet.Type = topodatapb.TabletType_REPLICA
+	input := make(chan *querypb.StreamHealthResponse)
+	createFakeConn(tablet, input)
+	resultChan := hc.Subscribe()
+	hc.AddTablet(tablet)
+	<-resultChan
+
+	newTarget := &querypb.Target{Keyspace: "k", Shard: "s2", TabletType: topodatapb.TabletType_REPLICA}
+	input <- &querypb.StreamHealthResponse{
+		TabletAlias:   tablet.Alias,
+		Target:        newTarget,
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1},
+	}
+	<-resultChan
+	require.Equal(t, 1, len(hc.GetHealthyTabletStats(newTarget)))
+
+	hc.RemoveTablet(tablet)
+	assert.Empty(t, hc.GetHealthyTabletStats(newTarget), "the tablet should have been removed from its new shard")
+	assert.Empty(t, hc.GetTabletStats(newTarget), "the tablet should have been removed from its new shard")
+}
+
 func TestHealthCheckStreamError(t *testing.T) {
 	ts := memorytopo.NewServer("cell")
 	hc := createTestHc(ts)
@@ -211,6 +300,7 @@ func TestHealthCheckStreamError(t *testing.T) {
 		Target:              &querypb.Target{},
 		Serving:             false,
 		MasterTermStartTime: 0,
+		Warming:             true,
 	}
 	result := <-resultChan
 	mustMatch(t, want, result, "Wrong TabletHealth data")
@@ -268,6 +358,7 @@ func TestHealthCheckVerifiesTabletAlias(t *testing.T) {
 		Target:              &querypb.Target{},
 		Serving:             false,
 		MasterTermStartTime: 0,
+		Warming:             true,
 	}
 	result := <-resultChan
 	mustMatch(t, want, result, "Wrong TabletHealth data")
@@ -310,6 +401,7 @@ func TestHealthCheckCloseWaitsForGoRoutines(t *testing.T) {
 		Target:              &querypb.Target{},
 		Serving:             false,
 		MasterTermStartTime: 0,
+		Warming:             true,
 	}
 	result := <-resultChan
 	mustMatch(t, want, result, "Wrong TabletHealth data")
@@ -353,6 +445,30 @@ func TestHealthCheckCloseWaitsForGoRoutines(t *testing.T) {
 	assert.Nil(t, hc.healthByAlias, "health data should be nil")
 }
 
+func TestActiveConnections(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+
+	var tablets []*topodatapb.Tablet
+	for i := 0; i < 3; i++ {
+		tablet := topo.NewTablet(uint32(i+1), "cell", fmt.Sprintf("active%d", i))
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.PortMap["vt"] = 1
+		tablet.Type = topodatapb.TabletType_REPLICA
+		createFakeConn(tablet, make(chan *querypb.StreamHealthResponse))
+		tablets = append(tablets, tablet)
+	}
+	hc.AddTablets(tablets)
+	assert.Equal(t, 3, hc.ActiveConnections())
+
+	hc.RemoveTablet(tablets[0])
+	waitForCondition(t, func() bool { return hc.ActiveConnections() == 2 }, "the health check of the removed tablet should stop")
+
+	hc.Close()
+	assert.Zero(t, hc.ActiveConnections(), "no health check should be left after Close")
+}
+
 func TestHealthCheckTimeout(t *testing.T) {
 	ts := memorytopo.NewServer("cell")
 	hc := createTestHc(ts)
@@ -371,6 +487,7 @@ func TestHealthCheckTimeout(t *testing.T) {
 		Target:              &querypb.Target{},
 		Serving:             false,
 		MasterTermStartTime: 0,
+		Warming:             true,
 	}
 	result := <-resultChan
 	mustMatch(t, want, result, "Wrong TabletHealth data")
@@ -421,6 +538,443 @@ func TestHealthCheckTimeout(t *testing.T) {
 	mustMatch(t, want, result, "Wrong TabletHealth data")
 }
 
+func TestCloseReason(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+
+	newTablet := func(uid uint32) (*topodatapb.Tablet, *fakeConn, chan *querypb.StreamHealthResponse) {
+		tablet := topo.NewTablet(uid, "cell", "a")
+		tablet.PortMap["vt"] = int32(uid)
+		input := make(chan *querypb.StreamHealthResponse)
+		fc := createFakeConn(tablet, input)
+		fc.errCh = make(chan error)
+		return tablet, fc, input
+	}
+	removed, removedConn, removedInput := newTablet(1)
+	failed, failedConn, failedInput := newTablet(2)
+	kept, keptConn, keptInput := newTablet(3)
+
+	resultChan := hc.Subscribe()
+	for _, tt := range []struct {
+		tablet *topodatapb.Tablet
+		input  chan *querypb.StreamHealthResponse
+	}{{removed, removedInput}, {failed, failedInput}, {kept, keptInput}} {
+		hc.AddTablet(tt.tablet)
+		<-resultChan
+		tt.input <- &querypb.StreamHealthResponse{
+			TabletAlias:   tt.tablet.Alias,
+			Target:        &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
+			Serving:       true,
+			RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+		}
+		<-resultChan
+	}
+
+	hc.RemoveTablet(removed)
+	failedConn.errCh <- fmt.Errorf("some stream error")
+	waitForCondition(t, func() bool {
+		return len(removedConn.getCloseReasons()) == 1 && len(failedConn.getCloseReasons()) == 1
+	}, "the connections were not closed")
+	assert.Equal(t, []string{CloseReasonRemoved}, removedConn.getCloseReasons())
+	assert.Equal(t, []string{CloseReasonError}, failedConn.getCloseReasons())
+	assert.Empty(t, keptConn.getCloseReasons())
+
+	hc.Close()
+	assert.Equal(t, []string{CloseReasonShutdown}, keptConn.getCloseReasons())
+	assert.Equal(t, []string{CloseReasonRemoved}, removedConn.getCloseReasons())
+	assert.Equal(t, CloseReasonError, failedConn.getCloseReasons()[0])
+}
+
+// TestHealthCheckTimeoutFakeClock tests the health check timeout with a
+// fake clock, without waiting for it.
+func TestHealthCheckTimeoutFakeClock(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	clock := newFakeClock()
+	hc.clock = clock
+
+	tablet := topo.NewTablet(0, "cell", "a")
+	tablet.PortMap["vt"] = 1
+	input := make(chan *querypb.StreamHealthResponse)
+	fc := createFakeConn(tablet, input)
+	resultChan := hc.Subscribe()
+	hc.AddTablet(tablet)
+	<-resultChan
+
+	input <- &querypb.StreamHealthResponse{
+		TabletAlias:   tablet.Alias,
+		Target:        &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.2},
+	}
+	result := <-resultChan
+	assert.True(t, result.Serving)
+	hc.mu.Lock()
+	thc := hc.healthByAlias[tabletAliasString(topoproto.TabletAliasString(tablet.Alias))]
+	hc.mu.Unlock()
+	assert.Equal(t, clock.Now(), thc.getLastResponseTimestamp())
+
+	// the timeout is an hour, the fake clock makes it expire right away.
+	// The clock is advanced until the watchdog, which restarts its timer
+	// after the response, notices.
+	for result.LastError == nil || !strings.Contains(result.LastError.Error(), "healthcheck timed out") {
+		clock.Advance(hc.healthCheckTimeout)
+		select {
+		case result = <-resultChan:
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	assert.False(t, result.Serving)
+	assert.True(t, fc.isCanceled(), "StreamHealth should be canceled after timeout, but is not")
+}
+
+func TestHealthCheckAdaptiveTimeout(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	clock := newFakeClock()
+	hc.clock = clock
+	hc.adaptiveTimeoutMultiplier = 3
+	hc.adaptiveTimeoutMin = time.Second
+	hc.adaptiveTimeoutMax = time.Minute
+
+	tablet := topo.NewTablet(0, "cell", "a")
+	tablet.PortMap["vt"] = 1
+	input := make(chan *querypb.StreamHealthResponse)
+	createFakeConn(tablet, input)
+	resultChan := hc.Subscribe()
+	hc.AddTablet(tablet)
+	<-resultChan
+	hc.mu.Lock()
+	thc := hc.healthByAlias[tabletAliasString(topoproto.TabletAliasString(tablet.Alias))]
+	hc.mu.Unlock()
+
+	// the tablet reports its health every 2s
+	shr := &querypb.StreamHealthResponse{
+		TabletAlias:   tablet.Alias,
+		Target:        &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.2},
+	}
+	for i := 0; i < 5; i++ {
+		if i > 0 {
+			clock.Advance(2 * time.Second)
+		}
+		input <- shr
+		<-resultChan
+		if i < adaptiveTimeoutMinSamples {
+			assert.Equal(t, hc.healthCheckTimeout, thc.timeout(hc), "not enough responses to adapt the timeout")
+		}
+	}
+	assert.Equal(t, 6*time.Second, thc.timeout(hc))
+
+	// the timeout is noticed after about 6s instead of an hour
+	start := clock.Now()
+	var result *TabletHealth
+	for result == nil || result.LastError == nil || !strings.Contains(result.LastError.Error(), "healthcheck timed out") {
+		clock.Advance(time.Second)
+		select {
+		case result = <-resultChan:
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	elapsed := clock.Now().Sub(start)
+	assert.True(t, elapsed >= 6*time.Second && elapsed < time.Minute, "timed out after %v", elapsed)
+
+	// the bounds apply
+	hc.adaptiveTimeoutMax = 4 * time.Second
+	assert.Equal(t, 4*time.Second, thc.timeout(hc))
+	hc.adaptiveTimeoutMax = time.Minute
+	hc.adaptiveTimeoutMin = 10 * time.Second
+	assert.Equal(t, 10*time.Second, thc.timeout(hc))
+}
+
+// fakeClock is a clock which only moves when advanced.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeClockWaiter
+}
+
+type fakeClockWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now()}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeClockWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// hasWaiter returns true if a timer fires in exactly d from now.
+func (c *fakeClock) hasWaiter(d time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, w := range c.waiters {
+		if w.at.Equal(c.now.Add(d)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Advance moves the clock forward, and fires the timers which are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = waiters
+}
+
+// TestHealthCheckBackoffGrowsOnImmediateDrop tests that a tablet which sends
+// one message and then drops the stream does not reset the retry backoff.
+func TestHealthCheckBackoffGrowsOnImmediateDrop(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := NewHealthCheck(context.Background(), 10*time.Millisecond, time.Hour, ts, "cell")
+	defer hc.Close()
+
+	tablet := topo.NewTablet(0, "cell", "a")
+	tablet.Keyspace = "k"
+	tablet.Shard = "s"
+	tablet.PortMap["vt"] = 1
+	tablet.Type = topodatapb.TabletType_REPLICA
+	fc := createFakeConn(tablet, nil)
+	fc.fixedResult = &querypb.StreamHealthResponse{
+		TabletAlias:   tablet.Alias,
+		Target:        &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+	}
+	clock := newFakeClock()
+	hc.clock = clock
+	hc.AddTablet(tablet)
+
+	// each retry waits twice as long as the previous one
+	for i, delay := range []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 80 * time.Millisecond} {
+		waitForCondition(t, func() bool {
+			return fc.streamCount() == i+1 && clock.hasWaiter(delay)
+		}, "stream %v should be retried after %v", i+1, delay)
+		clock.Advance(delay)
+	}
+}
+
+func TestRetryDelayByTabletType(t *testing.T) {
+	defer func(old tabletTypeDurations) { retryDelayByTabletType = old }(retryDelayByTabletType)
+	require.NoError(t, retryDelayByTabletType.Set("master:10ms"))
+	assert.Equal(t, "master:10ms", retryDelayByTabletType.String())
+
+	ts := memorytopo.NewServer("cell")
+	hc := NewHealthCheck(context.Background(), time.Hour, time.Hour, ts, "cell")
+	defer hc.Close()
+
+	var conns []*fakeConn
+	for i, tabletType := range []topodatapb.TabletType{topodatapb.TabletType_MASTER, topodatapb.TabletType_RDONLY} {
+		tablet := topo.NewTablet(uint32(i+1), "cell", fmt.Sprintf("retry%d", i))
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.PortMap["vt"] = int32(i + 1)
+		tablet.Type = tabletType
+		fc := createFakeConn(tablet, nil)
+		// the stream drops right after the first response
+		fc.fixedResult = &querypb.StreamHealthResponse{
+			TabletAlias:   tablet.Alias,
+			Target:        &querypb.Target{Keyspace: "k", Shard: "s", TabletType: tabletType},
+			Serving:       true,
+			RealtimeStats: &querypb.RealtimeStats{},
+		}
+		conns = append(conns, fc)
+	}
+	for _, fc := range conns {
+		hc.AddTablet(fc.tablet)
+	}
+
+	// the master is retried after 10ms, the rdonly only after the global hour
+	waitForCondition(t, func() bool { return conns[0].streamCount() >= 3 }, "the master should have been retried")
+	assert.Equal(t, 1, conns[1].streamCount(), "the rdonly should not have been retried")
+}
+
+func TestAddTablets(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	resultChan := hc.Subscribe()
+
+	tablets := createBatchTablets(10)
+	var conns []*fakeConn
+	for _, tablet := range tablets {
+		conns = append(conns, createFakeConn(tablet, make(chan *querypb.StreamHealthResponse)))
+	}
+	hc.AddTablets(tablets)
+
+	hc.mu.Lock()
+	assert.Equal(t, len(tablets), len(hc.healthByAlias), "all tablets should be registered")
+	hc.mu.Unlock()
+	// the initial notifications were dropped as nobody was reading them
+	for len(resultChan) > 0 {
+		<-resultChan
+	}
+
+	// every tablet gets its own health check stream
+	for i, tablet := range tablets {
+		conns[i].hcChan <- &querypb.StreamHealthResponse{
+			TabletAlias:   tablet.Alias,
+			Target:        &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
+			Serving:       true,
+			RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+		}
+		result := <-resultChan
+		assert.True(t, result.Serving, "tablet %v should be serving", tablet.Alias)
+	}
+	a := hc.GetHealthyTabletStats(&querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA})
+	assert.Equal(t, len(tablets), len(a), "Wrong number of results")
+}
+
+func TestSetTablets(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+
+	var tablets []*topodatapb.Tablet
+	for i := 0; i < 4; i++ {
+		tablet := topo.NewTablet(uint32(i+1), "cell", fmt.Sprintf("set%d", i))
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.PortMap["vt"] = 1
+		tablet.Type = topodatapb.TabletType_REPLICA
+		tablets = append(tablets, tablet)
+	}
+	// the third tablet moves to another port
+	moved := proto.Clone(tablets[2]).(*topodatapb.Tablet)
+	moved.PortMap["vt"] = 2
+	var conns []*fakeConn
+	for _, tablet := range append(tablets, moved) {
+		conns = append(conns, createFakeConn(tablet, make(chan *querypb.StreamHealthResponse)))
+	}
+	healthChecks := func() map[string]*tabletHealthCheck {
+		hc.mu.Lock()
+		defer hc.mu.Unlock()
+		res := make(map[string]*tabletHealthCheck)
+		for alias, thc := range hc.healthByAlias {
+			res[string(alias)] = thc
+		}
+		return res
+	}
+
+	hc.SetTablets(tablets[:3])
+	before := healthChecks()
+	require.Equal(t, 3, len(before))
+
+	hc.SetTablets([]*topodatapb.Tablet{tablets[1], moved, tablets[3]})
+	after := healthChecks()
+	require.Equal(t, 3, len(after))
+	// the first tablet is removed
+	assert.NotContains(t, after, topoproto.TabletAliasString(tablets[0].Alias))
+	assert.Error(t, before[topoproto.TabletAliasString(tablets[0].Alias)].ctx.Err(), "the health check of the removed tablet should be stopped")
+	// the second one is kept as is
+	alias := topoproto.TabletAliasString(tablets[1].Alias)
+	assert.Same(t, before[alias], after[alias], "the unchanged tablet should not be replaced")
+	assert.NoError(t, after[alias].ctx.Err())
+	// the third one is replaced
+	alias = topoproto.TabletAliasString(tablets[2].Alias)
+	assert.False(t, before[alias] == after[alias], "the moved tablet should be replaced")
+	assert.Error(t, before[alias].ctx.Err(), "the health check at the old address should be stopped")
+	assert.Equal(t, TabletToMapKey(moved), TabletToMapKey(after[alias].Tablet))
+	// and the fourth one is added
+	assert.Contains(t, after, topoproto.TabletAliasString(tablets[3].Alias))
+}
+
+func BenchmarkAddTablet(b *testing.B) {
+	ts := memorytopo.NewServer("cell")
+	tablets := createBatchTablets(1000)
+	for _, tablet := range tablets {
+		createFakeConn(tablet, nil)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hc := createTestHc(ts)
+		for _, tablet := range tablets {
+			hc.AddTablet(tablet)
+		}
+		b.StopTimer()
+		hc.Close()
+		b.StartTimer()
+	}
+}
+
+func BenchmarkAddTablets(b *testing.B) {
+	ts := memorytopo.NewServer("cell")
+	tablets := createBatchTablets(1000)
+	for _, tablet := range tablets {
+		createFakeConn(tablet, nil)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hc := createTestHc(ts)
+		hc.AddTablets(tablets)
+		b.StopTimer()
+		hc.Close()
+		b.StartTimer()
+	}
+}
+
+func createBatchTablets(n int) []*topodatapb.Tablet {
+	tablets := make([]*topodatapb.Tablet, 0, n)
+	for i := 0; i < n; i++ {
+		tablet := topo.NewTablet(uint32(1000+i), "cell", fmt.Sprintf("batch%d", i))
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.PortMap["vt"] = 1
+		tablet.Type = topodatapb.TabletType_REPLICA
+		tablets = append(tablets, tablet)
+	}
+	return tablets
+}
+
+// TestHealthCheckTimeoutNoFirstResponse tests the error reported when a
+// tablet accepts the stream but never sends a health response.
+func TestHealthCheckTimeoutNoFirstResponse(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	hc.healthCheckTimeout = 100 * time.Millisecond
+	defer hc.Close()
+
+	tablet := topo.NewTablet(0, "cell", "silent")
+	tablet.PortMap["vt"] = 1
+	input := make(chan *querypb.StreamHealthResponse)
+	createFakeConn(tablet, input)
+	resultChan := hc.Subscribe()
+	hc.AddTablet(tablet)
+	// Immediately after AddTablet() there will be the first notification.
+	<-resultChan
+
+	result := <-resultChan
+	assert.False(t, result.Serving, "tabletHealthCheck: %+v; want not serving", result)
+	require.NotNil(t, result.LastError)
+	assert.Contains(t, result.LastError.Error(), "no health response received since connect")
+}
+
 // TestGetHealthyTablets tests the functionality of GetHealthyTabletStats.
 func TestGetHealthyTablets(t *testing.T) {
 	ts := memorytopo.NewServer("cell")
@@ -614,58 +1168,3420 @@ func TestGetHealthyTablets(t *testing.T) {
 	mustMatch(t, want, a, "unexpected result")
 }
 
-func TestAliases(t *testing.T) {
-	ts := memorytopo.NewServer("cell", "cell1", "cell2")
+func TestHealthCheckResponsesReceived(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
 	hc := createTestHc(ts)
 	defer hc.Close()
-
-	cellsAlias := &topodatapb.CellsAlias{
-		Cells: []string{"cell", "cell1"},
-	}
-	assert.Nil(t, ts.CreateCellsAlias(context.Background(), "region1", cellsAlias), "failed to create cell alias")
-	defer ts.DeleteCellsAlias(context.Background(), "region1")
-	cellsAlias = &topodatapb.CellsAlias{
-		Cells: []string{"cell2"},
-	}
-	assert.Nil(t, ts.CreateCellsAlias(context.Background(), "region2", cellsAlias), "failed to create cell alias")
-	defer ts.DeleteCellsAlias(context.Background(), "region2")
-
-	// add a tablet as replica in diff cell, same region
-	tablet := topo.NewTablet(1, "cell1", "host3")
-	tablet.Keyspace = "k"
+	tablet := topo.NewTablet(0, "cell", "a")
+	tablet.Keyspace = "kresp"
 	tablet.Shard = "s"
 	tablet.PortMap["vt"] = 1
 	tablet.Type = topodatapb.TabletType_REPLICA
 	input := make(chan *querypb.StreamHealthResponse)
-	fc := createFakeConn(tablet, input)
-	// create a channel and subscribe to healthcheck
+	createFakeConn(tablet, input)
 	resultChan := hc.Subscribe()
 	hc.AddTablet(tablet)
-	// should get a result, but this will hang if cell alias logic is broken
-	// so wait and timeout
-	ticker := time.NewTicker(1 * time.Second)
-	select {
-	case err := <-fc.cbErrCh:
-		require.Fail(t, "Unexpected error: %v", err)
-	case <-resultChan:
-	case <-ticker.C:
-		require.Fail(t, "Timed out waiting for HealthCheck update")
-	}
+	<-resultChan
 
-	shr := &querypb.StreamHealthResponse{
-		TabletAlias:                         tablet.Alias,
-		Target:                              &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
-		Serving:                             true,
-		TabletExternallyReparentedTimestamp: 0,
-		RealtimeStats:                       &querypb.RealtimeStats{SecondsBehindMaster: 10, CpuUsage: 0.2},
+	statsKey := "kresp.s.replica"
+	before := hcResponseCounters.Counts()[statsKey]
+	for i := 0; i < 3; i++ {
+		input <- &querypb.StreamHealthResponse{
+			TabletAlias:   tablet.Alias,
+			Target:        &querypb.Target{Keyspace: "kresp", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
+			Serving:       true,
+			RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: uint32(i), CpuUsage: 0.5},
+		}
+		<-resultChan
 	}
-	want := []*TabletHealth{{
-		Tablet:              tablet,
-		Target:              &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
-		Serving:             true,
-		Stats:               &querypb.RealtimeStats{SecondsBehindMaster: 10, CpuUsage: 0.2},
-		MasterTermStartTime: 0,
-	}}
+	assert.EqualValues(t, before+3, hcResponseCounters.Counts()[statsKey], "wrong number of responses counted")
+}
+
+func TestHealthCheckResponseStaleness(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	resultChan := hc.Subscribe()
+
+	var tablets []*topodatapb.Tablet
+	for i := 0; i < 4; i++ {
+		tablet := topo.NewTablet(uint32(i), "cell", "a")
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.PortMap["vt"] = int32(i + 1)
+		tablet.Type = topodatapb.TabletType_REPLICA
+		input := make(chan *querypb.StreamHealthResponse)
+		createFakeConn(tablet, input)
+		hc.AddTablet(tablet)
+		<-resultChan
+		// the last tablet never sends a health response
+		if i < 3 {
+			input <- &querypb.StreamHealthResponse{
+				TabletAlias:   tablet.Alias,
+				Target:        &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
+				Serving:       true,
+				RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+			}
+			<-resultChan
+		}
+		tablets = append(tablets, tablet)
+	}
+
+	// simulate responses received 50ms, 2s and 20s before now
+	now := time.Now()
+	for i, ago := range []time.Duration{50 * time.Millisecond, 2 * time.Second, 20 * time.Second} {
+		hc.mu.Lock()
+		thc := hc.healthByAlias[tabletAliasString(topoproto.TabletAliasString(tablets[i].Alias))]
+		hc.mu.Unlock()
+		thc.connMu.Lock()
+		thc.lastResponseTimestamp = now.Add(-ago)
+		thc.connMu.Unlock()
+	}
+
+	h := stats.NewHistogram("", "", responseStalenessCutoffs)
+	hc.sampleResponseStaleness(h, now)
+	assert.Equal(t, int64(3), h.Count())
+	assert.Equal(t, map[string]int64{
+		"100": 1, "500": 0, "1000": 0, "5000": 1, "10000": 0, "30000": 1, "60000": 0, "300000": 0, "600000": 0, "inf": 0,
+	}, h.Counts())
+
+	// ten minutes later, with no new responses, every tablet is in the tail
+	hc.sampleResponseStaleness(h, now.Add(10*time.Minute+time.Second))
+	assert.Equal(t, int64(6), h.Count())
+	assert.Equal(t, int64(3), h.Counts()["inf"])
+}
+
+func TestShardsAtRisk(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	g := stats.NewGaugesWithMultiLabels("", "", []string{"Keyspace", "ShardName"})
+
+	master := topo.NewTablet(0, "cell", "a")
+	master.Keyspace = "k"
+	master.Shard = "s"
+	master.PortMap["vt"] = 1
+	master.Type = topodatapb.TabletType_MASTER
+	masterInput := make(chan *querypb.StreamHealthResponse)
+	createFakeConn(master, masterInput)
+	replica := topo.NewTablet(1, "cell", "b")
+	replica.Keyspace = "k"
+	replica.Shard = "s"
+	replica.PortMap["vt"] = 2
+	replica.Type = topodatapb.TabletType_REPLICA
+	replicaInput := make(chan *querypb.StreamHealthResponse)
+	createFakeConn(replica, replicaInput)
+
+	resultChan := hc.Subscribe()
+	hc.AddTablet(master)
+	<-resultChan
+	hc.sampleShardsAtRisk(g)
+	assert.Equal(t, map[string]int64{"k.s": 0}, g.Counts(), "the master is not healthy yet")
+
+	masterInput <- &querypb.StreamHealthResponse{
+		TabletAlias:                         master.Alias,
+		Target:                              &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_MASTER},
+		Serving:                             true,
+		TabletExternallyReparentedTimestamp: 10,
+		RealtimeStats:                       &querypb.RealtimeStats{CpuUsage: 0.5},
+	}
+	<-resultChan
+	hc.sampleShardsAtRisk(g)
+	assert.Equal(t, map[string]int64{"k.s": 1}, g.Counts(), "a master without replica is at risk")
+
+	// a replica which is not serving yet doesn't help
+	hc.AddTablet(replica)
+	<-resultChan
+	hc.sampleShardsAtRisk(g)
+	assert.Equal(t, map[string]int64{"k.s": 1}, g.Counts())
+
+	replicaInput <- &querypb.StreamHealthResponse{
+		TabletAlias:   replica.Alias,
+		Target:        &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+	}
+	<-resultChan
+	hc.sampleShardsAtRisk(g)
+	assert.Equal(t, map[string]int64{"k.s": 0}, g.Counts(), "the replica clears the risk")
+
+	// the shard is forgotten with its master
+	hc.RemoveTablet(master)
+	hc.sampleShardsAtRisk(g)
+	assert.Empty(t, g.Counts())
+}
+
+func TestRegisterStatsAfterClose(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	hc.RegisterStats()
+	hc.Close()
+	assert.Equal(t, "0", expvar.Get("HealthcheckChecksum").String(), "a closed healthcheck should not be reported")
+
+	// a new healthcheck can register the stats again
+	hc = createTestHc(ts)
+	defer hc.Close()
+	tablet := topo.NewTablet(1, "cell", "a")
+	tablet.Keyspace = "k"
+	tablet.Shard = "s"
+	tablet.PortMap["vt"] = 1
+	tablet.Type = topodatapb.TabletType_REPLICA
+	input := make(chan *querypb.StreamHealthResponse)
+	createFakeConn(tablet, input)
+	resultChan := hc.Subscribe()
+	hc.AddTablet(tablet)
+	<-resultChan
+	input <- &querypb.StreamHealthResponse{
+		TabletAlias:   tablet.Alias,
+		Target:        &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+	}
+	<-resultChan
+	hc.RegisterStats()
+	hc.RegisterStats()
+	assert.Equal(t, fmt.Sprint(hc.stateChecksum()), expvar.Get("HealthcheckChecksum").String())
+	assert.Equal(t, fmt.Sprint(hc.membershipChecksum()), expvar.Get("HealthcheckMembershipChecksum").String())
+	assert.Contains(t, expvar.Get("HealthcheckHealthyTablets").String(), `"k.s.replica": 1`)
+
+	hc.UnregisterStats()
+	assert.Equal(t, "{}", expvar.Get("HealthcheckHealthyTablets").String())
+}
+
+func TestTabletServingStats(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	resultChan := hc.Subscribe()
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+
+	var tablets []*topodatapb.Tablet
+	var inputs []chan *querypb.StreamHealthResponse
+	for i := 0; i < 2; i++ {
+		tablet := topo.NewTablet(uint32(i+1), "cell", fmt.Sprintf("servingstats%d", i))
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.PortMap["vt"] = int32(i + 1)
+		tablet.Type = topodatapb.TabletType_REPLICA
+		input := make(chan *querypb.StreamHealthResponse)
+		createFakeConn(tablet, input)
+		tablets = append(tablets, tablet)
+		inputs = append(inputs, input)
+	}
+	for i, tablet := range tablets {
+		hc.AddTablet(tablet)
+		<-resultChan
+		// only the first tablet is serving
+		inputs[i] <- &querypb.StreamHealthResponse{
+			TabletAlias:   tablet.Alias,
+			Target:        target,
+			Serving:       i == 0,
+			RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1},
+		}
+		<-resultChan
+	}
+
+	hc.RegisterStats()
+	defer hc.UnregisterStats()
+	// the gauge is opt-in
+	assert.Equal(t, "{}", expvar.Get("HealthcheckTabletServing").String())
+
+	hc.perTabletServingStats = true
+	assert.Equal(t, map[string]int64{
+		"cell-0000000001.k.s.replica": 1,
+		"cell-0000000002.k.s.replica": 0,
+	}, hc.tabletServingStats())
+	assert.Contains(t, expvar.Get("HealthcheckTabletServing").String(), `"cell-0000000001.k.s.replica": 1`)
+
+	// the gauge follows the serving state
+	inputs[0] <- &querypb.StreamHealthResponse{
+		TabletAlias:   tablets[0].Alias,
+		Target:        target,
+		Serving:       false,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1},
+	}
+	<-resultChan
+	inputs[1] <- &querypb.StreamHealthResponse{
+		TabletAlias:   tablets[1].Alias,
+		Target:        target,
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1},
+	}
+	<-resultChan
+	assert.Equal(t, map[string]int64{
+		"cell-0000000001.k.s.replica": 0,
+		"cell-0000000002.k.s.replica": 1,
+	}, hc.tabletServingStats())
+}
+
+func TestMembershipChecksum(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc1 := createTestHc(ts)
+	defer hc1.Close()
+	hc2 := createTestHc(ts)
+	defer hc2.Close()
+	// the health of the tablets is only checked by hc1
+	hc2.healthStreamDisabled = true
+	resultChan := hc1.Subscribe()
+	assert.Equal(t, hc1.membershipChecksum(), hc2.membershipChecksum())
+
+	var tablets []*topodatapb.Tablet
+	var inputs []chan *querypb.StreamHealthResponse
+	for i := 0; i < 2; i++ {
+		tablet := topo.NewTablet(uint32(i+1), "cell", fmt.Sprintf("member%d", i))
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.PortMap["vt"] = 1
+		tablet.Type = topodatapb.TabletType_REPLICA
+		input := make(chan *querypb.StreamHealthResponse)
+		createFakeConn(tablet, input)
+		tablets = append(tablets, tablet)
+		inputs = append(inputs, input)
+	}
+	// the tablets are added in a different order
+	hc2.AddTablets([]*topodatapb.Tablet{tablets[1], tablets[0]})
+	for i, tablet := range tablets {
+		hc1.AddTablet(tablet)
+		<-resultChan
+		inputs[i] <- &querypb.StreamHealthResponse{
+			TabletAlias:                         tablet.Alias,
+			Target:                              &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_MASTER},
+			Serving:                             true,
+			TabletExternallyReparentedTimestamp: 10,
+			RealtimeStats:                       &querypb.RealtimeStats{SecondsBehindMaster: 1},
+		}
+		<-resultChan
+	}
+	assert.NotEqual(t, hc1.stateChecksum(), hc2.stateChecksum(), "the health of the tablets differs")
+	assert.Equal(t, hc1.membershipChecksum(), hc2.membershipChecksum(), "the tablets are the same")
+
+	hc2.RemoveTablet(tablets[0])
+	assert.NotEqual(t, hc1.membershipChecksum(), hc2.membershipChecksum(), "the tablets differ")
+}
+
+func TestHealthyTabletStats(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+
+	var tablets []*topodatapb.Tablet
+	var inputs []chan *querypb.StreamHealthResponse
+	for i, tabletType := range []topodatapb.TabletType{topodatapb.TabletType_REPLICA, topodatapb.TabletType_REPLICA, topodatapb.TabletType_REPLICA, topodatapb.TabletType_MASTER, topodatapb.TabletType_MASTER} {
+		tablet := topo.NewTablet(uint32(i), "cell", "a")
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.PortMap["vt"] = int32(i + 1)
+		tablet.Type = tabletType
+		input := make(chan *querypb.StreamHealthResponse)
+		createFakeConn(tablet, input)
+		tablets = append(tablets, tablet)
+		inputs = append(inputs, input)
+	}
+	resultChan := hc.Subscribe()
+	for i, tablet := range tablets {
+		hc.AddTablet(tablet)
+		<-resultChan
+		shr := &querypb.StreamHealthResponse{
+			TabletAlias:                         tablet.Alias,
+			Target:                              &querypb.Target{Keyspace: "k", Shard: "s", TabletType: tablet.Type},
+			Serving:                             true,
+			TabletExternallyReparentedTimestamp: int64(i),
+			RealtimeStats:                       &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+		}
+		if tablet.Type == topodatapb.TabletType_MASTER {
+			shr.RealtimeStats.SecondsBehindMaster = 0
+		}
+		// the last replica is not healthy
+		if i == 2 {
+			shr.RealtimeStats.HealthError = "some error"
+		}
+		inputs[i] <- shr
+		<-resultChan
+	}
+
+	counts := hc.healthyTabletStats()
+	replicaTarget := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+	masterTarget := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_MASTER}
+	assert.EqualValues(t, 2, counts["k.s.replica"])
+	assert.EqualValues(t, len(hc.GetHealthyTabletStats(replicaTarget)), counts["k.s.replica"])
+	assert.EqualValues(t, 1, counts["k.s.master"])
+	assert.EqualValues(t, len(hc.GetHealthyTabletStats(masterTarget)), counts["k.s.master"])
+}
+
+func TestDuplicateMasterStats(t *testing.T) {
+	ts := memorytopo.NewServer("cell", "cell1")
+	hc := createTestHc(ts)
+	defer hc.Close()
+
+	master1 := topo.NewTablet(1, "cell", "a")
+	master2 := topo.NewTablet(2, "cell1", "b")
+	var inputs []chan *querypb.StreamHealthResponse
+	for i, tablet := range []*topodatapb.Tablet{master1, master2} {
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.PortMap["vt"] = int32(i + 1)
+		tablet.Type = topodatapb.TabletType_MASTER
+		input := make(chan *querypb.StreamHealthResponse)
+		createFakeConn(tablet, input)
+		inputs = append(inputs, input)
+	}
+	masterResponse := func(tablet *topodatapb.Tablet, serving bool) *querypb.StreamHealthResponse {
+		return &querypb.StreamHealthResponse{
+			TabletAlias:                         tablet.Alias,
+			Target:                              &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_MASTER},
+			Serving:                             serving,
+			TabletExternallyReparentedTimestamp: int64(tablet.Alias.Uid),
+			RealtimeStats:                       &querypb.RealtimeStats{CpuUsage: 0.5},
+		}
+	}
+
+	resultChan := hc.Subscribe()
+	hc.AddTablet(master1)
+	<-resultChan
+	inputs[0] <- masterResponse(master1, true)
+	<-resultChan
+	assert.Equal(t, map[string]int64{"k.s": 0}, hc.duplicateMasterStats())
+
+	// a second master shows up in another cell
+	hc.AddTablet(master2)
+	<-resultChan
+	inputs[1] <- masterResponse(master2, true)
+	<-resultChan
+	assert.Equal(t, map[string]int64{"k.s": 2}, hc.duplicateMasterStats())
+
+	// the condition clears once the old master stops serving
+	inputs[0] <- masterResponse(master1, false)
+	<-resultChan
+	assert.Equal(t, map[string]int64{"k.s": 0}, hc.duplicateMasterStats())
+}
+
+func TestHealthCheckMaxConcurrentStreams(t *testing.T) {
+	defer func(old int) { *maxConcurrentStreams = old }(*maxConcurrentStreams)
+	*maxConcurrentStreams = 4
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	require.NotNil(t, hc.streamPool)
+
+	const tabletCount = 100
+	var tablets []*topodatapb.Tablet
+	for i := 0; i < tabletCount; i++ {
+		tablet := topo.NewTablet(uint32(i), "cell", "a")
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.PortMap["vt"] = int32(i + 1)
+		tablet.Type = topodatapb.TabletType_REPLICA
+		fc := createFixedHealthConn(tablet, &querypb.StreamHealthResponse{
+			TabletAlias:   tablet.Alias,
+			Target:        &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
+			Serving:       true,
+			RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+		})
+		// the polls end the streams after the first response
+		fc.eofEndsStream = true
+		tablets = append(tablets, tablet)
+	}
+
+	before := runtime.NumGoroutine()
+	hc.AddTablets(tablets)
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+	waitForCondition(t, func() bool {
+		return len(hc.GetHealthyTabletStats(target)) == tabletCount
+	}, "not all tablets received a health update")
+
+	// no goroutine is started per tablet, allow for some transient ones
+	waitForCondition(t, func() bool {
+		return runtime.NumGoroutine()-before < tabletCount/4
+	}, "too many goroutines: %v before adding tablets, %v after", before, runtime.NumGoroutine())
+}
+
+// TestHealthCheckPollInterval checks that with
+// -healthcheck_max_concurrent_streams each tablet is polled once per
+// -healthcheck_poll_interval, whatever the retry delay.
+func TestHealthCheckPollInterval(t *testing.T) {
+	defer func(old int) { *maxConcurrentStreams = old }(*maxConcurrentStreams)
+	*maxConcurrentStreams = 2
+	defer func(old time.Duration) { *pollInterval = old }(*pollInterval)
+	*pollInterval = time.Minute
+	clock := newFakeClock()
+	ts := memorytopo.NewServer("cell")
+	hc := NewHealthCheck(context.Background(), 1*time.Millisecond, time.Hour, ts, "cell", func(hc *HealthCheckImpl) {
+		hc.clock = clock
+	})
+	defer hc.Close()
+	require.NotNil(t, hc.streamPool)
+
+	const tabletCount = 5
+	var conns []*fakeConn
+	for i := 0; i < tabletCount; i++ {
+		tablet := topo.NewTablet(uint32(i), "cell", "a")
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.PortMap["vt"] = int32(i + 1)
+		tablet.Type = topodatapb.TabletType_REPLICA
+		fc := createFixedHealthConn(tablet, &querypb.StreamHealthResponse{
+			TabletAlias:   tablet.Alias,
+			Target:        &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
+			Serving:       true,
+			RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+		})
+		fc.eofEndsStream = true
+		conns = append(conns, fc)
+		hc.AddTablet(tablet)
+	}
+
+	// polled waits until every tablet was polled exactly n times, and is
+	// waiting for the next poll.
+	polled := func(n int) {
+		waitForCondition(t, func() bool {
+			for _, fc := range conns {
+				if fc.streamCount() != n {
+					return false
+				}
+			}
+			hc.streamPool.mu.Lock()
+			queued := len(hc.streamPool.queue)
+			hc.streamPool.mu.Unlock()
+			return queued == tabletCount && clock.hasWaiter(*pollInterval)
+		}, "the tablets were not polled %v times", n)
+	}
+
+	// the tablets are polled right away, then once per interval over a
+	// window of 10 intervals
+	polled(1)
+	const intervals = 10
+	for i := 0; i < intervals; i++ {
+		clock.Advance(*pollInterval)
+		polled(i + 2)
+	}
+	for _, fc := range conns {
+		assert.Equal(t, 1+intervals, fc.streamCount(), "polls of tablet %v", fc.tablet.Alias)
+	}
+}
+
+func TestHealthCheckResponseValidator(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+
+	tablet := topo.NewTablet(0, "cell", "a")
+	tablet.Keyspace = "k"
+	tablet.Shard = "s"
+	tablet.PortMap["vt"] = 1
+	tablet.Type = topodatapb.TabletType_REPLICA
+	tablet.Tags = map[string]string{"validated": "true"}
+	input := make(chan *querypb.StreamHealthResponse)
+	createFakeConn(tablet, input)
+
+	tablet2 := topo.NewTablet(1, "cell", "b")
+	tablet2.Keyspace = "k"
+	tablet2.Shard = "s"
+	tablet2.PortMap["vt"] = 2
+	tablet2.Type = topodatapb.TabletType_REPLICA
+	input2 := make(chan *querypb.StreamHealthResponse)
+	createFakeConn(tablet2, input2)
+
+	tablets := map[string]*topodatapb.Tablet{
+		topoproto.TabletAliasString(tablet.Alias):  tablet,
+		topoproto.TabletAliasString(tablet2.Alias): tablet2,
+	}
+	hc.SetResponseValidator(func(shr *querypb.StreamHealthResponse) error {
+		if _, ok := tablets[topoproto.TabletAliasString(shr.TabletAlias)].Tags["validated"]; !ok {
+			return fmt.Errorf("tablet %v is missing the validated tag", topoproto.TabletAliasString(shr.TabletAlias))
+		}
+		return nil
+	})
+
+	resultChan := hc.Subscribe()
+	hc.AddTablet(tablet)
+	<-resultChan
+	hc.AddTablet(tablet2)
+	<-resultChan
+
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+	input <- &querypb.StreamHealthResponse{
+		TabletAlias:   tablet.Alias,
+		Target:        target,
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+	}
+	result := <-resultChan
+	assert.True(t, result.Serving, "validated tablet should be serving")
+	assert.Nil(t, result.LastError)
+
+	input2 <- &querypb.StreamHealthResponse{
+		TabletAlias:   tablet2.Alias,
+		Target:        target,
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+	}
+	result = <-resultChan
+	assert.False(t, result.Serving, "rejected tablet should not be serving")
+	require.NotNil(t, result.LastError)
+	assert.Contains(t, result.LastError.Error(), "missing the validated tag")
+
+	a := hc.GetHealthyTabletStats(target)
+	require.Equal(t, 1, len(a), "Wrong number of results")
+	assert.True(t, topoproto.TabletAliasEqual(tablet.Alias, a[0].Tablet.Alias), "wrong healthy tablet: %v", a[0].Tablet.Alias)
+}
+
+func TestTabletDenylist(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	resultChan := hc.Subscribe()
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+
+	var tablets []*topodatapb.Tablet
+	for i := 0; i < 3; i++ {
+		tablet := topo.NewTablet(uint32(i+1), "cell", fmt.Sprintf("host%d", i))
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.PortMap["vt"] = int32(i + 1)
+		tablet.Type = topodatapb.TabletType_REPLICA
+		input := make(chan *querypb.StreamHealthResponse, 1)
+		createFakeConn(tablet, input)
+		hc.AddTablet(tablet)
+		<-resultChan
+		input <- &querypb.StreamHealthResponse{
+			TabletAlias:   tablet.Alias,
+			Target:        target,
+			Serving:       true,
+			RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+		}
+		<-resultChan
+		tablets = append(tablets, tablet)
+	}
+	assert.Equal(t, 3, len(hc.GetHealthyTabletStats(target)), "Wrong number of results")
+
+	hc.SetTabletDenylist([]*topodatapb.TabletAlias{tablets[1].Alias})
+	a := hc.GetHealthyTabletStats(target)
+	assert.Equal(t, 2, len(a), "Wrong number of results")
+	for _, th := range a {
+		assert.False(t, topoproto.TabletAliasEqual(tablets[1].Alias, th.Tablet.Alias), "denylisted tablet %v was returned", th.Tablet.Alias)
+	}
+
+	// the denylisted tablet is still in the cache
+	tcsl := hc.CacheStatus()
+	require.Equal(t, 1, len(tcsl))
+	assert.Equal(t, 3, len(tcsl[0].TabletsStats))
+	assert.Equal(t, []string{topoproto.TabletAliasString(tablets[1].Alias)}, tcsl[0].DenylistedTablets)
+
+	// clearing the denylist makes the tablet available again
+	hc.SetTabletDenylist(nil)
+	assert.Equal(t, 3, len(hc.GetHealthyTabletStats(target)), "Wrong number of results")
+	assert.Empty(t, hc.CacheStatus()[0].DenylistedTablets)
+}
+
+func TestDrainingTablet(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	resultChan := hc.Subscribe()
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+
+	var tablets []*topodatapb.Tablet
+	var inputs []chan *querypb.StreamHealthResponse
+	for i := 0; i < 2; i++ {
+		tablet := topo.NewTablet(uint32(i+1), "cell", fmt.Sprintf("draining%d", i))
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.PortMap["vt"] = int32(i + 1)
+		tablet.Type = topodatapb.TabletType_REPLICA
+		input := make(chan *querypb.StreamHealthResponse, 1)
+		createFakeConn(tablet, input)
+		tablets = append(tablets, tablet)
+		inputs = append(inputs, input)
+	}
+	for i, tablet := range tablets {
+		hc.AddTablet(tablet)
+		<-resultChan
+		inputs[i] <- &querypb.StreamHealthResponse{
+			TabletAlias:   tablet.Alias,
+			Target:        target,
+			Serving:       true,
+			RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1},
+		}
+		<-resultChan
+	}
+	assert.Equal(t, 2, len(hc.GetHealthyTabletStats(target)), "Wrong number of results")
+
+	// the second tablet starts shutting down
+	inputs[1] <- &querypb.StreamHealthResponse{
+		TabletAlias:   tablets[1].Alias,
+		Target:        target,
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, HealthError: DrainingHealthError},
+	}
+	th := <-resultChan
+	assert.True(t, th.Draining)
+	assert.True(t, th.Serving, "a draining tablet is still serving")
+	assert.Nil(t, th.LastError, "draining is not a health check error")
+	a := hc.GetHealthyTabletStats(target)
+	require.Equal(t, 1, len(a), "Wrong number of results")
+	assert.True(t, topoproto.TabletAliasEqual(tablets[0].Alias, a[0].Tablet.Alias), "draining tablet %v was returned", a[0].Tablet.Alias)
+	explanations := hc.ExplainSelection(target)
+	require.Equal(t, 2, len(explanations))
+	assert.Equal(t, SelectionReasonDraining, explanations[1].Reason)
+
+	// the draining tablet is still in the cache
+	tcsl := hc.CacheStatus()
+	require.Equal(t, 1, len(tcsl))
+	require.Equal(t, 2, len(tcsl[0].TabletsStats))
+	assert.Contains(t, string(tcsl[0].StatusAsHTML()), "(Draining)")
+	for _, ts := range tcsl[0].TabletsStats {
+		assert.Equal(t, topoproto.TabletAliasEqual(tablets[1].Alias, ts.Tablet.Alias), ts.Draining, "wrong draining state for %v", ts.Tablet.Alias)
+	}
+
+	// it is used again once it does not report draining anymore
+	inputs[1] <- &querypb.StreamHealthResponse{
+		TabletAlias:   tablets[1].Alias,
+		Target:        target,
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1},
+	}
+	th = <-resultChan
+	assert.False(t, th.Draining)
+	assert.Equal(t, 2, len(hc.GetHealthyTabletStats(target)), "Wrong number of results")
+}
+
+func TestDegradedTablet(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	hc.healthErrorAsDegraded = true
+	resultChan := hc.Subscribe()
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+
+	var tablets []*topodatapb.Tablet
+	var inputs []chan *querypb.StreamHealthResponse
+	for i := 0; i < 2; i++ {
+		tablet := topo.NewTablet(uint32(i+1), "cell", fmt.Sprintf("degraded%d", i))
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.PortMap["vt"] = int32(i + 1)
+		tablet.Type = topodatapb.TabletType_REPLICA
+		input := make(chan *querypb.StreamHealthResponse, 1)
+		createFakeConn(tablet, input)
+		tablets = append(tablets, tablet)
+		inputs = append(inputs, input)
+	}
+	for i, tablet := range tablets {
+		hc.AddTablet(tablet)
+		<-resultChan
+		inputs[i] <- &querypb.StreamHealthResponse{
+			TabletAlias:   tablet.Alias,
+			Target:        target,
+			Serving:       true,
+			RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1},
+		}
+		<-resultChan
+	}
+	assert.Equal(t, 2, len(hc.GetHealthyTabletStats(target)), "Wrong number of results")
+
+	// the second tablet reports a health error
+	inputs[1] <- &querypb.StreamHealthResponse{
+		TabletAlias:   tablets[1].Alias,
+		Target:        target,
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, HealthError: "disk almost full"},
+	}
+	th := <-resultChan
+	assert.True(t, th.Degraded)
+	assert.True(t, th.Serving, "a degraded tablet is still serving")
+	assert.Nil(t, th.LastError, "degraded is not a health check error")
+	a := hc.GetHealthyTabletStats(target)
+	require.Equal(t, 1, len(a), "Wrong number of results")
+	assert.True(t, topoproto.TabletAliasEqual(tablets[0].Alias, a[0].Tablet.Alias), "degraded tablet %v was returned", a[0].Tablet.Alias)
+	explanations := hc.ExplainSelection(target)
+	require.Equal(t, 2, len(explanations))
+	assert.Equal(t, SelectionReasonDegraded, explanations[1].Reason)
+	tcsl := hc.CacheStatus()
+	require.Equal(t, 1, len(tcsl))
+	assert.Contains(t, string(tcsl[0].StatusAsHTML()), "(Degraded: disk almost full)")
+
+	// the degraded tablet is used once it is the only serving one
+	inputs[0] <- &querypb.StreamHealthResponse{
+		TabletAlias:   tablets[0].Alias,
+		Target:        target,
+		Serving:       false,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1},
+	}
+	<-resultChan
+	a = hc.GetHealthyTabletStats(target)
+	require.Equal(t, 1, len(a), "Wrong number of results")
+	assert.True(t, topoproto.TabletAliasEqual(tablets[1].Alias, a[0].Tablet.Alias), "degraded tablet %v was not returned", a[0].Tablet.Alias)
+	assert.True(t, a[0].Degraded)
+
+	// without the flag, the health error makes the tablet not serving
+	hc.healthErrorAsDegraded = false
+	inputs[1] <- &querypb.StreamHealthResponse{
+		TabletAlias:   tablets[1].Alias,
+		Target:        target,
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, HealthError: "disk almost full"},
+	}
+	th = <-resultChan
+	assert.False(t, th.Degraded)
+	assert.False(t, th.Serving)
+	assert.Empty(t, hc.GetHealthyTabletStats(target))
+}
+
+func TestGetAllConnections(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	resultChan := hc.Subscribe()
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+
+	var tablets []*topodatapb.Tablet
+	var conns []*fakeConn
+	for i := 0; i < 3; i++ {
+		tablet := topo.NewTablet(uint32(i+1), "cell", fmt.Sprintf("all%d", i))
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.PortMap["vt"] = int32(i + 1)
+		tablet.Type = topodatapb.TabletType_REPLICA
+		tablets = append(tablets, tablet)
+		conns = append(conns, createFakeConn(tablet, make(chan *querypb.StreamHealthResponse)))
+	}
+	for i, tablet := range tablets {
+		hc.AddTablet(tablet)
+		<-resultChan
+		// the last tablet is not serving
+		conns[i].hcChan <- &querypb.StreamHealthResponse{
+			TabletAlias:   tablet.Alias,
+			Target:        target,
+			Serving:       i < 2,
+			RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1},
+		}
+		<-resultChan
+	}
+
+	all := hc.GetAllConnections(target)
+	require.Equal(t, 2, len(all), "there should be one connection per healthy tablet")
+	assert.ElementsMatch(t, []queryservice.QueryService{conns[0], conns[1]}, all)
+	assert.Empty(t, hc.GetAllConnections(&querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_RDONLY}))
+}
+
+func TestHealthCheckDialError(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+
+	// no fake connection is registered for this tablet, so dialing fails
+	tablet := topo.NewTablet(0, "cell", "nodial")
+	tablet.Keyspace = "kdial"
+	tablet.Shard = "s"
+	tablet.PortMap["vt"] = 1
+	tablet.Type = topodatapb.TabletType_REPLICA
+	statsKey := "kdial.s.replica"
+	before := hcDialErrorCounters.Counts()[statsKey]
+	hc.AddTablet(tablet)
+
+	// wait for a few dial attempts
+	deadline := time.Now().Add(5 * time.Second)
+	for hcDialErrorCounters.Counts()[statsKey] < before+2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.GreaterOrEqual(t, hcDialErrorCounters.Counts()[statsKey], before+2, "dial errors should have been counted")
+	assert.Zero(t, hcErrorCounters.Counts()[statsKey], "dial errors should not be counted as health check errors")
+
+	tcsl := hc.CacheStatus()
+	require.Equal(t, 1, len(tcsl))
+	th := tcsl[0].TabletsStats[0]
+	require.NotNil(t, th.LastDialError)
+	assert.Contains(t, th.LastDialError.Error(), "not found")
+}
+
+func TestWarmingTablet(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	hc.initialWarmFraction = 1
+	resultChan := hc.Subscribe()
+
+	tablet := topo.NewTablet(0, "cell", "warming")
+	tablet.Keyspace = "kwarm"
+	tablet.Shard = "s"
+	tablet.PortMap["vt"] = 1
+	tablet.Type = topodatapb.TabletType_REPLICA
+	input := make(chan *querypb.StreamHealthResponse)
+	createFakeConn(tablet, input)
+	hc.AddTablet(tablet)
+	result := <-resultChan
+	assert.True(t, result.Warming, "the tablet should be warming until its first response")
+
+	target := &querypb.Target{Keyspace: "kwarm", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+	explanations := hc.ExplainSelection(target)
+	require.Equal(t, 1, len(explanations))
+	assert.Equal(t, SelectionReasonWarming, explanations[0].Reason)
+	tcsl := hc.CacheStatus()
+	require.Equal(t, 1, len(tcsl))
+	assert.Contains(t, string(tcsl[0].StatusAsHTML()), "(Warming)")
+	assert.EqualValues(t, 1, hc.warmingTabletStats()["kwarm.s.replica"])
+	ctx, cancel := context.WithTimeout(context.Background(), 2*waitAvailableTabletInterval)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, hc.WaitForInitialTopology(ctx), "the tablet should be waited for")
+
+	input <- &querypb.StreamHealthResponse{
+		TabletAlias:   tablet.Alias,
+		Target:        target,
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1},
+	}
+	result = <-resultChan
+	assert.False(t, result.Warming, "the tablet should not be warming after its first response")
+	assert.EqualValues(t, 0, hc.warmingTabletStats()["kwarm.s.replica"])
+	assert.NotContains(t, string(hc.CacheStatus()[0].StatusAsHTML()), "(Warming)")
+	assert.NoError(t, hc.WaitForInitialTopology(context.Background()))
+}
+
+func TestErrorCategory(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		dial bool
+		want string
+	}{
+		{nil, false, ""},
+		{vterrors.New(vtrpcpb.Code_UNAVAILABLE, "connection refused"), false, ErrorCategoryNetwork},
+		{vterrors.New(vtrpcpb.Code_DEADLINE_EXCEEDED, "healthcheck timed out"), false, ErrorCategoryNetwork},
+		{fmt.Errorf("no such host"), true, ErrorCategoryNetwork},
+		{context.Canceled, false, ErrorCategoryCanceled},
+		{vterrors.New(vtrpcpb.Code_CANCELED, "stream canceled"), true, ErrorCategoryCanceled},
+		{fmt.Errorf("vttablet error: replication is not running"), false, ErrorCategoryApplication},
+		{vterrors.New(vtrpcpb.Code_FAILED_PRECONDITION, "health stats mismatch"), false, ErrorCategoryApplication},
+		{vterrors.New(vtrpcpb.Code_UNAUTHENTICATED, "bad credentials"), false, ErrorCategoryAuth},
+		{vterrors.New(vtrpcpb.Code_PERMISSION_DENIED, "not allowed"), true, ErrorCategoryAuth},
+	} {
+		assert.Equal(t, tc.want, errorCategory(tc.err, tc.dial), "wrong category for %v (dial: %v)", tc.err, tc.dial)
+	}
+
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	resultChan := hc.Subscribe()
+
+	tablet := topo.NewTablet(0, "cell", "category")
+	tablet.Keyspace = "kcat"
+	tablet.Shard = "s"
+	tablet.PortMap["vt"] = 1
+	tablet.Type = topodatapb.TabletType_REPLICA
+	input := make(chan *querypb.StreamHealthResponse)
+	fc := createFakeConn(tablet, input)
+	fc.errCh = make(chan error)
+	hc.AddTablet(tablet)
+	<-resultChan
+
+	// an application level health error
+	input <- &querypb.StreamHealthResponse{
+		TabletAlias:   tablet.Alias,
+		Target:        &querypb.Target{Keyspace: "kcat", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{HealthError: "replication is not running"},
+	}
+	result := <-resultChan
+	assert.Equal(t, ErrorCategoryApplication, result.ErrorCategory)
+	assert.Contains(t, string((&TabletsCacheStatus{TabletsStats: TabletStatsList{result}}).StatusAsHTML()), "(Category: application)")
+
+	// an authentication error ending the stream
+	authKey := "kcat.s.replica." + ErrorCategoryAuth
+	before := hcErrorCategoryCounters.Counts()[authKey]
+	fc.errCh <- vterrors.New(vtrpcpb.Code_UNAUTHENTICATED, "bad credentials")
+	result = <-resultChan
+	assert.Equal(t, ErrorCategoryAuth, result.ErrorCategory)
+	assert.EqualValues(t, 1, hcErrorCategoryCounters.Counts()[authKey]-before, "the error should have been counted")
+}
+
+func TestTabletsExcludedByCell(t *testing.T) {
+	ts := memorytopo.NewServer("cell", "unaliased")
+	hc := createTestHc(ts)
+	defer hc.Close()
+
+	tablet := topo.NewTablet(0, "unaliased", "remote")
+	tablet.Keyspace = "k"
+	tablet.Shard = "s"
+	tablet.PortMap["vt"] = 1
+	tablet.Type = topodatapb.TabletType_REPLICA
+	before := hcExcludedByCellCounters.Counts()["unaliased"]
+	hc.AddTablet(tablet)
+
+	assert.EqualValues(t, 1, hcExcludedByCellCounters.Counts()["unaliased"]-before, "the exclusion should have been counted")
+	hc.mu.Lock()
+	_, ok := hc.healthByAlias[tabletAliasString(topoproto.TabletAliasString(tablet.Alias))]
+	hc.mu.Unlock()
+	assert.False(t, ok, "the tablet of the remote cell should not be health checked")
+	assert.Empty(t, hc.CacheStatus())
+}
+
+func TestMaxRetryDuration(t *testing.T) {
+	defer func(old time.Duration) { *maxRetryDuration = old }(*maxRetryDuration)
+	*maxRetryDuration = 50 * time.Millisecond
+	ts := memorytopo.NewServer("cell")
+	hc := NewHealthCheck(context.Background(), time.Millisecond, 10*time.Millisecond, ts, "cell")
+	defer hc.Close()
+
+	// no fake connection is registered for this tablet, so dialing always fails
+	tablet := topo.NewTablet(0, "cell", "nodial")
+	tablet.Keyspace = "kretry"
+	tablet.Shard = "s"
+	tablet.PortMap["vt"] = 1
+	tablet.Type = topodatapb.TabletType_REPLICA
+	hc.AddTablet(tablet)
+
+	// the health check goroutine exits once the budget is spent
+	done := make(chan struct{})
+	go func() {
+		hc.connsWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the health check of the unreachable tablet is still retrying")
+	}
+	assert.Empty(t, hc.GetTabletStats(&querypb.Target{Keyspace: "kretry", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}))
+	hc.mu.Lock()
+	assert.Empty(t, hc.healthByAlias)
+	hc.mu.Unlock()
+}
+
+// TestMaxRetryDurationAddedAgain tests that a tablet evicted after its retry
+// budget is added again by the next refresh of the topology watcher.
+func TestMaxRetryDurationAddedAgain(t *testing.T) {
+	defer func(old time.Duration) { *maxRetryDuration = old }(*maxRetryDuration)
+	*maxRetryDuration = time.Minute
+	defer func(old string) { *CellsToWatch = old }(*CellsToWatch)
+	*CellsToWatch = "cell"
+	ctx := context.Background()
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	clock := newFakeClock()
+	hc.clock = clock
+
+	// no fake connection is registered for this tablet, so dialing always fails
+	tablet := topo.NewTablet(1, "cell", "evicted")
+	tablet.Keyspace = "kevict"
+	tablet.Shard = "s"
+	tablet.PortMap["vt"] = 1
+	tablet.Type = topodatapb.TabletType_REPLICA
+	require.NoError(t, ts.CreateTablet(ctx, tablet))
+	alias := tabletAliasString(topoproto.TabletAliasString(tablet.Alias))
+	getThc := func() *tabletHealthCheck {
+		hc.mu.Lock()
+		defer hc.mu.Unlock()
+		return hc.healthByAlias[alias]
+	}
+
+	require.NoError(t, hc.RefreshNow(ctx))
+	evicted := getThc()
+	require.NotNil(t, evicted, "the tablet should be added by the refresh")
+	waitForCondition(t, func() bool {
+		clock.Advance(time.Minute)
+		return getThc() == nil
+	}, "the unreachable tablet should be evicted")
+
+	// the tablet is reachable again
+	createFakeConn(tablet, make(chan *querypb.StreamHealthResponse))
+	require.NoError(t, hc.RefreshNow(ctx))
+	added := getThc()
+	require.NotNil(t, added, "the evicted tablet should be added again by the refresh")
+	assert.True(t, added != evicted, "the tablet should be health checked again")
+
+	// the stale health check doesn't remove the tablet added again
+	hc.evictTablet(evicted)
+	assert.True(t, getThc() == added, "the tablet added again should not be removed")
+}
+
+func TestMaxConnectionsPerCell(t *testing.T) {
+	defer func(old int) { *maxConnectionsPerCell = old }(*maxConnectionsPerCell)
+	*maxConnectionsPerCell = 2
+	ts := memorytopo.NewServer("cell", "remote")
+	hc := createTestHc(ts)
+	defer hc.Close()
+
+	newTablet := func(uid uint32, cell string) *topodatapb.Tablet {
+		tablet := topo.NewTablet(uid, cell, "a")
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.PortMap["vt"] = int32(uid)
+		// the masters of the remote cells are included
+		tablet.Type = topodatapb.TabletType_MASTER
+		return tablet
+	}
+	var tablets []*topodatapb.Tablet
+	conns := make(map[uint32]*fakeConn)
+	for uid := uint32(1); uid <= 3; uid++ {
+		tablets = append(tablets, newTablet(uid, "cell"))
+	}
+	for uid := uint32(4); uid <= 7; uid++ {
+		tablets = append(tablets, newTablet(uid, "remote"))
+	}
+	for _, tablet := range tablets {
+		conns[tablet.Alias.Uid] = createFakeConn(tablet, make(chan *querypb.StreamHealthResponse))
+	}
+	resultChan := hc.Subscribe()
+	for _, tablet := range tablets {
+		hc.AddTablet(tablet)
+		<-resultChan
+	}
+
+	streaming := func() map[uint32]bool {
+		res := make(map[uint32]bool)
+		for uid, fc := range conns {
+			fc.mu.Lock()
+			if fc.streams > 0 && !fc.canceled {
+				res[uid] = true
+			}
+			fc.mu.Unlock()
+		}
+		return res
+	}
+	healthUnknown := func() map[uint32]bool {
+		res := make(map[uint32]bool)
+		for _, tcs := range hc.CacheStatus() {
+			for _, th := range tcs.TabletsStats {
+				if th.HealthUnknown {
+					res[th.Tablet.Alias.Uid] = true
+				}
+			}
+		}
+		return res
+	}
+	// the local cell is exempt, only the first two remote tablets are streamed
+	waitForCondition(t, func() bool {
+		return reflect.DeepEqual(streaming(), map[uint32]bool{1: true, 2: true, 3: true, 4: true, 5: true})
+	}, "wrong streams")
+	assert.Equal(t, map[uint32]bool{6: true, 7: true}, healthUnknown())
+
+	// removing a streamed remote tablet frees a slot for the next one
+	hc.RemoveTablet(tablets[3])
+	waitForCondition(t, func() bool {
+		return reflect.DeepEqual(streaming(), map[uint32]bool{1: true, 2: true, 3: true, 5: true, 6: true})
+	}, "wrong streams after removal")
+	assert.Equal(t, map[uint32]bool{7: true}, healthUnknown())
+
+	// a waiting tablet which is removed is not streamed later
+	hc.RemoveTablet(tablets[6])
+	assert.Empty(t, healthUnknown())
+	hc.RemoveTablet(tablets[4])
+	waitForCondition(t, func() bool {
+		return reflect.DeepEqual(streaming(), map[uint32]bool{1: true, 2: true, 3: true, 6: true})
+	}, "wrong streams after removals")
+}
+
+func TestConnectionState(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+
+	// no fake connection is registered for this tablet, so dialing fails
+	noDial := topo.NewTablet(0, "cell", "nodial")
+	noDial.Keyspace = "kstate"
+	noDial.Shard = "s"
+	noDial.PortMap["vt"] = 1
+	noDial.Type = topodatapb.TabletType_REPLICA
+	healthy := topo.NewTablet(1, "cell", "healthy")
+	healthy.Keyspace = "kstate"
+	healthy.Shard = "s"
+	healthy.PortMap["vt"] = 2
+	healthy.Type = topodatapb.TabletType_REPLICA
+	input := make(chan *querypb.StreamHealthResponse)
+	createFakeConn(healthy, input)
+
+	// before any connection attempt
+	assert.Equal(t, ConnectionStateConnecting, (&TabletHealth{Tablet: healthy}).ConnectionState())
+
+	resultChan := hc.Subscribe()
+	hc.AddTablet(healthy)
+	<-resultChan
+	input <- &querypb.StreamHealthResponse{
+		TabletAlias:   healthy.Alias,
+		Target:        &querypb.Target{Keyspace: "kstate", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+	}
+	th := <-resultChan
+	assert.Equal(t, ConnectionStateReady, th.ConnectionState())
+
+	hc.AddTablet(noDial)
+	waitForCondition(t, func() bool {
+		for _, tcs := range hc.CacheStatus() {
+			for _, th := range tcs.TabletsStats {
+				if th.Tablet.Alias.Uid == 0 && th.LastDialError != nil {
+					return true
+				}
+			}
+		}
+		return false
+	}, "the dial failure was not recorded")
+	for _, tcs := range hc.CacheStatus() {
+		for _, th := range tcs.TabletsStats {
+			if th.Tablet.Alias.Uid == 0 {
+				assert.Equal(t, ConnectionStateTransientFailure, th.ConnectionState())
+				assert.Contains(t, string(tcs.StatusAsHTML()), "(Connection: TRANSIENT_FAILURE)")
+			} else {
+				assert.Equal(t, ConnectionStateReady, th.ConnectionState())
+			}
+		}
+	}
+}
+
+func TestHealthCheckConnectionVerifier(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	var mu sync.Mutex
+	verified := 0
+	hc.SetConnectionVerifier(func(tablet *topodatapb.Tablet, conn queryservice.QueryService) error {
+		mu.Lock()
+		defer mu.Unlock()
+		verified++
+		if tablet.Tags["identity"] != "trusted" {
+			return fmt.Errorf("unexpected identity %q", tablet.Tags["identity"])
+		}
+		return nil
+	})
+
+	tablet := topo.NewTablet(0, "cell", "untrusted")
+	tablet.Keyspace = "kverify"
+	tablet.Shard = "s"
+	tablet.PortMap["vt"] = 1
+	tablet.Type = topodatapb.TabletType_REPLICA
+	tablet.Tags = map[string]string{"identity": "impostor"}
+	fc := createFakeConn(tablet, make(chan *querypb.StreamHealthResponse))
+	statsKey := "kverify.s.replica"
+	before := hcDialErrorCounters.Counts()[statsKey]
+	hc.AddTablet(tablet)
+
+	// the connection is closed without being used, and made again later
+	waitForCondition(t, func() bool {
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+		return fc.closes >= 2
+	}, "the rejected connection was not closed and retried")
+	assert.Zero(t, fc.streamCount(), "the health of a rejected connection should not be streamed")
+	assert.GreaterOrEqual(t, hcDialErrorCounters.Counts()[statsKey], before+2, "rejected connections should be counted as dial errors")
+	mu.Lock()
+	assert.GreaterOrEqual(t, verified, 2)
+	mu.Unlock()
+	tcsl := hc.CacheStatus()
+	require.Equal(t, 1, len(tcsl))
+	th := tcsl[0].TabletsStats[0]
+	require.NotNil(t, th.LastDialError)
+	assert.Contains(t, th.LastDialError.Error(), "connection verification failed")
+
+	// once the connection is trusted, the health is streamed
+	hc.SetConnectionVerifier(nil)
+	waitForCondition(t, func() bool {
+		return fc.streamCount() > 0
+	}, "the health of the tablet was not streamed once the verifier was removed")
+}
+
+func TestFailedInitialConnect(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+
+	newTablet := func(uid uint32) *topodatapb.Tablet {
+		tablet := topo.NewTablet(uid, "cell", fmt.Sprintf("connectdeadline%d", uid))
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.PortMap["vt"] = int32(uid)
+		tablet.Type = topodatapb.TabletType_REPLICA
+		return tablet
+	}
+	// the first tablet cannot be dialed, the second one accepts the
+	// stream but does not respond yet, the third one cannot be dialed but
+	// has no deadline
+	unreachable := newTablet(1)
+	hung := newTablet(2)
+	input := make(chan *querypb.StreamHealthResponse)
+	createFakeConn(hung, input)
+	noDeadline := newTablet(3)
+	stats := func(tablet *topodatapb.Tablet) *TabletHealth {
+		for _, th := range hc.GetTabletStats(target) {
+			if topoproto.TabletAliasEqual(th.Tablet.Alias, tablet.Alias) {
+				return th
+			}
+		}
+		require.Fail(t, "tablet not found", "%v", tablet.Alias)
+		return nil
+	}
+
+	const deadline = 500 * time.Millisecond
+	start := time.Now()
+	hc.AddTabletWithConnectDeadline(unreachable, start.Add(deadline))
+	hc.AddTabletWithConnectDeadline(hung, start.Add(deadline))
+	hc.AddTablet(noDeadline)
+	assert.False(t, stats(unreachable).FailedInitialConnect)
+	assert.False(t, stats(hung).FailedInitialConnect)
+
+	for _, tablet := range []*topodatapb.Tablet{unreachable, hung} {
+		waitForCondition(t, func() bool { return stats(tablet).FailedInitialConnect }, "tablet %v not marked", tablet.Alias)
+		assert.True(t, time.Since(start) >= deadline, "tablet %v marked before the deadline", tablet.Alias)
+		th := stats(tablet)
+		assert.True(t, errors.Is(th.LastError, ErrFailedInitialConnect), "want ErrFailedInitialConnect, got %v", th.LastError)
+		assert.Equal(t, vtrpcpb.Code_DEADLINE_EXCEEDED, vterrors.Code(th.LastError))
+		assert.False(t, th.Warming)
+	}
+	assert.Contains(t, stats(unreachable).LastError.Error(), "not found")
+	th := stats(noDeadline)
+	assert.False(t, th.FailedInitialConnect)
+	assert.False(t, errors.Is(th.LastError, ErrFailedInitialConnect), "unexpected error %v", th.LastError)
+
+	// the state is cleared once the tablet responds
+	resultChan := hc.Subscribe()
+	input <- &querypb.StreamHealthResponse{
+		TabletAlias:   hung.Alias,
+		Target:        target,
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1},
+	}
+	waitForCondition(t, func() bool {
+		th := <-resultChan
+		return topoproto.TabletAliasEqual(th.Tablet.Alias, hung.Alias) && th.Serving
+	})
+	th = stats(hung)
+	assert.False(t, th.FailedInitialConnect)
+	assert.Nil(t, th.LastError)
+	assert.Equal(t, 1, len(hc.GetHealthyTabletStats(target)))
+}
+
+func TestWaitForServingTabletsByTarget(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	clock := newFakeClock()
+	hc.clock = clock
+	resultChan := hc.Subscribe()
+
+	var targets []*querypb.Target
+	var tablets []*topodatapb.Tablet
+	var inputs []chan *querypb.StreamHealthResponse
+	for i, shard := range []string{"s1", "s2", "s3"} {
+		targets = append(targets, &querypb.Target{Keyspace: "k", Shard: shard, TabletType: topodatapb.TabletType_REPLICA})
+		tablet := topo.NewTablet(uint32(i+1), "cell", fmt.Sprintf("bytarget%d", i))
+		tablet.Keyspace = "k"
+		tablet.Shard = shard
+		tablet.PortMap["vt"] = int32(i + 1)
+		tablet.Type = topodatapb.TabletType_REPLICA
+		input := make(chan *querypb.StreamHealthResponse)
+		createFakeConn(tablet, input)
+		tablets = append(tablets, tablet)
+		inputs = append(inputs, input)
+	}
+	respond := func(i int, serving bool) {
+		inputs[i] <- &querypb.StreamHealthResponse{
+			TabletAlias:   tablets[i].Alias,
+			Target:        targets[i],
+			Serving:       serving,
+			RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1},
+		}
+		<-resultChan
+	}
+	for i, tablet := range tablets {
+		hc.AddTablet(tablet)
+		<-resultChan
+		// the first tablet is serving right away, the others are not
+		respond(i, i == 0)
+	}
+
+	// the second target becomes serving while waiting, the third never does
+	var mu sync.Mutex
+	var served []*querypb.Target
+	done := make(chan map[*querypb.Target]error)
+	go func() {
+		done <- hc.WaitForServingTabletsByTarget(context.Background(), targets, time.Minute, func(target *querypb.Target) {
+			mu.Lock()
+			defer mu.Unlock()
+			served = append(served, target)
+		})
+	}()
+	waitForCondition(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(served) == 1
+	})
+	respond(1, true)
+	waitForCondition(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(served) == 2
+	})
+	// the third target is given up once the timeout elapsed on the healthcheck clock
+	select {
+	case errs := <-done:
+		t.Fatalf("the wait returned before the timeout: %v", errs)
+	default:
+	}
+	clock.Advance(time.Minute)
+	errs := <-done
+	assert.Equal(t, []*querypb.Target{targets[0], targets[1]}, served)
+	require.Equal(t, 1, len(errs), "unexpected errors: %v", errs)
+	require.Error(t, errs[targets[2]])
+	assert.Equal(t, vtrpcpb.Code_DEADLINE_EXCEEDED, vterrors.Code(errs[targets[2]]))
+	assert.Contains(t, errs[targets[2]].Error(), "k/s3")
+
+	// without a timeout, the targets are waited for until the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	errs = hc.WaitForServingTabletsByTarget(ctx, targets, 0, nil)
+	assert.Equal(t, map[*querypb.Target]error{targets[2]: context.DeadlineExceeded}, errs)
+
+	// the map is empty once all the targets are served
+	respond(2, true)
+	assert.Empty(t, hc.WaitForServingTabletsByTarget(context.Background(), targets, time.Minute, nil))
+}
+
+func TestWaitForTabletCondition(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+	lowLag := func(tablets []*TabletHealth) bool {
+		for _, th := range tablets {
+			if th.Serving && th.Stats != nil && th.Stats.SecondsBehindMaster < 2 {
+				return true
+			}
+		}
+		return false
+	}
+
+	// no tablets yet
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, hc.WaitForTabletCondition(ctx, target, lowLag))
+
+	tablet := topo.NewTablet(0, "cell", "a")
+	tablet.Keyspace = "k"
+	tablet.Shard = "s"
+	tablet.PortMap["vt"] = 1
+	tablet.Type = topodatapb.TabletType_REPLICA
+	input := make(chan *querypb.StreamHealthResponse)
+	createFakeConn(tablet, input)
+	resultChan := hc.Subscribe()
+	hc.AddTablet(tablet)
+	<-resultChan
+
+	// a lagging replica does not satisfy the condition
+	input <- &querypb.StreamHealthResponse{
+		TabletAlias:   tablet.Alias,
+		Target:        target,
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 10, CpuUsage: 0.5},
+	}
+	<-resultChan
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel2()
+	assert.Equal(t, context.DeadlineExceeded, hc.WaitForTabletCondition(ctx2, target, lowLag))
+
+	// it unblocks once the replica catches up
+	done := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- hc.WaitForTabletCondition(ctx, target, lowLag)
+	}()
+	input <- &querypb.StreamHealthResponse{
+		TabletAlias:   tablet.Alias,
+		Target:        target,
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+	}
+	<-resultChan
+	assert.NoError(t, <-done)
+}
+
+func TestIsKeyspaceWatched(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	assert.True(t, hc.IsKeyspaceWatched("ks1"), "all keyspaces should be watched by default")
+	hc.Close()
+
+	KeyspacesToWatch = testKeyspacesToWatch
+	defer func() { KeyspacesToWatch = nil }()
+	hc = createTestHc(ts)
+	defer hc.Close()
+	for _, test := range testFilterByKeyspace {
+		assert.Equal(t, test.expected, hc.IsKeyspaceWatched(test.keyspace), "IsKeyspaceWatched(%v)", test.keyspace)
+	}
+}
+
+func TestReadFallbackOrder(t *testing.T) {
+	defer func() { readFallbackOrder = nil }()
+	assert.Empty(t, ReadFallbackTabletTypes(topodatapb.TabletType_RDONLY), "no fallback by default")
+
+	readFallbackOrder = []topodatapb.TabletType{topodatapb.TabletType_RDONLY, topodatapb.TabletType_BACKUP, topodatapb.TabletType_REPLICA}
+	assert.Equal(t, []topodatapb.TabletType{topodatapb.TabletType_BACKUP, topodatapb.TabletType_REPLICA}, ReadFallbackTabletTypes(topodatapb.TabletType_RDONLY))
+	// the fallback only goes in the configured order
+	assert.Empty(t, ReadFallbackTabletTypes(topodatapb.TabletType_REPLICA), "replica has no type to fall back to")
+	assert.Empty(t, ReadFallbackTabletTypes(topodatapb.TabletType_SPARE), "spare is not in the list")
+	// the master never falls back
+	readFallbackOrder = []topodatapb.TabletType{topodatapb.TabletType_MASTER, topodatapb.TabletType_REPLICA}
+	assert.Empty(t, ReadFallbackTabletTypes(topodatapb.TabletType_MASTER))
+}
+
+func TestServingStateLogJSON(t *testing.T) {
+	defer func(old bool) { *servingStateLogJSON = old }(*servingStateLogJSON)
+	*servingStateLogJSON = true
+	lines := make(chan string, 10)
+	defer func(old func(string)) { servingStateLogger = old }(servingStateLogger)
+	servingStateLogger = func(line string) { lines <- line }
+
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	clock := newFakeClock()
+	hc.clock = clock
+	tablet := topo.NewTablet(0, "cell", "a")
+	tablet.Keyspace = "k"
+	tablet.Shard = "s"
+	tablet.PortMap["vt"] = 1
+	input := make(chan *querypb.StreamHealthResponse)
+	createFakeConn(tablet, input)
+	resultChan := hc.Subscribe()
+	hc.AddTablet(tablet)
+	<-resultChan
+
+	readChange := func() servingStateChange {
+		t.Helper()
+		select {
+		case line := <-lines:
+			var change servingStateChange
+			require.NoError(t, json.Unmarshal([]byte(line), &change), line)
+			assert.Contains(t, line, `"old_serving"`)
+			return change
+		case <-time.After(5 * time.Second):
+			t.Fatal("the serving state change was not logged")
+		}
+		return servingStateChange{}
+	}
+
+	shr := &querypb.StreamHealthResponse{
+		TabletAlias:   tablet.Alias,
+		Target:        &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+	}
+	input <- shr
+	<-resultChan
+	change := readChange()
+	assert.Equal(t, "cell-0000000000", change.Alias)
+	assert.Equal(t, "k", change.Keyspace)
+	assert.Equal(t, "s", change.Shard)
+	assert.Equal(t, "replica", change.TabletType)
+	assert.False(t, change.OldServing)
+	assert.True(t, change.NewServing)
+	assert.Equal(t, "healthCheck update", change.Reason)
+	assert.True(t, clock.Now().Equal(change.Timestamp), "the change should be timestamped by the healthcheck clock, got %v", change.Timestamp)
+
+	// no change, nothing logged
+	input <- shr
+	<-resultChan
+
+	shr = &querypb.StreamHealthResponse{
+		TabletAlias:   tablet.Alias,
+		Target:        &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
+		Serving:       false,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+	}
+	input <- shr
+	<-resultChan
+	change = readChange()
+	assert.True(t, change.OldServing)
+	assert.False(t, change.NewServing)
+	select {
+	case line := <-lines:
+		t.Errorf("unexpected serving state change: %v", line)
+	default:
+	}
+}
+
+func TestAddTabletTwice(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	tablet := topo.NewTablet(0, "cell", "a")
+	tablet.PortMap["vt"] = 1
+	input := make(chan *querypb.StreamHealthResponse)
+	fc := createFakeConn(tablet, input)
+	resultChan := hc.Subscribe()
+
+	before := hcDuplicateAddCounter.Get()
+	hc.AddTablet(tablet)
+	<-resultChan
+	// the same tablet, as read by other watchers of the cell, with a new tag
+	refreshed := proto.Clone(tablet).(*topodatapb.Tablet)
+	refreshed.Tags = map[string]string{"refreshed": "true"}
+	hc.AddTablet(proto.Clone(tablet).(*topodatapb.Tablet))
+	hc.AddTablets([]*topodatapb.Tablet{refreshed})
+	assert.Equal(t, before+2, hcDuplicateAddCounter.Get())
+	// the health check goroutines are counted when they are started
+	assert.Equal(t, 1, hc.ActiveConnections(), "the tablet should be health checked once")
+
+	waitForCondition(t, func() bool {
+		return fc.streamCount() > 0
+	}, "the tablet was not health checked")
+	input <- &querypb.StreamHealthResponse{
+		TabletAlias:   tablet.Alias,
+		Target:        &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+	}
+	th := <-resultChan
+	assert.Equal(t, refreshed.Tags, th.Tablet.Tags, "the tablet record should be refreshed")
+	assert.Equal(t, 1, fc.streamCount(), "the tablet should be health checked once")
+	require.Len(t, hc.CacheStatus(), 1)
+	assert.Len(t, hc.CacheStatus()[0].TabletsStats, 1)
+}
+
+func TestErrorRate(t *testing.T) {
+	hc := &HealthCheckImpl{errorRateDecay: 0.2}
+	thc := &tabletHealthCheck{}
+	for i := 0; i < 100; i++ {
+		thc.recordOutcome(hc, i%2 == 1)
+	}
+	// alternating outcomes converge to 1/(2-decay) after an error, and to
+	// (1-decay)/(2-decay) after a success
+	assert.InDelta(t, 1/1.8, thc.SimpleCopy().ErrorRate, 1e-9)
+	thc.recordOutcome(hc, false)
+	assert.InDelta(t, 0.8/1.8, thc.SimpleCopy().ErrorRate, 1e-9)
+	// only successes decay towards 0
+	for i := 0; i < 100; i++ {
+		thc.recordOutcome(hc, false)
+	}
+	assert.InDelta(t, 0, thc.SimpleCopy().ErrorRate, 1e-9)
+
+	// the health errors reported by the tablet count as errors
+	ts := memorytopo.NewServer("cell")
+	hc = createTestHc(ts)
+	defer hc.Close()
+	tablet := topo.NewTablet(0, "cell", "a")
+	tablet.PortMap["vt"] = 1
+	input := make(chan *querypb.StreamHealthResponse)
+	createFakeConn(tablet, input)
+	resultChan := hc.Subscribe()
+	hc.AddTablet(tablet)
+	<-resultChan
+	shr := &querypb.StreamHealthResponse{
+		TabletAlias:   tablet.Alias,
+		Target:        &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+	}
+	input <- shr
+	th := <-resultChan
+	assert.Equal(t, 0.0, th.ErrorRate)
+	input <- &querypb.StreamHealthResponse{
+		TabletAlias:   tablet.Alias,
+		Target:        &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{HealthError: "some error", SecondsBehindMaster: 1, CpuUsage: 0.5},
+	}
+	th = <-resultChan
+	assert.InDelta(t, *errorRateDecay, th.ErrorRate, 1e-9)
+	assert.InDelta(t, *errorRateDecay, hc.CacheStatus()[0].TabletsStats[0].ErrorRate, 1e-9)
+}
+
+func TestRedials(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	tablet := topo.NewTablet(0, "cell", "a")
+	tablet.PortMap["vt"] = 1
+	input := make(chan *querypb.StreamHealthResponse)
+	fc := createFakeConn(tablet, input)
+	fc.errCh = make(chan error)
+	resultChan := hc.Subscribe()
+	hc.AddTablet(tablet)
+	<-resultChan
+	shr := &querypb.StreamHealthResponse{
+		TabletAlias:   tablet.Alias,
+		Target:        &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+	}
+	input <- shr
+	th := <-resultChan
+	assert.EqualValues(t, 0, th.Redials)
+	counterKey := "k.s.replica"
+	redials := hcRedialCounters.Counts()[counterKey]
+
+	for i := 1; i <= 3; i++ {
+		fc.errCh <- fmt.Errorf("some stream error")
+		th = <-resultChan
+		assert.Error(t, th.LastError)
+		// the stream is retried on a new connection
+		input <- shr
+		th = <-resultChan
+		assert.EqualValues(t, i, th.Redials)
+	}
+	assert.EqualValues(t, 3, hcRedialCounters.Counts()[counterKey]-redials)
+	assert.EqualValues(t, 3, hc.CacheStatus()[0].TabletsStats[0].Redials)
+}
+
+func TestDumpState(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+
+	serving := topo.NewTablet(1, "cell", "a")
+	serving.Keyspace = "k"
+	serving.Shard = "s"
+	serving.PortMap["vt"] = 1
+	serving.Type = topodatapb.TabletType_REPLICA
+	input := make(chan *querypb.StreamHealthResponse)
+	createFakeConn(serving, input)
+	// no fake connection, it can't be dialed
+	down := topo.NewTablet(2, "cell", "b")
+	down.Keyspace = "k"
+	down.Shard = "s"
+	down.PortMap["vt"] = 2
+	down.Type = topodatapb.TabletType_RDONLY
+
+	resultChan := hc.Subscribe()
+	hc.AddTablet(serving)
+	<-resultChan
+	replica := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+	input <- &querypb.StreamHealthResponse{
+		TabletAlias:   serving.Alias,
+		Target:        replica,
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+	}
+	<-resultChan
+	hc.AddTablet(down)
+	<-resultChan
+
+	rdonly := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_RDONLY}
+	dump := hc.DumpState()
+	require.Len(t, dump, 2)
+	replicaKey := string(hc.keyFromTarget(replica))
+	rdonlyKey := string(hc.keyFromTarget(rdonly))
+	require.Len(t, dump[replicaKey], 1)
+	require.Len(t, dump[rdonlyKey], 1)
+	assert.True(t, proto.Equal(serving, dump[replicaKey][0].Tablet))
+	assert.True(t, dump[replicaKey][0].Serving)
+	// the unhealthy tablets are dumped too
+	assert.True(t, proto.Equal(down, dump[rdonlyKey][0].Tablet))
+	assert.False(t, dump[rdonlyKey][0].Serving)
+
+	// the dump is a deep copy
+	dump[replicaKey][0].Serving = false
+	dump[replicaKey][0].Tablet.Hostname = "modified"
+	dump[replicaKey][0].Stats.SecondsBehindMaster = 100
+	dump = hc.DumpState()
+	assert.True(t, dump[replicaKey][0].Serving)
+	assert.Equal(t, "a", dump[replicaKey][0].Tablet.Hostname)
+	assert.Equal(t, uint32(1), dump[replicaKey][0].Stats.SecondsBehindMaster)
+	assert.Equal(t, "a", serving.Hostname)
+}
+
+func TestIsTabletServing(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+
+	tablet := topo.NewTablet(0, "cell", "a")
+	tablet.PortMap["vt"] = 1
+	input := make(chan *querypb.StreamHealthResponse)
+	createFakeConn(tablet, input)
+	resultChan := hc.Subscribe()
+
+	serving, known := hc.IsTabletServing(tablet.Alias)
+	assert.False(t, known, "the tablet is not added yet")
+	assert.False(t, serving)
+
+	hc.AddTablet(tablet)
+	<-resultChan
+	serving, known = hc.IsTabletServing(tablet.Alias)
+	assert.True(t, known)
+	assert.False(t, serving, "no health response yet")
+
+	shr := &querypb.StreamHealthResponse{
+		TabletAlias:   tablet.Alias,
+		Target:        &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+	}
+	input <- shr
+	<-resultChan
+	serving, known = hc.IsTabletServing(tablet.Alias)
+	assert.True(t, known)
+	assert.True(t, serving)
+
+	shr.Serving = false
+	input <- shr
+	<-resultChan
+	serving, known = hc.IsTabletServing(tablet.Alias)
+	assert.True(t, known)
+	assert.False(t, serving)
+
+	serving, known = hc.IsTabletServing(&topodatapb.TabletAlias{Cell: "cell", Uid: 42})
+	assert.False(t, known)
+	assert.False(t, serving)
+}
+
+func TestAllowedTabletTypesByKeyspace(t *testing.T) {
+	defer func(old keyspaceTabletTypes) { allowedTabletTypesByKeyspace = old }(allowedTabletTypesByKeyspace)
+	defer func(old []topodatapb.TabletType) { AllowedTabletTypes = old }(AllowedTabletTypes)
+
+	var types keyspaceTabletTypes
+	require.Error(t, types.Set("ksA"))
+	require.Error(t, types.Set("ksA:bogus"))
+	require.NoError(t, types.Set("ksA:master,replica,rdonly; ksB:master,replica;"))
+	assert.Equal(t, "ksA:master,rdonly,replica;ksB:master,replica", types.String())
+	allowedTabletTypesByKeyspace = types
+	AllowedTabletTypes = []topodatapb.TabletType{topodatapb.TabletType_MASTER}
+
+	assert.True(t, IsTabletTypeAllowed("ksA", topodatapb.TabletType_RDONLY))
+	assert.False(t, IsTabletTypeAllowed("ksB", topodatapb.TabletType_RDONLY))
+	assert.True(t, IsTabletTypeAllowed("ksB", topodatapb.TabletType_REPLICA))
+	// the other keyspaces fall back to the global list
+	assert.Equal(t, AllowedTabletTypes, AllowedTabletTypesForKeyspace("ksC"))
+	assert.False(t, IsTabletTypeAllowed("ksC", topodatapb.TabletType_REPLICA))
+	AllowedTabletTypes = nil
+	assert.True(t, IsTabletTypeAllowed("ksC", topodatapb.TabletType_REPLICA))
+
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	inputs := make(map[uint32]chan *querypb.StreamHealthResponse)
+	newTablet := func(uid uint32, keyspace string, tabletType topodatapb.TabletType) *topodatapb.Tablet {
+		tablet := topo.NewTablet(uid, "cell", "a")
+		tablet.Keyspace = keyspace
+		tablet.Shard = "0"
+		tablet.Type = tabletType
+		tablet.PortMap["vt"] = int32(uid)
+		inputs[uid] = make(chan *querypb.StreamHealthResponse)
+		createFakeConn(tablet, inputs[uid])
+		return tablet
+	}
+	resultChan := hc.Subscribe()
+	hc.AddTablets([]*topodatapb.Tablet{
+		newTablet(1, "ksA", topodatapb.TabletType_RDONLY),
+		newTablet(2, "ksB", topodatapb.TabletType_RDONLY),
+		newTablet(3, "ksC", topodatapb.TabletType_RDONLY),
+	})
+	hc.AddTablet(newTablet(4, "ksB", topodatapb.TabletType_REPLICA))
+
+	_, known := hc.IsTabletServing(&topodatapb.TabletAlias{Cell: "cell", Uid: 1})
+	assert.True(t, known, "rdonly is allowed in ksA")
+	_, known = hc.IsTabletServing(&topodatapb.TabletAlias{Cell: "cell", Uid: 2})
+	assert.False(t, known, "rdonly is not allowed in ksB")
+	_, known = hc.IsTabletServing(&topodatapb.TabletAlias{Cell: "cell", Uid: 3})
+	assert.True(t, known, "ksC is not filtered")
+	_, known = hc.IsTabletServing(&topodatapb.TabletAlias{Cell: "cell", Uid: 4})
+	assert.True(t, known, "replica is allowed in ksB")
+
+	assert.Nil(t, hc.GetHealthyTabletStats(&querypb.Target{Keyspace: "ksB", Shard: "0", TabletType: topodatapb.TabletType_RDONLY}))
+
+	// the global list is only enforced when routing
+	AllowedTabletTypes = []topodatapb.TabletType{topodatapb.TabletType_MASTER}
+	ksC := &querypb.Target{Keyspace: "ksC", Shard: "0", TabletType: topodatapb.TabletType_RDONLY}
+	inputs[3] <- &querypb.StreamHealthResponse{
+		TabletAlias:   &topodatapb.TabletAlias{Cell: "cell", Uid: 3},
+		Target:        ksC,
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+	}
+	waitForCondition(t, func() bool {
+		select {
+		case <-resultChan:
+		default:
+		}
+		return len(hc.GetHealthyTabletStats(ksC)) == 1
+	}, "the healthy rdonly of ksC should be returned")
+}
+
+// TestAllowedTabletTypesByKeyspaceTypeChange checks that a tablet rejected
+// because of its type is added once its type is allowed, even if the
+// watcher doesn't refresh the known tablets.
+func TestAllowedTabletTypesByKeyspaceTypeChange(t *testing.T) {
+	defer func(old keyspaceTabletTypes) { allowedTabletTypesByKeyspace = old }(allowedTabletTypesByKeyspace)
+	allowedTabletTypesByKeyspace = keyspaceTabletTypes{"ksB": {topodatapb.TabletType_MASTER, topodatapb.TabletType_REPLICA}}
+
+	ctx := context.Background()
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	tablet := topo.NewTablet(1, "cell", "a")
+	tablet.Keyspace = "ksB"
+	tablet.Shard = "0"
+	tablet.Type = topodatapb.TabletType_RDONLY
+	tablet.PortMap["vt"] = 1
+	require.NoError(t, ts.CreateTablet(ctx, tablet))
+	createFakeConn(tablet, make(chan *querypb.StreamHealthResponse))
+
+	tw := NewCellTabletsWatcher(ctx, ts, hc, nil, "cell", time.Hour, false, 5)
+	defer tw.Stop()
+	tw.loadTablets()
+	_, known := hc.IsTabletServing(tablet.Alias)
+	assert.False(t, known, "rdonly is not allowed in ksB")
+
+	_, err := ts.UpdateTabletFields(ctx, tablet.Alias, func(tablet *topodatapb.Tablet) error {
+		tablet.Type = topodatapb.TabletType_REPLICA
+		return nil
+	})
+	require.NoError(t, err)
+	tw.loadTablets()
+	_, known = hc.IsTabletServing(tablet.Alias)
+	assert.True(t, known, "the tablet should be added once it is a replica")
+}
+
+func TestNewTabletFilter(t *testing.T) {
+	filter, err := newTabletFilter(nil, nil, nil)
+	require.NoError(t, err)
+	assert.Nil(t, filter)
+
+	_, err = newTabletFilter(nil, []string{"ks1"}, nil)
+	assert.Error(t, err)
+
+	// -keyspaces_to_watch and -tablet_filters are both applied
+	filter, err = newTabletFilter(NewFilterByKeyspace([]string{"ks1", "ks2"}), []string{"ks1|-80", "ks3|-80"}, nil)
+	require.NoError(t, err)
+	tests := []struct {
+		keyspace string
+		shard    string
+		included bool
+	}{
+		{"ks1", "-40", true},
+		{"ks1", "80-", false},
+		{"ks2", "-40", false},
+		{"ks3", "-40", false},
+	}
+	for _, tt := range tests {
+		tablet := &topodatapb.Tablet{Keyspace: tt.keyspace, Shard: tt.shard}
+		assert.Equal(t, tt.included, filter.IsIncluded(tablet), "%v/%v", tt.keyspace, tt.shard)
+	}
+
+	filter, err = newTabletFilter(NewFilterByKeyspace([]string{"ks1"}), nil, []string{"pool=a"})
+	require.NoError(t, err)
+	assert.True(t, filter.IsIncluded(&topodatapb.Tablet{Keyspace: "ks1", Shard: "0", Tags: map[string]string{"pool": "a"}}))
+	assert.False(t, filter.IsIncluded(&topodatapb.Tablet{Keyspace: "ks1", Shard: "0", Tags: map[string]string{"pool": "b"}}))
+	assert.False(t, filter.IsIncluded(&topodatapb.Tablet{Keyspace: "ks2", Shard: "0", Tags: map[string]string{"pool": "a"}}))
+}
+
+func TestPauseResume(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+
+	tablet := topo.NewTablet(0, "cell", "a")
+	tablet.PortMap["vt"] = 1
+	input := make(chan *querypb.StreamHealthResponse)
+	fc := createFakeConn(tablet, input)
+	fc.errCh = make(chan error)
+	resultChan := hc.Subscribe()
+	hc.AddTablet(tablet)
+	<-resultChan
+
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+	shr := &querypb.StreamHealthResponse{
+		TabletAlias:   tablet.Alias,
+		Target:        target,
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+	}
+	input <- shr
+	<-resultChan
+	require.Len(t, hc.GetHealthyTabletStats(target), 1)
+
+	hc.Pause()
+	notServing := &querypb.StreamHealthResponse{
+		TabletAlias:   tablet.Alias,
+		Target:        target,
+		Serving:       false,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+	}
+	// the second response is only read once the first one was processed
+	input <- notServing
+	input <- notServing
+	select {
+	case th := <-resultChan:
+		t.Fatalf("unexpected update while paused: %v", th)
+	default:
+	}
+	assert.Len(t, hc.GetHealthyTabletStats(target), 1, "the tablet should keep its last known state while paused")
+	serving, _ := hc.IsTabletServing(tablet.Alias)
+	assert.True(t, serving)
+
+	// a stream error neither changes the state nor closes the connection,
+	// the stream is retried on it
+	fc.errCh <- fmt.Errorf("some stream error")
+	waitForCondition(t, func() bool { return fc.streamCount() == 2 }, "the stream was not retried")
+	assert.Empty(t, fc.getCloseReasons(), "the connection should be kept while paused")
+	assert.Len(t, hc.GetHealthyTabletStats(target), 1, "the tablet should keep its last known state while paused")
+	serving, _ = hc.IsTabletServing(tablet.Alias)
+	assert.True(t, serving)
+
+	hc.Resume()
+	input <- notServing
+	<-resultChan
+	assert.Empty(t, hc.GetHealthyTabletStats(target))
+	serving, _ = hc.IsTabletServing(tablet.Alias)
+	assert.False(t, serving)
+}
+
+func TestExplainSelection(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	resultChan := hc.Subscribe()
+
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+	addTablet := func(uid uint32, serving bool, stats *querypb.RealtimeStats) {
+		tablet := topo.NewTablet(uid, "cell", "a")
+		tablet.PortMap["vt"] = int32(uid)
+		input := make(chan *querypb.StreamHealthResponse)
+		createFakeConn(tablet, input)
+		hc.AddTablet(tablet)
+		<-resultChan
+		input <- &querypb.StreamHealthResponse{
+			TabletAlias:   tablet.Alias,
+			Target:        target,
+			Serving:       serving,
+			RealtimeStats: stats,
+		}
+		<-resultChan
+	}
+	addTablet(1, true, &querypb.RealtimeStats{SecondsBehindMaster: 1})
+	addTablet(2, false, &querypb.RealtimeStats{SecondsBehindMaster: 1})
+	addTablet(3, true, &querypb.RealtimeStats{HealthError: "unhealthy"})
+	addTablet(4, true, &querypb.RealtimeStats{SecondsBehindMaster: 1})
+	addTablet(5, true, &querypb.RealtimeStats{SecondsBehindMaster: 10 * 3600})
+	hc.SetTabletDenylist([]*topodatapb.TabletAlias{{Cell: "cell", Uid: 4}})
+
+	want := []TabletSelectionExplanation{
+		{Alias: &topodatapb.TabletAlias{Cell: "cell", Uid: 1}, Included: true, Reason: SelectionReasonIncluded},
+		{Alias: &topodatapb.TabletAlias{Cell: "cell", Uid: 2}, Reason: SelectionReasonNotServing},
+		{Alias: &topodatapb.TabletAlias{Cell: "cell", Uid: 3}, Reason: SelectionReasonError},
+		{Alias: &topodatapb.TabletAlias{Cell: "cell", Uid: 4}, Reason: SelectionReasonDenylisted},
+		{Alias: &topodatapb.TabletAlias{Cell: "cell", Uid: 5}, Reason: SelectionReasonReplicationLag},
+	}
+	got := hc.ExplainSelection(target)
+	require.Len(t, got, len(want))
+	for i := range want {
+		assert.True(t, proto.Equal(want[i].Alias, got[i].Alias), "got %v, want %v", got[i].Alias, want[i].Alias)
+		assert.Equal(t, want[i].Included, got[i].Included, "tablet %v", want[i].Alias)
+		assert.Equal(t, want[i].Reason, got[i].Reason, "tablet %v", want[i].Alias)
+	}
+	assert.Len(t, hc.GetHealthyTabletStats(target), 1)
+
+	assert.Empty(t, hc.ExplainSelection(&querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_RDONLY}))
+}
+
+func TestTargetNormalizer(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	resultChan := hc.Subscribe()
+
+	addTablet := func(uid uint32, keyspace string) {
+		tablet := topo.NewTablet(uid, "cell", "a")
+		tablet.Keyspace = keyspace
+		tablet.Shard = "0"
+		tablet.Type = topodatapb.TabletType_REPLICA
+		tablet.PortMap["vt"] = int32(uid)
+		input := make(chan *querypb.StreamHealthResponse)
+		createFakeConn(tablet, input)
+		hc.AddTablet(tablet)
+		<-resultChan
+		input <- &querypb.StreamHealthResponse{
+			TabletAlias:   tablet.Alias,
+			Target:        &querypb.Target{Keyspace: keyspace, Shard: "0", TabletType: topodatapb.TabletType_REPLICA},
+			Serving:       true,
+			RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1},
+		}
+		<-resultChan
+	}
+	target := func(keyspace string) *querypb.Target {
+		return &querypb.Target{Keyspace: keyspace, Shard: "0", TabletType: topodatapb.TabletType_REPLICA}
+	}
+	// ks1 and ks2 are served by the tablets of both
+	normalizer := func(target *querypb.Target) *querypb.Target {
+		if target.Keyspace != "ks1" && target.Keyspace != "ks2" {
+			return target
+		}
+		res := proto.Clone(target).(*querypb.Target)
+		res.Keyspace = "ks"
+		return res
+	}
+
+	// the tablets known before the normalizer is set are regrouped
+	addTablet(1, "ks1")
+	assert.Len(t, hc.GetHealthyTabletStats(target("ks2")), 0)
+	hc.SetTargetNormalizer(normalizer)
+	assert.Len(t, hc.GetHealthyTabletStats(target("ks2")), 1)
+
+	addTablet(2, "ks2")
+	addTablet(3, "ks3")
+	assert.Len(t, hc.GetHealthyTabletStats(target("ks1")), 2)
+	assert.Len(t, hc.GetHealthyTabletStats(target("ks2")), 2)
+	assert.Len(t, hc.GetHealthyTabletStats(target("ks3")), 1)
+
+	// the removal of a tablet uses the same key
+	hc.RemoveTablet(&topodatapb.Tablet{Alias: &topodatapb.TabletAlias{Cell: "cell", Uid: 2}, Keyspace: "ks2", Shard: "0", Type: topodatapb.TabletType_REPLICA})
+	assert.Len(t, hc.GetTabletStats(target("ks1")), 1)
+
+	hc.SetTargetNormalizer(nil)
+	assert.Len(t, hc.GetHealthyTabletStats(target("ks1")), 1)
+	assert.Len(t, hc.GetHealthyTabletStats(target("ks2")), 0)
+}
+
+func TestCellsToWatch(t *testing.T) {
+	ts := memorytopo.NewServer("cell1", "cell2")
+	ctx := context.Background()
+
+	cells, err := cellsToWatch(ctx, ts, " cell1, bogus,,cell2,cell1,cell 3")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cell1", "cell2"}, cells)
+
+	cells, err = cellsToWatch(ctx, ts, "")
+	require.NoError(t, err)
+	assert.Empty(t, cells)
+
+	_, err = cellsToWatch(ctx, ts, "bogus,other")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "none of the cells to watch")
+
+	// only the valid cells are watched
+	defer func(old string) { *CellsToWatch = old }(*CellsToWatch)
+	*CellsToWatch = "cell2,bogus"
+	hc := NewHealthCheck(ctx, time.Millisecond, time.Hour, ts, "cell1")
+	defer hc.Close()
+	require.Len(t, hc.topoWatchers, 1)
+	assert.Equal(t, "cell2", hc.topoWatchers[0].cell)
+}
+
+func TestWaitForInitialTopology(t *testing.T) {
+	// the cell is empty, the first load still completes
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, hc.WaitForInitialTopology(ctx))
+	assert.Empty(t, hc.CacheStatus())
+
+	// a watcher which has not loaded the topology yet blocks
+	tw := NewCellTabletsWatcher(context.Background(), ts, hc, nil, "cell", time.Hour, true, 5)
+	hc.topoWatchers = append(hc.topoWatchers, tw)
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer shortCancel()
+	assert.Equal(t, context.DeadlineExceeded, hc.WaitForInitialTopology(shortCtx))
+
+	go tw.Start()
+	require.NoError(t, hc.WaitForInitialTopology(ctx))
+}
+
+func TestWithInitialTablets(t *testing.T) {
+	defer func(old string) { *CellsToWatch = old }(*CellsToWatch)
+	*CellsToWatch = "cell"
+	memoryTS, factory := memorytopo.NewServerAndFactory("cell", "other")
+	// the watchers can't list the tablets until release is closed
+	release := make(chan struct{})
+	ts, err := topo.NewWithFactory(&gatedFactory{Factory: factory, release: release}, "", "")
+	require.NoError(t, err)
+	ctx := context.Background()
+	newTablet := func(uid uint32, cell string, port int32) *topodatapb.Tablet {
+		// a host no fake connection is registered for
+		tablet := topo.NewTablet(uid, cell, "seeded")
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.Type = topodatapb.TabletType_REPLICA
+		tablet.PortMap["vt"] = port
+		return tablet
+	}
+	// the same in the snapshot and in topo
+	require.NoError(t, memoryTS.CreateTablet(ctx, newTablet(1, "cell", 1)))
+	// moved since the snapshot
+	require.NoError(t, memoryTS.CreateTablet(ctx, newTablet(2, "cell", 22)))
+	seeded := []*topodatapb.Tablet{
+		newTablet(1, "cell", 1),
+		newTablet(2, "cell", 2),
+		// deleted since the snapshot
+		newTablet(3, "cell", 3),
+		// not watched
+		newTablet(4, "other", 4),
+	}
+
+	hc := NewHealthCheck(ctx, time.Millisecond, time.Hour, ts, "cell", WithInitialTablets(seeded))
+	defer hc.Close()
+	ports := func() map[uint32]int32 {
+		hc.mu.Lock()
+		defer hc.mu.Unlock()
+		res := make(map[uint32]int32)
+		for _, thc := range hc.healthByAlias {
+			res[thc.Tablet.Alias.Uid] = thc.Tablet.PortMap["vt"]
+		}
+		return res
+	}
+	// the tablets are known before the watchers load the topo
+	assert.Equal(t, map[uint32]int32{1: 1, 2: 2, 3: 3}, ports())
+
+	close(release)
+	require.NoError(t, hc.WaitForInitialTopology(ctx))
+	assert.Equal(t, map[uint32]int32{1: 1, 2: 22}, ports())
+}
+
+// gatedFactory is a topo.Factory whose connections block on listing the
+// tablets until release is closed.
+type gatedFactory struct {
+	topo.Factory
+	release chan struct{}
+}
+
+func (f *gatedFactory) Create(cell, serverAddr, root string) (topo.Conn, error) {
+	conn, err := f.Factory.Create(cell, serverAddr, root)
+	if err != nil {
+		return nil, err
+	}
+	return &gatedConn{Conn: conn, release: f.release}, nil
+}
+
+type gatedConn struct {
+	topo.Conn
+	release chan struct{}
+}
+
+func (c *gatedConn) ListDir(ctx context.Context, dirPath string, full bool) ([]topo.DirEntry, error) {
+	if dirPath == topo.TabletsPath {
+		select {
+		case <-c.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return c.Conn.ListDir(ctx, dirPath, full)
+}
+
+func TestWithTopoServerForCell(t *testing.T) {
+	defer func(old string) { *CellsToWatch = old }(*CellsToWatch)
+	*CellsToWatch = "cell1,cell2"
+	ctx := context.Background()
+	newTablet := func(uid uint32, cell string) *topodatapb.Tablet {
+		tablet := topo.NewTablet(uid, cell, "a")
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.Type = topodatapb.TabletType_REPLICA
+		tablet.PortMap["vt"] = int32(uid)
+		return tablet
+	}
+	// the tablets are only in the topo of their own cell, and the topo of
+	// cell1 has a stale record of cell2 which must be ignored
+	globalTS := memorytopo.NewServer("cell1", "cell2")
+	cell1TS := memorytopo.NewServer("cell1", "cell2")
+	require.NoError(t, cell1TS.CreateTablet(ctx, newTablet(1, "cell1")))
+	require.NoError(t, cell1TS.CreateTablet(ctx, newTablet(99, "cell2")))
+	cell2TS := memorytopo.NewServer("cell1", "cell2")
+	require.NoError(t, cell2TS.CreateTablet(ctx, newTablet(2, "cell2")))
+	servers := map[string]*topo.Server{"cell1": cell1TS, "cell2": cell2TS}
+
+	hc := NewHealthCheck(ctx, time.Millisecond, time.Hour, globalTS, "cell1", WithTopoServerForCell(func(cell string) *topo.Server {
+		return servers[cell]
+	}))
+	defer hc.Close()
+	require.Len(t, hc.topoWatchers, 2)
+	for _, tw := range hc.topoWatchers {
+		assert.Same(t, servers[tw.cell], tw.topoServer, "wrong topo server for %v", tw.cell)
+	}
+
+	require.NoError(t, hc.WaitForInitialTopology(ctx))
+	found := make(map[string][]string)
+	for _, tw := range hc.topoWatchers {
+		tw.mu.Lock()
+		for alias := range tw.tablets {
+			found[tw.cell] = append(found[tw.cell], alias)
+		}
+		tw.mu.Unlock()
+	}
+	assert.Equal(t, map[string][]string{"cell1": {"cell1-0000000001"}, "cell2": {"cell2-0000000002"}}, found)
+}
+
+func TestRefreshNow(t *testing.T) {
+	defer func(old string) { *CellsToWatch = old }(*CellsToWatch)
+	*CellsToWatch = "cell"
+	defer func(old time.Duration) { *RefreshInterval = old }(*RefreshInterval)
+	*RefreshInterval = time.Hour
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	require.NoError(t, hc.WaitForInitialTopology(context.Background()))
+
+	tablet := topo.NewTablet(0, "cell", "a")
+	tablet.Keyspace = "k"
+	tablet.Shard = "s"
+	tablet.PortMap["vt"] = 1
+	tablet.Type = topodatapb.TabletType_REPLICA
+	createFakeConn(tablet, make(chan *querypb.StreamHealthResponse))
+	require.NoError(t, ts.CreateTablet(context.Background(), tablet))
+	assert.Empty(t, hc.CacheStatus(), "tablet should not be known before the refresh")
+
+	// concurrent refreshes are fine and all see the new tablet
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, hc.RefreshNow(context.Background()))
+		}()
+	}
+	wg.Wait()
+	tcsl := hc.CacheStatus()
+	require.Equal(t, 1, len(tcsl), "tablet should be known after the refresh")
+	assert.True(t, topoproto.TabletAliasEqual(tablet.Alias, tcsl[0].TabletsStats[0].Tablet.Alias))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, hc.RefreshNow(ctx))
+
+	// once closed, there is no reload anymore
+	hc.Close()
+	assert.Equal(t, context.Canceled, hc.RefreshNow(context.Background()))
+}
+
+func TestTopoWatcherStatus(t *testing.T) {
+	ts := memorytopo.NewServer("cell1", "cell2")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	hc.topoWatchers = []*TopologyWatcher{
+		NewCellTabletsWatcher(context.Background(), ts, hc, nil, "cell1", time.Hour, true, 5),
+		NewCellTabletsWatcher(context.Background(), ts, hc, nil, "cell2", time.Hour, true, 5),
+	}
+
+	// only cell1 has a tablet
+	tablet := topo.NewTablet(0, "cell1", "a")
+	tablet.Keyspace = "k"
+	tablet.Shard = "s"
+	tablet.PortMap["vt"] = 1
+	tablet.Type = topodatapb.TabletType_REPLICA
+	createFakeConn(tablet, make(chan *querypb.StreamHealthResponse))
+	require.NoError(t, ts.CreateTablet(context.Background(), tablet))
+
+	for _, tw := range hc.topoWatchers {
+		go tw.Start()
+		<-tw.firstLoadChan
+	}
+
+	status := hc.TopoWatcherStatus()
+	require.Len(t, status, 2)
+	assert.Equal(t, "cell1", status[0].Cell)
+	assert.Equal(t, 1, status[0].TabletCount)
+	assert.Equal(t, hc.topoWatchers[0].TopoChecksum(), status[0].TopoChecksum)
+	assert.NotZero(t, status[0].TopoChecksum)
+	assert.Equal(t, "cell2", status[1].Cell)
+	assert.Equal(t, 0, status[1].TabletCount)
+	assert.Zero(t, status[1].TopoChecksum)
+	for _, entry := range status {
+		assert.False(t, entry.LastRefresh.IsZero(), "cell %v was never refreshed", entry.Cell)
+		assert.True(t, entry.RefreshLag >= 0 && entry.RefreshLag < time.Hour, "cell %v has a wrong refresh lag: %v", entry.Cell, entry.RefreshLag)
+	}
+
+	// the status is served next to the tablet cache, which stays a list
+	w := httptest.NewRecorder()
+	hc.serveTopoWatchers(w, httptest.NewRequest("GET", "/debug/gateway/topo_watchers", nil))
+	var served []TopoWatcherStatusEntry
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &served))
+	require.Len(t, served, 2)
+	assert.Equal(t, "cell2", served[1].Cell)
+	w = httptest.NewRecorder()
+	hc.ServeHTTP(w, httptest.NewRequest("GET", "/debug/gateway", nil))
+	var tablets []json.RawMessage
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &tablets))
+	assert.NotContains(t, w.Body.String(), `"Cell": "cell2"`)
+}
+
+func TestServeHTTPFilter(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+
+	for i, ks := range []struct{ keyspace, shard string }{{"ks1", "-80"}, {"ks1", "80-"}, {"ks2", "-80"}} {
+		tablet := topo.NewTablet(uint32(i+1), "cell", fmt.Sprintf("filter%d", i))
+		tablet.Keyspace = ks.keyspace
+		tablet.Shard = ks.shard
+		tablet.PortMap["vt"] = 1
+		tablet.Type = topodatapb.TabletType_REPLICA
+		hc.AddTablet(tablet)
+	}
+
+	targets := func(url string) []string {
+		w := httptest.NewRecorder()
+		hc.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var status []struct {
+			Target *querypb.Target
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+		var res []string
+		for _, tcs := range status {
+			res = append(res, tcs.Target.Keyspace+"/"+tcs.Target.Shard)
+		}
+		return res
+	}
+	assert.Equal(t, []string{"ks1/-80", "ks1/80-", "ks2/-80"}, targets("/debug/gateway"))
+	assert.Equal(t, []string{"ks1/-80", "ks1/80-"}, targets("/debug/gateway?keyspace=ks1"))
+	assert.Equal(t, []string{"ks1/-80", "ks2/-80"}, targets("/debug/gateway?shard=-80"))
+	assert.Equal(t, []string{"ks1/-80"}, targets("/debug/gateway?keyspace=ks1&shard=-80"))
+	assert.Empty(t, targets("/debug/gateway?keyspace=ks3"))
+	// the other parameters are ignored
+	assert.Equal(t, []string{"ks1/-80", "ks1/80-"}, targets("/debug/gateway?keyspace=ks1&cell=cell"))
+
+	for _, url := range []string{
+		"/debug/gateway?keyspace=",
+		"/debug/gateway?keyspace=ks1&keyspace=ks2",
+		"/debug/gateway?shard=80-40",
+		"/debug/gateway?shard=-8-0",
+	} {
+		w := httptest.NewRecorder()
+		hc.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, "malformed request %v", url)
+	}
+}
+
+func TestServeHTTPGzip(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	tablet := topo.NewTablet(1, "cell", "gzip")
+	tablet.Keyspace = "k"
+	tablet.Shard = "s"
+	tablet.PortMap["vt"] = 1
+	tablet.Type = topodatapb.TabletType_REPLICA
+	hc.AddTablet(tablet)
+	// don't let the dial errors change the cache between the requests
+	hc.Pause()
+
+	serve := func(acceptEncoding string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/debug/gateway", nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		hc.ServeHTTP(w, r)
+		return w
+	}
+	plain := serve("")
+	assert.Empty(t, plain.Header().Get("Content-Encoding"))
+	assert.Contains(t, plain.Body.String(), `"keyspace": "k"`)
+
+	compressed := serve("deflate, gzip;q=0.8")
+	assert.Equal(t, "gzip", compressed.Header().Get("Content-Encoding"))
+	gz, err := gzip.NewReader(compressed.Body)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, plain.Body.String(), string(body))
+
+	// the clients which refuse gzip get the uncompressed output
+	refused := serve("gzip;q=0, deflate")
+	assert.Empty(t, refused.Header().Get("Content-Encoding"))
+	assert.Equal(t, plain.Body.String(), refused.Body.String())
+}
+
+func TestAddTabletAfterClose(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	hc.Close()
+
+	tablet := topo.NewTablet(0, "cell", "a")
+	tablet.PortMap["vt"] = 1
+	before := hcAddAfterCloseCounter.Get()
+	hc.AddTablet(tablet)
+	assert.Equal(t, before+1, hcAddAfterCloseCounter.Get())
+	hc.AddTablets(createBatchTablets(3))
+	assert.Equal(t, before+4, hcAddAfterCloseCounter.Get())
+	assert.Empty(t, hc.CacheStatus())
+}
+
+func TestGetAllTablets(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	assert.Empty(t, hc.GetAllTablets())
+
+	var tablets []*topodatapb.Tablet
+	for i := 0; i < 3; i++ {
+		tablet := topo.NewTablet(uint32(i), "cell", "a")
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.PortMap["vt"] = int32(i + 1)
+		tablet.Type = topodatapb.TabletType_REPLICA
+		createFakeConn(tablet, make(chan *querypb.StreamHealthResponse))
+		tablets = append(tablets, tablet)
+	}
+	resultChan := hc.Subscribe()
+	for _, tablet := range tablets {
+		hc.AddTablet(tablet)
+		<-resultChan
+	}
+	// no response was received, they are known anyway
+	utils.MustMatch(t, tablets, hc.GetAllTablets(), "wrong tablets")
+
+	// the returned tablets are copies
+	hc.GetAllTablets()[0].Hostname = "modified"
+	assert.Equal(t, "a", hc.GetAllTablets()[0].Hostname)
+
+	hc.RemoveTablet(tablets[1])
+	utils.MustMatch(t, []*topodatapb.Tablet{tablets[0], tablets[2]}, hc.GetAllTablets(), "wrong tablets after removal")
+}
+
+func TestKnownTargets(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	assert.Empty(t, hc.KnownTargets())
+
+	newTablet := func(uid uint32, shard string, tabletType topodatapb.TabletType) *topodatapb.Tablet {
+		tablet := topo.NewTablet(uid, "cell", "a")
+		tablet.Keyspace = "k"
+		tablet.Shard = shard
+		tablet.PortMap["vt"] = int32(uid)
+		tablet.Type = tabletType
+		return tablet
+	}
+	tablets := []*topodatapb.Tablet{
+		newTablet(1, "-80", topodatapb.TabletType_MASTER),
+		newTablet(2, "-80", topodatapb.TabletType_REPLICA),
+		newTablet(3, "-80", topodatapb.TabletType_REPLICA),
+		newTablet(4, "80-", topodatapb.TabletType_REPLICA),
+		newTablet(5, "80-", topodatapb.TabletType_RDONLY),
+	}
+	resultChan := hc.Subscribe()
+	for _, tablet := range tablets {
+		createFakeConn(tablet, make(chan *querypb.StreamHealthResponse))
+	}
+	for _, tablet := range tablets {
+		hc.AddTablet(tablet)
+		<-resultChan
+	}
+	utils.MustMatch(t, []*querypb.Target{
+		{Keyspace: "k", Shard: "-80", TabletType: topodatapb.TabletType_MASTER},
+		{Keyspace: "k", Shard: "-80", TabletType: topodatapb.TabletType_REPLICA},
+		{Keyspace: "k", Shard: "80-", TabletType: topodatapb.TabletType_RDONLY},
+		{Keyspace: "k", Shard: "80-", TabletType: topodatapb.TabletType_REPLICA},
+	}, hc.KnownTargets(), "wrong targets")
+
+	// the targets without tablets are not known anymore
+	hc.RemoveTablet(tablets[4])
+	utils.MustMatch(t, []*querypb.Target{
+		{Keyspace: "k", Shard: "-80", TabletType: topodatapb.TabletType_MASTER},
+		{Keyspace: "k", Shard: "-80", TabletType: topodatapb.TabletType_REPLICA},
+		{Keyspace: "k", Shard: "80-", TabletType: topodatapb.TabletType_REPLICA},
+	}, hc.KnownTargets(), "wrong targets after removal")
+}
+
+func TestDisableHealthStream(t *testing.T) {
+	defer func(old bool) { *disableHealthStream = old }(*disableHealthStream)
+	*disableHealthStream = true
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+
+	var tablets []*topodatapb.Tablet
+	for i := 0; i < 3; i++ {
+		tablet := topo.NewTablet(uint32(i), "cell", "a")
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.PortMap["vt"] = int32(i + 1)
+		tablet.Type = topodatapb.TabletType_REPLICA
+		if i == 0 {
+			tablet.Type = topodatapb.TabletType_MASTER
+		}
+		createFakeConn(tablet, make(chan *querypb.StreamHealthResponse))
+		tablets = append(tablets, tablet)
+	}
+	hc.AddTablets(tablets)
+
+	// the tablets are known, and returned with an unknown health
+	utils.MustMatch(t, tablets, hc.GetAllTablets(), "wrong tablets")
+	replicas := hc.GetHealthyTabletStats(&querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA})
+	assert.Len(t, replicas, 2)
+	masters := hc.GetHealthyTabletStats(&querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_MASTER})
+	require.Len(t, masters, 1)
+	assert.Equal(t, uint32(0), masters[0].Tablet.Alias.Uid)
+	assert.False(t, masters[0].Serving)
+	tcsl := hc.CacheStatus()
+	require.Len(t, tcsl, 2)
+	for _, tcs := range tcsl {
+		assert.True(t, tcs.HealthUnknown, "tablets of %v should be marked with an unknown health", tcs.Target)
+		assert.Contains(t, string(tcs.StatusAsHTML()), "(Health Unknown)")
+	}
+
+	// no connection is ever made
+	time.Sleep(50 * time.Millisecond)
+	for _, tablet := range tablets {
+		fc := connMap[TabletToMapKey(tablet)]
+		fc.mu.Lock()
+		assert.Equal(t, 0, fc.streams, "tablet %v should not be health checked", tablet.Alias)
+		fc.mu.Unlock()
+	}
+}
+
+func TestTabletTypeChangeToNewTarget(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+
+	tablet := topo.NewTablet(0, "cell", "a")
+	tablet.Keyspace = "k"
+	tablet.Shard = "s"
+	tablet.PortMap["vt"] = 1
+	tablet.Type = topodatapb.TabletType_REPLICA
+	input := make(chan *querypb.StreamHealthResponse)
+	createFakeConn(tablet, input)
+	resultChan := hc.Subscribe()
+	hc.AddTablet(tablet)
+	<-resultChan
+
+	// no tablet of type RDONLY is known yet
+	rdonlyTarget := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_RDONLY}
+	require.Empty(t, hc.GetTabletStats(rdonlyTarget))
+	input <- &querypb.StreamHealthResponse{
+		TabletAlias:   tablet.Alias,
+		Target:        rdonlyTarget,
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+	}
+	<-resultChan
+
+	replicaTarget := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+	assert.Empty(t, hc.GetTabletStats(replicaTarget))
+	ths := hc.GetTabletStats(rdonlyTarget)
+	require.Len(t, ths, 1)
+	assert.True(t, topoproto.TabletAliasEqual(tablet.Alias, ths[0].Tablet.Alias))
+	assert.Len(t, hc.GetHealthyTabletStats(rdonlyTarget), 1)
+}
+
+func TestHealthErrorGracePeriod(t *testing.T) {
+	defer func(old time.Duration) { *healthErrorGracePeriod = old }(*healthErrorGracePeriod)
+	*healthErrorGracePeriod = time.Minute
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	clock := newFakeClock()
+	hc.clock = clock
+
+	tablet := topo.NewTablet(0, "cell", "a")
+	tablet.Keyspace = "k"
+	tablet.Shard = "s"
+	tablet.PortMap["vt"] = 1
+	tablet.Type = topodatapb.TabletType_REPLICA
+	input := make(chan *querypb.StreamHealthResponse)
+	createFakeConn(tablet, input)
+	resultChan := hc.Subscribe()
+	hc.AddTablet(tablet)
+	<-resultChan
+
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+	send := func(healthError string) *TabletHealth {
+		input <- &querypb.StreamHealthResponse{
+			TabletAlias:   tablet.Alias,
+			Target:        target,
+			Serving:       true,
+			RealtimeStats: &querypb.RealtimeStats{HealthError: healthError, SecondsBehindMaster: 1, CpuUsage: 0.5},
+		}
+		return <-resultChan
+	}
+
+	// a single blip is ignored
+	th := send("")
+	assert.True(t, th.Serving)
+	th = send("schema reload")
+	assert.True(t, th.Serving, "tablet should stay serving during the grace period")
+	assert.NoError(t, th.LastError)
+	th = send("")
+	assert.True(t, th.Serving)
+	assert.Len(t, hc.GetHealthyTabletStats(target), 1)
+
+	// an error which persists for the grace period is not
+	send("broken")
+	clock.Advance(*healthErrorGracePeriod)
+	th = send("broken")
+	assert.False(t, th.Serving, "tablet should not be serving once the grace period is over")
+	assert.EqualError(t, th.LastError, "vttablet error: broken")
+	assert.Empty(t, hc.GetHealthyTabletStats(target))
+}
+
+func TestServingDebounce(t *testing.T) {
+	defer func(old time.Duration) { *servingDebounce = old }(*servingDebounce)
+	*servingDebounce = time.Minute
+	defer func(old string) { *servingDebounceDirection = old }(*servingDebounceDirection)
+
+	for _, direction := range []string{servingDebounceNotServing, servingDebounceServing} {
+		*servingDebounceDirection = direction
+		ts := memorytopo.NewServer("cell")
+		hc := createTestHc(ts)
+		clock := newFakeClock()
+		hc.clock = clock
+
+		tablet := topo.NewTablet(0, "cell", "a")
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.PortMap["vt"] = 1
+		tablet.Type = topodatapb.TabletType_REPLICA
+		input := make(chan *querypb.StreamHealthResponse)
+		createFakeConn(tablet, input)
+		resultChan := hc.Subscribe()
+		hc.AddTablet(tablet)
+		<-resultChan
+
+		target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+		send := func(serving bool) *TabletHealth {
+			input <- &querypb.StreamHealthResponse{
+				TabletAlias:   tablet.Alias,
+				Target:        target,
+				Serving:       serving,
+				RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+			}
+			return <-resultChan
+		}
+		// the debounced state, and the one which takes effect immediately
+		debounced, immediate := false, true
+		if direction == servingDebounceServing {
+			debounced, immediate = true, false
+		}
+
+		// the first response takes effect immediately
+		th := send(immediate)
+		assert.Equal(t, immediate, th.Serving, direction)
+
+		// a blip is ignored, even once the debounce period is over
+		th = send(debounced)
+		assert.Equal(t, immediate, th.Serving, "%v: the blip should be ignored during the debounce period", direction)
+		th = send(immediate)
+		assert.Equal(t, immediate, th.Serving, direction)
+		clock.Advance(time.Minute)
+		assert.Equal(t, immediate, hc.GetTabletStats(target)[0].Serving, direction)
+		if immediate {
+			assert.Len(t, hc.GetHealthyTabletStats(target), 1, "%v: the selection should not be disrupted", direction)
+		}
+
+		// a change which persists for the debounce period takes effect
+		send(debounced)
+		clock.Advance(30 * time.Second)
+		th = send(debounced)
+		assert.Equal(t, immediate, th.Serving, direction)
+		clock.Advance(30 * time.Second)
+		th = <-resultChan
+		assert.Equal(t, debounced, th.Serving, "%v: the change should take effect after the debounce period", direction)
+		assert.Equal(t, debounced, hc.GetTabletStats(target)[0].Serving, direction)
+		if debounced {
+			assert.Len(t, hc.GetHealthyTabletStats(target), 1, direction)
+		} else {
+			assert.Empty(t, hc.GetHealthyTabletStats(target), direction)
+		}
+
+		// and the opposite change takes effect immediately
+		th = send(immediate)
+		assert.Equal(t, immediate, th.Serving, direction)
+		hc.Close()
+	}
+}
+
+func TestGetHealthyTabletStatsReturnsCopies(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+
+	tablet := topo.NewTablet(0, "cell", "a")
+	tablet.Keyspace = "k"
+	tablet.Shard = "s"
+	tablet.PortMap["vt"] = 1
+	tablet.Type = topodatapb.TabletType_REPLICA
+	input := make(chan *querypb.StreamHealthResponse)
+	createFakeConn(tablet, input)
+	resultChan := hc.Subscribe()
+	hc.AddTablet(tablet)
+	<-resultChan
+
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+	shr := &querypb.StreamHealthResponse{
+		TabletAlias:   tablet.Alias,
+		Target:        target,
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+	}
+	input <- shr
+	<-resultChan
+
+	// modifying the returned stats does not affect the healthcheck
+	ths := hc.GetHealthyTabletStats(target)
+	require.Len(t, ths, 1)
+	ths[0].Serving = false
+	ths[0].LastError = errors.New("modified by the caller")
+	ths = hc.GetHealthyTabletStats(target)
+	require.Len(t, ths, 1)
+	assert.True(t, ths[0].Serving)
+	assert.NoError(t, ths[0].LastError)
+
+	// reading the returned stats while the tablet health is updated does not race
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for _, th := range hc.GetHealthyTabletStats(target) {
+				_ = th.Serving
+				_ = th.Stats.CpuUsage
+				_ = th.LastError
+			}
+			for _, tcs := range hc.CacheStatus() {
+				for _, th := range tcs.TabletsStats {
+					_ = th.Serving
+				}
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		input <- shr
+		<-resultChan
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestTabletStateChangeTimes(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	clock := newFakeClock()
+	hc.clock = clock
+
+	tablet := topo.NewTablet(0, "cell", "a")
+	tablet.Keyspace = "k"
+	tablet.Shard = "s"
+	tablet.PortMap["vt"] = 1
+	tablet.Type = topodatapb.TabletType_REPLICA
+	input := make(chan *querypb.StreamHealthResponse)
+	createFakeConn(tablet, input)
+	resultChan := hc.Subscribe()
+	hc.AddTablet(tablet)
+	added := <-resultChan
+	assert.Equal(t, clock.Now(), added.FirstSeen, "FirstSeen should be set when the tablet is added")
+	assert.Equal(t, added.FirstSeen, added.LastStateChange)
+
+	send := func(serving bool) *TabletHealth {
+		// make sure that a change gets a later time
+		clock.Advance(time.Second)
+		input <- &querypb.StreamHealthResponse{
+			TabletAlias:   tablet.Alias,
+			Target:        &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
+			Serving:       serving,
+			RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+		}
+		return <-resultChan
+	}
+
+	th := send(true)
+	assert.Equal(t, added.FirstSeen, th.FirstSeen, "FirstSeen should not change")
+	assert.Equal(t, clock.Now(), th.LastStateChange, "LastStateChange should advance when the tablet starts serving")
+	servingSince := th.LastStateChange
+
+	th = send(true)
+	assert.Equal(t, servingSince, th.LastStateChange, "LastStateChange should not change without a transition")
+
+	th = send(false)
+	assert.Equal(t, added.FirstSeen, th.FirstSeen, "FirstSeen should not change")
+	assert.Equal(t, clock.Now(), th.LastStateChange, "LastStateChange should advance when the tablet stops serving")
+
+	tcsl := hc.CacheStatus()
+	require.Len(t, tcsl, 1)
+	assert.Equal(t, added.FirstSeen, tcsl[0].TabletsStats[0].FirstSeen)
+	assert.Equal(t, th.LastStateChange, tcsl[0].TabletsStats[0].LastStateChange)
+}
+
+func TestMinServingDuration(t *testing.T) {
+	defer func(old time.Duration) { *minServingDuration = old }(*minServingDuration)
+	*minServingDuration = 200 * time.Millisecond
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+	var tablets []*topodatapb.Tablet
+	var inputs []chan *querypb.StreamHealthResponse
+	for i := 0; i < 2; i++ {
+		tablet := topo.NewTablet(uint32(i+1), "cell", fmt.Sprintf("host%v", i+1))
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.PortMap["vt"] = int32(i + 1)
+		tablet.Type = topodatapb.TabletType_REPLICA
+		input := make(chan *querypb.StreamHealthResponse)
+		createFakeConn(tablet, input)
+		tablets = append(tablets, tablet)
+		inputs = append(inputs, input)
+	}
+	resultChan := hc.Subscribe()
+	for _, tablet := range tablets {
+		hc.AddTablet(tablet)
+		<-resultChan
+	}
+	serve := func(i int) {
+		inputs[i] <- &querypb.StreamHealthResponse{
+			TabletAlias:   tablets[i].Alias,
+			Target:        target,
+			Serving:       true,
+			RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+		}
+		<-resultChan
+	}
+	healthyUids := func() []uint32 {
+		var uids []uint32
+		for _, th := range hc.GetHealthyTabletStats(target) {
+			uids = append(uids, th.Tablet.Alias.Uid)
+		}
+		sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+		return uids
+	}
+
+	// the only serving tablet is used, even though it just started serving
+	serve(0)
+	assert.Equal(t, []uint32{1}, healthyUids())
+
+	// once it has been serving long enough, a tablet which just started
+	// serving is not used
+	time.Sleep(*minServingDuration)
+	serve(1)
+	assert.Equal(t, []uint32{1}, healthyUids())
+
+	// until it has been serving long enough too
+	waitForCondition(t, func() bool {
+		return len(healthyUids()) == 2
+	}, "the tablet was not used after serving for the minimum duration")
+}
+
+func TestOnMasterChange(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+
+	type masterChange struct {
+		keyspace, shard string
+		old, new        *topodatapb.Tablet
+	}
+	var mu sync.Mutex
+	var changes []masterChange
+	hc.OnMasterChange(func(keyspace, shard string, old, new *topodatapb.Tablet) {
+		mu.Lock()
+		defer mu.Unlock()
+		changes = append(changes, masterChange{keyspace, shard, old, new})
+	})
+	getChanges := func() []masterChange {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]masterChange(nil), changes...)
+	}
+
+	master := topo.NewTablet(1, "cell", "a")
+	replica := topo.NewTablet(2, "cell", "b")
+	var inputs []chan *querypb.StreamHealthResponse
+	for i, tablet := range []*topodatapb.Tablet{master, replica} {
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.PortMap["vt"] = int32(i + 1)
+		input := make(chan *querypb.StreamHealthResponse)
+		createFakeConn(tablet, input)
+		inputs = append(inputs, input)
+	}
+	master.Type = topodatapb.TabletType_MASTER
+	replica.Type = topodatapb.TabletType_REPLICA
+	response := func(tablet *topodatapb.Tablet, tabletType topodatapb.TabletType, term int64) *querypb.StreamHealthResponse {
+		return &querypb.StreamHealthResponse{
+			TabletAlias:                         tablet.Alias,
+			Target:                              &querypb.Target{Keyspace: "k", Shard: "s", TabletType: tabletType},
+			Serving:                             true,
+			TabletExternallyReparentedTimestamp: term,
+			RealtimeStats:                       &querypb.RealtimeStats{CpuUsage: 0.5},
+		}
+	}
+
+	resultChan := hc.Subscribe()
+	hc.AddTablet(master)
+	<-resultChan
+	hc.AddTablet(replica)
+	<-resultChan
+	inputs[0] <- response(master, topodatapb.TabletType_MASTER, 10)
+	<-resultChan
+	inputs[1] <- response(replica, topodatapb.TabletType_REPLICA, 0)
+	<-resultChan
+	// the first master is not a change
+	assert.Empty(t, getChanges())
+
+	// reparent: the replica becomes the master
+	inputs[1] <- response(replica, topodatapb.TabletType_MASTER, 20)
+	<-resultChan
+	// further updates from either tablet are not changes
+	inputs[1] <- response(replica, topodatapb.TabletType_MASTER, 20)
+	<-resultChan
+	inputs[0] <- response(master, topodatapb.TabletType_MASTER, 10)
+	<-resultChan
+
+	got := getChanges()
+	require.Len(t, got, 1)
+	assert.Equal(t, "k", got[0].keyspace)
+	assert.Equal(t, "s", got[0].shard)
+	assert.True(t, topoproto.TabletAliasEqual(master.Alias, got[0].old.Alias), "wrong old master %v", got[0].old.Alias)
+	assert.True(t, topoproto.TabletAliasEqual(replica.Alias, got[0].new.Alias), "wrong new master %v", got[0].new.Alias)
+}
+
+func TestFreshestMaster(t *testing.T) {
+	newMaster := func(uid uint32) *topodatapb.Tablet {
+		tablet := topo.NewTablet(uid, "cell", "a")
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.PortMap["vt"] = int32(uid)
+		tablet.Type = topodatapb.TabletType_MASTER
+		return tablet
+	}
+	stale := newMaster(1)
+	fresh := newMaster(2)
+	// as fresh as fresh, but with a greater alias
+	tie := newMaster(3)
+	terms := map[uint32]int64{1: 10, 2: 20, 3: 20}
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_MASTER}
+
+	for _, order := range [][]*topodatapb.Tablet{
+		{stale, fresh, tie},
+		{fresh, stale, tie},
+		{tie, fresh, stale},
+		{tie, stale, fresh},
+	} {
+		ts := memorytopo.NewServer("cell")
+		hc := createTestHc(ts)
+		resultChan := hc.Subscribe()
+		inputs := make(map[uint32]chan *querypb.StreamHealthResponse)
+		for _, tablet := range order {
+			input := make(chan *querypb.StreamHealthResponse)
+			createFakeConn(tablet, input)
+			inputs[tablet.Alias.Uid] = input
+		}
+		for _, tablet := range order {
+			hc.AddTablet(tablet)
+			<-resultChan
+		}
+		report := func(tablet *topodatapb.Tablet) {
+			inputs[tablet.Alias.Uid] <- &querypb.StreamHealthResponse{
+				TabletAlias:                         tablet.Alias,
+				Target:                              target,
+				Serving:                             true,
+				TabletExternallyReparentedTimestamp: terms[tablet.Alias.Uid],
+				RealtimeStats:                       &querypb.RealtimeStats{},
+			}
+			<-resultChan
+		}
+		for _, tablet := range order {
+			report(tablet)
+		}
+		// the demoted master is still rejected when it reports again
+		report(stale)
+
+		ths := hc.GetHealthyTabletStats(target)
+		require.Len(t, ths, 1)
+		assert.True(t, topoproto.TabletAliasEqual(fresh.Alias, ths[0].Tablet.Alias), "order %v: got master %v", order, ths[0].Tablet.Alias)
+		assert.EqualValues(t, 20, ths[0].MasterTermStartTime)
+		hc.Close()
+	}
+}
+
+func TestIsMoreRecentMaster(t *testing.T) {
+	master := func(uid uint32, term int64) *TabletHealth {
+		return &TabletHealth{
+			Tablet:              topo.NewTablet(uid, "cell", "a"),
+			MasterTermStartTime: term,
+		}
+	}
+	assert.True(t, IsMoreRecentMaster(master(2, 20), master(1, 10)))
+	assert.False(t, IsMoreRecentMaster(master(1, 10), master(2, 20)))
+	// the same term start time is ordered by alias
+	assert.True(t, IsMoreRecentMaster(master(1, 20), master(2, 20)))
+	assert.False(t, IsMoreRecentMaster(master(2, 20), master(1, 20)))
+}
+
+func TestOnTargetAvailabilityChange(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	clock := newFakeClock()
+	hc.clock = clock
+	hc.availabilityDebounce = time.Second
+
+	type availabilityChange struct {
+		target    *querypb.Target
+		available bool
+	}
+	changes := make(chan availabilityChange, 10)
+	hc.OnTargetAvailabilityChange(func(target *querypb.Target, available bool) {
+		changes <- availabilityChange{target, available}
+	})
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+	expectChange := func(available bool) {
+		t.Helper()
+		select {
+		case change := <-changes:
+			utils.MustMatch(t, target, change.target, "wrong target")
+			assert.Equal(t, available, change.available)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the availability change to %v was not reported", available)
+		}
+	}
+	expectNoChange := func() {
+		t.Helper()
+		select {
+		case change := <-changes:
+			t.Fatalf("unexpected availability change: %v", change)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	var tablets []*topodatapb.Tablet
+	var inputs []chan *querypb.StreamHealthResponse
+	for i := 0; i < 2; i++ {
+		tablet := topo.NewTablet(uint32(i), "cell", "a")
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.PortMap["vt"] = int32(i + 1)
+		tablet.Type = topodatapb.TabletType_REPLICA
+		input := make(chan *querypb.StreamHealthResponse)
+		createFakeConn(tablet, input)
+		tablets = append(tablets, tablet)
+		inputs = append(inputs, input)
+	}
+	resultChan := hc.Subscribe()
+	for _, tablet := range tablets {
+		hc.AddTablet(tablet)
+		<-resultChan
+	}
+	send := func(i int, serving bool) {
+		inputs[i] <- &querypb.StreamHealthResponse{
+			TabletAlias:   tablets[i].Alias,
+			Target:        target,
+			Serving:       serving,
+			RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1},
+		}
+		<-resultChan
+	}
+
+	send(0, true)
+	send(1, true)
+	clock.Advance(time.Second)
+	expectChange(true)
+
+	// draining one replica leaves the target available
+	send(0, false)
+	clock.Advance(time.Second)
+	expectNoChange()
+
+	// a blip of the last one is ignored
+	send(1, false)
+	send(1, true)
+	clock.Advance(time.Second)
+	expectNoChange()
+
+	// but draining all the replicas for longer is not
+	send(1, false)
+	clock.Advance(time.Second)
+	expectChange(false)
+
+	// recovery
+	send(0, true)
+	clock.Advance(time.Second)
+	expectChange(true)
+
+	// removing the last serving replica makes the target unavailable too
+	hc.RemoveTablet(tablets[0])
+	clock.Advance(time.Second)
+	expectChange(false)
+}
+
+func TestHealthCheckStreamDuration(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+
+	tablet := topo.NewTablet(0, "cell", "a")
+	tablet.Keyspace = "kdur"
+	tablet.Shard = "s"
+	tablet.PortMap["vt"] = 1
+	tablet.Type = topodatapb.TabletType_REPLICA
+	input := make(chan *querypb.StreamHealthResponse)
+	fc := createFakeConn(tablet, input)
+	fc.errCh = make(chan error)
+	var countBefore, totalBefore int64
+	if histogram := hcStreamDurations.Histograms()["kdur.s.replica"]; histogram != nil {
+		countBefore, totalBefore = histogram.Count(), histogram.Total()
+	}
+	resultChan := hc.Subscribe()
+	hc.AddTablet(tablet)
+	<-resultChan
+
+	start := time.Now()
+	input <- &querypb.StreamHealthResponse{
+		TabletAlias:   tablet.Alias,
+		Target:        &querypb.Target{Keyspace: "kdur", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+	}
+	<-resultChan
+	// keep the stream up for a while before it fails
+	time.Sleep(50 * time.Millisecond)
+	fc.errCh <- fmt.Errorf("some stream error")
+	<-resultChan
+	elapsed := time.Since(start)
+
+	histogram := hcStreamDurations.Histograms()["kdur.s.replica"]
+	require.NotNil(t, histogram, "stream duration was not recorded")
+	assert.Equal(t, countBefore+1, histogram.Count())
+	duration := time.Duration(histogram.Total() - totalBefore)
+	assert.True(t, duration >= 50*time.Millisecond, "stream duration %v is too short", duration)
+	assert.True(t, duration <= elapsed, "stream duration %v is too long", duration)
+}
+
+func TestEvictionLatency(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	clock := newFakeClock()
+	hc.clock = clock
+
+	tablet := topo.NewTablet(0, "cell", "a")
+	tablet.Keyspace = "kevict"
+	tablet.Shard = "s"
+	tablet.PortMap["vt"] = 1
+	tablet.Type = topodatapb.TabletType_REPLICA
+	input := make(chan *querypb.StreamHealthResponse)
+	createFakeConn(tablet, input)
+	var countBefore, totalBefore int64
+	if histogram := hcEvictionLatencies.Histograms()["kevict.s.replica"]; histogram != nil {
+		countBefore, totalBefore = histogram.Count(), histogram.Total()
+	}
+	resultChan := hc.Subscribe()
+	hc.AddTablet(tablet)
+	<-resultChan
+
+	response := func(serving bool) *querypb.StreamHealthResponse {
+		return &querypb.StreamHealthResponse{
+			TabletAlias:   tablet.Alias,
+			Target:        &querypb.Target{Keyspace: "kevict", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
+			Serving:       serving,
+			RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+		}
+	}
+	input <- response(true)
+	<-resultChan
+	input <- response(false)
+	<-resultChan
+	// the tablet is only removed a while after it stopped serving
+	clock.Advance(time.Minute)
+	hc.RemoveTablet(tablet)
+
+	histogram := hcEvictionLatencies.Histograms()["kevict.s.replica"]
+	require.NotNil(t, histogram, "eviction latency was not recorded")
+	assert.Equal(t, countBefore+1, histogram.Count())
+	assert.Equal(t, time.Minute, time.Duration(histogram.Total()-totalBefore))
+}
+
+func TestNoTabletError(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+
+	// no tablets at all
+	err := vterrors.Wrapf(hc.NoTabletError(target), "target: k.s.replica")
+	assert.True(t, errors.Is(err, ErrNoTablets), "want ErrNoTablets, got %v", err)
+	assert.False(t, errors.Is(err, ErrNoHealthyTablets), "did not want ErrNoHealthyTablets, got %v", err)
+	assert.Equal(t, vtrpcpb.Code_UNAVAILABLE, vterrors.Code(err))
+
+	// one tablet which is not serving yet
+	tablet := topo.NewTablet(0, "cell", "a")
+	tablet.Keyspace = "k"
+	tablet.Shard = "s"
+	tablet.PortMap["vt"] = 1
+	tablet.Type = topodatapb.TabletType_REPLICA
+	input := make(chan *querypb.StreamHealthResponse)
+	createFakeConn(tablet, input)
+	resultChan := hc.Subscribe()
+	hc.AddTablet(tablet)
+	<-resultChan
+
+	assert.Empty(t, hc.GetHealthyTabletStats(target))
+	err = vterrors.Wrapf(hc.NoTabletError(target), "target: k.s.replica")
+	assert.True(t, errors.Is(err, ErrNoHealthyTablets), "want ErrNoHealthyTablets, got %v", err)
+	assert.False(t, errors.Is(err, ErrNoTablets), "did not want ErrNoTablets, got %v", err)
+	assert.Equal(t, vtrpcpb.Code_UNAVAILABLE, vterrors.Code(err))
+}
+
+func TestHealthCheckHTTPPath(t *testing.T) {
+	mux := http.NewServeMux()
+	ts1 := memorytopo.NewServer("cell")
+	hc1 := NewHealthCheck(context.Background(), 1*time.Millisecond, time.Hour, ts1, "cell", WithServeMux(mux), WithHTTPPath("/debug/gateway1"))
+	defer hc1.Close()
+	ts2 := memorytopo.NewServer("cell")
+	hc2 := NewHealthCheck(context.Background(), 1*time.Millisecond, time.Hour, ts2, "cell", WithServeMux(mux), WithHTTPPath("/debug/gateway2"))
+	defer hc2.Close()
+	// registering the same path again must not panic
+	hc3 := NewHealthCheck(context.Background(), 1*time.Millisecond, time.Hour, ts2, "cell", WithServeMux(mux), WithHTTPPath("/debug/gateway2"))
+	defer hc3.Close()
+
+	tablet := topo.NewTablet(0, "cell", "a")
+	tablet.Keyspace = "k"
+	tablet.Shard = "s"
+	tablet.PortMap["vt"] = 1
+	input := make(chan *querypb.StreamHealthResponse)
+	createFakeConn(tablet, input)
+	resultChan := hc1.Subscribe()
+	hc1.AddTablet(tablet)
+	<-resultChan
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	get := func(path string) string {
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+	assert.Contains(t, get("/debug/gateway1"), `"keyspace": "k"`)
+	assert.NotContains(t, get("/debug/gateway2"), `"keyspace": "k"`)
+}
+
+func TestHealthHistory(t *testing.T) {
+	mux := http.NewServeMux()
+	ts := memorytopo.NewServer("cell")
+	clock := newFakeClock()
+	hc := NewHealthCheck(context.Background(), 1*time.Millisecond, time.Hour, ts, "cell", WithServeMux(mux), func(hc *HealthCheckImpl) {
+		hc.clock = clock
+	})
+	defer hc.Close()
+	resultChan := hc.Subscribe()
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+
+	tablet := topo.NewTablet(1, "cell", "history")
+	tablet.Keyspace = "k"
+	tablet.Shard = "s"
+	tablet.PortMap["vt"] = 1
+	tablet.Type = topodatapb.TabletType_REPLICA
+	input := make(chan *querypb.StreamHealthResponse, 1)
+	createFakeConn(tablet, input)
+	hc.AddTablet(tablet)
+	<-resultChan
+	input <- &querypb.StreamHealthResponse{
+		TabletAlias:   tablet.Alias,
+		Target:        target,
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1},
+	}
+	<-resultChan
+	input <- &querypb.StreamHealthResponse{
+		TabletAlias:   tablet.Alias,
+		Target:        target,
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{HealthError: "some error"},
+	}
+	<-resultChan
+	hc.RemoveTablet(tablet)
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/debug/gateway/history")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var events []HealthEvent
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&events))
+
+	// the stream of the removed tablet may still fail after it is removed
+	require.True(t, len(events) >= 5, "not enough events: %v", events)
+	var kinds []string
+	for _, e := range events[:5] {
+		kinds = append(kinds, e.Event)
+		assert.Equal(t, "cell-0000000001", e.Alias)
+		assert.Equal(t, "k", e.Keyspace)
+		assert.Equal(t, "s", e.Shard)
+		assert.Equal(t, "replica", e.TabletType)
+		assert.True(t, e.Timestamp.Equal(clock.Now()), "event %v is not timestamped by the healthcheck clock", e)
+	}
+	assert.Equal(t, []string{HealthEventAdded, HealthEventServing, HealthEventError, HealthEventNotServing, HealthEventRemoved}, kinds)
+	assert.Equal(t, "vttablet error: some error", events[2].Detail)
+
+	// the events older than the retention are dropped
+	clock.Advance(hc.history.retention + time.Minute)
+	for _, e := range hc.history.snapshot() {
+		assert.False(t, e.Timestamp.Equal(events[0].Timestamp), "event older than the retention was kept: %v", e)
+	}
+
+	// and the history is bounded
+	for i := 0; i < maxHealthHistoryEvents+10; i++ {
+		hc.history.record(&tabletHealthCheck{Tablet: tablet, Target: target}, HealthEventError, "error")
+	}
+	assert.Equal(t, maxHealthHistoryEvents, len(hc.history.snapshot()))
+}
+
+func TestAliases(t *testing.T) {
+	ts := memorytopo.NewServer("cell", "cell1", "cell2")
+	hc := createTestHc(ts)
+	defer hc.Close()
+
+	cellsAlias := &topodatapb.CellsAlias{
+		Cells: []string{"cell", "cell1"},
+	}
+	assert.Nil(t, ts.CreateCellsAlias(context.Background(), "region1", cellsAlias), "failed to create cell alias")
+	defer ts.DeleteCellsAlias(context.Background(), "region1")
+	cellsAlias = &topodatapb.CellsAlias{
+		Cells: []string{"cell2"},
+	}
+	assert.Nil(t, ts.CreateCellsAlias(context.Background(), "region2", cellsAlias), "failed to create cell alias")
+	defer ts.DeleteCellsAlias(context.Background(), "region2")
+
+	// add a tablet as replica in diff cell, same region
+	tablet := topo.NewTablet(1, "cell1", "host3")
+	tablet.Keyspace = "k"
+	tablet.Shard = "s"
+	tablet.PortMap["vt"] = 1
+	tablet.Type = topodatapb.TabletType_REPLICA
+	input := make(chan *querypb.StreamHealthResponse)
+	fc := createFakeConn(tablet, input)
+	// create a channel and subscribe to healthcheck
+	resultChan := hc.Subscribe()
+	hc.AddTablet(tablet)
+	// should get a result, but this will hang if cell alias logic is broken
+	// so wait and timeout
+	ticker := time.NewTicker(1 * time.Second)
+	select {
+	case err := <-fc.cbErrCh:
+		require.Fail(t, "Unexpected error: %v", err)
+	case <-resultChan:
+	case <-ticker.C:
+		require.Fail(t, "Timed out waiting for HealthCheck update")
+	}
+
+	shr := &querypb.StreamHealthResponse{
+		TabletAlias:                         tablet.Alias,
+		Target:                              &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
+		Serving:                             true,
+		TabletExternallyReparentedTimestamp: 0,
+		RealtimeStats:                       &querypb.RealtimeStats{SecondsBehindMaster: 10, CpuUsage: 0.2},
+	}
+	want := []*TabletHealth{{
+		Tablet:              tablet,
+		Target:              &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA},
+		Serving:             true,
+		Stats:               &querypb.RealtimeStats{SecondsBehindMaster: 10, CpuUsage: 0.2},
+		MasterTermStartTime: 0,
+	}}
 
 	input <- shr
 	ticker = time.NewTicker(1 * time.Second)
@@ -705,6 +4621,33 @@ func TestAliases(t *testing.T) {
 	mustMatch(t, want, a, "Wrong TabletHealth data")
 }
 
+func TestTabletHealthStatsAccessors(t *testing.T) {
+	th := &TabletHealth{
+		Tablet: topo.NewTablet(1, "cell", "a"),
+		Stats:  &querypb.RealtimeStats{Qps: 12.5, CpuUsage: 0.75, SecondsBehindMaster: 3},
+	}
+	assert.Equal(t, 12.5, th.QPS())
+	assert.Equal(t, 0.75, th.CPUUsage())
+	assert.Equal(t, 3*time.Second, th.ReplicationLag())
+
+	b, err := json.Marshal(th)
+	require.NoError(t, err)
+	var got map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &got))
+	assert.Equal(t, 12.5, got["QPS"])
+	assert.Equal(t, 0.75, got["CPUUsage"])
+	assert.Equal(t, float64(3*time.Second), got["ReplicationLag"])
+	assert.Contains(t, got, "Tablet", "the fields of TabletHealth should still be marshaled")
+
+	// no stats were received yet
+	th = &TabletHealth{Tablet: topo.NewTablet(1, "cell", "a")}
+	assert.Equal(t, 0.0, th.QPS())
+	assert.Equal(t, 0.0, th.CPUUsage())
+	assert.Equal(t, time.Duration(0), th.ReplicationLag())
+	_, err = json.Marshal(th)
+	require.NoError(t, err)
+}
+
 func TestTemplate(t *testing.T) {
 	tablet := topo.NewTablet(0, "cell", "a")
 	ts := []*TabletHealth{
@@ -758,6 +4701,89 @@ func TestDebugURLFormatting(t *testing.T) {
 	require.Contains(t, wr.String(), expectedURL, "output missing formatted URL")
 }
 
+func TestDebugURLIPv6(t *testing.T) {
+	defer func(old string) {
+		*TabletURLTemplateString = old
+		ParseTabletURLTemplateFromFlag()
+	}(*TabletURLTemplateString)
+
+	tablet := topo.NewTablet(0, "cell", "2001:db8::1")
+	tablet.PortMap["vt"] = 15000
+	tablet.MysqlPort = 3306
+	tablet.Tags = map[string]string{"debug_port": "8080"}
+	th := &TabletHealth{Tablet: tablet}
+
+	tests := []struct {
+		template string
+		want     string
+	}{{
+		template: "http://{{.GetTabletHostPort}}/debug/status",
+		want:     "http://[2001:db8::1]:15000/debug/status",
+	}, {
+		template: "mysql://{{.GetMysqlHostPort}}",
+		want:     "mysql://[2001:db8::1]:3306",
+	}, {
+		template: `http://{{.GetTagHostPort "debug_port"}}/debug/vars`,
+		want:     "http://[2001:db8::1]:8080/debug/vars",
+	}, {
+		// falls back to the vt port
+		template: `http://{{.GetTagHostPort "missing"}}`,
+		want:     "http://[2001:db8::1]:15000",
+	}}
+	for _, tt := range tests {
+		*TabletURLTemplateString = tt.template
+		ParseTabletURLTemplateFromFlag()
+		got := th.getTabletDebugURL()
+		assert.Equal(t, tt.want, got)
+		u, err := url.Parse(got)
+		require.NoError(t, err, got)
+		assert.Equal(t, "2001:db8::1", u.Hostname())
+	}
+
+	// an address which is already bracketed is not bracketed again
+	tablet.Hostname = "[2001:db8::1]"
+	assert.Equal(t, "[2001:db8::1]:15000", th.GetTabletHostPort())
+}
+
+func TestReloadTabletURLTemplate(t *testing.T) {
+	defer func(old string) {
+		*TabletURLTemplateString = old
+		ParseTabletURLTemplateFromFlag()
+	}(*TabletURLTemplateString)
+
+	tablet := topo.NewTablet(0, "cell", "host.dc.domain")
+	tablet.PortMap["vt"] = 15000
+	th := &TabletHealth{Tablet: tablet}
+	*TabletURLTemplateString = "http://{{.GetTabletHostPort}}"
+	require.NoError(t, ReloadTabletURLTemplate())
+	assert.Equal(t, "http://host.dc.domain:15000", th.getTabletDebugURL())
+
+	// the URLs are rendered while the template is reloaded
+	done := make(chan struct{})
+	rendered := make(chan struct{})
+	go func() {
+		defer close(rendered)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				th.getTabletDebugURL()
+			}
+		}
+	}()
+	*TabletURLTemplateString = "https://{{.GetHostNameLevel 0}}.bastion.corp/debug/status"
+	require.NoError(t, ReloadTabletURLTemplate())
+	close(done)
+	<-rendered
+	assert.Equal(t, "https://host.bastion.corp/debug/status", th.getTabletDebugURL())
+
+	// an invalid template is not used
+	*TabletURLTemplateString = "http://{{.GetTabletHostPort"
+	assert.Error(t, ReloadTabletURLTemplate())
+	assert.Equal(t, "https://host.bastion.corp/debug/status", th.getTabletDebugURL())
+}
+
 func tabletDialer(tablet *topodatapb.Tablet, _ grpcclient.FailFast) (queryservice.QueryService, error) {
 	key := TabletToMapKey(tablet)
 	if qs, ok := connMap[key]; ok {
@@ -766,6 +4792,21 @@ func tabletDialer(tablet *topodatapb.Tablet, _ grpcclient.FailFast) (queryservic
 	return nil, fmt.Errorf("tablet %v not found", key)
 }
 
+// waitForCondition polls cond until it returns true, and fails the test
+// if it doesn't within 10 seconds.
+func waitForCondition(t *testing.T, cond func() bool, msgAndArgs ...interface{}) {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for !cond() {
+		select {
+		case <-timeout:
+			assert.Fail(t, "condition not met in time", msgAndArgs...)
+			return
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
 func createTestHc(ts *topo.Server) *HealthCheckImpl {
 	return NewHealthCheck(context.Background(), 1*time.Millisecond, time.Hour, ts, "cell")
 }
@@ -775,6 +4816,9 @@ type fakeConn struct {
 	tablet *topodatapb.Tablet
 	// If fixedResult is set, the channels are not used.
 	fixedResult *querypb.StreamHealthResponse
+	// If eofEndsStream is set, the stream of fixedResult ends without error
+	// when the callback returns io.EOF, like the grpc connections do.
+	eofEndsStream bool
 	// hcChan should be an unbuffered channel which holds the tablet's next health response.
 	hcChan chan *querypb.StreamHealthResponse
 	// errCh is either an unbuffered channel which holds the stream error to return, or nil.
@@ -784,6 +4828,12 @@ type fakeConn struct {
 
 	mu       sync.Mutex
 	canceled bool
+	// streams is the number of StreamHealth calls
+	streams int
+	// closes is the number of Close calls
+	closes int
+	// closeReasons are the CloseReason of the Close calls
+	closeReasons []string
 }
 
 func createFakeConn(tablet *topodatapb.Tablet, c chan *querypb.StreamHealthResponse) *fakeConn {
@@ -800,8 +4850,14 @@ func createFakeConn(tablet *topodatapb.Tablet, c chan *querypb.StreamHealthRespo
 
 // StreamHealth implements queryservice.QueryService.
 func (fc *fakeConn) StreamHealth(ctx context.Context, callback func(shr *querypb.StreamHealthResponse) error) error {
+	fc.mu.Lock()
+	fc.streams++
+	fc.mu.Unlock()
 	if fc.fixedResult != nil {
-		return callback(fc.fixedResult)
+		if err := callback(fc.fixedResult); err != io.EOF || !fc.eofEndsStream {
+			return err
+		}
+		return nil
 	}
 	for {
 		select {
@@ -827,12 +4883,33 @@ func (fc *fakeConn) StreamHealth(ctx context.Context, callback func(shr *querypb
 	}
 }
 
+// Close implements queryservice.QueryService.
+func (fc *fakeConn) Close(ctx context.Context) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.closes++
+	fc.closeReasons = append(fc.closeReasons, CloseReason(ctx))
+	return nil
+}
+
+func (fc *fakeConn) getCloseReasons() []string {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return append([]string(nil), fc.closeReasons...)
+}
+
 func (fc *fakeConn) isCanceled() bool {
 	fc.mu.Lock()
 	defer fc.mu.Unlock()
 	return fc.canceled
 }
 
+func (fc *fakeConn) streamCount() int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.streams
+}
+
 func (fc *fakeConn) resetCanceledFlag() {
 	fc.mu.Lock()
 	defer fc.mu.Unlock()
@@ -856,5 +4933,5 @@ var mustMatch = utils.MustMatchFn(
 	[]interface{}{ // types with unexported fields
 		TabletHealth{},
 	},
-	[]string{".Conn"}, // ignored fields
+	[]string{".Conn", ".FirstSeen", ".LastStateChange"}, // ignored fields
 )
@@ -222,7 +222,7 @@ func (e LegacyTabletStats) NamedStatusURL() string {
 // {{.NamedStatusURL}} -> test-0000000001/debug/status
 func (e LegacyTabletStats) getTabletDebugURL() string {
 	var buffer bytes.Buffer
-	tabletURLTemplate.Execute(&buffer, e)
+	getTabletURLTemplate().Execute(&buffer, e)
 	return buffer.String()
 }
 
@@ -386,9 +386,7 @@ func NewLegacyHealthCheck(retryDelay, healthCheckTimeout time.Duration) LegacyHe
 		healthCheckTimeout: healthCheckTimeout,
 	}
 
-	healthcheckOnce.Do(func() {
-		http.Handle("/debug/gateway", hc)
-	})
+	registerDebugHandler(http.DefaultServeMux, DefaultHealthCheckHTTPPath, hc)
 
 	return hc
 }
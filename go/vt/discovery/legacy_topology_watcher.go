@@ -215,8 +215,15 @@ func (tw *LegacyTopologyWatcher) loadTablets() {
 			// Check if there's a tablet with the same address key but a
 			// different alias. If so, replace it and keep track of the
 			// replaced alias to make sure it isn't removed later.
+			// The address key alone is not enough to identify a replacement:
+			// two different tablets can transiently share a recycled host:port.
+			// So a tablet is only replaced if its alias is no longer listed
+			// in the topo, otherwise both tablets are kept.
 			found := false
 			for _, otherVal := range tw.tablets {
+				if _, stillListed := newTablets[otherVal.alias]; stillListed {
+					continue
+				}
 				if newVal.key == otherVal.key {
 					found = true
 					tw.tr.ReplaceTablet(otherVal.tablet, newVal.tablet, alias)
@@ -412,6 +412,46 @@ func TestLegacyFilterByShard(t *testing.T) {
 	}
 }
 
+func TestLegacyTopologyWatcherSharedAddress(t *testing.T) {
+	ts := memorytopo.NewServer("aa")
+	fhc := NewFakeLegacyHealthCheck()
+	tw := NewLegacyCellTabletsWatcher(context.Background(), ts, fhc, "aa", 10*time.Minute, true, 5)
+	if err := tw.WaitForInitialTopology(); err != nil {
+		t.Fatalf("initial WaitForInitialTopology failed")
+	}
+
+	// Two different tablets which both use host1:123, e.g. because
+	// the address was recycled while the first tablet is still registered.
+	tablet1 := &topodatapb.Tablet{
+		Alias:    &topodatapb.TabletAlias{Cell: "aa", Uid: 1},
+		Hostname: "host1",
+		PortMap:  map[string]int32{"vt": 123},
+		Keyspace: "keyspace",
+		Shard:    "shard",
+	}
+	if err := ts.CreateTablet(context.Background(), tablet1); err != nil {
+		t.Fatalf("CreateTablet failed: %v", err)
+	}
+	tw.loadTablets()
+
+	counts := topologyWatcherOperations.Counts()
+	tablet2 := proto.Clone(tablet1).(*topodatapb.Tablet)
+	tablet2.Alias.Uid = 2
+	if err := ts.CreateTablet(context.Background(), tablet2); err != nil {
+		t.Fatalf("CreateTablet failed: %v", err)
+	}
+	tw.loadTablets()
+	checkLegacyOpCounts(t, tw, counts, map[string]int64{"ListTablets": 1, "GetTablet": 2, "AddTablet": 1})
+
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	for _, alias := range []string{"aa-0000000001", "aa-0000000002"} {
+		if _, ok := tw.tablets[alias]; !ok {
+			t.Errorf("tablet %v was wrongly replaced, tablets: %v", alias, tw.tablets)
+		}
+	}
+}
+
 func TestLegacyFilterByKeyspace(t *testing.T) {
 	hc := NewFakeLegacyHealthCheck()
 	tr := NewLegacyFilterByKeyspace(hc, testKeyspacesToWatch)
@@ -0,0 +1,167 @@
+/*
+Copyright 2020 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"vitess.io/vitess/go/vt/proto/query"
+	"vitess.io/vitess/go/vt/proto/topodata"
+	"vitess.io/vitess/go/vt/topo/topoproto"
+)
+
+// observerBufferSize is the number of updates an ObserverHealthCheck can
+// fall behind its source before updates get dropped.
+const observerBufferSize = 1024
+
+// ObserverHealthCheck is a read-only view of a HealthCheckImpl. It does not
+// open any connection to the tablets: it maintains a mirror of the tablet
+// health by subscribing to the updates of the source HealthCheck.
+//
+// The mirror is only eventually consistent with the source. Updates are
+// applied asynchronously, and they are dropped if the observer falls more
+// than observerBufferSize updates behind, in which case the mirror stays
+// stale for a tablet until its next update. Updates which are not broadcast
+// by the source, like the tablet denylist, are not mirrored.
+type ObserverHealthCheck struct {
+	source  *HealthCheckImpl
+	updates chan *TabletHealth
+	done    chan struct{}
+
+	// mu protects tablets.
+	mu sync.Mutex
+	// tablets is the latest known health of each tablet, by alias
+	tablets map[tabletAliasString]*TabletHealth
+}
+
+// NewObserverHealthCheck returns an ObserverHealthCheck mirroring source.
+// Close must be called to stop observing the source.
+func NewObserverHealthCheck(source *HealthCheckImpl) *ObserverHealthCheck {
+	o := &ObserverHealthCheck{
+		source:  source,
+		updates: source.subscribe(observerBufferSize, true),
+		done:    make(chan struct{}),
+		tablets: make(map[tabletAliasString]*TabletHealth),
+	}
+
+	// Seed the mirror with the current state of the source. We subscribed
+	// first so that no update is missed in between.
+	source.mu.Lock()
+	for _, ths := range source.healthData {
+		for alias, th := range ths {
+			// don't share the TabletHealth of the source
+			o.tablets[alias] = th.deepCopy()
+		}
+	}
+	source.mu.Unlock()
+
+	go o.run()
+	return o
+}
+
+// run applies the updates of the source until the observer or the source is closed.
+func (o *ObserverHealthCheck) run() {
+	for {
+		select {
+		case <-o.done:
+			return
+		case th := <-o.updates:
+			if th == nil {
+				// the source has been closed
+				return
+			}
+			o.apply(th)
+		}
+	}
+}
+
+// apply records a single update in the mirror.
+func (o *ObserverHealthCheck) apply(th *TabletHealth) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	alias := tabletAliasString(topoproto.TabletAliasString(th.Tablet.Alias))
+	if th.Removed {
+		delete(o.tablets, alias)
+		return
+	}
+	o.tablets[alias] = th
+}
+
+// Close stops observing the source.
+func (o *ObserverHealthCheck) Close() {
+	o.source.Unsubscribe(o.updates)
+	close(o.done)
+}
+
+// GetHealthyTabletStats returns the healthy tablets for the target, as known
+// by the mirror. Like HealthCheckImpl.GetHealthyTabletStats, at most one tablet
+// is returned for TabletType_MASTER, the one with the highest MasterTermStartTime.
+// Only the serving tablets without error are returned.
+// The returned array and the TabletHealth in it are owned by the caller.
+func (o *ObserverHealthCheck) GetHealthyTabletStats(target *query.Target) []*TabletHealth {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var all []*TabletHealth
+	for _, th := range o.tablets {
+		if th.Target.Keyspace == target.Keyspace && th.Target.Shard == target.Shard && th.Target.TabletType == target.TabletType {
+			all = append(all, th.Copy())
+		}
+	}
+	if target.TabletType != topodata.TabletType_MASTER {
+		return FilterStatsByReplicationLag(all)
+	}
+	var master *TabletHealth
+	for _, th := range all {
+		if !th.Serving || th.LastError != nil {
+			continue
+		}
+		if master == nil || th.MasterTermStartTime > master.MasterTermStartTime {
+			master = th
+		}
+	}
+	if master == nil {
+		return nil
+	}
+	return []*TabletHealth{master}
+}
+
+// CacheStatus returns a displayable version of the mirror.
+func (o *ObserverHealthCheck) CacheStatus() TabletsCacheStatusList {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	tcsMap := make(map[string]*TabletsCacheStatus)
+	for _, th := range o.tablets {
+		key := fmt.Sprintf("%v.%v.%v.%v", th.Tablet.Alias.Cell, th.Target.Keyspace, th.Target.Shard, th.Target.TabletType.String())
+		tcs, ok := tcsMap[key]
+		if !ok {
+			tcs = &TabletsCacheStatus{
+				Cell:   th.Tablet.Alias.Cell,
+				Target: th.Target,
+			}
+			tcsMap[key] = tcs
+		}
+		tcs.TabletsStats = append(tcs.TabletsStats, th.Copy())
+	}
+	tcsl := make(TabletsCacheStatusList, 0, len(tcsMap))
+	for _, tcs := range tcsMap {
+		tcsl = append(tcsl, tcs)
+	}
+	sort.Sort(tcsl)
+	return tcsl
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2020 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"vitess.io/vitess/go/vt/topo"
+	"vitess.io/vitess/go/vt/topo/memorytopo"
+
+	querypb "vitess.io/vitess/go/vt/proto/query"
+	topodatapb "vitess.io/vitess/go/vt/proto/topodata"
+)
+
+func TestObserverHealthCheck(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+
+	tablet1 := topo.NewTablet(1, "cell", "a")
+	tablet1.Keyspace = "k"
+	tablet1.Shard = "s"
+	tablet1.PortMap["vt"] = 1
+	tablet1.Type = topodatapb.TabletType_REPLICA
+	input1 := make(chan *querypb.StreamHealthResponse)
+	createFakeConn(tablet1, input1)
+	tablet2 := topo.NewTablet(2, "cell", "b")
+	tablet2.Keyspace = "k"
+	tablet2.Shard = "s"
+	tablet2.PortMap["vt"] = 2
+	tablet2.Type = topodatapb.TabletType_REPLICA
+	input2 := make(chan *querypb.StreamHealthResponse)
+	createFakeConn(tablet2, input2)
+
+	// a tablet known before the observer is created is part of the mirror
+	resultChan := hc.Subscribe()
+	hc.AddTablet(tablet1)
+	<-resultChan
+
+	observer := NewObserverHealthCheck(hc)
+	defer observer.Close()
+	require.Len(t, observer.CacheStatus(), 1)
+	assert.Empty(t, observer.GetHealthyTabletStats(target))
+
+	// add
+	hc.AddTablet(tablet2)
+	<-resultChan
+	waitForCondition(t, func() bool {
+		tcsl := observer.CacheStatus()
+		return len(tcsl) == 1 && len(tcsl[0].TabletsStats) == 2
+	}, "observer did not mirror the added tablet")
+
+	// serving
+	input2 <- &querypb.StreamHealthResponse{
+		TabletAlias:   tablet2.Alias,
+		Target:        target,
+		Serving:       true,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+	}
+	<-resultChan
+	waitForCondition(t, func() bool {
+		return len(observer.GetHealthyTabletStats(target)) == 1
+	}, "observer did not mirror the serving tablet")
+	mustMatch(t, hc.GetHealthyTabletStats(target), observer.GetHealthyTabletStats(target), "observer and source disagree")
+
+	// the returned tablets are copies, modifying them does not affect the mirror
+	ths := observer.GetHealthyTabletStats(target)
+	ths[0].Serving = false
+	observer.CacheStatus()[0].TabletsStats[0].Serving = false
+	mustMatch(t, hc.GetHealthyTabletStats(target), observer.GetHealthyTabletStats(target), "the caller modified the mirror")
+
+	// not serving
+	input2 <- &querypb.StreamHealthResponse{
+		TabletAlias:   tablet2.Alias,
+		Target:        target,
+		Serving:       false,
+		RealtimeStats: &querypb.RealtimeStats{SecondsBehindMaster: 1, CpuUsage: 0.5},
+	}
+	<-resultChan
+	waitForCondition(t, func() bool {
+		return len(observer.GetHealthyTabletStats(target)) == 0
+	}, "observer did not mirror the non serving tablet")
+
+	// remove
+	hc.RemoveTablet(tablet2)
+	waitForCondition(t, func() bool {
+		tcsl := observer.CacheStatus()
+		return len(tcsl) == 1 && len(tcsl[0].TabletsStats) == 1 && tcsl[0].TabletsStats[0].Tablet.Alias.Uid == 1
+	}, "observer did not mirror the removed tablet")
+}
+
+func TestObserverHealthCheckMaster(t *testing.T) {
+	ts := memorytopo.NewServer("cell")
+	hc := createTestHc(ts)
+	defer hc.Close()
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_MASTER}
+	observer := NewObserverHealthCheck(hc)
+	defer observer.Close()
+
+	newMaster := func(uid uint32) (*topodatapb.Tablet, chan *querypb.StreamHealthResponse) {
+		tablet := topo.NewTablet(uid, "cell", "observedmaster")
+		tablet.Keyspace = "k"
+		tablet.Shard = "s"
+		tablet.PortMap["vt"] = int32(uid)
+		tablet.Type = topodatapb.TabletType_MASTER
+		input := make(chan *querypb.StreamHealthResponse)
+		createFakeConn(tablet, input)
+		return tablet, input
+	}
+	tablet1, input1 := newMaster(1)
+	tablet2, input2 := newMaster(2)
+	resultChan := hc.Subscribe()
+	hc.AddTablet(tablet1)
+	<-resultChan
+	hc.AddTablet(tablet2)
+	<-resultChan
+
+	input1 <- &querypb.StreamHealthResponse{
+		TabletAlias:                         tablet1.Alias,
+		Target:                              target,
+		Serving:                             true,
+		TabletExternallyReparentedTimestamp: 10,
+		RealtimeStats:                       &querypb.RealtimeStats{CpuUsage: 0.5},
+	}
+	<-resultChan
+	// the most recent master is not serving, it must not be returned
+	input2 <- &querypb.StreamHealthResponse{
+		TabletAlias:                         tablet2.Alias,
+		Target:                              target,
+		Serving:                             false,
+		TabletExternallyReparentedTimestamp: 20,
+		RealtimeStats:                       &querypb.RealtimeStats{CpuUsage: 0.5},
+	}
+	<-resultChan
+	waitForCondition(t, func() bool {
+		tcsl := observer.CacheStatus()
+		return len(tcsl) == 1 && len(tcsl[0].TabletsStats) == 2 && tcsl[0].TabletsStats[0].MasterTermStartTime != 0 && tcsl[0].TabletsStats[1].MasterTermStartTime != 0
+	}, "observer did not mirror the masters")
+	ths := observer.GetHealthyTabletStats(target)
+	require.Len(t, ths, 1)
+	assert.EqualValues(t, 1, ths[0].Tablet.Alias.Uid, "the serving master should be returned")
+}
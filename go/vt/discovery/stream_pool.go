@@ -0,0 +1,174 @@
+/*
+Copyright 2020 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// minPollInterval is the shortest -healthcheck_poll_interval, so that the
+// tablets are not flooded with StreamHealth RPCs.
+const minPollInterval = time.Second
+
+// streamPool runs the health checks of all tablets over a bounded number of
+// goroutines, instead of one checkConn goroutine per tablet.
+//
+// Each tablet is polled: a worker opens a health stream, reads a single
+// response and closes the stream, and the tablet is polled again after
+// interval. The latency tradeoff is that a change of the health of a tablet
+// is noticed up to interval later, plus the time it takes for a worker to be
+// available when all of them are busy, instead of as soon as the tablet
+// reports it. The pool must be large enough for all the tablets to be polled
+// within interval, otherwise the polls fall behind.
+type streamPool struct {
+	hc       *HealthCheckImpl
+	interval time.Duration
+	// work hands the tablets which are due to the workers
+	work chan *tabletHealthCheck
+	// wake notifies the scheduler that a tablet was added to the queue
+	wake chan struct{}
+
+	// mu protects queue.
+	mu    sync.Mutex
+	queue pollQueue
+}
+
+// newStreamPool creates a streamPool with the given number of workers,
+// and starts it. It stops when hc is closed.
+func newStreamPool(hc *HealthCheckImpl, workers int, interval time.Duration) *streamPool {
+	p := &streamPool{
+		hc:       hc,
+		interval: interval,
+		work:     make(chan *tabletHealthCheck),
+		wake:     make(chan struct{}, 1),
+	}
+	hc.connsWG.Add(workers + 1)
+	go p.schedule()
+	for i := 0; i < workers; i++ {
+		go p.runWorker()
+	}
+	return p
+}
+
+// add queues thc to be polled at the given time.
+func (p *streamPool) add(thc *tabletHealthCheck, at time.Time) {
+	p.mu.Lock()
+	select {
+	case <-p.hc.closeChan:
+		// the scheduler is gone
+		p.mu.Unlock()
+		thc.finalizeConn(p.hc)
+		return
+	default:
+	}
+	heap.Push(&p.queue, &pollItem{thc: thc, at: at})
+	p.mu.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// schedule hands the tablets to the workers when they are due.
+func (p *streamPool) schedule() {
+	defer p.hc.connsWG.Done()
+	for {
+		var next *tabletHealthCheck
+		wait := p.interval
+		p.mu.Lock()
+		if len(p.queue) > 0 {
+			if d := p.queue[0].at.Sub(p.hc.clock.Now()); d <= 0 {
+				next = heap.Pop(&p.queue).(*pollItem).thc
+			} else {
+				wait = d
+			}
+		}
+		p.mu.Unlock()
+
+		if next != nil {
+			select {
+			case p.work <- next:
+			case <-p.hc.closeChan:
+				next.finalizeConn(p.hc)
+				p.finalizeQueued()
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-p.hc.clock.After(wait):
+		case <-p.wake:
+		case <-p.hc.closeChan:
+			p.finalizeQueued()
+			return
+		}
+	}
+}
+
+// finalizeQueued closes the connections of the tablets left in the queue.
+func (p *streamPool) finalizeQueued() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, item := range p.queue {
+		item.thc.finalizeConn(p.hc)
+	}
+	p.queue = nil
+}
+
+// runWorker polls the tablets handed by the scheduler, until hc is closed.
+func (p *streamPool) runWorker() {
+	defer p.hc.connsWG.Done()
+	for {
+		select {
+		case thc := <-p.work:
+			if thc.ctx.Err() == nil && thc.pollHealth(p.hc) {
+				p.add(thc, p.hc.clock.Now().Add(p.interval))
+				continue
+			}
+			// the tablet was removed
+			thc.finalizeConn(p.hc)
+		case <-p.hc.closeChan:
+			return
+		}
+	}
+}
+
+// pollItem is a tablet waiting in the queue of a streamPool.
+type pollItem struct {
+	thc *tabletHealthCheck
+	at  time.Time
+}
+
+// pollQueue is a heap of pollItem, ordered by the time they are due.
+type pollQueue []*pollItem
+
+func (q pollQueue) Len() int            { return len(q) }
+func (q pollQueue) Less(i, j int) bool  { return q[i].at.Before(q[j].at) }
+func (q pollQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *pollQueue) Push(x interface{}) { *q = append(*q, x.(*pollItem)) }
+
+func (q *pollQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return item
+}
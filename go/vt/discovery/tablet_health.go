@@ -18,7 +18,10 @@ package discovery
 
 import (
 	"bytes"
+	"encoding/json"
+	"strconv"
 	"strings"
+	"time"
 
 	"vitess.io/vitess/go/vt/vttablet/queryservice"
 
@@ -26,6 +29,9 @@ import (
 	"vitess.io/vitess/go/netutil"
 	"vitess.io/vitess/go/vt/proto/query"
 	"vitess.io/vitess/go/vt/proto/topodata"
+	"vitess.io/vitess/go/vt/proto/vtrpc"
+	"vitess.io/vitess/go/vt/topo/topoproto"
+	"vitess.io/vitess/go/vt/vterrors"
 )
 
 // TabletHealth represents simple tablet health data that is returned to users of healthcheck.
@@ -37,7 +43,45 @@ type TabletHealth struct {
 	Stats               *query.RealtimeStats
 	MasterTermStartTime int64
 	LastError           error
+	LastDialError       error
 	Serving             bool
+	// FirstSeen is the time at which the tablet was added to the healthcheck.
+	FirstSeen time.Time
+	// LastStateChange is the time at which Serving last changed,
+	// or FirstSeen if it never changed.
+	LastStateChange time.Time
+	// ErrorRate is the exponential moving average of the health check
+	// errors of the tablet, between 0 (no error) and 1 (only errors).
+	ErrorRate float64
+	// ErrorCategory is the category of LastError, one of the ErrorCategory*
+	// constants, or empty if there is no error.
+	ErrorCategory string
+	// Redials is the number of times the connection to the tablet was made
+	// again after the previous one was closed on error.
+	Redials int64
+	// Warming is set while the health check of the tablet waits for its
+	// first response, unless it failed: the tablet is connecting, not down.
+	Warming bool
+	// HealthUnknown is set while the health of the tablet is not checked,
+	// because -max_connections_per_cell is reached for its cell.
+	HealthUnknown bool
+	// Draining is set while the tablet reports DrainingHealthError.
+	Draining bool
+	// Degraded is set while the tablet reports another health error, with
+	// -healthcheck_health_error_as_degraded: it is still serving, but only
+	// used if no other tablet of its target is healthy.
+	Degraded bool
+	// FailedInitialConnect is set if the tablet sent no health check
+	// response by the deadline given to AddTabletWithConnectDeadline, until
+	// it sends one. LastError is then an ErrFailedInitialConnect error.
+	FailedInitialConnect bool
+	// Removed is only set on the update broadcast when the tablet is
+	// removed from the healthcheck, to the internal subscribers which
+	// asked for it. Subscribe never returns such updates.
+	Removed bool
+	// Stale is only set by the gateway on a tablet it returns for routing
+	// although it is not healthy, see -allow_stale_reads_when_unhealthy.
+	Stale bool
 }
 
 // DeepEqual compares two TabletHealth. Since we include protos, we
@@ -52,11 +96,179 @@ func (th *TabletHealth) DeepEqual(other *TabletHealth) bool {
 			(th.LastError != nil && other.LastError != nil && th.LastError.Error() == other.LastError.Error()))
 }
 
+// Copy returns a copy of th, so that the caller can modify it without
+// affecting the healthcheck. Like SimpleCopy, this is not a deep copy:
+// the protos are shared because they are never changed after creation.
+func (th *TabletHealth) Copy() *TabletHealth {
+	res := *th
+	return &res
+}
+
+// deepCopy returns a copy of th which shares nothing with it but the
+// connection and the errors.
+func (th *TabletHealth) deepCopy() *TabletHealth {
+	res := th.Copy()
+	res.Tablet = proto.Clone(th.Tablet).(*topodata.Tablet)
+	res.Target = proto.Clone(th.Target).(*query.Target)
+	if th.Stats != nil {
+		res.Stats = proto.Clone(th.Stats).(*query.RealtimeStats)
+	}
+	return res
+}
+
+// IsMoreRecentMaster returns true if a became master after b, according to
+// the MasterTermStartTime they reported. Of two masters which reported the
+// same time, the one with the smallest alias is the most recent, so that
+// the same one is always chosen.
+func IsMoreRecentMaster(a, b *TabletHealth) bool {
+	if a.MasterTermStartTime != b.MasterTermStartTime {
+		return a.MasterTermStartTime > b.MasterTermStartTime
+	}
+	return topoproto.TabletAliasString(a.Tablet.Alias) < topoproto.TabletAliasString(b.Tablet.Alias)
+}
+
+// The categories of the health check errors, see TabletHealth.ErrorCategory.
+const (
+	// ErrorCategoryNetwork is for the errors dialing the tablet or
+	// reaching it, including the health check timeouts.
+	ErrorCategoryNetwork = "network"
+	// ErrorCategoryCanceled is for the streams canceled by the healthcheck.
+	ErrorCategoryCanceled = "canceled"
+	// ErrorCategoryApplication is for the health errors reported by the
+	// tablet and the other errors returned by it.
+	ErrorCategoryApplication = "application"
+	// ErrorCategoryAuth is for the authentication and permission errors.
+	ErrorCategoryAuth = "auth"
+)
+
+// errorCategory returns the category of a health check error from its vtrpc
+// code, or the empty string if err is nil. dial is true if the error was
+// returned by dialing the tablet.
+func errorCategory(err error, dial bool) string {
+	if err == nil {
+		return ""
+	}
+	switch code := vterrors.Code(err); {
+	case code == vtrpc.Code_CANCELED:
+		return ErrorCategoryCanceled
+	case code == vtrpc.Code_UNAUTHENTICATED || code == vtrpc.Code_PERMISSION_DENIED:
+		return ErrorCategoryAuth
+	case dial || code == vtrpc.Code_UNAVAILABLE || code == vtrpc.Code_DEADLINE_EXCEEDED:
+		return ErrorCategoryNetwork
+	default:
+		return ErrorCategoryApplication
+	}
+}
+
+// QPS returns the queries per second reported by the tablet, or 0 if unknown.
+func (th *TabletHealth) QPS() float64 {
+	if th.Stats == nil {
+		return 0
+	}
+	return th.Stats.Qps
+}
+
+// CPUUsage returns the CPU usage reported by the tablet, or 0 if unknown.
+func (th *TabletHealth) CPUUsage() float64 {
+	if th.Stats == nil {
+		return 0
+	}
+	return th.Stats.CpuUsage
+}
+
+// ReplicationLag returns the replication lag reported by the tablet, or 0 if unknown.
+func (th *TabletHealth) ReplicationLag() time.Duration {
+	if th.Stats == nil {
+		return 0
+	}
+	return time.Duration(th.Stats.SecondsBehindMaster) * time.Second
+}
+
+// The connection states reported by ConnectionState, named like the
+// states of a gRPC channel.
+const (
+	ConnectionStateReady            = "READY"
+	ConnectionStateConnecting       = "CONNECTING"
+	ConnectionStateTransientFailure = "TRANSIENT_FAILURE"
+)
+
+// connectivityStater is implemented by the connections which can report
+// the state of their underlying channel, like the gRPC ones.
+type connectivityStater interface {
+	ConnectivityState() string
+}
+
+// ConnectionState returns the state of the connection to the tablet. If the
+// connection doesn't report it, a coarse state is inferred from the health
+// check: READY if the tablet is connected, TRANSIENT_FAILURE if dialing it
+// or streaming its health failed, CONNECTING otherwise.
+func (th *TabletHealth) ConnectionState() string {
+	if cs, ok := th.Conn.(connectivityStater); ok {
+		return cs.ConnectivityState()
+	}
+	switch {
+	case th.Conn != nil:
+		return ConnectionStateReady
+	case th.LastDialError != nil || th.LastError != nil:
+		return ConnectionStateTransientFailure
+	default:
+		return ConnectionStateConnecting
+	}
+}
+
+// MarshalJSON adds the values of QPS, CPUUsage, ReplicationLag and
+// ConnectionState to the fields of TabletHealth, so that the readers of
+// the CacheStatus JSON do not have to dig into Stats.
+func (th *TabletHealth) MarshalJSON() ([]byte, error) {
+	// tabletHealth has the fields of TabletHealth but not its methods,
+	// which avoids calling MarshalJSON recursively
+	type tabletHealth TabletHealth
+	return json.Marshal(&struct {
+		*tabletHealth
+		QPS             float64
+		CPUUsage        float64
+		ReplicationLag  time.Duration
+		ConnectionState string
+	}{
+		tabletHealth:    (*tabletHealth)(th),
+		QPS:             th.QPS(),
+		CPUUsage:        th.CPUUsage(),
+		ReplicationLag:  th.ReplicationLag(),
+		ConnectionState: th.ConnectionState(),
+	})
+}
+
 // GetTabletHostPort formats a tablet host port address.
+// IPv6 addresses are bracketed.
 func (th *TabletHealth) GetTabletHostPort() string {
-	hostname := th.Tablet.Hostname
-	vtPort := th.Tablet.PortMap["vt"]
-	return netutil.JoinHostPort(hostname, vtPort)
+	return joinHostPort(th.Tablet.Hostname, th.Tablet.PortMap["vt"])
+}
+
+// GetMysqlHostPort formats the host port address of the MySQL of the tablet.
+// It uses the hostname of the tablet if the MySQL hostname is not set.
+func (th *TabletHealth) GetMysqlHostPort() string {
+	hostname := th.Tablet.MysqlHostname
+	if hostname == "" {
+		hostname = th.Tablet.Hostname
+	}
+	return joinHostPort(hostname, th.Tablet.MysqlPort)
+}
+
+// GetTagHostPort formats a tablet host port address with the port set in
+// the given tag of the tablet, e.g. for a debug port which is not in its
+// port map. It falls back to the vt port if the tag is not a valid port.
+func (th *TabletHealth) GetTagHostPort(tag string) string {
+	port, err := strconv.ParseUint(th.Tablet.Tags[tag], 10, 16)
+	if err != nil {
+		return th.GetTabletHostPort()
+	}
+	return joinHostPort(th.Tablet.Hostname, int32(port))
+}
+
+// joinHostPort is netutil.JoinHostPort, for a host which may already be a
+// bracketed IPv6 address.
+func joinHostPort(host string, port int32) string {
+	return netutil.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), port)
 }
 
 // GetHostNameLevel returns the specified hostname level. If the level does not exist it will pick the closest level.
@@ -86,8 +298,10 @@ func (th *TabletHealth) GetHostNameLevel(level int) string {
 // http://{{.GetTabletHostPort}} -> http://host.dc.domain:22
 // https://{{.Tablet.Hostname}} -> https://host.dc.domain
 // https://{{.GetHostNameLevel 0}}.bastion.corp -> https://host.bastion.corp
+// http://{{.GetTagHostPort "debug_port"}} -> http://host.dc.domain:8080 if the tablet has the tag debug_port:8080
+// http://{{.GetTabletHostPort}} -> http://[2001:db8::1]:22 for a tablet with the hostname 2001:db8::1
 func (th *TabletHealth) getTabletDebugURL() string {
 	var buffer bytes.Buffer
-	tabletURLTemplate.Execute(&buffer, th)
+	getTabletURLTemplate().Execute(&buffer, th)
 	return buffer.String()
 }
@@ -18,7 +18,10 @@ package discovery
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -46,9 +49,11 @@ type tabletHealthCheck struct {
 	// cancelFunc must be called before discarding tabletHealthCheck.
 	// This will ensure that the associated checkConn goroutine will terminate.
 	cancelFunc context.CancelFunc
-	// Tablet is the tablet object that was sent to HealthCheck.AddTablet.
+	// Tablet is the tablet object that was last sent to HealthCheck.AddTablet.
+	// It is only changed with both connMu and the mutex of the healthcheck
+	// locked, see setTablet.
 	Tablet *topodata.Tablet
-	// mutex to protect Conn
+	// mutex to protect Conn and lastResponseTimestamp
 	connMu sync.Mutex
 	// Conn is the connection associated with the tablet.
 	Conn queryservice.QueryService
@@ -68,9 +73,70 @@ type tabletHealthCheck struct {
 	// LastError is the error we last saw when trying to get the
 	// tablet's healthcheck.
 	LastError error
+	// lastDialError is the error we last saw when trying to dial the
+	// tablet. It is cleared once dialing succeeds.
+	lastDialError error
+	// FirstSeen is the time at which the tablet was added to the healthcheck.
+	FirstSeen time.Time
+	// LastStateChange is the time at which Serving last changed,
+	// or FirstSeen if it never changed.
+	LastStateChange time.Time
+	// responseIntervals are the most recent intervals between two health
+	// check responses, used by the adaptive timeout. It is protected by connMu.
+	responseIntervals []time.Duration
+	// errorRate is the exponential moving average of the health check
+	// errors, see recordOutcome. It is protected by connMu.
+	errorRate float64
+	// connected is set once a connection to the tablet was made.
+	// It is protected by connMu.
+	connected bool
+	// redials is the number of connections made after the first one.
+	// It is protected by connMu.
+	redials int64
+	// unhealthySince is the time at which the tablet stopped serving, or
+	// zero if it is serving or never served. It is protected by connMu.
+	unhealthySince time.Time
+	// servingMu serializes the changes of the serving state made by the
+	// health check and by the timers of the pending serving states.
+	servingMu sync.Mutex
+	// warming is set until the first valid health check response of the
+	// tablet is received. It is protected by connMu.
+	warming bool
+	// draining is set while the tablet reports DrainingHealthError.
+	// It is protected by connMu.
+	draining bool
+	// degraded is set while the tablet reports a health error, with
+	// -healthcheck_health_error_as_degraded. It is protected by connMu.
+	degraded bool
+	// healthUnknown is set while the health of the tablet is not checked,
+	// see -max_connections_per_cell. It is protected by connMu.
+	healthUnknown bool
+	// cellConnection is set if the health check of the tablet counts in
+	// -max_connections_per_cell. It is protected by the mutex of the healthcheck.
+	cellConnection bool
+	// pendingServing is the serving state reported by the tablet but not
+	// applied yet, see -healthcheck_serving_debounce. It is protected by servingMu.
+	pendingServing *pendingServingState
+	// connectDeadline is the time by which the tablet must send its first
+	// health check response, or zero, see AddTabletWithConnectDeadline.
+	// initialConnectErr is set if it did not. They are protected by connMu.
+	connectDeadline   time.Time
+	initialConnectErr error
+	// history is the health history of the healthcheck, nil if disabled.
+	history *healthHistory
 	// possibly delete both these
 	loggedServingState    bool
 	lastResponseTimestamp time.Time // timestamp of the last healthcheck response
+	streamStartTime       time.Time // timestamp at which the current StreamHealth stream was started
+	firstHealthErrorTime  time.Time // timestamp of the first of the consecutive responses reporting a health error
+}
+
+// pendingServingState is a serving state reported by a tablet, which is
+// applied once it was reported for -healthcheck_serving_debounce.
+type pendingServingState struct {
+	serving bool
+	// shr is the latest response which reported it
+	shr *query.StreamHealthResponse
 }
 
 // String is defined because we want to print a []*tabletHealthCheck array nicely.
@@ -85,17 +151,133 @@ func (thc *tabletHealthCheck) String() string {
 func (thc *tabletHealthCheck) SimpleCopy() *TabletHealth {
 	thc.connMu.Lock()
 	defer thc.connMu.Unlock()
+	lastError := thc.LastError
+	if thc.initialConnectErr != nil {
+		lastError = thc.initialConnectErr
+	}
 	return &TabletHealth{
 		Conn:                thc.Conn,
 		Tablet:              thc.Tablet,
 		Target:              thc.Target,
 		Stats:               thc.Stats,
-		LastError:           thc.LastError,
+		LastError:           lastError,
+		LastDialError:       thc.lastDialError,
 		MasterTermStartTime: thc.MasterTermStartTime,
 		Serving:             thc.Serving,
+		FirstSeen:           thc.FirstSeen,
+		LastStateChange:     thc.LastStateChange,
+		ErrorRate:           thc.errorRate,
+		ErrorCategory:       errorCategory(lastError, thc.lastDialError != nil),
+		Redials:             thc.redials,
+		Warming:             thc.warming && lastError == nil && !thc.healthUnknown,
+		HealthUnknown:       thc.healthUnknown,
+		Draining:            thc.draining,
+		Degraded:            thc.degraded,
+
+		FailedInitialConnect: thc.initialConnectErr != nil,
 	}
 }
 
+// getTablet returns thc.Tablet, for the callers which hold neither connMu
+// nor the mutex of the healthcheck.
+func (thc *tabletHealthCheck) getTablet() *topodata.Tablet {
+	thc.connMu.Lock()
+	defer thc.connMu.Unlock()
+	return thc.Tablet
+}
+
+// setTablet replaces the tablet record, when the same tablet is added again
+// at the same address. The health check goes on with the same connection.
+// The mutex of the healthcheck must be locked before calling this function.
+func (thc *tabletHealthCheck) setTablet(tablet *topodata.Tablet) {
+	thc.connMu.Lock()
+	defer thc.connMu.Unlock()
+	thc.Tablet = tablet
+}
+
+// getLastResponseTimestamp returns the time at which the last health check
+// response was received, or the zero time if none was received yet.
+func (thc *tabletHealthCheck) getLastResponseTimestamp() time.Time {
+	thc.connMu.Lock()
+	defer thc.connMu.Unlock()
+	return thc.lastResponseTimestamp
+}
+
+// DrainingHealthError is the health error reported by a tablet which is
+// shutting down gracefully. The tablet is not treated as unhealthy, but while
+// it reports it, it is not returned for new queries unless it is a master.
+const DrainingHealthError = "draining"
+
+// adaptiveTimeoutSamples is the number of response intervals over which the
+// adaptive timeout is computed. Fewer intervals than adaptiveTimeoutMinSamples
+// are not enough to tell the interval at which the tablet responds.
+const (
+	adaptiveTimeoutSamples    = 10
+	adaptiveTimeoutMinSamples = 3
+)
+
+// timeout returns how long the health check waits for the next response
+// of the tablet: hc.healthCheckTimeout, or when the adaptive timeout is
+// enabled, a multiple of the median interval between its recent responses.
+func (thc *tabletHealthCheck) timeout(hc *HealthCheckImpl) time.Duration {
+	if hc.adaptiveTimeoutMultiplier <= 0 {
+		return hc.healthCheckTimeout
+	}
+	thc.connMu.Lock()
+	intervals := append([]time.Duration(nil), thc.responseIntervals...)
+	thc.connMu.Unlock()
+	if len(intervals) < adaptiveTimeoutMinSamples {
+		return hc.healthCheckTimeout
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+	timeout := time.Duration(float64(intervals[len(intervals)/2]) * hc.adaptiveTimeoutMultiplier)
+	if timeout < hc.adaptiveTimeoutMin {
+		timeout = hc.adaptiveTimeoutMin
+	}
+	if timeout > hc.adaptiveTimeoutMax {
+		timeout = hc.adaptiveTimeoutMax
+	}
+	return timeout
+}
+
+// isServing returns the current serving state of the tablet.
+func (thc *tabletHealthCheck) isServing() bool {
+	thc.connMu.Lock()
+	defer thc.connMu.Unlock()
+	return thc.Serving
+}
+
+// recordOutcome updates the error rate of the tablet with the outcome of
+// a health check: a valid response or an error.
+func (thc *tabletHealthCheck) recordOutcome(hc *HealthCheckImpl, failed bool) {
+	outcome := 0.0
+	if failed {
+		outcome = 1
+	}
+	thc.connMu.Lock()
+	defer thc.connMu.Unlock()
+	thc.errorRate = hc.errorRateDecay*outcome + (1-hc.errorRateDecay)*thc.errorRate
+}
+
+// servingStateChange is the structured form of a serving state change,
+// logged when -healthcheck_serving_state_log_json is set.
+type servingStateChange struct {
+	Alias      string    `json:"alias"`
+	Keyspace   string    `json:"keyspace"`
+	Shard      string    `json:"shard"`
+	TabletType string    `json:"type"`
+	OldServing bool      `json:"old_serving"`
+	NewServing bool      `json:"new_serving"`
+	Reason     string    `json:"reason"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// servingStateLogger receives the JSON serving state changes.
+// It is a variable so that the tests can capture them.
+var servingStateLogger = func(line string) {
+	log.Info(line)
+}
+
 // setServingState sets the tablet state to the given value.
 //
 // If the state changes, it logs the change so that failures
@@ -103,65 +285,153 @@ func (thc *tabletHealthCheck) SimpleCopy() *TabletHealth {
 // but don't continue to log if the connection stays down.
 //
 // thc.mu must be locked before calling this function
-func (thc *tabletHealthCheck) setServingState(serving bool, reason string) {
+func (thc *tabletHealthCheck) setServingState(hc *HealthCheckImpl, serving bool, reason string) {
 	if !thc.loggedServingState || (serving != thc.Serving) {
 		// Emit the log from a separate goroutine to avoid holding
 		// the th lock while logging is happening
-		go log.Infof("HealthCheckUpdate(Serving State): tablet: %v serving => %v for %v/%v (%v) reason: %s",
-			topotools.TabletIdent(thc.Tablet),
-			serving,
-			thc.Tablet.GetKeyspace(),
-			thc.Tablet.GetShard(),
-			thc.Target.GetTabletType(),
-			reason,
-		)
+		tablet := thc.getTablet()
+		if *servingStateLogJSON {
+			thc.logServingStateJSON(hc, tablet, serving, reason)
+		} else {
+			go log.Infof("HealthCheckUpdate(Serving State): tablet: %v serving => %v for %v/%v (%v) reason: %s",
+				topotools.TabletIdent(tablet),
+				serving,
+				tablet.GetKeyspace(),
+				tablet.GetShard(),
+				thc.Target.GetTabletType(),
+				reason,
+			)
+		}
 		thc.loggedServingState = true
 	}
+	thc.connMu.Lock()
+	defer thc.connMu.Unlock()
+	if serving != thc.Serving {
+		thc.LastStateChange = hc.clock.Now()
+		if serving {
+			thc.unhealthySince = time.Time{}
+			thc.history.record(thc, HealthEventServing, reason)
+		} else {
+			thc.unhealthySince = thc.LastStateChange
+			thc.history.record(thc, HealthEventNotServing, reason)
+		}
+	}
 	thc.Serving = serving
 }
 
-// stream streams healthcheck responses to callback.
-func (thc *tabletHealthCheck) stream(ctx context.Context, callback func(*query.StreamHealthResponse) error) error {
-	conn := thc.Connection()
+// getUnhealthySince returns the time at which the tablet stopped serving,
+// or the zero time if it is serving or never served.
+func (thc *tabletHealthCheck) getUnhealthySince() time.Time {
+	thc.connMu.Lock()
+	defer thc.connMu.Unlock()
+	return thc.unhealthySince
+}
+
+// logServingStateJSON logs the change of the serving state of tablet to the
+// given value as a JSON object.
+func (thc *tabletHealthCheck) logServingStateJSON(hc *HealthCheckImpl, tablet *topodata.Tablet, serving bool, reason string) {
+	change := servingStateChange{
+		Alias:      topoproto.TabletAliasString(tablet.Alias),
+		Keyspace:   tablet.GetKeyspace(),
+		Shard:      tablet.GetShard(),
+		TabletType: topoproto.TabletTypeLString(thc.Target.GetTabletType()),
+		OldServing: thc.Serving,
+		NewServing: serving,
+		Reason:     reason,
+		Timestamp:  hc.clock.Now(),
+	}
+	line, err := json.Marshal(change)
+	if err != nil {
+		log.Errorf("cannot marshal the serving state change of tablet %v: %v", change.Alias, err)
+		return
+	}
+	go servingStateLogger(string(line))
+}
+
+// stream streams healthcheck responses to callback, and records how long
+// the stream lasted.
+func (thc *tabletHealthCheck) stream(ctx context.Context, hc *HealthCheckImpl, callback func(*query.StreamHealthResponse) error) error {
+	conn := thc.Connection(hc)
 	if conn == nil {
 		// This signals the caller to retry
 		return nil
 	}
+	start := time.Now()
 	err := conn.StreamHealth(ctx, callback)
+	hcStreamDurations.Record([]string{thc.Target.Keyspace, thc.Target.Shard, topoproto.TabletTypeLString(thc.Target.TabletType)}, start)
 	if err != nil {
 		// Depending on the specific error the caller can take action
-		thc.closeConnection(ctx, err)
+		thc.closeConnection(ctx, hc, err)
 	}
 	return err
 }
 
-func (thc *tabletHealthCheck) Connection() queryservice.QueryService {
+func (thc *tabletHealthCheck) Connection(hc *HealthCheckImpl) queryservice.QueryService {
 	thc.connMu.Lock()
-	defer thc.connMu.Unlock()
-	return thc.connectionLocked()
-}
+	conn := thc.Conn
+	thc.connMu.Unlock()
+	if conn != nil {
+		return conn
+	}
 
-func (thc *tabletHealthCheck) connectionLocked() queryservice.QueryService {
-	if thc.Conn == nil {
-		conn, err := tabletconn.GetDialer()(thc.Tablet, grpcclient.FailFast(true))
-		if err != nil {
-			thc.LastError = err
-			return nil
+	// Dial and verify without holding connMu: the verifier is a user
+	// callback, and getting it takes hc.mu, which is acquired before
+	// connMu elsewhere.
+	tablet := thc.getTablet()
+	conn, err := tabletconn.GetDialer()(tablet, grpcclient.FailFast(true))
+	if err == nil {
+		if verifier := hc.getConnectionVerifier(); verifier != nil {
+			if verifyErr := verifier(tablet, conn); verifyErr != nil {
+				// the connection can't be trusted, handle it as if it couldn't be made
+				_ = conn.Close(thc.ctx)
+				err = fmt.Errorf("connection verification failed: %v", verifyErr)
+			}
 		}
-		thc.Conn = conn
-		thc.LastError = nil
 	}
+
+	thc.connMu.Lock()
+	defer thc.connMu.Unlock()
+	if thc.Conn != nil {
+		// another caller connected in the meantime, keep its connection
+		if err == nil {
+			_ = conn.Close(thc.ctx)
+		}
+		return thc.Conn
+	}
+	if err != nil {
+		hcDialErrorCounters.Add([]string{thc.Target.Keyspace, thc.Target.Shard, topoproto.TabletTypeLString(thc.Target.TabletType)}, 1)
+		thc.LastError = err
+		thc.lastDialError = err
+		thc.countError(err, true)
+		return nil
+	}
+	if thc.connected {
+		// the previous connection was closed because its stream failed
+		thc.redials++
+		hcRedialCounters.Add([]string{thc.Target.Keyspace, thc.Target.Shard, topoproto.TabletTypeLString(thc.Target.TabletType)}, 1)
+	}
+	thc.connected = true
+	thc.Conn = conn
+	thc.LastError = nil
+	thc.lastDialError = nil
 	return thc.Conn
 }
 
 // processResponse reads one health check response, and updates health
 func (thc *tabletHealthCheck) processResponse(hc *HealthCheckImpl, shr *query.StreamHealthResponse) error {
+	thc.servingMu.Lock()
+	defer thc.servingMu.Unlock()
 	select {
 	case <-thc.ctx.Done():
 		return thc.ctx.Err()
 	default:
 	}
 
+	// keep the last known state while paused
+	if hc.paused.Get() {
+		return nil
+	}
+
 	// Check for invalid data, better than panicking.
 	if shr.Target == nil || shr.RealtimeStats == nil {
 		return fmt.Errorf("health stats is not valid: %v", shr)
@@ -170,9 +440,23 @@ func (thc *tabletHealthCheck) processResponse(hc *HealthCheckImpl, shr *query.St
 	// an app-level error from tablet, force serving state.
 	var healthErr error
 	serving := shr.Serving
-	if shr.RealtimeStats.HealthError != "" {
-		healthErr = fmt.Errorf("vttablet error: %v", shr.RealtimeStats.HealthError)
-		serving = false
+	draining := shr.RealtimeStats.HealthError == DrainingHealthError
+	degraded := false
+	if shr.RealtimeStats.HealthError != "" && !draining {
+		if thc.firstHealthErrorTime.IsZero() {
+			thc.firstHealthErrorTime = hc.clock.Now()
+		}
+		// ignore the error until it has been reported for the whole grace period
+		if hc.clock.Now().Sub(thc.firstHealthErrorTime) >= *healthErrorGracePeriod {
+			if hc.healthErrorAsDegraded {
+				degraded = true
+			} else {
+				healthErr = fmt.Errorf("vttablet error: %v", shr.RealtimeStats.HealthError)
+				serving = false
+			}
+		}
+	} else {
+		thc.firstHealthErrorTime = time.Time{}
 	}
 
 	if shr.TabletAlias != nil && !proto.Equal(shr.TabletAlias, thc.Tablet.Alias) {
@@ -181,29 +465,103 @@ func (thc *tabletHealthCheck) processResponse(hc *HealthCheckImpl, shr *query.St
 		// With the next topo refresh we will get a new tablet with the new host/port
 		return vterrors.New(vtrpc.Code_FAILED_PRECONDITION, fmt.Sprintf("health stats mismatch, tablet %+v alias does not match response alias %v", thc.Tablet, shr.TabletAlias))
 	}
+	hcResponseCounters.Add([]string{shr.Target.Keyspace, shr.Target.Shard, topoproto.TabletTypeLString(shr.Target.TabletType)}, 1)
+
+	// run the custom validation, if any, on responses that passed the built-in checks.
+	if validator := hc.getResponseValidator(); validator != nil && healthErr == nil {
+		if err := validator(shr); err != nil {
+			healthErr = err
+			serving = false
+		}
+	}
+
+	if healthErr == nil {
+		serving = thc.debounceServing(hc, shr, serving)
+	}
 
 	currentTarget := thc.Target
 	// check whether this is a trivial update so as to update healthy map
-	trivialNonMasterUpdate := thc.LastError == nil && thc.Serving && shr.RealtimeStats.HealthError == "" && shr.Serving &&
-		currentTarget.TabletType != topodata.TabletType_MASTER && currentTarget.TabletType == shr.Target.TabletType && thc.isTrivialReplagChange(shr.RealtimeStats)
+	trivialNonMasterUpdate := thc.LastError == nil && thc.Serving && healthErr == nil && serving && thc.draining == draining && thc.degraded == degraded &&
+		currentTarget.TabletType != topodata.TabletType_MASTER && sameTarget(currentTarget, shr.Target) && thc.isTrivialReplagChange(shr.RealtimeStats)
 	isMasterUpdate := shr.Target.TabletType == topodata.TabletType_MASTER
 	isMasterChange := thc.Target.TabletType != topodata.TabletType_MASTER && shr.Target.TabletType == topodata.TabletType_MASTER
-	thc.lastResponseTimestamp = time.Now()
+	thc.connMu.Lock()
+	now := hc.clock.Now()
+	if !thc.lastResponseTimestamp.IsZero() {
+		thc.responseIntervals = append(thc.responseIntervals, now.Sub(thc.lastResponseTimestamp))
+		if len(thc.responseIntervals) > adaptiveTimeoutSamples {
+			thc.responseIntervals = thc.responseIntervals[1:]
+		}
+	}
+	thc.lastResponseTimestamp = now
+	thc.warming = false
+	thc.initialConnectErr = nil
+	thc.draining = draining
+	thc.degraded = degraded
+	thc.connMu.Unlock()
 	thc.Target = shr.Target
 	thc.MasterTermStartTime = shr.TabletExternallyReparentedTimestamp
 	thc.Stats = shr.RealtimeStats
 	thc.LastError = healthErr
+	thc.recordOutcome(hc, healthErr != nil)
+	if healthErr != nil {
+		thc.countError(healthErr, false)
+	}
 	reason := "healthCheck update"
 	if healthErr != nil {
 		reason = "healthCheck update error: " + healthErr.Error()
 	}
-	thc.setServingState(serving, reason)
+	thc.setServingState(hc, serving, reason)
 
 	// notify downstream for master change
 	hc.updateHealth(thc.SimpleCopy(), shr, currentTarget, trivialNonMasterUpdate, isMasterUpdate, isMasterChange)
 	return nil
 }
 
+// debounceServing returns the serving state to apply for a response which
+// reports the given one. With -healthcheck_serving_debounce, a change in the
+// debounced direction is kept pending, and only applied if no response
+// cancels it before the end of the debounce period.
+// thc.servingMu must be locked before calling this function.
+func (thc *tabletHealthCheck) debounceServing(hc *HealthCheckImpl, shr *query.StreamHealthResponse, serving bool) bool {
+	// the first response is applied right away
+	if hc.servingDebounce <= 0 || serving != hc.debouncedServing || serving == thc.Serving || thc.Stats == nil {
+		thc.pendingServing = nil
+		return serving
+	}
+	if thc.pendingServing != nil {
+		thc.pendingServing.shr = shr
+		return thc.Serving
+	}
+	pending := &pendingServingState{serving: serving, shr: shr}
+	thc.pendingServing = pending
+	timer := hc.clock.After(hc.servingDebounce)
+	hc.connsWG.Add(1)
+	go func() {
+		defer hc.connsWG.Done()
+		select {
+		case <-timer:
+			thc.applyPendingServing(hc, pending)
+		case <-thc.ctx.Done():
+		}
+	}()
+	return thc.Serving
+}
+
+// applyPendingServing applies the given pending serving state, unless a
+// response cancelled it in the meantime.
+func (thc *tabletHealthCheck) applyPendingServing(hc *HealthCheckImpl, pending *pendingServingState) {
+	thc.servingMu.Lock()
+	defer thc.servingMu.Unlock()
+	if thc.pendingServing != pending || thc.ctx.Err() != nil {
+		return
+	}
+	thc.pendingServing = nil
+	currentTarget := thc.Target
+	thc.setServingState(hc, pending.serving, fmt.Sprintf("healthCheck update reported for %v", hc.servingDebounce))
+	hc.updateHealth(thc.SimpleCopy(), pending.shr, currentTarget, false, pending.shr.Target.TabletType == topodata.TabletType_MASTER, false)
+}
+
 // isTrivialReplagChange returns true iff the old and new RealtimeStats
 // haven't changed enough to warrant re-calling FilterLegacyStatsByReplicationLag.
 func (thc *tabletHealthCheck) isTrivialReplagChange(newStats *query.RealtimeStats) bool {
@@ -235,11 +593,13 @@ func (thc *tabletHealthCheck) isTrivialReplagChange(newStats *query.RealtimeStat
 func (thc *tabletHealthCheck) checkConn(hc *HealthCheckImpl) {
 	defer func() {
 		// TODO(deepthi): We should ensure any return from this func calls the equivalent of hc.deleteTablet
-		thc.finalizeConn()
+		thc.finalizeConn(hc)
+		hc.activeConns.Add(-1)
 		hc.connsWG.Done()
 	}()
 
-	retryDelay := hc.retryDelay
+	initialRetryDelay := hc.retryDelayFor(thc.getTablet().Type)
+	retryDelay := initialRetryDelay
 	for {
 		streamCtx, streamCancel := context.WithCancel(thc.ctx)
 
@@ -253,12 +613,19 @@ func (thc *tabletHealthCheck) checkConn(hc *HealthCheckImpl) {
 		// between the goroutine that sets it and the check for its value
 		// later.
 		timedout := sync2.NewAtomicBool(false)
+		connectDeadline := thc.connectDeadlineTimer(hc)
 		go func() {
+			timeout := hc.clock.After(thc.timeout(hc))
 			for {
 				select {
 				case <-servingStatus:
-					continue
-				case <-time.After(hc.healthCheckTimeout):
+					timeout = hc.clock.After(thc.timeout(hc))
+				case <-connectDeadline:
+					// the tablet accepted the stream but did not respond in
+					// time, the timeout keeps running
+					thc.checkConnectDeadline(hc)
+					connectDeadline = nil
+				case <-timeout:
 					timedout.Set(true)
 					streamCancel()
 					return
@@ -270,9 +637,14 @@ func (thc *tabletHealthCheck) checkConn(hc *HealthCheckImpl) {
 		}()
 
 		// Read stream health responses.
-		err := thc.stream(streamCtx, func(shr *query.StreamHealthResponse) error {
-			// We received a message. Reset the back-off.
-			retryDelay = hc.retryDelay
+		thc.streamStartTime = hc.clock.Now()
+		err := thc.stream(streamCtx, hc, func(shr *query.StreamHealthResponse) error {
+			// We received a message. Reset the back-off, but only once the stream
+			// has been up for a while so that a tablet which keeps dropping the
+			// stream right after the first message doesn't make us tight-loop.
+			if hc.clock.Now().Sub(thc.streamStartTime) > 2*retryDelay {
+				retryDelay = initialRetryDelay
+			}
 			// Don't block on send to avoid deadlocks.
 			select {
 			case servingStatus <- shr.Serving:
@@ -284,30 +656,44 @@ func (thc *tabletHealthCheck) checkConn(hc *HealthCheckImpl) {
 		// streamCancel to make sure the watcher goroutine terminates.
 		streamCancel()
 
-		if err != nil {
+		// The failures do not change the last known state while paused.
+		paused := hc.paused.Get()
+		if err != nil && !paused {
 			if strings.Contains(err.Error(), "health stats mismatch") {
-				hc.deleteTablet(thc.Tablet)
+				hc.deleteTablet(thc.getTablet())
 				return
 			}
+			thc.recordOutcome(hc, true)
 			res := thc.SimpleCopy()
 			hc.broadcast(res)
+		} else if res := thc.SimpleCopy(); res.LastDialError != nil && !paused {
+			// The tablet could not be dialed. Record it so that it can be displayed.
+			thc.recordOutcome(hc, true)
+			hc.updateTabletHealthData(thc.SimpleCopy())
 		}
 		// If there was a timeout send an error. We do this after stream has returned.
 		// This will ensure that this update prevails over any previous message that
 		// stream could have sent.
-		if timedout.Get() {
-			thc.LastError = fmt.Errorf("healthcheck timed out (latest %v)", thc.lastResponseTimestamp)
-			thc.setServingState(false, thc.LastError.Error())
-			hcErrorCounters.Add([]string{thc.Target.Keyspace, thc.Target.Shard, topoproto.TabletTypeLString(thc.Target.TabletType)}, 1)
-			hc.broadcast(thc.SimpleCopy())
+		if timedout.Get() && !paused {
+			thc.recordTimeout(hc)
 		}
 
+		if thc.retryBudgetExceeded(hc) {
+			hc.evictTablet(thc)
+			return
+		}
+		thc.checkConnectDeadline(hc)
+
 		// Streaming RPC failed e.g. because vttablet was restarted or took too long.
 		// Sleep until the next retry is up or the context is done/canceled.
 		select {
 		case <-thc.ctx.Done():
 			return
-		case <-time.After(retryDelay):
+		case <-thc.connectDeadlineTimer(hc):
+			// report the missed deadline right away, and retry without
+			// increasing the retry delay
+			thc.checkConnectDeadline(hc)
+		case <-hc.clock.After(retryDelay):
 			// Exponentially back-off to prevent tight-loop.
 			retryDelay *= 2
 			// Limit the retry delay backoff to the health check timeout
@@ -318,18 +704,156 @@ func (thc *tabletHealthCheck) checkConn(hc *HealthCheckImpl) {
 	}
 }
 
-func (thc *tabletHealthCheck) closeConnection(ctx context.Context, err error) {
-	log.Warningf("tablet %v healthcheck stream error: %v", thc.Tablet.Alias, err)
-	thc.setServingState(false, err.Error())
+// recordTimeout marks the tablet as not serving because no health check
+// response was received in time, and notifies the subscribers.
+func (thc *tabletHealthCheck) recordTimeout(hc *HealthCheckImpl) {
+	thc.servingMu.Lock()
+	defer thc.servingMu.Unlock()
+	if thc.lastResponseTimestamp.IsZero() {
+		// the tablet accepted the stream but never sent anything
+		thc.LastError = vterrors.Errorf(vtrpc.Code_DEADLINE_EXCEEDED, "healthcheck timed out: no health response received since connect at %v", thc.streamStartTime)
+	} else {
+		thc.LastError = vterrors.Errorf(vtrpc.Code_DEADLINE_EXCEEDED, "healthcheck timed out (latest %v)", thc.lastResponseTimestamp)
+	}
+	thc.countError(thc.LastError, false)
+	thc.setServingState(hc, false, thc.LastError.Error())
+	hcErrorCounters.Add([]string{thc.Target.Keyspace, thc.Target.Shard, topoproto.TabletTypeLString(thc.Target.TabletType)}, 1)
+	hc.broadcast(thc.SimpleCopy())
+}
+
+// connectDeadlineTimer returns a channel which receives the time at the
+// connect deadline of the tablet, or nil if it has none or it has passed.
+func (thc *tabletHealthCheck) connectDeadlineTimer(hc *HealthCheckImpl) <-chan time.Time {
+	thc.connMu.Lock()
+	defer thc.connMu.Unlock()
+	if thc.connectDeadline.IsZero() || thc.initialConnectErr != nil || !thc.lastResponseTimestamp.IsZero() {
+		return nil
+	}
+	wait := thc.connectDeadline.Sub(hc.clock.Now())
+	if wait <= 0 {
+		return nil
+	}
+	return hc.clock.After(wait)
+}
+
+// checkConnectDeadline marks the tablet as failed initial connect, and
+// notifies the subscribers, if its connect deadline passed before it sent
+// any health check response.
+func (thc *tabletHealthCheck) checkConnectDeadline(hc *HealthCheckImpl) {
+	thc.servingMu.Lock()
+	defer thc.servingMu.Unlock()
+	thc.connMu.Lock()
+	if thc.connectDeadline.IsZero() || thc.initialConnectErr != nil || !thc.lastResponseTimestamp.IsZero() || hc.clock.Now().Before(thc.connectDeadline) {
+		thc.connMu.Unlock()
+		return
+	}
+	if thc.LastError != nil {
+		thc.initialConnectErr = vterrors.Wrapf(ErrFailedInitialConnect, "no health check response by %v (last error: %v)", thc.connectDeadline, thc.LastError)
+	} else {
+		thc.initialConnectErr = vterrors.Wrapf(ErrFailedInitialConnect, "no health check response by %v", thc.connectDeadline)
+	}
+	err := thc.initialConnectErr
+	thc.connMu.Unlock()
+
+	log.Warningf("tablet %v: %v", topoproto.TabletAliasString(thc.getTablet().Alias), err.Error())
+	thc.countError(err, false)
+	thc.setServingState(hc, false, err.Error())
+	hc.updateTabletHealthData(thc.SimpleCopy())
+	hc.broadcast(thc.SimpleCopy())
+}
+
+// pollHealth reads a single health check response from the tablet, on a
+// stream which is closed right after. It is the equivalent of one iteration
+// of checkConn, used when the streams are run by a streamPool.
+// It returns false if the tablet must not be polled anymore.
+func (thc *tabletHealthCheck) pollHealth(hc *HealthCheckImpl) bool {
+	ctx, cancel := context.WithTimeout(thc.ctx, hc.healthCheckTimeout)
+	defer cancel()
+
+	thc.streamStartTime = hc.clock.Now()
+	err := thc.stream(ctx, hc, func(shr *query.StreamHealthResponse) error {
+		if err := thc.processResponse(hc, shr); err != nil {
+			return err
+		}
+		// We got what we wanted, end the stream.
+		return io.EOF
+	})
+
+	if err != nil {
+		if strings.Contains(err.Error(), "health stats mismatch") {
+			hc.deleteTablet(thc.getTablet())
+			return false
+		}
+		thc.recordOutcome(hc, true)
+		hc.broadcast(thc.SimpleCopy())
+	} else if res := thc.SimpleCopy(); res.LastDialError != nil {
+		// The tablet could not be dialed. Record it so that it can be displayed.
+		thc.recordOutcome(hc, true)
+		hc.updateTabletHealthData(thc.SimpleCopy())
+	}
+	if ctx.Err() == context.DeadlineExceeded && thc.ctx.Err() == nil {
+		thc.recordTimeout(hc)
+	}
+	thc.checkConnectDeadline(hc)
+	if thc.retryBudgetExceeded(hc) {
+		hc.evictTablet(thc)
+		return false
+	}
+	return thc.ctx.Err() == nil
+}
+
+// retryBudgetExceeded returns true if -healthcheck_max_retry_duration is set
+// and the tablet has not sent any health check response for that long, or
+// since it was added if it never did.
+func (thc *tabletHealthCheck) retryBudgetExceeded(hc *HealthCheckImpl) bool {
+	if hc.maxRetryDuration <= 0 || thc.ctx.Err() != nil {
+		return false
+	}
+	since := thc.getLastResponseTimestamp()
+	if since.IsZero() {
+		since = thc.FirstSeen
+	}
+	if hc.clock.Now().Sub(since) < hc.maxRetryDuration {
+		return false
+	}
+	log.Warningf("tablet %v has not sent any health check response since %v, removing it", topoproto.TabletAliasString(thc.getTablet().Alias), since)
+	return true
+}
+
+// closeConnection marks the tablet as not serving after the stream failed
+// with err, and closes its connection. While hc is paused, only the error
+// is counted.
+func (thc *tabletHealthCheck) closeConnection(ctx context.Context, hc *HealthCheckImpl, err error) {
+	thc.servingMu.Lock()
+	defer thc.servingMu.Unlock()
+	log.Warningf("tablet %v healthcheck stream error: %v", thc.getTablet().Alias, err)
+	if hc.paused.Get() {
+		// keep the last known state and the connection while paused, the
+		// next stream is opened on the same connection
+		thc.countError(err, false)
+		return
+	}
+	thc.setServingState(hc, false, err.Error())
 	thc.LastError = err
-	_ = thc.Conn.Close(ctx)
+	thc.countError(err, false)
+	_ = thc.Conn.Close(withCloseReason(ctx, CloseReasonError))
 	thc.Conn = nil
 }
 
-// finalizeConn closes the health checking connection.
+// countError counts a health check error of the tablet by category, and
+// records it in the health history.
+func (thc *tabletHealthCheck) countError(err error, dial bool) {
+	thc.history.record(thc, HealthEventError, err.Error())
+	hcErrorCategoryCounters.Add([]string{thc.Target.Keyspace, thc.Target.Shard, topoproto.TabletTypeLString(thc.Target.TabletType), errorCategory(err, dial)}, 1)
+}
+
+// finalizeConn closes the health checking connection, with
+// CloseReasonShutdown if hc is closed, CloseReasonRemoved otherwise.
 // To be called only on exit from checkConn().
-func (thc *tabletHealthCheck) finalizeConn() {
-	thc.setServingState(false, "finalizeConn closing connection")
+func (thc *tabletHealthCheck) finalizeConn(hc *HealthCheckImpl) {
+	thc.servingMu.Lock()
+	defer thc.servingMu.Unlock()
+	thc.setServingState(hc, false, "finalizeConn closing connection")
 	// Note: checkConn() exits only when thc.ctx.Done() is closed. Thus it's
 	// safe to simply get Err() value here and assign to LastError.
 	thc.LastError = thc.ctx.Err()
@@ -338,7 +862,11 @@ func (thc *tabletHealthCheck) finalizeConn() {
 		// Use a separate context, and add a timeout to prevent unbounded waits.
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		_ = thc.Conn.Close(ctx)
+		reason := CloseReasonRemoved
+		if hc.isClosed() {
+			reason = CloseReasonShutdown
+		}
+		_ = thc.Conn.Close(withCloseReason(ctx, reason))
 		thc.Conn = nil
 	}
 }
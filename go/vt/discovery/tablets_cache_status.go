@@ -18,6 +18,12 @@ type TabletsCacheStatus struct {
 	Cell         string
 	Target       *querypb.Target
 	TabletsStats TabletStatsList
+	// DenylistedTablets are the aliases of the tablets of TabletsStats
+	// which are excluded from routing by the tablet denylist.
+	DenylistedTablets []string `json:",omitempty"`
+	// HealthUnknown is true when the health of the tablets is not
+	// checked, because of -disable_health_stream.
+	HealthUnknown bool `json:",omitempty"`
 }
 
 // TabletStatsList is used for sorting.
@@ -62,18 +68,40 @@ func (tcs *TabletsCacheStatus) StatusAsHTML() template.HTML {
 	for _, ts := range tcs.TabletsStats {
 		color := "green"
 		extra := ""
-		if ts.LastError != nil {
+		if tcs.HealthUnknown || ts.HealthUnknown {
+			color = "gray"
+			extra = " (Health Unknown)"
+		} else if ts.Warming {
+			color = "gray"
+			extra = fmt.Sprintf(" (Warming) (Connection: %v)", ts.ConnectionState())
+		} else if ts.LastError != nil {
 			color = "red"
-			extra = fmt.Sprintf(" (%v)", ts.LastError)
+			extra = fmt.Sprintf(" (%v) (Category: %v) (Connection: %v)", ts.LastError, ts.ErrorCategory, ts.ConnectionState())
 		} else if !ts.Serving {
 			color = "red"
-			extra = " (Not Serving)"
+			extra = fmt.Sprintf(" (Not Serving) (Connection: %v)", ts.ConnectionState())
 		} else if ts.Target.TabletType == topodatapb.TabletType_MASTER {
 			extra = fmt.Sprintf(" (MasterTS: %v)", ts.MasterTermStartTime)
 		} else {
 			extra = fmt.Sprintf(" (RepLag: %v)", ts.Stats.SecondsBehindMaster)
 		}
+		if ts.Draining {
+			extra += " (Draining)"
+		}
+		if ts.Degraded {
+			extra += fmt.Sprintf(" (Degraded: %v)", ts.Stats.GetHealthError())
+		}
+		if ts.Redials > 0 {
+			extra += fmt.Sprintf(" (Redials: %v)", ts.Redials)
+		}
 		name := topoproto.TabletAliasString(ts.Tablet.Alias)
+		for _, denylisted := range tcs.DenylistedTablets {
+			if denylisted == name {
+				color = "gray"
+				extra += " (Denylisted)"
+				break
+			}
+		}
 		tLinks = append(tLinks, fmt.Sprintf(`<a href="%s" style="color:%v">%v</a>%v`, ts.getTabletDebugURL(), color, name, extra))
 	}
 	return template.HTML(strings.Join(tLinks, "<br>"))
@@ -82,7 +110,9 @@ func (tcs *TabletsCacheStatus) StatusAsHTML() template.HTML {
 func (tcs *TabletsCacheStatus) deepEqual(otcs *TabletsCacheStatus) bool {
 	return tcs.Cell == otcs.Cell &&
 		proto.Equal(tcs.Target, otcs.Target) &&
-		tcs.TabletsStats.deepEqual(otcs.TabletsStats)
+		tcs.TabletsStats.deepEqual(otcs.TabletsStats) &&
+		strings.Join(tcs.DenylistedTablets, ",") == strings.Join(otcs.DenylistedTablets, ",") &&
+		tcs.HealthUnknown == otcs.HealthUnknown
 }
 
 // TabletsCacheStatusList is used for sorting.
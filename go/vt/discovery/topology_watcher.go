@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"fmt"
 	"hash/crc32"
+	"path"
 	"sort"
 	"strings"
 	"sync"
@@ -31,6 +32,7 @@ import (
 
 	"golang.org/x/net/context"
 	"vitess.io/vitess/go/stats"
+	"vitess.io/vitess/go/sync2"
 	"vitess.io/vitess/go/trace"
 
 	"vitess.io/vitess/go/vt/log"
@@ -57,6 +59,11 @@ var (
 type tabletInfo struct {
 	alias  string
 	tablet *topodata.Tablet
+	// unverifiedRefreshes is the number of successful refreshes since
+	// the tablet was last read from topo.
+	unverifiedRefreshes int
+	// seeded is set if the tablet was never read from topo, see seedTablets.
+	seeded bool
 }
 
 // TopologyWatcher polls tablet from a configurable set of tablets
@@ -64,21 +71,41 @@ type tabletInfo struct {
 // the LegacyTabletRecorder AddTablet / RemoveTablet interface appropriately.
 type TopologyWatcher struct {
 	// set at construction time
-	topoServer          *topo.Server
-	tabletRecorder      TabletRecorder
-	tabletFilter        TabletFilter
-	cell                string
-	refreshInterval     time.Duration
-	refreshKnownTablets bool
-	getTablets          func(tw *TopologyWatcher) ([]*topodata.TabletAlias, error)
-	sem                 chan int
-	ctx                 context.Context
-	cancelFunc          context.CancelFunc
+	topoServer      *topo.Server
+	tabletRecorder  TabletRecorder
+	tabletFilter    TabletFilter
+	cell            string
+	refreshInterval time.Duration
+	// maxUnverifiedRefreshes is the number of refreshes after which a known
+	// tablet is reloaded even if refreshKnownTablets is false. 0 disables it.
+	// It is set from -tablet_refresh_known_tablets_every.
+	maxUnverifiedRefreshes int
+	// topoReadTimeout is the timeout of each GetTablet call, none if <= 0.
+	// It is set from -topo_read_timeout.
+	topoReadTimeout time.Duration
+	getTablets      func(tw *TopologyWatcher) ([]*topodata.TabletAlias, error)
+	// watchFiles returns the paths, in the cell, of the files which change
+	// when the tablets returned by getTablets change. If set, and if the
+	// topo server supports watches, the tablets are reloaded as soon as one
+	// of them changes. Otherwise they are only reloaded every
+	// refreshInterval. It is nil for the watchers of a whole cell, as the
+	// tablets of a cell are not listed in a file.
+	watchFiles func(tw *TopologyWatcher) ([]string, error)
+	sem        chan int
+	ctx        context.Context
+	cancelFunc context.CancelFunc
 	// wg keeps track of all launched Go routines.
 	wg sync.WaitGroup
+	// loadMu serializes the loading of tablets, so that refreshes never overlap.
+	loadMu sync.Mutex
+	// paused is set between Pause and Resume.
+	paused sync2.AtomicBool
 
 	// mu protects all variables below
 	mu sync.Mutex
+	// refreshKnownTablets is true if the known tablets are reloaded from
+	// topo on each refresh, see SetRefreshKnownTablets.
+	refreshKnownTablets bool
 	// tablets contains a map of alias -> tabletInfo for all known tablets
 	tablets map[string]*tabletInfo
 	// topoChecksum stores a crc32 of the tablets map and is exported as a metric
@@ -89,21 +116,26 @@ type TopologyWatcher struct {
 	firstLoadDone bool
 	// firstLoadChan is closed when the initial loading of topology data is done.
 	firstLoadChan chan struct{}
+	// pendingRefresh is closed when the out of band refresh which has been
+	// requested but not started yet is done. It is nil if there is none.
+	pendingRefresh chan struct{}
 }
 
 // NewTopologyWatcher returns a TopologyWatcher that monitors all
 // the tablets in a cell, and starts refreshing.
 func NewTopologyWatcher(ctx context.Context, topoServer *topo.Server, tr TabletRecorder, filter TabletFilter, cell string, refreshInterval time.Duration, refreshKnownTablets bool, topoReadConcurrency int, getTablets func(tw *TopologyWatcher) ([]*topodata.TabletAlias, error)) *TopologyWatcher {
 	tw := &TopologyWatcher{
-		topoServer:          topoServer,
-		tabletRecorder:      tr,
-		tabletFilter:        filter,
-		cell:                cell,
-		refreshInterval:     refreshInterval,
-		refreshKnownTablets: refreshKnownTablets,
-		getTablets:          getTablets,
-		sem:                 make(chan int, topoReadConcurrency),
-		tablets:             make(map[string]*tabletInfo),
+		topoServer:             topoServer,
+		tabletRecorder:         tr,
+		tabletFilter:           filter,
+		cell:                   cell,
+		refreshInterval:        refreshInterval,
+		refreshKnownTablets:    refreshKnownTablets,
+		maxUnverifiedRefreshes: *RefreshKnownTabletsEvery,
+		topoReadTimeout:        *TopoReadTimeout,
+		getTablets:             getTablets,
+		sem:                    make(chan int, topoReadConcurrency),
+		tablets:                make(map[string]*tabletInfo),
 	}
 	tw.firstLoadChan = make(chan struct{})
 
@@ -115,16 +147,122 @@ func NewTopologyWatcher(ctx context.Context, topoServer *topo.Server, tr TabletR
 
 // NewCellTabletsWatcher returns a TopologyWatcher that monitors all
 // the tablets in a cell, and starts refreshing.
+// There is no record listing the tablets of a cell to watch, so the tablets
+// are only reloaded every refreshInterval.
 func NewCellTabletsWatcher(ctx context.Context, topoServer *topo.Server, tr TabletRecorder, f TabletFilter, cell string, refreshInterval time.Duration, refreshKnownTablets bool, topoReadConcurrency int) *TopologyWatcher {
 	return NewTopologyWatcher(ctx, topoServer, tr, f, cell, refreshInterval, refreshKnownTablets, topoReadConcurrency, func(tw *TopologyWatcher) ([]*topodata.TabletAlias, error) {
 		return tw.topoServer.GetTabletsByCell(ctx, tw.cell)
 	})
 }
 
+// NewShardReplicationWatcher returns a TopologyWatcher that
+// monitors the tablets in a cell/keyspace/shard, and starts refreshing.
+// The ShardReplication record is watched, so that the tablets added to or
+// removed from the shard are seen right away.
+func NewShardReplicationWatcher(ctx context.Context, topoServer *topo.Server, tr TabletRecorder, f TabletFilter, cell, keyspace, shard string, refreshInterval time.Duration, refreshKnownTablets bool, topoReadConcurrency int) *TopologyWatcher {
+	tw := NewTopologyWatcher(ctx, topoServer, tr, f, cell, refreshInterval, refreshKnownTablets, topoReadConcurrency, func(tw *TopologyWatcher) ([]*topodata.TabletAlias, error) {
+		return getShardReplicationAliases(ctx, tw.topoServer, tw.cell, keyspace, shard)
+	})
+	tw.watchFiles = func(tw *TopologyWatcher) ([]string, error) {
+		return []string{shardReplicationPath(keyspace, shard)}, nil
+	}
+	return tw
+}
+
+// NewKeyspacesTabletsWatcher returns a TopologyWatcher that monitors the
+// tablets of the given keyspaces in a cell, and starts refreshing.
+// Instead of listing every tablet in the cell, it enumerates the tablets
+// through the ShardReplication record of each shard of the keyspaces.
+// The ShardReplication records of the shards which exist when the watcher
+// starts are watched, the tablets of the shards created later are seen
+// every refreshInterval.
+func NewKeyspacesTabletsWatcher(ctx context.Context, topoServer *topo.Server, tr TabletRecorder, f TabletFilter, cell string, keyspaces []string, refreshInterval time.Duration, refreshKnownTablets bool, topoReadConcurrency int) *TopologyWatcher {
+	tw := NewTopologyWatcher(ctx, topoServer, tr, f, cell, refreshInterval, refreshKnownTablets, topoReadConcurrency, func(tw *TopologyWatcher) ([]*topodata.TabletAlias, error) {
+		var result []*topodata.TabletAlias
+		for _, keyspace := range keyspaces {
+			shards, err := tw.topoServer.GetShardNames(ctx, keyspace)
+			switch {
+			case err == nil:
+			case topo.IsErrType(err, topo.NoNode):
+				// the keyspace does not exist (yet), it has no tablets
+				continue
+			default:
+				return nil, err
+			}
+			for _, shard := range shards {
+				aliases, err := getShardReplicationAliases(ctx, tw.topoServer, tw.cell, keyspace, shard)
+				if err != nil {
+					return nil, err
+				}
+				result = append(result, aliases...)
+			}
+		}
+		return result, nil
+	})
+	tw.watchFiles = func(tw *TopologyWatcher) ([]string, error) {
+		var files []string
+		for _, keyspace := range keyspaces {
+			shards, err := tw.topoServer.GetShardNames(tw.ctx, keyspace)
+			switch {
+			case err == nil:
+			case topo.IsErrType(err, topo.NoNode):
+				continue
+			default:
+				return nil, err
+			}
+			for _, shard := range shards {
+				files = append(files, shardReplicationPath(keyspace, shard))
+			}
+		}
+		return files, nil
+	}
+	return tw
+}
+
+// shardReplicationPath returns the path of the ShardReplication record of a
+// keyspace/shard in a cell.
+func shardReplicationPath(keyspace, shard string) string {
+	return path.Join(topo.KeyspacesPath, keyspace, topo.ShardsPath, shard, topo.ShardReplicationFile)
+}
+
+// getShardReplicationAliases returns the aliases of the tablets found in the
+// ShardReplication record of a cell/keyspace/shard.
+func getShardReplicationAliases(ctx context.Context, topoServer *topo.Server, cell, keyspace, shard string) ([]*topodata.TabletAlias, error) {
+	sri, err := topoServer.GetShardReplication(ctx, cell, keyspace, shard)
+	switch {
+	case err == nil:
+		// we handle this case after this switch block
+	case topo.IsErrType(err, topo.NoNode):
+		// this is not an error
+		return nil, nil
+	default:
+		return nil, err
+	}
+
+	result := make([]*topodata.TabletAlias, len(sri.Nodes))
+	for i, node := range sri.Nodes {
+		result[i] = node.TabletAlias
+	}
+	return result, nil
+}
+
 // Start starts the topology watcher
 func (tw *TopologyWatcher) Start() {
 	tw.wg.Add(1)
 	defer tw.wg.Done()
+	if tw.watchFiles != nil {
+		// the watches are set up before the first load, so that no change
+		// is missed
+		files, err := tw.watchFiles(tw)
+		if err != nil {
+			log.Warningf("Cannot watch the tablets of cell %v, polling them every %v: %v", tw.cell, tw.refreshInterval, err)
+		}
+		for _, file := range files {
+			changes, cancel, err := tw.watchChanges(file)
+			tw.wg.Add(1)
+			go tw.reloadOnChanges(file, changes, cancel, err)
+		}
+	}
 	ticker := time.NewTicker(tw.refreshInterval)
 	defer ticker.Stop()
 	for {
@@ -137,6 +275,132 @@ func (tw *TopologyWatcher) Start() {
 	}
 }
 
+// watchChanges sets up a watch on the given file of the cell.
+func (tw *TopologyWatcher) watchChanges(file string) (<-chan *topo.WatchData, topo.CancelFunc, error) {
+	conn, err := tw.topoServer.ConnForCell(tw.ctx, tw.cell)
+	if err != nil {
+		return nil, nil, err
+	}
+	current, changes, cancel := conn.Watch(tw.ctx, file)
+	if current.Err != nil {
+		return nil, nil, current.Err
+	}
+	return changes, cancel, nil
+}
+
+// reloadOnChanges reloads the tablets each time file changes, until
+// the watcher is stopped. changes, cancel and err are the result of the
+// first watchChanges call. If the watch fails, e.g. because the file does
+// not exist yet, it is set up again after refreshInterval, the tablets being
+// polled meanwhile. If the topo server does not support watches, the
+// tablets are only polled.
+func (tw *TopologyWatcher) reloadOnChanges(file string, changes <-chan *topo.WatchData, cancel topo.CancelFunc, err error) {
+	defer tw.wg.Done()
+	for {
+		if err == nil {
+			err = tw.reloadOnWatchData(changes, cancel)
+		}
+		if topo.IsErrType(err, topo.NoImplementation) {
+			log.Infof("The topo server of cell %v does not support watches, polling the tablets every %v", tw.cell, tw.refreshInterval)
+			return
+		}
+		select {
+		case <-tw.ctx.Done():
+			return
+		case <-time.After(tw.refreshInterval):
+		}
+		changes, cancel, err = tw.watchChanges(file)
+		if err == nil {
+			// catch up with the changes made while there was no watch
+			tw.RefreshNow(tw.ctx)
+		}
+	}
+}
+
+// reloadOnWatchData reloads the tablets on each change read from changes,
+// until the watch fails or the watcher is stopped.
+func (tw *TopologyWatcher) reloadOnWatchData(changes <-chan *topo.WatchData, cancel topo.CancelFunc) error {
+	defer cancel()
+	for {
+		select {
+		case <-tw.ctx.Done():
+			cancel()
+			for range changes {
+			}
+			return tw.ctx.Err()
+		case wd, ok := <-changes:
+			if !ok {
+				return nil
+			}
+			if wd.Err != nil {
+				return wd.Err
+			}
+			if err := tw.RefreshNow(tw.ctx); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// WaitForInitialTopology waits until the watcher has read the tablets from
+// the topo server for the first time, even if there are none.
+// It will return ctx.Err() if the context is canceled, or the watcher's
+// context error if it is stopped first.
+func (tw *TopologyWatcher) WaitForInitialTopology(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-tw.ctx.Done():
+		return tw.ctx.Err()
+	case <-tw.firstLoadChan:
+		return nil
+	}
+}
+
+// Pause stops reloading the tablets from topo until Resume is called, the
+// tablet recorder keeps the tablets it knows. If the tablets were not
+// loaded yet, they are still loaded once.
+func (tw *TopologyWatcher) Pause() {
+	tw.paused.Set(true)
+}
+
+// Resume undoes Pause, the tablets are reloaded at the next refresh.
+func (tw *TopologyWatcher) Resume() {
+	tw.paused.Set(false)
+}
+
+// seedTablets records the tablets of the watched cell which pass the filter
+// as known, as if they had been found in topo, and returns them. The next
+// refresh reads them from topo, and replaces or removes them as needed.
+// It must be called before Start.
+func (tw *TopologyWatcher) seedTablets(tablets []*topodata.Tablet) []*topodata.Tablet {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	var res []*topodata.Tablet
+	for _, tablet := range tablets {
+		if tablet.Alias.Cell != tw.cell || !(tw.tabletFilter == nil || tw.tabletFilter.IsIncluded(tablet)) {
+			continue
+		}
+		alias := topoproto.TabletAliasString(tablet.Alias)
+		tw.tablets[alias] = &tabletInfo{
+			alias:  alias,
+			tablet: tablet,
+			seeded: true,
+		}
+		res = append(res, tablet)
+	}
+	return res
+}
+
+// SetRefreshKnownTablets sets whether the known tablets are reloaded from
+// topo on each refresh, e.g. to pick up address changes, or only the new
+// ones. It applies from the next refresh on.
+func (tw *TopologyWatcher) SetRefreshKnownTablets(refresh bool) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.refreshKnownTablets = refresh
+}
+
 // Stop stops the watcher. It does not clean up the tablets added to LegacyTabletRecorder.
 func (tw *TopologyWatcher) Stop() {
 	tw.cancelFunc()
@@ -144,7 +408,79 @@ func (tw *TopologyWatcher) Stop() {
 	tw.wg.Wait()
 }
 
+// RefreshNow reloads the tablets from the topo without waiting for the
+// refresh interval, and returns when the reload is done.
+// Concurrent calls made before the reload starts share the same reload.
+// It will return ctx.Err() if the context is canceled, or the watcher's
+// context error if it is stopped, without reloading the tablets.
+func (tw *TopologyWatcher) RefreshNow(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tw.mu.Lock()
+	if err := tw.ctx.Err(); err != nil {
+		tw.mu.Unlock()
+		return err
+	}
+	done := tw.pendingRefresh
+	if done == nil {
+		done = make(chan struct{})
+		tw.pendingRefresh = done
+		// Stop waits for the reload
+		tw.wg.Add(1)
+		go func() {
+			defer tw.wg.Done()
+			defer close(done)
+			tw.loadMu.Lock()
+			defer tw.loadMu.Unlock()
+			// calls made from now on need another reload to see the latest data
+			tw.mu.Lock()
+			tw.pendingRefresh = nil
+			tw.mu.Unlock()
+			tw.loadTabletsLocked()
+		}()
+	}
+	tw.mu.Unlock()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// forgetTablet drops the tablet from the known tablets, so that the next
+// refresh reports it to the recorder again.
+func (tw *TopologyWatcher) forgetTablet(alias string) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	delete(tw.tablets, alias)
+}
+
 func (tw *TopologyWatcher) loadTablets() {
+	tw.loadMu.Lock()
+	defer tw.loadMu.Unlock()
+	tw.loadTabletsLocked()
+}
+
+// readContext returns the context of a tablet read from topo, which times
+// out after topoReadTimeout unless it is <= 0.
+func (tw *TopologyWatcher) readContext() (context.Context, context.CancelFunc) {
+	if tw.topoReadTimeout <= 0 {
+		return context.WithCancel(tw.ctx)
+	}
+	return context.WithTimeout(tw.ctx, tw.topoReadTimeout)
+}
+
+// loadTabletsLocked loads the tablets from the topo.
+// tw.loadMu must be locked before calling this function.
+func (tw *TopologyWatcher) loadTabletsLocked() {
+	// the first load runs even while paused, so that WaitForInitialTopology
+	// returns
+	if tw.paused.Get() && tw.firstLoadDone {
+		return
+	}
 	var wg sync.WaitGroup
 	newTablets := make(map[string]*tabletInfo)
 
@@ -172,9 +508,15 @@ func (tw *TopologyWatcher) loadTablets() {
 		tabletAliasStrs = append(tabletAliasStrs, aliasStr)
 
 		if !tw.refreshKnownTablets {
-			// we already have a tabletInfo for this and the flag tells us to not refresh
-			if val, ok := tw.tablets[aliasStr]; ok {
-				newTablets[aliasStr] = val
+			// we already have a tabletInfo for this and the flag tells us to not refresh,
+			// unless it has not been read for too long: its alias may still be listed
+			// even though the tablet itself was deleted from topo.
+			if val, ok := tw.tablets[aliasStr]; ok && !val.seeded && (tw.maxUnverifiedRefreshes <= 0 || val.unverifiedRefreshes < tw.maxUnverifiedRefreshes) {
+				newTablets[aliasStr] = &tabletInfo{
+					alias:               val.alias,
+					tablet:              val.tablet,
+					unverifiedRefreshes: val.unverifiedRefreshes + 1,
+				}
 				continue
 			}
 		}
@@ -183,7 +525,9 @@ func (tw *TopologyWatcher) loadTablets() {
 		go func(alias *topodata.TabletAlias) {
 			defer wg.Done()
 			tw.sem <- 1 // Wait for active queue to drain.
-			tablet, err := tw.topoServer.GetTablet(tw.ctx, alias)
+			ctx, cancel := tw.readContext()
+			tablet, err := tw.topoServer.GetTablet(ctx, alias)
+			cancel()
 			topologyWatcherOperations.Add(topologyWatcherOpGetTablet, 1)
 			<-tw.sem // Done; enable next request to run
 			if err != nil {
@@ -199,6 +543,16 @@ func (tw *TopologyWatcher) loadTablets() {
 			if !(tw.tabletFilter == nil || tw.tabletFilter.IsIncluded(tablet.Tablet)) {
 				return
 			}
+			if admitter, ok := tw.tabletRecorder.(tabletAdmitter); ok && !admitter.admitsTablet(tablet.Tablet) {
+				// not recorded as known, so that it is read again at the next refresh
+				return
+			}
+			if tablet.Alias.Cell != tw.cell {
+				// The tablet record was moved to another cell: it belongs to the
+				// watcher of that cell, so that only one watcher reports it.
+				log.Warningf("tablet %v is listed in cell %v but its record is in cell %v, ignoring it", topoproto.TabletAliasString(alias), tw.cell, tablet.Alias.Cell)
+				return
+			}
 			tw.mu.Lock()
 			aliasStr := topoproto.TabletAliasString(alias)
 			newTablets[aliasStr] = &tabletInfo{
@@ -211,31 +565,34 @@ func (tw *TopologyWatcher) loadTablets() {
 
 	tw.mu.Unlock()
 	wg.Wait()
+
+	// don't call into the recorder once the watcher is stopped: it may be closed already
+	select {
+	case <-tw.ctx.Done():
+		return
+	default:
+	}
 	tw.mu.Lock()
 
-	for alias, newVal := range newTablets {
-		// trust the alias from topo and add it if it doesn't exist
-		if val, ok := tw.tablets[alias]; !ok {
-			tw.tabletRecorder.AddTablet(newVal.tablet)
-			topologyWatcherOperations.Add(topologyWatcherOpAddTablet, 1)
+	diff := diffTablets(tw.tablets, newTablets)
+	for _, replaced := range diff.replaced {
+		tw.tabletRecorder.ReplaceTablet(replaced.old, replaced.new)
+		topologyWatcherOperations.Add(topologyWatcherOpReplaceTablet, 1)
+	}
+	if len(diff.added) > 0 {
+		if batch, ok := tw.tabletRecorder.(batchTabletRecorder); ok {
+			// add all the new tablets at once, which is much cheaper on the first load
+			batch.AddTablets(diff.added)
 		} else {
-			// check if the host and port have changed. If yes, replace tablet
-			oldKey := TabletToMapKey(val.tablet)
-			newKey := TabletToMapKey(newVal.tablet)
-			if oldKey != newKey {
-				// This is the case where the same tablet alias is now reporting
-				// a different address key.
-				tw.tabletRecorder.ReplaceTablet(val.tablet, newVal.tablet)
-				topologyWatcherOperations.Add(topologyWatcherOpReplaceTablet, 1)
+			for _, tablet := range diff.added {
+				tw.tabletRecorder.AddTablet(tablet)
 			}
 		}
+		topologyWatcherOperations.Add(topologyWatcherOpAddTablet, int64(len(diff.added)))
 	}
-
-	for _, val := range tw.tablets {
-		if _, ok := newTablets[val.alias]; !ok {
-			tw.tabletRecorder.RemoveTablet(val.tablet)
-			topologyWatcherOperations.Add(topologyWatcherOpRemoveTablet, 1)
-		}
+	for _, tablet := range diff.removed {
+		tw.tabletRecorder.RemoveTablet(tablet)
+		topologyWatcherOperations.Add(topologyWatcherOpRemoveTablet, 1)
 	}
 	tw.tablets = newTablets
 	if !tw.firstLoadDone {
@@ -260,6 +617,42 @@ func (tw *TopologyWatcher) loadTablets() {
 
 }
 
+// tabletsDiff is the difference between two sets of tablets, see diffTablets.
+type tabletsDiff struct {
+	added    []*topodata.Tablet
+	replaced []tabletReplacement
+	removed  []*topodata.Tablet
+}
+
+// tabletReplacement is a tablet whose address changed.
+type tabletReplacement struct {
+	old, new *topodata.Tablet
+}
+
+// diffTablets compares two sets of tablets keyed by alias. The tablets of
+// newTablets whose alias is not in oldTablets are added, and the ones of
+// oldTablets whose alias is not in newTablets are removed. A tablet whose
+// alias is in both is replaced if its address key changed.
+func diffTablets(oldTablets, newTablets map[string]*tabletInfo) tabletsDiff {
+	var diff tabletsDiff
+	for alias, newVal := range newTablets {
+		// trust the alias from topo and add it if it doesn't exist
+		if val, ok := oldTablets[alias]; !ok {
+			diff.added = append(diff.added, newVal.tablet)
+		} else if TabletToMapKey(val.tablet) != TabletToMapKey(newVal.tablet) {
+			// This is the case where the same tablet alias is now reporting
+			// a different address key.
+			diff.replaced = append(diff.replaced, tabletReplacement{old: val.tablet, new: newVal.tablet})
+		}
+	}
+	for alias, val := range oldTablets {
+		if _, ok := newTablets[alias]; !ok {
+			diff.removed = append(diff.removed, val.tablet)
+		}
+	}
+	return diff
+}
+
 // RefreshLag returns the time since the last refresh
 func (tw *TopologyWatcher) RefreshLag() time.Duration {
 	tw.mu.Lock()
@@ -276,6 +669,29 @@ func (tw *TopologyWatcher) TopoChecksum() uint32 {
 	return tw.topoChecksum
 }
 
+// TopoWatcherStatusEntry is the state of a TopologyWatcher, for display.
+type TopoWatcherStatusEntry struct {
+	Cell         string
+	LastRefresh  time.Time
+	RefreshLag   time.Duration
+	TopoChecksum uint32
+	TabletCount  int
+}
+
+// Status returns the current state of the watcher.
+func (tw *TopologyWatcher) Status() TopoWatcherStatusEntry {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	return TopoWatcherStatusEntry{
+		Cell:         tw.cell,
+		LastRefresh:  tw.lastRefresh,
+		RefreshLag:   time.Since(tw.lastRefresh),
+		TopoChecksum: tw.topoChecksum,
+		TabletCount:  len(tw.tablets),
+	}
+}
+
 // TabletFilter is an interface that can be given to a TopologyWatcher
 // to be applied as an additional filter on the list of tablets returned by its getTablets function
 type TabletFilter interface {
@@ -384,6 +800,74 @@ func NewFilterByKeyspace(selectedKeyspaces []string) *FilterByKeyspace {
 // IsIncluded returns true if the tablet's keyspace should be
 // forwarded to the underlying LegacyTabletRecorder.
 func (fbk *FilterByKeyspace) IsIncluded(tablet *topodata.Tablet) bool {
-	_, exist := fbk.keyspaces[tablet.Keyspace]
+	return fbk.isKeyspaceIncluded(tablet.Keyspace)
+}
+
+func (fbk *FilterByKeyspace) isKeyspaceIncluded(keyspace string) bool {
+	_, exist := fbk.keyspaces[keyspace]
 	return exist
 }
+
+// FilterByTags is a filter that filters tablets by tags.
+type FilterByTags struct {
+	selectors map[string]string
+}
+
+// NewFilterByTags creates a new FilterByTags. All tablets which have
+// all the tags of selectors, with the same values, are included.
+func NewFilterByTags(selectors map[string]string) *FilterByTags {
+	return &FilterByTags{
+		selectors: selectors,
+	}
+}
+
+// NewFilterByTagsFromList creates a new FilterByTags from a list of
+// key=value selectors.
+func NewFilterByTagsFromList(selectors []string) (*FilterByTags, error) {
+	m := make(map[string]string)
+	for _, selector := range selectors {
+		parts := strings.SplitN(selector, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid FilterByTags parameter: %v", selector)
+		}
+		m[parts[0]] = parts[1]
+	}
+	return NewFilterByTags(m), nil
+}
+
+// IsIncluded returns true if the tablet has all the tags of the filter.
+func (fbt *FilterByTags) IsIncluded(tablet *topodata.Tablet) bool {
+	for key, value := range fbt.selectors {
+		if tagValue, ok := tablet.Tags[key]; !ok || tagValue != value {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterAll is a filter that includes the tablets which are included by
+// all of its filters.
+type FilterAll struct {
+	filters []TabletFilter
+}
+
+// NewFilterAll creates a new FilterAll. nil filters are ignored.
+func NewFilterAll(filters ...TabletFilter) *FilterAll {
+	fa := &FilterAll{}
+	for _, filter := range filters {
+		if filter != nil {
+			fa.filters = append(fa.filters, filter)
+		}
+	}
+	return fa
+}
+
+// IsIncluded returns true if all the filters include the tablet.
+func (fa *FilterAll) IsIncluded(tablet *topodata.Tablet) bool {
+	for _, filter := range fa.filters {
+		if !filter.IsIncluded(tablet) {
+			return false
+		}
+	}
+	return true
+}
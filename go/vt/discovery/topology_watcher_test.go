@@ -17,7 +17,13 @@ limitations under the License.
 package discovery
 
 import (
+	"errors"
+	"fmt"
 	"math/rand"
+	"path"
+	"reflect"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
@@ -27,6 +33,7 @@ import (
 	topodatapb "vitess.io/vitess/go/vt/proto/topodata"
 	"vitess.io/vitess/go/vt/topo"
 	"vitess.io/vitess/go/vt/topo/memorytopo"
+	"vitess.io/vitess/go/vt/topo/topoproto"
 )
 
 func checkOpCounts(t *testing.T, prevCounts, deltas map[string]int64) map[string]int64 {
@@ -458,3 +465,621 @@ func TestFilterByKeyspace(t *testing.T) {
 		}
 	}
 }
+
+func TestFilterByTags(t *testing.T) {
+	testcases := []struct {
+		tags     map[string]string
+		included bool
+	}{
+		{tags: nil, included: false},
+		{tags: map[string]string{"pool": "oltp"}, included: false},
+		{tags: map[string]string{"pool": "analytics"}, included: false},
+		{tags: map[string]string{"pool": "analytics", "region": "eu"}, included: true},
+		{tags: map[string]string{"pool": "analytics", "region": "eu", "other": "x"}, included: true},
+	}
+
+	f, err := NewFilterByTagsFromList([]string{"pool=analytics", "region=eu"})
+	if err != nil {
+		t.Fatalf("cannot create FilterByTags: %v", err)
+	}
+	for _, tc := range testcases {
+		tablet := &topodatapb.Tablet{
+			Keyspace: "ks1",
+			Shard:    "0",
+			Tags:     tc.tags,
+		}
+		if got := f.IsIncluded(tablet); got != tc.included {
+			t.Errorf("IsIncluded(%v) returned %v but expected %v", tc.tags, got, tc.included)
+		}
+
+		// composed with a keyspace filter
+		all := NewFilterAll(NewFilterByKeyspace([]string{"ks1"}), f)
+		if got := all.IsIncluded(tablet); got != tc.included {
+			t.Errorf("IsIncluded(%v) composed with keyspace filter returned %v but expected %v", tc.tags, got, tc.included)
+		}
+		tablet.Keyspace = "ks2"
+		if all.IsIncluded(tablet) {
+			t.Errorf("IsIncluded(%v) composed with keyspace filter should not include keyspace ks2", tc.tags)
+		}
+	}
+
+	if _, err := NewFilterByTagsFromList([]string{"pool"}); err == nil {
+		t.Errorf("NewFilterByTagsFromList should fail without a value")
+	}
+}
+
+func TestKeyspacesTabletsWatcher(t *testing.T) {
+	ts := memorytopo.NewServer(testCell)
+	fhc := NewFakeHealthCheck()
+	ctx := context.Background()
+	keyspaces := []string{"ks1", "ks2", "ks3", "ks4", "ks5"}
+	shards := []string{"-80", "80-"}
+
+	var uid uint32
+	for _, keyspace := range keyspaces {
+		if err := ts.CreateKeyspace(ctx, keyspace, &topodatapb.Keyspace{}); err != nil {
+			t.Fatalf("CreateKeyspace failed: %v", err)
+		}
+		for _, shard := range shards {
+			if err := ts.CreateShard(ctx, keyspace, shard); err != nil {
+				t.Fatalf("CreateShard failed: %v", err)
+			}
+			for i := 0; i < 3; i++ {
+				uid++
+				tablet := &topodatapb.Tablet{
+					Alias: &topodatapb.TabletAlias{
+						Cell: testCell,
+						Uid:  uid,
+					},
+					Hostname: testHostName,
+					PortMap: map[string]int32{
+						"vt": int32(uid),
+					},
+					Keyspace: keyspace,
+					Shard:    shard,
+				}
+				if err := ts.CreateTablet(ctx, tablet); err != nil {
+					t.Fatalf("CreateTablet failed: %v", err)
+				}
+			}
+		}
+	}
+
+	topologyWatcherOperations.ZeroAll()
+	counts := topologyWatcherOperations.Counts()
+	tw := NewKeyspacesTabletsWatcher(ctx, ts, fhc, nil, testCell, []string{"ks2", "missing"}, 10*time.Minute, true, 5)
+	tw.loadTablets()
+
+	// only the 6 tablets of ks2 should have been fetched
+	checkOpCounts(t, counts, map[string]int64{"ListTablets": 1, "GetTablet": 6, "AddTablet": 6})
+	allTablets := fhc.GetAllTablets()
+	if len(allTablets) != 6 {
+		t.Errorf("fhc.GetAllTablets() returned %v tablets, want 6", len(allTablets))
+	}
+	for _, tablet := range allTablets {
+		if tablet.Keyspace != "ks2" {
+			t.Errorf("unexpected tablet %v from keyspace %v", tablet.Alias, tablet.Keyspace)
+		}
+	}
+	tw.Stop()
+}
+
+func TestTopologyWatcherTabletMovedCell(t *testing.T) {
+	ts := memorytopo.NewServer("aa", "bb")
+	ctx := context.Background()
+	fhcA := NewFakeHealthCheck()
+	fhcB := NewFakeHealthCheck()
+	twA := NewCellTabletsWatcher(ctx, ts, fhcA, nil, "aa", 10*time.Minute, true, 5)
+	defer twA.Stop()
+	twB := NewCellTabletsWatcher(ctx, ts, fhcB, nil, "bb", 10*time.Minute, true, 5)
+	defer twB.Stop()
+
+	tablet := &topodatapb.Tablet{
+		Alias: &topodatapb.TabletAlias{
+			Cell: "aa",
+			Uid:  1,
+		},
+		Hostname: "host1",
+		PortMap: map[string]int32{
+			"vt": 123,
+		},
+		Keyspace: "keyspace",
+		Shard:    "shard",
+	}
+	if err := ts.CreateTablet(ctx, tablet); err != nil {
+		t.Fatalf("CreateTablet failed: %v", err)
+	}
+	twA.loadTablets()
+	twB.loadTablets()
+	if got := len(fhcA.GetAllTablets()); got != 1 {
+		t.Fatalf("watcher of cell aa has %v tablets, want 1", got)
+	}
+
+	// Move the tablet to cell bb: the stale alias is still listed in cell aa,
+	// but its record now points to cell bb.
+	moved := proto.Clone(tablet).(*topodatapb.Tablet)
+	moved.Alias.Cell = "bb"
+	if err := ts.CreateTablet(ctx, moved); err != nil {
+		t.Fatalf("CreateTablet failed: %v", err)
+	}
+	conn, err := ts.ConnForCell(ctx, "aa")
+	if err != nil {
+		t.Fatalf("ConnForCell failed: %v", err)
+	}
+	data, err := proto.Marshal(moved)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if _, err := conn.Update(ctx, path.Join(topo.TabletsPath, topoproto.TabletAliasString(tablet.Alias), topo.TabletFile), data, nil); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	twA.loadTablets()
+	twB.loadTablets()
+
+	if got := len(fhcA.GetAllTablets()); got != 0 {
+		t.Errorf("watcher of cell aa has %v tablets, want 0", got)
+	}
+	allB := fhcB.GetAllTablets()
+	if len(allB) != 1 {
+		t.Fatalf("watcher of cell bb has %v tablets, want 1", len(allB))
+	}
+	for _, tb := range allB {
+		if tb.Alias.Cell != "bb" {
+			t.Errorf("watcher of cell bb has tablet %v, want cell bb", tb.Alias)
+		}
+	}
+}
+
+func TestTopologyWatcherRemovesTabletsDeletedDuringOutage(t *testing.T) {
+	ts, factory := memorytopo.NewServerAndFactory("aa")
+	ctx := context.Background()
+	fhc := NewFakeHealthCheck()
+	tw := NewShardReplicationWatcher(ctx, ts, fhc, nil, "aa", "keyspace", "shard", 10*time.Minute, false /* refreshKnownTablets */, 5)
+	defer tw.Stop()
+	if tw.maxUnverifiedRefreshes != 0 {
+		t.Fatalf("the known tablets should not be reloaded by default, got maxUnverifiedRefreshes %v", tw.maxUnverifiedRefreshes)
+	}
+	tw.maxUnverifiedRefreshes = 3
+
+	tablet := &topodatapb.Tablet{
+		Alias: &topodatapb.TabletAlias{
+			Cell: "aa",
+			Uid:  1,
+		},
+		Hostname: "host1",
+		PortMap: map[string]int32{
+			"vt": 123,
+		},
+		Keyspace: "keyspace",
+		Shard:    "shard",
+	}
+	if err := ts.CreateTablet(ctx, tablet); err != nil {
+		t.Fatalf("CreateTablet failed: %v", err)
+	}
+	tw.loadTablets()
+	if got := len(fhc.GetAllTablets()); got != 1 {
+		t.Fatalf("fhc.GetAllTablets() returned %v tablets, want 1", got)
+	}
+
+	// The tablet is deleted during a topo outage, but its alias is still
+	// listed in the replication graph.
+	factory.SetError(errors.New("topo unavailable"))
+	tw.loadTablets()
+	factory.SetError(nil)
+	if err := ts.DeleteTablet(ctx, tablet.Alias); err != nil {
+		t.Fatalf("DeleteTablet failed: %v", err)
+	}
+
+	counts := topologyWatcherOperations.Counts()
+	successfulRefreshes := 0
+	for i := 0; len(fhc.GetAllTablets()) > 0; i++ {
+		if successfulRefreshes > tw.maxUnverifiedRefreshes {
+			t.Fatalf("tablet still known after %v successful refreshes", successfulRefreshes)
+		}
+		if i%2 == 0 {
+			factory.SetError(errors.New("topo unavailable"))
+			tw.loadTablets()
+			factory.SetError(nil)
+			continue
+		}
+		tw.loadTablets()
+		successfulRefreshes++
+	}
+	checkOpCounts(t, counts, map[string]int64{"ListTablets": int64(2 * successfulRefreshes), "GetTablet": 1, "RemoveTablet": 1})
+}
+
+// blockingFactory is a topo.Factory whose connections block on reading
+// the path blockedPath, until the context is done.
+type blockingFactory struct {
+	topo.Factory
+	blockedPath string
+}
+
+func (f *blockingFactory) Create(cell, serverAddr, root string) (topo.Conn, error) {
+	conn, err := f.Factory.Create(cell, serverAddr, root)
+	if err != nil {
+		return nil, err
+	}
+	return &blockingConn{Conn: conn, blockedPath: f.blockedPath}, nil
+}
+
+type blockingConn struct {
+	topo.Conn
+	blockedPath string
+}
+
+func (c *blockingConn) Get(ctx context.Context, filePath string) ([]byte, topo.Version, error) {
+	if filePath == c.blockedPath {
+		<-ctx.Done()
+		return nil, nil, ctx.Err()
+	}
+	return c.Conn.Get(ctx, filePath)
+}
+
+func TestTopologyWatcherGetTabletTimeout(t *testing.T) {
+	ts, factory := memorytopo.NewServerAndFactory("aa")
+	ctx := context.Background()
+	for i := 1; i <= 3; i++ {
+		tablet := &topodatapb.Tablet{
+			Alias: &topodatapb.TabletAlias{
+				Cell: "aa",
+				Uid:  uint32(i),
+			},
+			Hostname: "host1",
+			PortMap: map[string]int32{
+				"vt": int32(i),
+			},
+			Keyspace: "keyspace",
+			Shard:    "shard",
+		}
+		if err := ts.CreateTablet(ctx, tablet); err != nil {
+			t.Fatalf("CreateTablet failed: %v", err)
+		}
+	}
+
+	// reading the second tablet hangs
+	blockedAlias := &topodatapb.TabletAlias{Cell: "aa", Uid: 2}
+	blockingTS, err := topo.NewWithFactory(&blockingFactory{
+		Factory:     factory,
+		blockedPath: path.Join(topo.TabletsPath, topoproto.TabletAliasString(blockedAlias), topo.TabletFile),
+	}, "", "")
+	if err != nil {
+		t.Fatalf("NewWithFactory failed: %v", err)
+	}
+	fhc := NewFakeHealthCheck()
+	tw := NewCellTabletsWatcher(ctx, blockingTS, fhc, nil, "aa", 10*time.Minute, true, 5)
+	defer tw.Stop()
+	tw.topoReadTimeout = 10 * time.Millisecond
+
+	counts := topologyWatcherOperations.Counts()
+	errorCounts := topologyWatcherErrors.Counts()
+	done := make(chan struct{})
+	go func() {
+		tw.loadTablets()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("the refresh did not complete")
+	}
+
+	checkOpCounts(t, counts, map[string]int64{"ListTablets": 1, "GetTablet": 3, "AddTablet": 2})
+	if got, want := topologyWatcherErrors.Counts()[topologyWatcherOpGetTablet]-errorCounts[topologyWatcherOpGetTablet], int64(1); got != want {
+		t.Errorf("GetTablet errors increased by %v, want %v", got, want)
+	}
+	allTablets := fhc.GetAllTablets()
+	if len(allTablets) != 2 {
+		t.Errorf("fhc.GetAllTablets() returned %v tablets, want 2", len(allTablets))
+	}
+	for _, tablet := range allTablets {
+		if proto.Equal(tablet.Alias, blockedAlias) {
+			t.Errorf("the tablet %v which could not be read should not be added", tablet.Alias)
+		}
+	}
+}
+
+func TestTopologyWatcherNoTopoReadTimeout(t *testing.T) {
+	ts := memorytopo.NewServer("aa")
+	ctx := context.Background()
+	tablet := &topodatapb.Tablet{
+		Alias:    &topodatapb.TabletAlias{Cell: "aa", Uid: 1},
+		Hostname: "host1",
+		PortMap:  map[string]int32{"vt": 1},
+		Keyspace: "keyspace",
+		Shard:    "shard",
+	}
+	if err := ts.CreateTablet(ctx, tablet); err != nil {
+		t.Fatalf("CreateTablet failed: %v", err)
+	}
+
+	fhc := NewFakeHealthCheck()
+	tw := NewCellTabletsWatcher(ctx, ts, fhc, nil, "aa", 10*time.Minute, true, 5)
+	defer tw.Stop()
+	// a timeout of 0 disables it, rather than failing every read
+	tw.topoReadTimeout = 0
+	tw.loadTablets()
+	if got := len(fhc.GetAllTablets()); got != 1 {
+		t.Fatalf("fhc.GetAllTablets() returned %v tablets, want 1", got)
+	}
+}
+
+func TestShardReplicationWatcherWatch(t *testing.T) {
+	ts := memorytopo.NewServer("aa")
+	ctx := context.Background()
+	newTablet := func(uid uint32) *topodatapb.Tablet {
+		return &topodatapb.Tablet{
+			Alias:    &topodatapb.TabletAlias{Cell: "aa", Uid: uid},
+			Hostname: "host1",
+			PortMap:  map[string]int32{"vt": int32(uid)},
+			Keyspace: "keyspace",
+			Shard:    "shard",
+		}
+	}
+	if err := ts.CreateTablet(ctx, newTablet(1)); err != nil {
+		t.Fatalf("CreateTablet failed: %v", err)
+	}
+
+	fhc := NewFakeHealthCheck()
+	// the refresh interval is too long for the polling to see the new tablet
+	tw := NewShardReplicationWatcher(ctx, ts, fhc, nil, "aa", "keyspace", "shard", time.Hour, true, 5)
+	go tw.Start()
+	defer tw.Stop()
+	if err := tw.WaitForInitialTopology(ctx); err != nil {
+		t.Fatalf("WaitForInitialTopology failed: %v", err)
+	}
+	if got := len(fhc.GetAllTablets()); got != 1 {
+		t.Fatalf("fhc.GetAllTablets() returned %v tablets, want 1", got)
+	}
+
+	if err := ts.CreateTablet(ctx, newTablet(2)); err != nil {
+		t.Fatalf("CreateTablet failed: %v", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for len(fhc.GetAllTablets()) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the new tablet was not added, fhc.GetAllTablets() = %v", fhc.GetAllTablets())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKeyspacesTabletsWatcherWatch(t *testing.T) {
+	ts := memorytopo.NewServer("aa")
+	ctx := context.Background()
+	if err := ts.CreateKeyspace(ctx, "keyspace", &topodatapb.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	for _, shard := range []string{"-80", "80-"} {
+		if err := ts.CreateShard(ctx, "keyspace", shard); err != nil {
+			t.Fatalf("CreateShard failed: %v", err)
+		}
+	}
+	newTablet := func(uid uint32, shard string) *topodatapb.Tablet {
+		return &topodatapb.Tablet{
+			Alias:    &topodatapb.TabletAlias{Cell: "aa", Uid: uid},
+			Hostname: "host1",
+			PortMap:  map[string]int32{"vt": int32(uid)},
+			Keyspace: "keyspace",
+			Shard:    shard,
+		}
+	}
+	// the ShardReplication records only exist once the shards have a tablet
+	for i, shard := range []string{"-80", "80-"} {
+		if err := ts.CreateTablet(ctx, newTablet(uint32(i+1), shard)); err != nil {
+			t.Fatalf("CreateTablet failed: %v", err)
+		}
+	}
+
+	fhc := NewFakeHealthCheck()
+	// the refresh interval is too long for the polling to see the new tablets
+	tw := NewKeyspacesTabletsWatcher(ctx, ts, fhc, nil, "aa", []string{"keyspace", "missing"}, time.Hour, true, 5)
+	go tw.Start()
+	defer tw.Stop()
+	if err := tw.WaitForInitialTopology(ctx); err != nil {
+		t.Fatalf("WaitForInitialTopology failed: %v", err)
+	}
+	if got := len(fhc.GetAllTablets()); got != 2 {
+		t.Fatalf("fhc.GetAllTablets() returned %v tablets, want 2", got)
+	}
+
+	// the ShardReplication record of each shard is watched
+	for i, shard := range []string{"-80", "80-"} {
+		if err := ts.CreateTablet(ctx, newTablet(uint32(i+3), shard)); err != nil {
+			t.Fatalf("CreateTablet failed: %v", err)
+		}
+		deadline := time.Now().Add(10 * time.Second)
+		for len(fhc.GetAllTablets()) != i+3 {
+			if time.Now().After(deadline) {
+				t.Fatalf("the new tablet of shard %v was not added, fhc.GetAllTablets() = %v", shard, fhc.GetAllTablets())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestCellTabletsWatcherPollsOnly(t *testing.T) {
+	ts := memorytopo.NewServer("aa")
+	// there is no record listing the tablets of a cell to watch
+	tw := NewCellTabletsWatcher(context.Background(), ts, NewFakeHealthCheck(), nil, "aa", time.Hour, true, 5)
+	defer tw.Stop()
+	if tw.watchFiles != nil {
+		t.Errorf("the tablets of a cell should only be polled")
+	}
+}
+
+func TestTopologyWatcherPausedBeforeFirstLoad(t *testing.T) {
+	ts := memorytopo.NewServer("aa")
+	ctx := context.Background()
+	tablet := &topodatapb.Tablet{
+		Alias:    &topodatapb.TabletAlias{Cell: "aa", Uid: 1},
+		Hostname: "host1",
+		PortMap:  map[string]int32{"vt": 1},
+		Keyspace: "keyspace",
+		Shard:    "shard",
+	}
+	if err := ts.CreateTablet(ctx, tablet); err != nil {
+		t.Fatalf("CreateTablet failed: %v", err)
+	}
+
+	fhc := NewFakeHealthCheck()
+	tw := NewCellTabletsWatcher(ctx, ts, fhc, nil, "aa", time.Hour, true, 5)
+	// the tablets are still loaded once, so that the wait returns
+	tw.Pause()
+	go tw.Start()
+	defer tw.Stop()
+	waitCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := tw.WaitForInitialTopology(waitCtx); err != nil {
+		t.Fatalf("WaitForInitialTopology failed: %v", err)
+	}
+	if got := len(fhc.GetAllTablets()); got != 1 {
+		t.Fatalf("fhc.GetAllTablets() returned %v tablets, want 1", got)
+	}
+}
+
+// noWatchFactory is a topo.Factory whose connections do not support watches.
+type noWatchFactory struct {
+	topo.Factory
+}
+
+func (f *noWatchFactory) Create(cell, serverAddr, root string) (topo.Conn, error) {
+	conn, err := f.Factory.Create(cell, serverAddr, root)
+	if err != nil {
+		return nil, err
+	}
+	return &noWatchConn{Conn: conn}, nil
+}
+
+type noWatchConn struct {
+	topo.Conn
+}
+
+func (c *noWatchConn) Watch(ctx context.Context, filePath string) (*topo.WatchData, <-chan *topo.WatchData, topo.CancelFunc) {
+	return &topo.WatchData{Err: topo.NewError(topo.NoImplementation, filePath)}, nil, nil
+}
+
+func TestShardReplicationWatcherNoWatch(t *testing.T) {
+	_, factory := memorytopo.NewServerAndFactory("aa")
+	ts, err := topo.NewWithFactory(&noWatchFactory{Factory: factory}, "", "")
+	if err != nil {
+		t.Fatalf("NewWithFactory failed: %v", err)
+	}
+	ctx := context.Background()
+	tablet := &topodatapb.Tablet{
+		Alias:    &topodatapb.TabletAlias{Cell: "aa", Uid: 1},
+		Hostname: "host1",
+		PortMap:  map[string]int32{"vt": 1},
+		Keyspace: "keyspace",
+		Shard:    "shard",
+	}
+	if err := ts.CreateTablet(ctx, tablet); err != nil {
+		t.Fatalf("CreateTablet failed: %v", err)
+	}
+
+	// the tablets are still polled
+	fhc := NewFakeHealthCheck()
+	tw := NewShardReplicationWatcher(ctx, ts, fhc, nil, "aa", "keyspace", "shard", time.Hour, true, 5)
+	go tw.Start()
+	defer tw.Stop()
+	if err := tw.WaitForInitialTopology(ctx); err != nil {
+		t.Fatalf("WaitForInitialTopology failed: %v", err)
+	}
+	if got := len(fhc.GetAllTablets()); got != 1 {
+		t.Fatalf("fhc.GetAllTablets() returned %v tablets, want 1", got)
+	}
+}
+
+func TestTopologyWatcherSetRefreshKnownTablets(t *testing.T) {
+	ts := memorytopo.NewServer("aa")
+	ctx := context.Background()
+	fhc := NewFakeHealthCheck()
+	tw := NewCellTabletsWatcher(ctx, ts, fhc, nil, "aa", 10*time.Minute, false /* refreshKnownTablets */, 5)
+	defer tw.Stop()
+	tw.maxUnverifiedRefreshes = 0
+
+	tablet := &topodatapb.Tablet{
+		Alias:    &topodatapb.TabletAlias{Cell: "aa", Uid: 1},
+		Hostname: "host1",
+		PortMap:  map[string]int32{"vt": 123},
+		Keyspace: "keyspace",
+		Shard:    "shard",
+	}
+	if err := ts.CreateTablet(ctx, tablet); err != nil {
+		t.Fatalf("CreateTablet failed: %v", err)
+	}
+	tw.loadTablets()
+	hostnames := func() []string {
+		var res []string
+		for _, tablet := range fhc.GetAllTablets() {
+			res = append(res, tablet.Hostname)
+		}
+		return res
+	}
+	if got, want := hostnames(), []string{"host1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("tablet hostnames = %v, want %v", got, want)
+	}
+
+	if _, err := ts.UpdateTabletFields(ctx, tablet.Alias, func(t *topodatapb.Tablet) error {
+		t.Hostname = "host2"
+		return nil
+	}); err != nil {
+		t.Fatalf("UpdateTabletFields failed: %v", err)
+	}
+	// the known tablet is not reloaded
+	tw.loadTablets()
+	if got, want := hostnames(), []string{"host1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("tablet hostnames = %v, want %v", got, want)
+	}
+
+	tw.SetRefreshKnownTablets(true)
+	tw.loadTablets()
+	if got, want := hostnames(), []string{"host2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("tablet hostnames = %v, want %v", got, want)
+	}
+}
+
+// addOnlyRecorder is a TabletRecorder which can't add tablets in batch.
+type addOnlyRecorder struct {
+	mu    sync.Mutex
+	added []string
+}
+
+func (r *addOnlyRecorder) AddTablet(tablet *topodatapb.Tablet) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.added = append(r.added, topoproto.TabletAliasString(tablet.Alias))
+}
+
+func (r *addOnlyRecorder) RemoveTablet(tablet *topodatapb.Tablet) {}
+
+func (r *addOnlyRecorder) ReplaceTablet(old, new *topodatapb.Tablet) {}
+
+func TestTopologyWatcherWithoutBatchRecorder(t *testing.T) {
+	ts := memorytopo.NewServer("aa")
+	ctx := context.Background()
+	recorder := &addOnlyRecorder{}
+	tw := NewCellTabletsWatcher(ctx, ts, recorder, nil, "aa", 10*time.Minute, true /* refreshKnownTablets */, 5)
+	defer tw.Stop()
+
+	for uid := uint32(1); uid <= 2; uid++ {
+		tablet := &topodatapb.Tablet{
+			Alias:    &topodatapb.TabletAlias{Cell: "aa", Uid: uid},
+			Hostname: fmt.Sprintf("host%d", uid),
+			PortMap:  map[string]int32{"vt": 123},
+			Keyspace: "keyspace",
+			Shard:    "shard",
+		}
+		if err := ts.CreateTablet(ctx, tablet); err != nil {
+			t.Fatalf("CreateTablet failed: %v", err)
+		}
+	}
+	tw.loadTablets()
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	sort.Strings(recorder.added)
+	if want := []string{"aa-0000000001", "aa-0000000002"}; !reflect.DeepEqual(recorder.added, want) {
+		t.Errorf("added tablets = %v, want %v", recorder.added, want)
+	}
+}
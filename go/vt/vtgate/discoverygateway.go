@@ -245,17 +245,8 @@ func (dg *DiscoveryGateway) withRetry(ctx context.Context, target *querypb.Targe
 	var err error
 	invalidTablets := make(map[string]bool)
 
-	if len(discovery.AllowedTabletTypes) > 0 {
-		var match bool
-		for _, allowed := range discovery.AllowedTabletTypes {
-			if allowed == target.TabletType {
-				match = true
-				break
-			}
-		}
-		if !match {
-			return vterrors.Errorf(vtrpcpb.Code_FAILED_PRECONDITION, "requested tablet type %v is not part of the allowed tablet types for this vtgate: %+v", target.TabletType.String(), discovery.AllowedTabletTypes)
-		}
+	if !discovery.IsTabletTypeAllowed(target.Keyspace, target.TabletType) {
+		return vterrors.Errorf(vtrpcpb.Code_FAILED_PRECONDITION, "requested tablet type %v is not part of the allowed tablet types for this vtgate: %+v", target.TabletType.String(), discovery.AllowedTabletTypesForKeyspace(target.Keyspace))
 	}
 
 	bufferedOnce := false
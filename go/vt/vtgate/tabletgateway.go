@@ -17,12 +17,19 @@ limitations under the License.
 package vtgate
 
 import (
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"flag"
 	"fmt"
+	"hash/fnv"
+	"math"
 	"math/rand"
 	"sort"
 	"sync"
 	"time"
 
+	"vitess.io/vitess/go/stats"
+	"vitess.io/vitess/go/vt/logutil"
 	"vitess.io/vitess/go/vt/topo/topoproto"
 
 	"golang.org/x/net/context"
@@ -42,6 +49,28 @@ import (
 
 const (
 	tabletGatewayImplementation = "tabletgateway"
+
+	// tabletSelectionRandom picks the healthy tablets in random order,
+	// the tablets closest to the local cell first.
+	tabletSelectionRandom = "random"
+	// tabletSelectionOrdered picks the healthy tablets in alias order,
+	// which makes the routing reproducible.
+	tabletSelectionOrdered = "ordered"
+	// tabletSelectionFreshest picks the healthy tablets closest to the local
+	// cell in order of increasing replication lag.
+	tabletSelectionFreshest = "freshest"
+)
+
+var (
+	tabletSelectionPolicy      = flag.String("gateway_tablet_selection_policy", tabletSelectionRandom, "Allowed values: random (default), ordered, freshest. ordered always picks the healthy tablet with the lowest alias, which makes routing reproducible when debugging. freshest picks the healthy tablet of the local cell with the lowest replication lag, e.g. to read recent writes")
+	crossCellSpilloverFraction = flag.Float64("gateway_cross_cell_spillover_fraction", 0, "fraction of the queries, between 0 and 1, sent to a tablet of another cell even though the local cell has healthy tablets, e.g. to keep the connections to the other cells warm. The tablets of the same cell alias are preferred")
+	cpuUsageCeiling            = flag.Float64("gateway_cpu_usage_ceiling", 0, "if set, the tablets are picked less often as the cpu usage they report approaches this value, in the unit of the cpu_usage of their realtime stats, and not at all above it unless all the tablets are. 0 disables the cpu usage weighting")
+	allowStaleReads            = flag.Bool("allow_stale_reads_when_unhealthy", false, "if set, GetTabletAndConnection returns a tablet which is known but not healthy when a replica or rdonly target has no healthy tablet, instead of failing. The tablet is marked as Stale")
+	warnCrossCellMaster        = flag.Bool("healthcheck_warn_cross_cell_master", false, "if set, a warning is logged, at most every 5 seconds, when the master picked for a query is not in the local cell or cell alias, e.g. to detect the masters placed far from the vtgates. They are counted in CrossCellMasterSelections regardless")
+
+	// the masters picked for queries from another cell, see recordMasterSelection
+	crossCellMasterSelections = stats.NewCountersWithMultiLabels("CrossCellMasterSelections", "Masters picked for queries although they are not in the local cell or cell alias", []string{"Keyspace", "ShardName"})
+	crossCellMasterLogger     = logutil.NewThrottledLogger("CrossCellMasterSelections", 5*time.Second)
 )
 
 func init() {
@@ -65,6 +94,10 @@ type HealthCheck interface {
 	// TabletConnection returns the TabletConn of the given tablet.
 	TabletConnection(alias *topodatapb.TabletAlias) (queryservice.QueryService, error)
 
+	// GetAllConnections returns the connections to all the healthy tablets
+	// of the target.
+	GetAllConnections(target *querypb.Target) []queryservice.QueryService
+
 	// RegisterStats registers the connection counts stats
 	RegisterStats()
 
@@ -79,6 +112,38 @@ type HealthCheck interface {
 
 var _ HealthCheck = (*discovery.HealthCheckImpl)(nil)
 
+// tabletStatsGetter is implemented by the healthchecks which return the
+// unhealthy tablets too, like discovery.HealthCheckImpl. Without it, there
+// are no stale reads.
+type tabletStatsGetter interface {
+	// GetTabletStats returns all the tablets of the target, healthy or not.
+	GetTabletStats(target *querypb.Target) []*discovery.TabletHealth
+}
+
+var _ tabletStatsGetter = (*discovery.HealthCheckImpl)(nil)
+
+// cellAliasGetter is implemented by the healthchecks which know the cell
+// aliases, like discovery.HealthCheckImpl. Without it, the tablets of the
+// other cells of the same cell alias are not preferred.
+type cellAliasGetter interface {
+	// GetAliasByCell returns the cell alias the given cell belongs to,
+	// or the cell itself if it is not part of any alias.
+	GetAliasByCell(cell string) string
+}
+
+var _ cellAliasGetter = (*discovery.HealthCheckImpl)(nil)
+
+// noTabletErrorer is implemented by the healthchecks which tell apart the
+// targets without tablets from the targets without healthy tablets, like
+// discovery.HealthCheckImpl.
+type noTabletErrorer interface {
+	// NoTabletError returns discovery.ErrNoTablets if there are no tablets for
+	// the target, or discovery.ErrNoHealthyTablets if none of them is healthy.
+	NoTabletError(target *querypb.Target) error
+}
+
+var _ noTabletErrorer = (*discovery.HealthCheckImpl)(nil)
+
 // TabletGateway implements the Gateway interface.
 // This implementation uses the new healthcheck module.
 type TabletGateway struct {
@@ -87,6 +152,20 @@ type TabletGateway struct {
 	srvTopoServer srvtopo.Server
 	localCell     string
 	retryCount    int
+	// selectionPolicy is the order in which the healthy tablets are tried,
+	// one of tabletSelectionRandom, tabletSelectionOrdered or
+	// tabletSelectionFreshest.
+	selectionPolicy string
+	// spilloverFraction is the probability with which a tablet which is
+	// not in the local cell is tried first, when there are local tablets.
+	spilloverFraction float64
+	// cpuUsageCeiling is the cpu usage at which a tablet is not picked
+	// anymore, if there are other tablets. 0 disables it.
+	cpuUsageCeiling float64
+	// allowStaleReads is set from -allow_stale_reads_when_unhealthy.
+	allowStaleReads bool
+	// warnCrossCellMaster is set from -healthcheck_warn_cross_cell_master.
+	warnCrossCellMaster bool
 
 	// mu protects the fields of this group.
 	mu sync.Mutex
@@ -96,6 +175,12 @@ type TabletGateway struct {
 
 	// buffer, if enabled, buffers requests during a detected MASTER failover.
 	buffer *buffer.Buffer
+
+	// rngMu protects rng.
+	rngMu sync.Mutex
+	// rng is used to shuffle tablets. It is seeded independently for each
+	// gateway so that vtgates do not all pick tablets in the same order.
+	rng *rand.Rand
 }
 
 func createTabletGateway(ctx context.Context, _ discovery.LegacyHealthCheck, serv srvtopo.Server, cell string, _ int) Gateway {
@@ -112,15 +197,26 @@ func NewTabletGateway(ctx context.Context, serv srvtopo.Server, localCell string
 			log.Exitf("Unable to create new TabletGateway: %v", err)
 		}
 	}
+	switch *tabletSelectionPolicy {
+	case tabletSelectionRandom, tabletSelectionOrdered, tabletSelectionFreshest:
+	default:
+		log.Exitf("Unknown tablet selection policy: %v", *tabletSelectionPolicy)
+	}
 	hc := discovery.NewHealthCheck(ctx, *HealthCheckRetryDelay, *HealthCheckTimeout, topoServer, localCell)
 
 	gw := &TabletGateway{
-		hc:                hc,
-		srvTopoServer:     serv,
-		localCell:         localCell,
-		retryCount:        *RetryCount,
-		statusAggregators: make(map[string]*TabletStatusAggregator),
-		buffer:            buffer.New(),
+		hc:                  hc,
+		srvTopoServer:       serv,
+		localCell:           localCell,
+		retryCount:          *RetryCount,
+		selectionPolicy:     *tabletSelectionPolicy,
+		spilloverFraction:   *crossCellSpilloverFraction,
+		cpuUsageCeiling:     *cpuUsageCeiling,
+		allowStaleReads:     *allowStaleReads,
+		warnCrossCellMaster: *warnCrossCellMaster,
+		statusAggregators:   make(map[string]*TabletStatusAggregator),
+		buffer:              buffer.New(),
+		rng:                 newShuffleRand(),
 	}
 	// subscribe to healthcheck updates so that buffer can be notified if needed
 	// we run this in a separate goroutine so that normal processing doesn't need to block
@@ -208,17 +304,8 @@ func (gw *TabletGateway) withRetry(ctx context.Context, target *querypb.Target,
 	var err error
 	invalidTablets := make(map[string]bool)
 
-	if len(discovery.AllowedTabletTypes) > 0 {
-		var match bool
-		for _, allowed := range discovery.AllowedTabletTypes {
-			if allowed == target.TabletType {
-				match = true
-				break
-			}
-		}
-		if !match {
-			return vterrors.Errorf(vtrpcpb.Code_FAILED_PRECONDITION, "requested tablet type %v is not part of the allowed tablet types for this vtgate: %+v", target.TabletType.String(), discovery.AllowedTabletTypes)
-		}
+	if !discovery.IsTabletTypeAllowed(target.Keyspace, target.TabletType) {
+		return vterrors.Errorf(vtrpcpb.Code_FAILED_PRECONDITION, "requested tablet type %v is not part of the allowed tablet types for this vtgate: %+v", target.TabletType.String(), discovery.AllowedTabletTypesForKeyspace(target.Keyspace))
 	}
 
 	bufferedOnce := false
@@ -249,43 +336,39 @@ func (gw *TabletGateway) withRetry(ctx context.Context, target *querypb.Target,
 			}
 		}
 
-		tablets := gw.hc.GetHealthyTabletStats(target)
+		tablets := gw.healthyTablets(target)
 		if len(tablets) == 0 {
 			// fail fast if there is no tablet
-			err = vterrors.New(vtrpcpb.Code_UNAVAILABLE, "no valid tablet")
+			err = gw.noTabletError(target)
 			break
 		}
-		gw.shuffleTablets(gw.localCell, tablets)
-
-		var th *discovery.TabletHealth
 		// skip tablets we tried before
-		for _, t := range tablets {
-			tabletLastUsed = t.Tablet
-			if _, ok := invalidTablets[topoproto.TabletAliasString(tabletLastUsed.Alias)]; !ok {
-				th = t
-				break
-			} else {
-				tabletLastUsed = nil
-			}
-		}
-		if tabletLastUsed == nil {
+		th := gw.pickTablet(gw.localCell, nil, tablets, invalidTablets)
+		if th == nil {
+			tabletLastUsed = nil
 			// do not override error from last attempt.
 			if err == nil {
-				err = vterrors.New(vtrpcpb.Code_UNAVAILABLE, "no available connection")
+				err = discovery.ErrNoHealthyTablets
 			}
 			break
 		}
+		tabletLastUsed = th.Tablet
 
 		// execute
-		if th == nil || th.Conn == nil {
+		if th.Conn == nil {
 			err = vterrors.Errorf(vtrpcpb.Code_UNAVAILABLE, "no connection for tablet %v", tabletLastUsed)
 			invalidTablets[topoproto.TabletAliasString(tabletLastUsed.Alias)] = true
 			continue
 		}
 
+		// the tablet may be of a fallback type, address it with its own type
+		tabletTarget := target
+		if th.Target.TabletType != target.TabletType {
+			tabletTarget = &querypb.Target{Keyspace: target.Keyspace, Shard: target.Shard, TabletType: th.Target.TabletType, Cell: target.Cell}
+		}
 		startTime := time.Now()
 		var canRetry bool
-		canRetry, err = inner(ctx, target, th.Conn)
+		canRetry, err = inner(ctx, tabletTarget, th.Conn)
 		gw.updateStats(target, startTime, err)
 		if canRetry {
 			invalidTablets[topoproto.TabletAliasString(tabletLastUsed.Alias)] = true
@@ -318,51 +401,499 @@ func (gw *TabletGateway) getStatsAggregator(target *querypb.Target) *TabletStatu
 	return aggr
 }
 
-func (gw *TabletGateway) shuffleTablets(cell string, tablets []*discovery.TabletHealth) {
-	sameCell, diffCell, sameCellMax := 0, 0, -1
-	length := len(tablets)
+// GetTabletAndConnection returns a healthy tablet of the target which is not
+// in invalidTablets, and its connection. The tablets closest to localCell
+// are preferred.
+func (gw *TabletGateway) GetTabletAndConnection(target *querypb.Target, localCell string, invalidTablets map[string]bool) (*discovery.TabletHealth, queryservice.QueryService, error) {
+	return gw.GetTabletAndConnectionExcludingCells(target, localCell, invalidTablets, nil)
+}
+
+// GetTabletAndConnectionExcludingCells is like GetTabletAndConnection, but
+// never returns a tablet of one of excludeCells, e.g. because the cell is
+// being drained. It returns an UNAVAILABLE error if all the healthy tablets
+// are in excluded cells.
+// With -allow_stale_reads_when_unhealthy, a tablet which is not healthy is
+// returned, marked as Stale, if the target has no healthy tablet.
+func (gw *TabletGateway) GetTabletAndConnectionExcludingCells(target *querypb.Target, localCell string, invalidTablets map[string]bool, excludeCells []string) (*discovery.TabletHealth, queryservice.QueryService, error) {
+	return gw.getTabletAndConnection(target, localCell, invalidTablets, excludeCells, nil)
+}
+
+// GetTabletAndConnectionPreferringTags is like GetTabletAndConnection, but
+// prefers the tablets which have all the given tags, e.g. region=us-east,
+// whatever their cell. The other tablets are only returned if none of the
+// tablets with the tags can be used. The tags are ignored by the ordered
+// and freshest selection policies.
+func (gw *TabletGateway) GetTabletAndConnectionPreferringTags(target *querypb.Target, localCell string, invalidTablets map[string]bool, preferredTags map[string]string) (*discovery.TabletHealth, queryservice.QueryService, error) {
+	return gw.getTabletAndConnection(target, localCell, invalidTablets, nil, preferredTags)
+}
+
+// getTabletAndConnection implements GetTabletAndConnectionExcludingCells
+// and GetTabletAndConnectionPreferringTags.
+func (gw *TabletGateway) getTabletAndConnection(target *querypb.Target, localCell string, invalidTablets map[string]bool, excludeCells []string, preferredTags map[string]string) (*discovery.TabletHealth, queryservice.QueryService, error) {
+	tablets := gw.healthyTablets(target)
+	stale := false
+	if len(tablets) == 0 {
+		if tablets = gw.staleTablets(target); len(tablets) == 0 {
+			return nil, nil, gw.noTabletError(target)
+		}
+		stale = true
+	}
+	if len(excludeCells) > 0 {
+		tablets = excludeTabletsInCells(tablets, excludeCells)
+		if len(tablets) == 0 {
+			return nil, nil, vterrors.Errorf(vtrpcpb.Code_UNAVAILABLE, "no healthy %v tablet for %v outside of the excluded cells %v", target.TabletType, topoproto.KeyspaceShardString(target.Keyspace, target.Shard), excludeCells)
+		}
+	}
+	th := gw.pickTablet(localCell, preferredTags, tablets, invalidTablets)
+	if th != nil {
+		th.Stale = stale
+	}
+	return tabletAndConnection(th)
+}
+
+// noTabletError returns the error to report when no tablet of the target
+// can be used, see noTabletErrorer. It is discovery.ErrNoTablets if the
+// healthcheck can't tell.
+func (gw *TabletGateway) noTabletError(target *querypb.Target) error {
+	if nte, ok := gw.hc.(noTabletErrorer); ok {
+		return nte.NoTabletError(target)
+	}
+	return discovery.ErrNoTablets
+}
+
+// healthyTablets returns the healthy tablets of the target. If there are
+// none, the healthy tablets of the first -read_fallback_order tablet type
+// which has some, and is allowed for the keyspace, are returned instead.
+func (gw *TabletGateway) healthyTablets(target *querypb.Target) []*discovery.TabletHealth {
+	tablets := gw.hc.GetHealthyTabletStats(target)
+	if len(tablets) > 0 {
+		return tablets
+	}
+	for _, tabletType := range discovery.ReadFallbackTabletTypes(target.TabletType) {
+		if !discovery.IsTabletTypeAllowed(target.Keyspace, tabletType) {
+			continue
+		}
+		fallback := &querypb.Target{Keyspace: target.Keyspace, Shard: target.Shard, TabletType: tabletType}
+		if tablets = gw.hc.GetHealthyTabletStats(fallback); len(tablets) > 0 {
+			return tablets
+		}
+	}
+	return nil
+}
+
+// staleTablets returns the tablets of the target which have a connection,
+// healthy or not, if stale reads are allowed. Stale reads are never allowed
+// from a master.
+func (gw *TabletGateway) staleTablets(target *querypb.Target) []*discovery.TabletHealth {
+	if !gw.allowStaleReads || target.TabletType == topodatapb.TabletType_MASTER {
+		return nil
+	}
+	stats, ok := gw.hc.(tabletStatsGetter)
+	if !ok {
+		return nil
+	}
+	var res []*discovery.TabletHealth
+	for _, th := range stats.GetTabletStats(target) {
+		if th.Conn != nil {
+			res = append(res, th)
+		}
+	}
+	return res
+}
+
+// GetTabletAndConnectionForKey is like GetTabletAndConnection, but always
+// returns the same tablet for the same key while that tablet is healthy,
+// e.g. to take advantage of caching on the tablet. When that tablet is in
+// invalidTablets, the tablet with the next highest weight for the key is
+// returned. The tablets closest to localCell are preferred.
+func (gw *TabletGateway) GetTabletAndConnectionForKey(target *querypb.Target, localCell, key string, invalidTablets map[string]bool) (*discovery.TabletHealth, queryservice.QueryService, error) {
+	tablets := gw.healthyTablets(target)
+	if len(tablets) == 0 {
+		return nil, nil, gw.noTabletError(target)
+	}
+	return tabletAndConnection(gw.pickTabletForKey(localCell, key, tablets, invalidTablets))
+}
+
+// HedgedTablets are the tablets returned by GetTabletAndConnectionHedged.
+type HedgedTablets struct {
+	// Primary is the tablet to use first.
+	Primary *discovery.TabletHealth
+	// Backup is another tablet of the target, to use if the primary is slow.
+	// It is nil if there is no other usable tablet.
+	Backup *discovery.TabletHealth
+	// HedgeAfter is how long Execute waits for the primary before it also
+	// tries the backup.
+	HedgeAfter time.Duration
+}
+
+// GetTabletAndConnectionHedged is like GetTabletAndConnection, but also
+// returns a backup tablet, distinct from the primary tablet, for hedged
+// reads: see HedgedTablets.Execute.
+func (gw *TabletGateway) GetTabletAndConnectionHedged(ctx context.Context, target *querypb.Target, localCell string, invalidTablets map[string]bool, hedgeAfter time.Duration) (*HedgedTablets, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	tablets := gw.healthyTablets(target)
+	if len(tablets) == 0 {
+		return nil, gw.noTabletError(target)
+	}
+	primary, _, err := tabletAndConnection(gw.pickTablet(localCell, nil, tablets, invalidTablets))
+	if err != nil {
+		return nil, err
+	}
+	res := &HedgedTablets{Primary: primary, HedgeAfter: hedgeAfter}
+
+	skipped := map[string]bool{topoproto.TabletAliasString(primary.Tablet.Alias): true}
+	for alias := range invalidTablets {
+		skipped[alias] = true
+	}
+	if backup := gw.pickTablet(localCell, nil, tablets, skipped); backup != nil && backup.Conn != nil {
+		res.Backup = backup
+	}
+	return res, nil
+}
+
+// Execute runs f with the connection of the primary tablet. If it has not
+// returned after HedgeAfter, f is also run with the connection of the backup
+// tablet, and the first success is returned, or the error of the primary if
+// both fail. The other call is then canceled through its context.
+// Since f may run twice concurrently, it must only be used for reads.
+func (ht *HedgedTablets) Execute(ctx context.Context, f func(ctx context.Context, conn queryservice.QueryService) error) error {
+	if ht.Backup == nil {
+		return f(ctx, ht.Primary.Conn)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	primaryErr := make(chan error, 1)
+	go func() {
+		primaryErr <- f(ctx, ht.Primary.Conn)
+	}()
+	timer := time.NewTimer(ht.HedgeAfter)
+	defer timer.Stop()
+	select {
+	case err := <-primaryErr:
+		return err
+	case <-timer.C:
+	}
+
+	backupErr := make(chan error, 1)
+	go func() {
+		backupErr <- f(ctx, ht.Backup.Conn)
+	}()
+	select {
+	case err := <-primaryErr:
+		if err == nil {
+			return nil
+		}
+		if <-backupErr == nil {
+			return nil
+		}
+		return err
+	case err := <-backupErr:
+		if err == nil {
+			return nil
+		}
+		return <-primaryErr
+	}
+}
+
+// tabletAndConnection returns the picked tablet and its connection, or an
+// error if no tablet was picked or it has no connection.
+func tabletAndConnection(th *discovery.TabletHealth) (*discovery.TabletHealth, queryservice.QueryService, error) {
+	if th == nil {
+		return nil, nil, discovery.ErrNoHealthyTablets
+	}
+	if th.Conn == nil {
+		return nil, nil, vterrors.Errorf(vtrpcpb.Code_UNAVAILABLE, "no connection for tablet %v", th.Tablet)
+	}
+	return th, th.Conn, nil
+}
 
-	// move all same cell tablets to the front, this is O(n)
-	for {
-		sameCellMax = diffCell - 1
-		sameCell = gw.nextTablet(cell, tablets, sameCell, length, true)
-		diffCell = gw.nextTablet(cell, tablets, diffCell, length, false)
-		// either no more diffs or no more same cells should stop the iteration
-		if sameCell < 0 || diffCell < 0 {
+// excludeTabletsInCells returns the tablets which are not in any of the
+// given cells. It filters tablets in place.
+func excludeTabletsInCells(tablets []*discovery.TabletHealth, cells []string) []*discovery.TabletHealth {
+	res := tablets[:0]
+	for _, th := range tablets {
+		excluded := false
+		for _, cell := range cells {
+			if th.Tablet.Alias.Cell == cell {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			res = append(res, th)
+		}
+	}
+	return res
+}
+
+// pickTablet returns the tablet to try next according to the selection
+// policy, skipping the tablets we tried before, or nil if there is none.
+// The random and freshest policies prefer the tablets closest to cell, and
+// the random policy prefers the tablets with all the preferredTags first.
+// The tablets over the cpu usage ceiling are only picked if all the others
+// were tried, the least busy first.
+// tablets is reordered in place.
+func (gw *TabletGateway) pickTablet(cell string, preferredTags map[string]string, tablets []*discovery.TabletHealth, invalidTablets map[string]bool) *discovery.TabletHealth {
+	switch gw.selectionPolicy {
+	case tabletSelectionOrdered:
+		sort.Slice(tablets, func(i, j int) bool {
+			return topoproto.TabletAliasString(tablets[i].Tablet.Alias) < topoproto.TabletAliasString(tablets[j].Tablet.Alias)
+		})
+	case tabletSelectionFreshest:
+		gw.sortByFreshness(cell, tablets)
+	default:
+		gw.shuffleTablets(cell, preferredTags, tablets)
+	}
+	var picked, leastBusy *discovery.TabletHealth
+	for _, th := range tablets {
+		if invalidTablets[topoproto.TabletAliasString(th.Tablet.Alias)] {
+			continue
+		}
+		if gw.cpuWeight(th) > 0 {
+			picked = th
 			break
 		}
+		if leastBusy == nil || th.CPUUsage() < leastBusy.CPUUsage() {
+			leastBusy = th
+		}
+	}
+	if picked == nil {
+		picked = leastBusy
+	}
+	gw.recordMasterSelection(cell, picked)
+	return picked
+}
+
+// recordMasterSelection counts the master picked for a query if it is not
+// in the given cell or its cell alias, as the query then crosses cells.
+func (gw *TabletGateway) recordMasterSelection(cell string, th *discovery.TabletHealth) {
+	if th == nil || th.Target.TabletType != topodatapb.TabletType_MASTER || gw.proximity(cell)(th) < 2 {
+		return
+	}
+	crossCellMasterSelections.Add([]string{th.Target.Keyspace, th.Target.Shard}, 1)
+	if gw.warnCrossCellMaster {
+		crossCellMasterLogger.Warningf("The master %v of %v is in cell %v, not in the local cell %v or its cell alias",
+			topoproto.TabletAliasString(th.Tablet.Alias), topoproto.KeyspaceShardString(th.Target.Keyspace, th.Target.Shard), th.Tablet.Alias.Cell, cell)
+	}
+}
 
-		if sameCell < diffCell {
-			// fast forward the `sameCell` lookup to `diffCell + 1`, `diffCell` unchanged
-			sameCell = diffCell + 1
-		} else {
-			// sameCell > diffCell, swap needed
-			tablets[sameCell], tablets[diffCell] = tablets[diffCell], tablets[sameCell]
-			sameCell++
-			diffCell++
+// sortByFreshness sorts the tablets closest to cell first, and among them
+// the ones with the lowest replication lag first. A master has no lag.
+func (gw *TabletGateway) sortByFreshness(cell string, tablets []*discovery.TabletHealth) {
+	tier := gw.proximity(cell)
+	lag := func(th *discovery.TabletHealth) time.Duration {
+		if th.Target.TabletType == topodatapb.TabletType_MASTER {
+			return 0
 		}
+		return th.ReplicationLag()
 	}
+	sort.Slice(tablets, func(i, j int) bool {
+		if ti, tj := tier(tablets[i]), tier(tablets[j]); ti != tj {
+			return ti < tj
+		}
+		if li, lj := lag(tablets[i]), lag(tablets[j]); li != lj {
+			return li < lj
+		}
+		return topoproto.TabletAliasString(tablets[i].Tablet.Alias) < topoproto.TabletAliasString(tablets[j].Tablet.Alias)
+	})
+}
 
-	//shuffle in same cell tablets
-	for i := sameCellMax; i > 0; i-- {
-		swap := rand.Intn(i + 1)
-		tablets[i], tablets[swap] = tablets[swap], tablets[i]
+// cpuWeight returns the relative probability, between 0 and 1, with which
+// the tablet is picked given the cpu usage it reports: 1 when the cpu
+// usage ceiling is disabled, down to 0 at the ceiling and above.
+func (gw *TabletGateway) cpuWeight(th *discovery.TabletHealth) float64 {
+	if gw.cpuUsageCeiling <= 0 {
+		return 1
+	}
+	return math.Max(0, 1-th.CPUUsage()/gw.cpuUsageCeiling)
+}
+
+// proximity returns a function which ranks the tablets by their distance
+// to the given cell: 0 for the tablets of the cell, 1 for the tablets of the
+// other cells of its cell alias, 2 for the rest.
+// The cell alias of each cell is looked up once by the returned function,
+// which must not be used concurrently.
+func (gw *TabletGateway) proximity(cell string) func(th *discovery.TabletHealth) int {
+	aliases, ok := gw.hc.(cellAliasGetter)
+	cellAlias := ""
+	tiers := make(map[string]int)
+	return func(th *discovery.TabletHealth) int {
+		tabletCell := th.Tablet.Alias.Cell
+		if tabletCell == cell {
+			return 0
+		}
+		if !ok {
+			return 2
+		}
+		if tier, found := tiers[tabletCell]; found {
+			return tier
+		}
+		if cellAlias == "" {
+			cellAlias = aliases.GetAliasByCell(cell)
+		}
+		tier := 2
+		if aliases.GetAliasByCell(tabletCell) == cellAlias {
+			tier = 1
+		}
+		tiers[tabletCell] = tier
+		return tier
 	}
+}
 
-	//shuffle in diff cell tablets
-	for i, diffCellMin := length-1, sameCellMax+1; i > diffCellMin; i-- {
-		swap := rand.Intn(i-sameCellMax) + diffCellMin
+// pickTabletForKey returns the tablet with the highest rendezvous hashing
+// weight for key among the tablets closest to cell, skipping the tablets we
+// tried before, or nil if there is none. A key keeps landing on the same
+// tablet as long as it is healthy, and when a tablet goes away only the keys
+// which landed on it move.
+func (gw *TabletGateway) pickTabletForKey(cell, key string, tablets []*discovery.TabletHealth, invalidTablets map[string]bool) *discovery.TabletHealth {
+	tier := gw.proximity(cell)
+	type rankedTablet struct {
+		th     *discovery.TabletHealth
+		tier   int
+		weight uint64
+	}
+	ranked := make([]rankedTablet, 0, len(tablets))
+	for _, th := range tablets {
+		alias := topoproto.TabletAliasString(th.Tablet.Alias)
+		if invalidTablets[alias] {
+			continue
+		}
+		ranked = append(ranked, rankedTablet{th: th, tier: tier(th), weight: rendezvousWeight(key, alias)})
+	}
+	if len(ranked) == 0 {
+		return nil
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].tier != ranked[j].tier {
+			return ranked[i].tier < ranked[j].tier
+		}
+		return ranked[i].weight > ranked[j].weight
+	})
+	gw.recordMasterSelection(cell, ranked[0].th)
+	return ranked[0].th
+}
+
+// rendezvousWeight returns the weight of the given tablet for key.
+func rendezvousWeight(key, alias string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(alias))
+	return h.Sum64()
+}
+
+// shuffleTablets orders the tablets by proximity to the given cell, and
+// shuffles them within each group: the tablets of the cell come first,
+// then the tablets of the other cells of its cell alias, then the rest.
+// With a probability of spilloverFraction, the first tablet of the nearest
+// other cell is moved in front of the tablets of the cell.
+// If the cpu usage ceiling is set, the tablets are weighted by cpuWeight
+// within each group.
+// If preferredTags is set, the tablets which have all the tags come first,
+// each of the two buckets being ordered as above.
+func (gw *TabletGateway) shuffleTablets(cell string, preferredTags map[string]string, tablets []*discovery.TabletHealth) {
+	if len(preferredTags) > 0 {
+		// two way partition of the tablets by tags, then by tier
+		preferredEnd := 0
+		for i, th := range tablets {
+			if hasTags(th.Tablet, preferredTags) {
+				tablets[preferredEnd], tablets[i] = tablets[i], tablets[preferredEnd]
+				preferredEnd++
+			}
+		}
+		gw.shuffleTablets(cell, nil, tablets[:preferredEnd])
+		gw.shuffleTablets(cell, nil, tablets[preferredEnd:])
+		return
+	}
+
+	tier := gw.proximity(cell)
+
+	// three way partition of the tablets by tier, this is O(n)
+	sameCellEnd, sameAliasEnd, diffAliasStart := 0, 0, len(tablets)
+	for sameAliasEnd < diffAliasStart {
+		switch tier(tablets[sameAliasEnd]) {
+		case 0:
+			tablets[sameCellEnd], tablets[sameAliasEnd] = tablets[sameAliasEnd], tablets[sameCellEnd]
+			sameCellEnd++
+			sameAliasEnd++
+		case 1:
+			sameAliasEnd++
+		default:
+			diffAliasStart--
+			tablets[sameAliasEnd], tablets[diffAliasStart] = tablets[diffAliasStart], tablets[sameAliasEnd]
+		}
+	}
+
+	gw.rngMu.Lock()
+	defer gw.rngMu.Unlock()
+
+	shuffle := gw.shuffleLocked
+	if gw.cpuUsageCeiling > 0 {
+		shuffle = gw.weightedShuffleLocked
+	}
+	shuffle(tablets[:sameCellEnd])
+	shuffle(tablets[sameCellEnd:sameAliasEnd])
+	shuffle(tablets[sameAliasEnd:])
+
+	// occasionally try the nearest other cell first, the local tablets are
+	// tried next
+	if sameCellEnd > 0 && sameCellEnd < len(tablets) && gw.rng.Float64() < gw.spilloverFraction {
+		spillover := tablets[sameCellEnd]
+		copy(tablets[1:sameCellEnd+1], tablets[:sameCellEnd])
+		tablets[0] = spillover
+	}
+}
+
+// hasTags returns true if the tablet has all the given tags.
+func hasTags(tablet *topodatapb.Tablet, tags map[string]string) bool {
+	for k, v := range tags {
+		if tv, ok := tablet.Tags[k]; !ok || tv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// shuffleLocked shuffles the tablets in place.
+// gw.rngMu must be locked before calling this function.
+func (gw *TabletGateway) shuffleLocked(tablets []*discovery.TabletHealth) {
+	for i := len(tablets) - 1; i > 0; i-- {
+		swap := gw.rng.Intn(i + 1)
 		tablets[i], tablets[swap] = tablets[swap], tablets[i]
 	}
 }
 
-func (gw *TabletGateway) nextTablet(cell string, tablets []*discovery.TabletHealth, offset, length int, sameCell bool) int {
-	for ; offset < length; offset++ {
-		if (tablets[offset].Tablet.Alias.Cell == cell) == sameCell {
-			return offset
+// weightedShuffleLocked shuffles the tablets in place, so that each tablet
+// comes first with a probability proportional to its cpuWeight. The tablets
+// with a weight of 0 come last.
+// gw.rngMu must be locked before calling this function.
+func (gw *TabletGateway) weightedShuffleLocked(tablets []*discovery.TabletHealth) {
+	// Efraimidis-Spirakis weighted random sampling: sorting by u^(1/w)
+	// with u uniform in [0, 1)
+	keys := make(map[*discovery.TabletHealth]float64, len(tablets))
+	for _, th := range tablets {
+		keys[th] = -1
+		if w := gw.cpuWeight(th); w > 0 {
+			keys[th] = math.Pow(gw.rng.Float64(), 1/w)
 		}
 	}
-	return -1
+	sort.Slice(tablets, func(i, j int) bool {
+		return keys[tablets[i]] > keys[tablets[j]]
+	})
+}
+
+// newShuffleRand returns a random source seeded from crypto/rand, falling
+// back to the current time if that fails.
+func newShuffleRand() *rand.Rand {
+	var seed int64
+	if err := binary.Read(cryptorand.Reader, binary.LittleEndian, &seed); err != nil {
+		log.Warningf("cannot read random seed, using current time: %v", err)
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed))
 }
 
 // TabletsCacheStatus returns a displayable version of the health check cache.
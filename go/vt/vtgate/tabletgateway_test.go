@@ -0,0 +1,632 @@
+/*
+Copyright 2020 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vtgate
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"vitess.io/vitess/go/vt/discovery"
+	"vitess.io/vitess/go/vt/topo"
+	"vitess.io/vitess/go/vt/topo/memorytopo"
+	"vitess.io/vitess/go/vt/topo/topoproto"
+	"vitess.io/vitess/go/vt/vterrors"
+	"vitess.io/vitess/go/vt/vttablet/queryservice"
+	"vitess.io/vitess/go/vt/vttablet/sandboxconn"
+
+	querypb "vitess.io/vitess/go/vt/proto/query"
+	topodatapb "vitess.io/vitess/go/vt/proto/topodata"
+	vtrpcpb "vitess.io/vitess/go/vt/proto/vtrpc"
+)
+
+func TestTabletGatewayShuffleTabletsUniform(t *testing.T) {
+	hc := discovery.NewHealthCheck(context.Background(), time.Millisecond, time.Hour, memorytopo.NewServer("cell1", "cell2"), "cell1")
+	defer hc.Close()
+	gw := &TabletGateway{hc: hc, rng: newShuffleRand()}
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+	tablets := []*discovery.TabletHealth{
+		{Tablet: topo.NewTablet(1, "cell1", "host1"), Target: target, Serving: true},
+		{Tablet: topo.NewTablet(2, "cell1", "host2"), Target: target, Serving: true},
+		{Tablet: topo.NewTablet(3, "cell1", "host3"), Target: target, Serving: true},
+		{Tablet: topo.NewTablet(4, "cell2", "host4"), Target: target, Serving: true},
+	}
+
+	const iterations = 30000
+	firstCounts := make(map[string]int)
+	for i := 0; i < iterations; i++ {
+		gw.shuffleTablets("cell1", nil, tablets)
+		assert.Equal(t, "cell2", tablets[3].Tablet.Alias.Cell, "diff cell tablet should be in the rear")
+		firstCounts[topoproto.TabletAliasString(tablets[0].Tablet.Alias)]++
+	}
+
+	// every same cell tablet should be picked first about a third of the time
+	assert.Equal(t, 3, len(firstCounts), "unexpected tablets picked first: %v", firstCounts)
+	expected := float64(iterations) / 3
+	for alias, count := range firstCounts {
+		assert.InDelta(t, expected, float64(count), expected*0.05, "tablet %v picked first %v times, expected about %v", alias, count, expected)
+	}
+}
+
+func TestTabletGatewayShuffleTabletsCellAlias(t *testing.T) {
+	ctx := context.Background()
+	ts := memorytopo.NewServer("cell1", "cell2", "cell3")
+	if err := ts.CreateCellsAlias(ctx, "region1", &topodatapb.CellsAlias{Cells: []string{"cell1", "cell2"}}); err != nil {
+		t.Fatalf("CreateCellsAlias failed: %v", err)
+	}
+	hc := discovery.NewHealthCheck(ctx, time.Millisecond, time.Hour, ts, "cell1")
+	defer hc.Close()
+	gw := &TabletGateway{hc: hc, rng: newShuffleRand()}
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+	sameCell := &discovery.TabletHealth{Tablet: topo.NewTablet(1, "cell1", "host1"), Target: target, Serving: true}
+	sameAlias := []*discovery.TabletHealth{
+		{Tablet: topo.NewTablet(2, "cell2", "host2"), Target: target, Serving: true},
+		{Tablet: topo.NewTablet(3, "cell2", "host3"), Target: target, Serving: true},
+	}
+	diffAlias := []*discovery.TabletHealth{
+		{Tablet: topo.NewTablet(4, "cell3", "host4"), Target: target, Serving: true},
+		{Tablet: topo.NewTablet(5, "cell3", "host5"), Target: target, Serving: true},
+	}
+
+	for i := 0; i < 100; i++ {
+		tablets := []*discovery.TabletHealth{diffAlias[0], sameAlias[0], diffAlias[1], sameCell, sameAlias[1]}
+		gw.shuffleTablets("cell1", nil, tablets)
+		assert.Equal(t, "cell1", tablets[0].Tablet.Alias.Cell, "same cell tablet should be first")
+		assert.Equal(t, "cell2", tablets[1].Tablet.Alias.Cell, "same alias tablets should be next")
+		assert.Equal(t, "cell2", tablets[2].Tablet.Alias.Cell, "same alias tablets should be next")
+		assert.Equal(t, "cell3", tablets[3].Tablet.Alias.Cell, "diff alias tablets should be in the rear")
+		assert.Equal(t, "cell3", tablets[4].Tablet.Alias.Cell, "diff alias tablets should be in the rear")
+	}
+
+	// with no tablet in the local cell, the same alias tablets come first
+	for i := 0; i < 100; i++ {
+		tablets := []*discovery.TabletHealth{diffAlias[0], diffAlias[1], sameAlias[0], sameAlias[1]}
+		gw.shuffleTablets("cell1", nil, tablets)
+		assert.Equal(t, "cell2", tablets[0].Tablet.Alias.Cell, "same alias tablet should be picked first")
+		assert.Equal(t, "cell2", tablets[1].Tablet.Alias.Cell, "same alias tablet should be picked first")
+	}
+}
+
+// aliasCountingHealthCheck counts the cell alias lookups.
+type aliasCountingHealthCheck struct {
+	staticHealthCheck
+	lookups int
+}
+
+func (hc *aliasCountingHealthCheck) GetAliasByCell(cell string) string {
+	hc.lookups++
+	if cell == "cell3" {
+		return "cell3"
+	}
+	return "region1"
+}
+
+func TestTabletGatewayShuffleTabletsAliasLookups(t *testing.T) {
+	hc := &aliasCountingHealthCheck{}
+	gw := &TabletGateway{hc: hc, rng: newShuffleRand()}
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+	var tablets []*discovery.TabletHealth
+	for uid := uint32(1); uid <= 12; uid++ {
+		cell := fmt.Sprintf("cell%d", uid%3+1)
+		tablets = append(tablets, &discovery.TabletHealth{Tablet: topo.NewTablet(uid, cell, "host"), Target: target, Serving: true})
+	}
+	gw.shuffleTablets("cell1", nil, tablets)
+	// the local cell, and each of the two other cells, once
+	assert.Equal(t, 3, hc.lookups)
+	for i, cell := range []string{"cell1", "cell1", "cell1", "cell1", "cell2", "cell2", "cell2", "cell2", "cell3", "cell3", "cell3", "cell3"} {
+		assert.Equal(t, cell, tablets[i].Tablet.Alias.Cell)
+	}
+
+	// without cell aliases only the local cell is preferred
+	gw.hc = &staticHealthCheck{}
+	gw.shuffleTablets("cell1", nil, tablets)
+	for _, th := range tablets[:4] {
+		assert.Equal(t, "cell1", th.Tablet.Alias.Cell)
+	}
+}
+
+func TestTabletGatewayCrossCellMasterSelections(t *testing.T) {
+	gw := &TabletGateway{hc: &aliasCountingHealthCheck{}, selectionPolicy: tabletSelectionOrdered, rng: newShuffleRand()}
+	target := &querypb.Target{Keyspace: "kmaster", Shard: "s", TabletType: topodatapb.TabletType_MASTER}
+	counts := func() int64 {
+		return crossCellMasterSelections.Counts()["kmaster.s"]
+	}
+
+	before := counts()
+	// cell2 is in the cell alias of cell1
+	sameAlias := &discovery.TabletHealth{Tablet: topo.NewTablet(1, "cell2", "host1"), Target: target, Serving: true}
+	require.Equal(t, sameAlias, gw.pickTablet("cell1", nil, []*discovery.TabletHealth{sameAlias}, nil))
+	assert.Equal(t, before, counts(), "the master of the same cell alias should not be counted")
+
+	remote := &discovery.TabletHealth{Tablet: topo.NewTablet(2, "cell3", "host2"), Target: target, Serving: true}
+	require.Equal(t, remote, gw.pickTablet("cell1", nil, []*discovery.TabletHealth{remote}, nil))
+	require.Equal(t, remote, gw.pickTabletForKey("cell1", "key", []*discovery.TabletHealth{remote}, nil))
+	assert.Equal(t, before+2, counts(), "the remote master should be counted each time it is picked")
+}
+
+func TestTabletGatewayPickTabletOrdered(t *testing.T) {
+	gw := &TabletGateway{selectionPolicy: tabletSelectionOrdered, rng: newShuffleRand()}
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+	tablets := []*discovery.TabletHealth{
+		{Tablet: topo.NewTablet(1, "cell1", "host1"), Target: target, Serving: true},
+		{Tablet: topo.NewTablet(2, "cell2", "host2"), Target: target, Serving: true},
+		{Tablet: topo.NewTablet(3, "cell1", "host3"), Target: target, Serving: true},
+		{Tablet: topo.NewTablet(4, "cell2", "host4"), Target: target, Serving: true},
+	}
+
+	tests := []struct {
+		invalidTablets map[string]bool
+		want           string
+	}{{
+		invalidTablets: map[string]bool{},
+		want:           "cell1-0000000001",
+	}, {
+		invalidTablets: map[string]bool{"cell1-0000000001": true},
+		want:           "cell1-0000000003",
+	}, {
+		invalidTablets: map[string]bool{"cell1-0000000001": true, "cell1-0000000003": true},
+		want:           "cell2-0000000002",
+	}}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			// the order in which the healthcheck returns the tablets does not matter
+			rand.Shuffle(len(tablets), func(i, j int) { tablets[i], tablets[j] = tablets[j], tablets[i] })
+			th := gw.pickTablet("cell1", nil, tablets, tt.invalidTablets)
+			require.NotNil(t, th)
+			assert.Equal(t, tt.want, topoproto.TabletAliasString(th.Tablet.Alias), "invalid tablets: %v", tt.invalidTablets)
+		}
+	}
+
+	all := map[string]bool{"cell1-0000000001": true, "cell1-0000000003": true, "cell2-0000000002": true, "cell2-0000000004": true}
+	assert.Nil(t, gw.pickTablet("cell1", nil, tablets, all))
+}
+
+func TestTabletGatewayPickTabletFreshest(t *testing.T) {
+	gw := &TabletGateway{hc: &staticHealthCheck{}, selectionPolicy: tabletSelectionFreshest, rng: newShuffleRand()}
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+	replica := func(uid uint32, cell string, lag uint32) *discovery.TabletHealth {
+		return &discovery.TabletHealth{
+			Tablet:  topo.NewTablet(uid, cell, "host"),
+			Target:  target,
+			Serving: true,
+			Stats:   &querypb.RealtimeStats{SecondsBehindMaster: lag},
+		}
+	}
+	tablets := []*discovery.TabletHealth{
+		replica(1, "cell1", 10),
+		replica(2, "cell1", 2),
+		replica(3, "cell1", 5),
+		// fresher, but in another cell
+		replica(4, "cell2", 0),
+	}
+
+	for i := 0; i < 20; i++ {
+		// the order in which the healthcheck returns the tablets does not matter
+		rand.Shuffle(len(tablets), func(i, j int) { tablets[i], tablets[j] = tablets[j], tablets[i] })
+		th := gw.pickTablet("cell1", nil, tablets, map[string]bool{})
+		require.NotNil(t, th)
+		assert.Equal(t, "cell1-0000000002", topoproto.TabletAliasString(th.Tablet.Alias))
+		var order []string
+		for _, th := range tablets {
+			order = append(order, topoproto.TabletAliasString(th.Tablet.Alias))
+		}
+		assert.Equal(t, []string{"cell1-0000000002", "cell1-0000000003", "cell1-0000000001", "cell2-0000000004"}, order)
+	}
+	th := gw.pickTablet("cell1", nil, tablets, map[string]bool{"cell1-0000000002": true})
+	require.NotNil(t, th)
+	assert.Equal(t, "cell1-0000000003", topoproto.TabletAliasString(th.Tablet.Alias))
+
+	// the master is the freshest, whatever lag it reports
+	master := replica(5, "cell1", 100)
+	master.Target = &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_MASTER}
+	th = gw.pickTablet("cell1", nil, append(tablets, master), map[string]bool{})
+	require.NotNil(t, th)
+	assert.Equal(t, "cell1-0000000005", topoproto.TabletAliasString(th.Tablet.Alias))
+}
+
+func TestTabletGatewayShuffleTabletsSpillover(t *testing.T) {
+	hc := discovery.NewHealthCheck(context.Background(), time.Millisecond, time.Hour, memorytopo.NewServer("cell1", "cell2"), "cell1")
+	defer hc.Close()
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+	tablets := []*discovery.TabletHealth{
+		{Tablet: topo.NewTablet(1, "cell1", "host1"), Target: target, Serving: true},
+		{Tablet: topo.NewTablet(2, "cell1", "host2"), Target: target, Serving: true},
+		{Tablet: topo.NewTablet(3, "cell2", "host3"), Target: target, Serving: true},
+	}
+
+	for _, fraction := range []float64{0, 0.1, 0.5} {
+		// a fixed seed keeps the spillover rate within the bound below
+		gw := &TabletGateway{hc: hc, rng: rand.New(rand.NewSource(1)), spilloverFraction: fraction}
+		const iterations = 20000
+		spilled := 0
+		for i := 0; i < iterations; i++ {
+			gw.shuffleTablets("cell1", nil, tablets)
+			if tablets[0].Tablet.Alias.Cell != "cell1" {
+				spilled++
+				// the local tablets are still tried next
+				assert.Equal(t, "cell1", tablets[1].Tablet.Alias.Cell)
+				assert.Equal(t, "cell1", tablets[2].Tablet.Alias.Cell)
+			}
+		}
+		assert.InDelta(t, fraction, float64(spilled)/iterations, 0.01, "unexpected spillover rate for fraction %v", fraction)
+	}
+}
+
+func TestTabletGatewayPickTabletCPUUsage(t *testing.T) {
+	hc := discovery.NewHealthCheck(context.Background(), time.Millisecond, time.Hour, memorytopo.NewServer("cell1"), "cell1")
+	defer hc.Close()
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+	idle := &discovery.TabletHealth{Tablet: topo.NewTablet(1, "cell1", "host1"), Target: target, Serving: true, Stats: &querypb.RealtimeStats{CpuUsage: 0.1}}
+	busy := &discovery.TabletHealth{Tablet: topo.NewTablet(2, "cell1", "host2"), Target: target, Serving: true, Stats: &querypb.RealtimeStats{CpuUsage: 0.95}}
+	tablets := []*discovery.TabletHealth{idle, busy}
+
+	// without a ceiling, both tablets are picked as often
+	gw := &TabletGateway{hc: hc, rng: newShuffleRand()}
+	const iterations = 20000
+	busyPicks := 0
+	for i := 0; i < iterations; i++ {
+		if gw.pickTablet("cell1", nil, tablets, nil) == busy {
+			busyPicks++
+		}
+	}
+	assert.InDelta(t, 0.5, float64(busyPicks)/iterations, 0.02)
+
+	// the weights are 0.9 and 0.05, the busy tablet is picked first about
+	// 0.05/0.95 of the time
+	gw.cpuUsageCeiling = 1
+	busyPicks = 0
+	for i := 0; i < iterations; i++ {
+		if gw.pickTablet("cell1", nil, tablets, nil) == busy {
+			busyPicks++
+		}
+	}
+	assert.InDelta(t, 0.05/0.95, float64(busyPicks)/iterations, 0.01)
+
+	// above the ceiling, the busy tablet is only picked as a last resort
+	gw.cpuUsageCeiling = 0.9
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, idle, gw.pickTablet("cell1", nil, tablets, nil))
+	}
+	assert.Equal(t, busy, gw.pickTablet("cell1", nil, tablets, map[string]bool{"cell1-0000000001": true}))
+
+	// if all the tablets are above the ceiling, the least busy one is picked
+	gw.cpuUsageCeiling = 0.05
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, idle, gw.pickTablet("cell1", nil, tablets, nil))
+	}
+}
+
+// staticHealthCheck is a HealthCheck which always returns the same tablets.
+type staticHealthCheck struct {
+	HealthCheck
+	tablets []*discovery.TabletHealth
+	// unhealthy are only returned by GetTabletStats
+	unhealthy []*discovery.TabletHealth
+}
+
+func (hc *staticHealthCheck) GetHealthyTabletStats(target *querypb.Target) []*discovery.TabletHealth {
+	return copyTablets(hc.tablets)
+}
+
+func (hc *staticHealthCheck) GetTabletStats(target *querypb.Target) []*discovery.TabletHealth {
+	return append(copyTablets(hc.tablets), copyTablets(hc.unhealthy)...)
+}
+
+// copyTablets returns copies of the tablets, which the caller owns like the
+// ones returned by the healthcheck.
+func copyTablets(tablets []*discovery.TabletHealth) []*discovery.TabletHealth {
+	var res []*discovery.TabletHealth
+	for _, th := range tablets {
+		res = append(res, th.Copy())
+	}
+	return res
+}
+
+func (hc *staticHealthCheck) NoTabletError(target *querypb.Target) error {
+	return discovery.ErrNoTablets
+}
+
+func (hc *staticHealthCheck) GetAliasByCell(cell string) string {
+	return cell
+}
+
+func TestTabletGatewayGetTabletAndConnectionExcludingCells(t *testing.T) {
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+	newTabletHealth := func(uid uint32, cell string) *discovery.TabletHealth {
+		tablet := topo.NewTablet(uid, cell, "host")
+		return &discovery.TabletHealth{Tablet: tablet, Target: target, Serving: true, Conn: sandboxconn.NewSandboxConn(tablet)}
+	}
+	hc := &staticHealthCheck{tablets: []*discovery.TabletHealth{
+		newTabletHealth(1, "cell1"),
+		newTabletHealth(2, "cell2"),
+	}}
+	gw := &TabletGateway{hc: hc, rng: newShuffleRand()}
+
+	for i := 0; i < 20; i++ {
+		th, conn, err := gw.GetTabletAndConnectionExcludingCells(target, "cell1", map[string]bool{}, []string{"cell1"})
+		require.NoError(t, err)
+		assert.Equal(t, "cell2", th.Tablet.Alias.Cell)
+		assert.Equal(t, th.Conn, conn)
+	}
+
+	// the local tablet is preferred when no cell is excluded
+	th, _, err := gw.GetTabletAndConnection(target, "cell1", map[string]bool{})
+	require.NoError(t, err)
+	assert.Equal(t, "cell1", th.Tablet.Alias.Cell)
+
+	// the only healthy tablet left is in the excluded cell
+	_, _, err = gw.GetTabletAndConnectionExcludingCells(target, "cell2", map[string]bool{"cell2-0000000002": true}, []string{"cell1"})
+	require.Error(t, err)
+	assert.Equal(t, vtrpcpb.Code_UNAVAILABLE, vterrors.Code(err))
+	hc.tablets = hc.tablets[:1]
+	_, _, err = gw.GetTabletAndConnectionExcludingCells(target, "cell1", map[string]bool{}, []string{"cell1"})
+	require.Error(t, err)
+	assert.Equal(t, vtrpcpb.Code_UNAVAILABLE, vterrors.Code(err))
+	assert.Contains(t, err.Error(), "outside of the excluded cells")
+}
+
+func TestTabletGatewayGetTabletAndConnectionPreferringTags(t *testing.T) {
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+	newTabletHealth := func(uid uint32, cell, region string) *discovery.TabletHealth {
+		tablet := topo.NewTablet(uid, cell, "host")
+		tablet.Tags = map[string]string{"region": region, "rack": "r1"}
+		return &discovery.TabletHealth{Tablet: tablet, Target: target, Serving: true, Conn: sandboxconn.NewSandboxConn(tablet)}
+	}
+	hc := &staticHealthCheck{tablets: []*discovery.TabletHealth{
+		newTabletHealth(1, "cell1", "us-west"),
+		newTabletHealth(2, "cell2", "us-east"),
+		newTabletHealth(3, "cell2", "us-east"),
+		newTabletHealth(4, "cell1", "us-west"),
+	}}
+	gw := &TabletGateway{hc: hc, rng: newShuffleRand()}
+	preferred := map[string]string{"region": "us-east"}
+
+	// the tablets with the tags are preferred over the local ones
+	picked := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		th, conn, err := gw.GetTabletAndConnectionPreferringTags(target, "cell1", map[string]bool{}, preferred)
+		require.NoError(t, err)
+		assert.Equal(t, "us-east", th.Tablet.Tags["region"])
+		assert.Equal(t, th.Conn, conn)
+		picked[topoproto.TabletAliasString(th.Tablet.Alias)] = true
+	}
+	assert.Equal(t, map[string]bool{"cell2-0000000002": true, "cell2-0000000003": true}, picked)
+
+	// all the tags must match
+	th, _, err := gw.GetTabletAndConnectionPreferringTags(target, "cell2", map[string]bool{}, map[string]string{"region": "us-west", "rack": "r1"})
+	require.NoError(t, err)
+	assert.Equal(t, "us-west", th.Tablet.Tags["region"])
+
+	// the other tablets are used when the ones with the tags were tried,
+	// the local ones first
+	for i := 0; i < 20; i++ {
+		th, _, err := gw.GetTabletAndConnectionPreferringTags(target, "cell1", map[string]bool{"cell2-0000000002": true, "cell2-0000000003": true}, preferred)
+		require.NoError(t, err)
+		assert.Equal(t, "cell1", th.Tablet.Alias.Cell)
+	}
+
+	// or when no tablet has the tags
+	for i := 0; i < 20; i++ {
+		th, _, err := gw.GetTabletAndConnectionPreferringTags(target, "cell1", map[string]bool{}, map[string]string{"region": "eu-west"})
+		require.NoError(t, err)
+		assert.Equal(t, "cell1", th.Tablet.Alias.Cell)
+	}
+}
+
+func TestTabletGatewayGetTabletAndConnectionForKey(t *testing.T) {
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+	hc := &staticHealthCheck{}
+	for uid := uint32(1); uid <= 4; uid++ {
+		tablet := topo.NewTablet(uid, "cell1", "host")
+		hc.tablets = append(hc.tablets, &discovery.TabletHealth{Tablet: tablet, Target: target, Serving: true, Conn: sandboxconn.NewSandboxConn(tablet)})
+	}
+	gw := &TabletGateway{hc: hc, rng: newShuffleRand()}
+
+	pick := func(key string, invalidTablets map[string]bool) string {
+		th, conn, err := gw.GetTabletAndConnectionForKey(target, "cell1", key, invalidTablets)
+		require.NoError(t, err)
+		assert.Equal(t, th.Conn, conn)
+		return topoproto.TabletAliasString(th.Tablet.Alias)
+	}
+
+	// the same key always lands on the same tablet, and the keys are spread
+	keys := make([]string, 100)
+	picked := make(map[string]string)
+	used := make(map[string]bool)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+		picked[keys[i]] = pick(keys[i], nil)
+		used[picked[keys[i]]] = true
+		for j := 0; j < 5; j++ {
+			assert.Equal(t, picked[keys[i]], pick(keys[i], nil))
+		}
+	}
+	assert.Len(t, used, 4)
+
+	// an invalid tablet falls back to the next tablet for the key
+	first := picked[keys[0]]
+	second := pick(keys[0], map[string]bool{first: true})
+	assert.NotEqual(t, first, second)
+
+	// when a tablet leaves, only the keys which landed on it move, and they
+	// move to their next tablet
+	removedAlias := topoproto.TabletAliasString(hc.tablets[0].Tablet.Alias)
+	fallback := make(map[string]string)
+	for _, key := range keys {
+		fallback[key] = pick(key, map[string]bool{removedAlias: true})
+	}
+	hc.tablets = hc.tablets[1:]
+	for _, key := range keys {
+		got := pick(key, nil)
+		if picked[key] != removedAlias {
+			assert.Equal(t, picked[key], got, "key %v moved", key)
+		} else {
+			assert.Equal(t, fallback[key], got, "key %v moved to an unexpected tablet", key)
+		}
+	}
+
+	// no tablet left
+	all := map[string]bool{}
+	for _, th := range hc.tablets {
+		all[topoproto.TabletAliasString(th.Tablet.Alias)] = true
+	}
+	_, _, err := gw.GetTabletAndConnectionForKey(target, "cell1", keys[0], all)
+	assert.Equal(t, discovery.ErrNoHealthyTablets, err)
+}
+
+func TestTabletGatewayGetTabletAndConnectionHedged(t *testing.T) {
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+	hc := &staticHealthCheck{}
+	for uid := uint32(1); uid <= 3; uid++ {
+		tablet := topo.NewTablet(uid, "cell1", "host")
+		hc.tablets = append(hc.tablets, &discovery.TabletHealth{Tablet: tablet, Target: target, Serving: true, Conn: sandboxconn.NewSandboxConn(tablet)})
+	}
+	gw := &TabletGateway{hc: hc, rng: newShuffleRand()}
+	ctx := context.Background()
+
+	for i := 0; i < 20; i++ {
+		ht, err := gw.GetTabletAndConnectionHedged(ctx, target, "cell1", map[string]bool{"cell1-0000000003": true}, time.Millisecond)
+		require.NoError(t, err)
+		require.NotNil(t, ht.Backup)
+		assert.NotEqual(t, topoproto.TabletAliasString(ht.Primary.Tablet.Alias), topoproto.TabletAliasString(ht.Backup.Tablet.Alias))
+		assert.NotEqual(t, "cell1-0000000003", topoproto.TabletAliasString(ht.Primary.Tablet.Alias))
+		assert.NotEqual(t, "cell1-0000000003", topoproto.TabletAliasString(ht.Backup.Tablet.Alias))
+	}
+
+	// a single usable tablet has no backup
+	ht, err := gw.GetTabletAndConnectionHedged(ctx, target, "cell1", map[string]bool{"cell1-0000000001": true, "cell1-0000000002": true}, time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, "cell1-0000000003", topoproto.TabletAliasString(ht.Primary.Tablet.Alias))
+	assert.Nil(t, ht.Backup)
+
+	// a slow primary is hedged by the backup
+	ht, err = gw.GetTabletAndConnectionHedged(ctx, target, "cell1", nil, 10*time.Millisecond)
+	require.NoError(t, err)
+	var used queryservice.QueryService
+	err = ht.Execute(ctx, func(ctx context.Context, conn queryservice.QueryService) error {
+		if conn == ht.Primary.Conn {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		used = conn
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, ht.Backup.Conn, used)
+
+	// a fast primary is not hedged
+	calls := 0
+	err = ht.Execute(ctx, func(ctx context.Context, conn queryservice.QueryService) error {
+		calls++
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, calls)
+
+	_, err = gw.GetTabletAndConnectionHedged(ctx, target, "cell1", map[string]bool{"cell1-0000000001": true, "cell1-0000000002": true, "cell1-0000000003": true}, time.Millisecond)
+	assert.Equal(t, discovery.ErrNoHealthyTablets, err)
+}
+
+func TestTabletGatewayGetTabletAndConnectionStale(t *testing.T) {
+	defer func(old bool) { *allowStaleReads = old }(*allowStaleReads)
+	target := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+	healthy := topo.NewTablet(1, "cell1", "host")
+	unhealthy := topo.NewTablet(2, "cell1", "host")
+	disconnected := topo.NewTablet(3, "cell1", "host")
+	hc := &staticHealthCheck{
+		tablets: []*discovery.TabletHealth{{Tablet: healthy, Target: target, Serving: true, Conn: sandboxconn.NewSandboxConn(healthy)}},
+		unhealthy: []*discovery.TabletHealth{
+			{Tablet: unhealthy, Target: target, Serving: false, Conn: sandboxconn.NewSandboxConn(unhealthy)},
+			{Tablet: disconnected, Target: target, Serving: false},
+		},
+	}
+
+	for _, allow := range []bool{false, true} {
+		*allowStaleReads = allow
+		gw := &TabletGateway{hc: hc, rng: newShuffleRand(), allowStaleReads: *allowStaleReads}
+
+		// a healthy tablet is always preferred
+		th, _, err := gw.GetTabletAndConnection(target, "cell1", nil)
+		require.NoError(t, err)
+		assert.Equal(t, "cell1-0000000001", topoproto.TabletAliasString(th.Tablet.Alias))
+		assert.False(t, th.Stale)
+
+		// no healthy tablet
+		healthyTablets := hc.tablets
+		hc.tablets = nil
+		th, conn, err := gw.GetTabletAndConnection(target, "cell1", nil)
+		if !allow {
+			assert.Equal(t, discovery.ErrNoTablets, err)
+		} else {
+			require.NoError(t, err)
+			// the tablet without a connection is not returned
+			assert.Equal(t, "cell1-0000000002", topoproto.TabletAliasString(th.Tablet.Alias))
+			assert.True(t, th.Stale)
+			assert.Equal(t, th.Conn, conn)
+			assert.False(t, hc.unhealthy[0].Stale, "the tablets of the healthcheck must not be modified")
+
+			// never from a master
+			_, _, err = gw.GetTabletAndConnection(&querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_MASTER}, "cell1", nil)
+			assert.Error(t, err)
+		}
+		hc.tablets = healthyTablets
+	}
+}
+
+// tabletTypeHealthCheck is a HealthCheck which returns the healthy tablets
+// of the requested tablet type.
+type tabletTypeHealthCheck struct {
+	staticHealthCheck
+	byType map[topodatapb.TabletType][]*discovery.TabletHealth
+}
+
+func (hc *tabletTypeHealthCheck) GetHealthyTabletStats(target *querypb.Target) []*discovery.TabletHealth {
+	return copyTablets(hc.byType[target.TabletType])
+}
+
+func TestTabletGatewayReadFallbackOrder(t *testing.T) {
+	defer func(old string) { flag.Set("read_fallback_order", old) }(flag.Lookup("read_fallback_order").Value.String())
+	replicaTarget := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_REPLICA}
+	rdonlyTarget := &querypb.Target{Keyspace: "k", Shard: "s", TabletType: topodatapb.TabletType_RDONLY}
+	replica := topo.NewTablet(1, "cell1", "host1")
+	hc := &tabletTypeHealthCheck{byType: map[topodatapb.TabletType][]*discovery.TabletHealth{
+		topodatapb.TabletType_REPLICA: {{Tablet: replica, Target: replicaTarget, Serving: true, Conn: sandboxconn.NewSandboxConn(replica)}},
+	}}
+	gw := &TabletGateway{hc: hc, rng: newShuffleRand()}
+
+	_, _, err := gw.GetTabletAndConnection(rdonlyTarget, "cell1", map[string]bool{})
+	require.Error(t, err, "no fallback by default")
+
+	require.NoError(t, flag.Set("read_fallback_order", "rdonly,replica"))
+	th, _, err := gw.GetTabletAndConnection(rdonlyTarget, "cell1", map[string]bool{})
+	require.NoError(t, err)
+	assert.Equal(t, topodatapb.TabletType_REPLICA, th.Target.TabletType, "rdonly should fall back to replica")
+	// the healthcheck itself doesn't fall back
+	assert.Empty(t, hc.GetHealthyTabletStats(rdonlyTarget))
+
+	// the fallback only goes in the configured order
+	require.NoError(t, flag.Set("read_fallback_order", "replica,rdonly"))
+	_, _, err = gw.GetTabletAndConnection(rdonlyTarget, "cell1", map[string]bool{})
+	require.Error(t, err, "rdonly has no type to fall back to")
+}
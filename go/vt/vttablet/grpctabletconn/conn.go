@@ -23,6 +23,7 @@ import (
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 	"vitess.io/vitess/go/netutil"
 	"vitess.io/vitess/go/sqltypes"
 	"vitess.io/vitess/go/vt/callerid"
@@ -69,7 +70,7 @@ func DialTablet(tablet *topodatapb.Tablet, failFast grpcclient.FailFast) (querys
 	} else {
 		addr = tablet.Hostname
 	}
-	opt, err := grpcclient.SecureDialOption(*cert, *key, *ca, *name)
+	opt, err := grpcclient.SecureDialOption(*cert, *key, *ca, serverName(tablet))
 	if err != nil {
 		return nil, err
 	}
@@ -88,6 +89,16 @@ func DialTablet(tablet *topodatapb.Tablet, failFast grpcclient.FailFast) (querys
 	return result, nil
 }
 
+// serverName returns the server name to use to validate the certificate
+// of the tablet: the tabletconn.GRPCServerNameTag tag of the tablet if set,
+// -tablet_grpc_server_name otherwise.
+func serverName(tablet *topodatapb.Tablet) string {
+	if override := tablet.Tags[tabletconn.GRPCServerNameTag]; override != "" {
+		return override
+	}
+	return *name
+}
+
 // Execute sends the query to VTTablet.
 func (conn *gRPCQueryClient) Execute(ctx context.Context, target *querypb.Target, query string, bindVars map[string]*querypb.BindVariable, transactionID int64, options *querypb.ExecuteOptions) (*sqltypes.Result, error) {
 	conn.mu.RLock()
@@ -739,6 +750,17 @@ func (conn *gRPCQueryClient) Close(ctx context.Context) error {
 	return cc.Close()
 }
 
+// ConnectivityState returns the state of the gRPC channel, e.g. READY or
+// TRANSIENT_FAILURE, or SHUTDOWN once the connection is closed.
+func (conn *gRPCQueryClient) ConnectivityState() string {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	if conn.cc == nil {
+		return connectivity.Shutdown.String()
+	}
+	return conn.cc.GetState().String()
+}
+
 // Tablet returns the rpc end point.
 func (conn *gRPCQueryClient) Tablet() *topodatapb.Tablet {
 	return conn.tablet
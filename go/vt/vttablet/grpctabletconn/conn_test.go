@@ -17,16 +17,19 @@ limitations under the License.
 package grpctabletconn
 
 import (
+	"flag"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"testing"
 
+	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 
 	"vitess.io/vitess/go/vt/servenv"
 	"vitess.io/vitess/go/vt/vttablet/grpcqueryservice"
+	"vitess.io/vitess/go/vt/vttablet/tabletconn"
 	"vitess.io/vitess/go/vt/vttablet/tabletconntest"
 
 	topodatapb "vitess.io/vitess/go/vt/proto/topodata"
@@ -95,6 +98,9 @@ func TestGRPCTabletAuthConn(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer os.Remove(f.Name())
+	// TestSuite points the client at the creds file, restore the flag so
+	// the following tests don't dial with a removed file
+	defer func(old string) { flag.Set("grpc_auth_static_client_creds", old) }(flag.Lookup("grpc_auth_static_client_creds").Value.String())
 	if _, err := io.WriteString(f, authJSON); err != nil {
 		t.Fatal(err)
 	}
@@ -114,3 +120,45 @@ func TestGRPCTabletAuthConn(t *testing.T) {
 		},
 	}, service, f)
 }
+
+func TestServerName(t *testing.T) {
+	defer func(old string) { *name = old }(*name)
+	*name = "default.example.com"
+
+	tablet := &topodatapb.Tablet{Hostname: "tablet1.example.com"}
+	if got, want := serverName(tablet), "default.example.com"; got != want {
+		t.Errorf("serverName() without tag = %v, want %v", got, want)
+	}
+
+	tablet.Tags = map[string]string{tabletconn.GRPCServerNameTag: "proxy.example.com"}
+	if got, want := serverName(tablet), "proxy.example.com"; got != want {
+		t.Errorf("serverName() with tag = %v, want %v", got, want)
+	}
+}
+
+func TestConnectivityState(t *testing.T) {
+	// nothing listens on this port, the channel connects lazily
+	conn, err := DialTablet(&topodatapb.Tablet{
+		Hostname: "127.0.0.1",
+		PortMap: map[string]int32{
+			"grpc": 1,
+		},
+	}, false)
+	if err != nil {
+		t.Fatalf("DialTablet failed: %v", err)
+	}
+	stater, ok := conn.(interface{ ConnectivityState() string })
+	if !ok {
+		t.Fatalf("%T does not report its connectivity state", conn)
+	}
+	if got := stater.ConnectivityState(); got == "" || got == "SHUTDOWN" {
+		t.Errorf("ConnectivityState() of an open connection = %q", got)
+	}
+
+	if err := conn.Close(context.Background()); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if got, want := stater.ConnectivityState(), "SHUTDOWN"; got != want {
+		t.Errorf("ConnectivityState() of a closed connection = %q, want %q", got, want)
+	}
+}
@@ -38,10 +38,15 @@ var (
 	TabletProtocol = flag.String("tablet_protocol", "grpc", "how to talk to the vttablets")
 )
 
+// GRPCServerNameTag is the tablet tag which, when set, overrides the
+// server name used to validate the certificate of the tablet. This is
+// useful when the tablets sit behind a proxy with a shared certificate.
+const GRPCServerNameTag = "grpc_server_name"
+
 // TabletDialer represents a function that will return a QueryService
 // object that can communicate with a tablet. Only the tablet's
-// HostName and PortMap should be used (and maybe the alias for debug
-// messages).
+// HostName, PortMap and GRPCServerNameTag tag should be used (and
+// maybe the alias for debug messages).
 //
 // timeout represents the connection timeout. If set to 0, this
 // connection should be established in the background and the